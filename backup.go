@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/baetyl/baetyl-go/log"
+	routing "github.com/qiangxue/fasthttp-routing"
+)
+
+const snapshotContentType = "application/octet-stream"
+
+// Backup streams a consistent snapshot of the database with all namespaces,
+// which can be uploaded to Restore later
+func (h *KVHandler) Backup(c *routing.Context) error {
+	c.Response.Header.SetContentType(snapshotContentType)
+	c.Response.Header.Set("Content-Disposition", `attachment; filename="state.db"`)
+	c.SetStatusCode(http.StatusOK)
+	c.SetBodyStreamWriter(func(w *bufio.Writer) {
+		n, err := h.db.Backup(w)
+		if err != nil {
+			// the status is already sent, the client gets a truncated snapshot which fails to restore
+			h.log.Error("failed to back up database", log.Error(err))
+			return
+		}
+		h.log.Info("database backed up", log.Any("size", n))
+	})
+	return nil
+}
+
+// Restore replaces the database with the snapshot in the request body atomically. The body is buffered
+// in memory before handled, so the snapshot is limited by server.maxRequestBodySize, and maxSnapshotSize if set
+func (h *KVHandler) Restore(c *routing.Context) error {
+	body := c.Request.Body()
+	if len(body) == 0 {
+		respondError(c, http.StatusBadRequest, "ERR_PARAM", "snapshot required")
+		return nil
+	}
+	if h.maxSnapshotSize > 0 && len(body) > h.maxSnapshotSize {
+		respondError(c, http.StatusRequestEntityTooLarge, "ERR_TOO_LARGE", fmt.Sprintf("snapshot larger than %d bytes", h.maxSnapshotSize))
+		return nil
+	}
+	err := h.db.Restore(bytes.NewReader(body))
+	if err != nil {
+		respondDBError(c, err)
+		return nil
+	}
+	h.log.Info("database restored", log.Any("size", len(body)))
+	respond(c, http.StatusOK, []byte(""))
+	return nil
+}
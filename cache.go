@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/baetyl/baetyl-state/database"
+	routing "github.com/qiangxue/fasthttp-routing"
+)
+
+// CacheStats returns the hit and miss counts and the usage of the cache decorating the database
+func (h *KVHandler) CacheStats(c *routing.Context) error {
+	stats, ok := database.CacheStatsOf(h.db)
+	if !ok {
+		respondError(c, http.StatusNotFound, "ERR_CACHE", "cache is not enabled")
+		return nil
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		respondError(c, 500, "ERR_JSON", err.Error())
+		return nil
+	}
+	respond(c, http.StatusOK, data)
+	return nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/baetyl/baetyl-go/utils"
+	"github.com/baetyl/baetyl-state/database"
+)
+
+// commands the subcommands of baetyl-state, the service runs if no subcommand is given
+var commands = map[string]func(args []string) error{
+	"export":     exportCommand,
+	"import":     importCommand,
+	"migrate":    migrateCommand,
+	"rotate-key": rotateKeyCommand,
+}
+
+// runCommand runs the subcommand named by the first argument, returns false if not a subcommand
+func runCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return false
+	}
+	if err := cmd(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", args[0], err.Error())
+		os.Exit(1)
+	}
+	return true
+}
+
+// dbFlags the flags to open the database of the service,
+// the database in the configuration file is overridden by -driver and -source
+type dbFlags struct {
+	conf   string
+	driver string
+	source string
+}
+
+func (f *dbFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.conf, "c", "etc/baetyl/service.yml", "the configuration file")
+	fs.StringVar(&f.driver, "driver", "", "the database driver, overrides the configuration file")
+	fs.StringVar(&f.source, "source", "", "the database source, overrides the configuration file")
+}
+
+// open opens the database configured
+func (f *dbFlags) open() (database.DB, error) {
+	conf, err := f.load()
+	if err != nil {
+		return nil, err
+	}
+	return database.New(conf)
+}
+
+// load loads the configuration of the database
+func (f *dbFlags) load() (database.Conf, error) {
+	var cfg Config
+	var err error
+	if utils.FileExists(f.conf) {
+		err = utils.LoadYAML(f.conf, &cfg)
+	} else {
+		err = utils.UnmarshalYAML(nil, &cfg)
+	}
+	if err != nil {
+		return database.Conf{}, err
+	}
+	if f.driver != "" {
+		cfg.Database.Driver = f.driver
+	}
+	if f.source != "" {
+		cfg.Database.Source = f.source
+	}
+	return cfg.Database, nil
+}
+
+func exportCommand(args []string) error {
+	var dbf dbFlags
+	var file, prefix string
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	dbf.register(fs)
+	fs.StringVar(&file, "f", "-", "the file to export into, - means stdout")
+	fs.StringVar(&prefix, "prefix", "", "only exports the keys with the prefix")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := dbf.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	out := os.Stdout
+	if file != "-" {
+		out, err = os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	n, err := export(db, out, prefix)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d kvs exported\n", n)
+	return nil
+}
+
+func importCommand(args []string) error {
+	var dbf dbFlags
+	var file string
+	var opts importOptions
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	dbf.register(fs)
+	fs.StringVar(&file, "f", "-", "the file to import from, - means stdin")
+	fs.StringVar(&opts.prefix, "prefix", "", "only imports the keys with the prefix")
+	fs.BoolVar(&opts.skipExisting, "skip-existing", false, "skips the keys already existing instead of overwriting them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := dbf.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	in := os.Stdin
+	if file != "-" {
+		in, err = os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+	res, err := importLines(db, in, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d kvs imported, %d kvs skipped\n", res.imported, res.skipped)
+	return nil
+}
+
+func migrateCommand(args []string) error {
+	var dbf dbFlags
+	var driver, source, keyFile string
+	var plaintext, force bool
+	var batchSize int
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dbf.register(fs)
+	fs.StringVar(&driver, "to-driver", "", "the driver of the destination database")
+	fs.StringVar(&source, "to-source", "", "the source of the destination database")
+	fs.StringVar(&keyFile, "to-key-file", "", "the key file to encrypt the destination database, defaults to the key file of the source")
+	fs.BoolVar(&plaintext, "plaintext", false, "stores the values in the destination database without encryption even if the source is encrypted")
+	fs.BoolVar(&force, "force", false, "migrates even if the destination database has data, the existing keys are overwritten, the other keys fail the verification")
+	fs.IntVar(&batchSize, "batch", importBatchSize, "the count of kvs copied in one batch")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if driver == "" || source == "" {
+		return errors.New("-to-driver and -to-source required")
+	}
+	if batchSize <= 0 {
+		return errors.New("-batch must be positive")
+	}
+	if plaintext && keyFile != "" {
+		return errors.New("-plaintext and -to-key-file are exclusive")
+	}
+
+	conf, err := dbf.load()
+	if err != nil {
+		return err
+	}
+	if conf.Driver == driver && path.Clean(conf.Source) == path.Clean(source) {
+		return errors.New("the source and destination are the same database")
+	}
+	// the destination is configured as the source except the storage and the key,
+	// the decorators wrap the service only, e.g. readonly would reject the migration
+	to := conf
+	to.Driver, to.Source, to.Decorators = driver, source, nil
+	if keyFile != "" {
+		to.KeyFile = keyFile
+	}
+	if plaintext {
+		to.KeyFile = ""
+	}
+
+	from, err := database.New(conf)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	err = os.MkdirAll(path.Dir(to.Source), 0755)
+	if err != nil {
+		return fmt.Errorf("failed to make db directory: %s", err.Error())
+	}
+	dst, err := database.New(to)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	n, err := migrate(from, dst, force, batchSize)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d kvs migrated and verified\n", n)
+	return nil
+}
+
+func rotateKeyCommand(args []string) error {
+	var dbf dbFlags
+	var oldFile, newFile string
+	fs := flag.NewFlagSet("rotate-key", flag.ContinueOnError)
+	dbf.register(fs)
+	fs.StringVar(&oldFile, "old-key", "", "the file of the current key, defaults to the key file configured, the values are not encrypted yet if neither")
+	fs.StringVar(&newFile, "new-key", "", "the file of the new key")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if newFile == "" {
+		return errors.New("-new-key required")
+	}
+
+	conf, err := dbf.load()
+	if err != nil {
+		return err
+	}
+	if oldFile == "" {
+		oldFile = conf.KeyFile
+	}
+	var oldKey []byte
+	if oldFile != "" {
+		if oldKey, err = database.LoadKey(oldFile); err != nil {
+			return err
+		}
+	}
+	newKey, err := database.LoadKey(newFile)
+	if err != nil {
+		return err
+	}
+
+	// the values are re-encrypted in the raw database, which is not guarded
+	// by the decorators, e.g. readonly, nor limited by the quotas
+	conf.KeyFile = ""
+	conf.Decorators = nil
+	conf.Quota, conf.Quotas = database.Quota{}, nil
+	db, err := database.New(conf)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	n, err := database.RotateKey(db, oldKey, newKey)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%d values re-encrypted, configure %s as the key file to use the new key\n", n, newFile)
+	return nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/baetyl/baetyl-state/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := path.Join(dir, "src.db")
+	db, err := database.New(database.Conf{Driver: "boltdb", Source: src})
+	assert.NoError(t, err)
+	expire := time.Now().Unix() + 60
+	err = db.Batch([]database.Op{
+		{Type: database.OpSet, KV: database.KV{Key: "a/1", Value: []byte("v1")}},
+		{Type: database.OpSet, KV: database.KV{Key: "a/2", Value: []byte("v2"), Expire: expire}},
+		{Type: database.OpSet, KV: database.KV{Key: "b/1", Value: []byte("v3"), ContentType: "text/plain", Labels: map[string]string{"a": "b"}}},
+	})
+	assert.NoError(t, err)
+	err = db.CreateNamespace("svc")
+	assert.NoError(t, err)
+	ns, err := db.Namespace("svc")
+	assert.NoError(t, err)
+	err = ns.Set(&database.KV{Key: "a/1", Value: []byte("s1")})
+	assert.NoError(t, err)
+
+	buf := new(bytes.Buffer)
+	n, err := export(db, buf, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 4)
+	assert.Equal(t, `{"key":"a/1","value":"djE="}`, lines[0])
+	assert.Equal(t, `{"key":"b/1","value":"djM=","contentType":"text/plain","labels":{"a":"b"}}`, lines[2])
+	assert.Equal(t, `{"namespace":"svc","key":"a/1","value":"czE="}`, lines[3])
+
+	buf2 := new(bytes.Buffer)
+	n, err = export(db, buf2, "a/")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	db.Close()
+
+	dst := path.Join(dir, "dst.db")
+	db, err = database.New(database.Conf{Driver: "boltdb", Source: dst})
+	assert.NoError(t, err)
+	defer db.Close()
+	err = db.Set(&database.KV{Key: "a/1", Value: []byte("old")})
+	assert.NoError(t, err)
+
+	// existing keys are skipped
+	res, err := importLines(db, bytes.NewReader(buf.Bytes()), importOptions{prefix: "a/", skipExisting: true})
+	assert.NoError(t, err)
+	assert.Equal(t, importResult{imported: 2, skipped: 2}, res)
+	kv, err := db.Get("a/1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("old"), kv.Value)
+	kv, err = db.Get("a/2")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v2"), kv.Value)
+	assert.Equal(t, expire, kv.Expire)
+	kv, err = db.Get("b/1")
+	assert.NoError(t, err)
+	assert.Nil(t, kv.Value)
+
+	// existing keys are overwritten
+	res, err = importLines(db, bytes.NewReader(buf.Bytes()), importOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, importResult{imported: 4}, res)
+	kv, err = db.Get("a/1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v1"), kv.Value)
+	kv, err = db.Get("b/1")
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain", kv.ContentType)
+	assert.Equal(t, map[string]string{"a": "b"}, kv.Labels)
+	ns, err = db.Namespace("svc")
+	assert.NoError(t, err)
+	kv, err = ns.Get("a/1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("s1"), kv.Value)
+
+	// expired kvs and blank lines are skipped
+	res, err = importLines(db, strings.NewReader("\n{\"key\":\"c\",\"expire\":1}\n"), importOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, importResult{skipped: 1}, res)
+
+	_, err = importLines(db, strings.NewReader("{\"key\":\"c\"}\n{\"value\":\"djE=\"}"), importOptions{})
+	assert.EqualError(t, err, "line 2: key required")
+	_, err = importLines(db, strings.NewReader("{"), importOptions{})
+	assert.Error(t, err)
+	_, err = importLines(db, strings.NewReader(`{"namespace":"../x","key":"c"}`), importOptions{})
+	assert.Error(t, err)
+}
+
+func TestExportImportCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := path.Join(dir, "src.db")
+	db, err := database.New(database.Conf{Driver: "boltdb", Source: src})
+	assert.NoError(t, err)
+	err = db.Set(&database.KV{Key: "k", Value: []byte("v")})
+	assert.NoError(t, err)
+	db.Close()
+
+	file := path.Join(dir, "kvs.jsonl")
+	err = exportCommand([]string{"-c", path.Join(dir, "none.yml"), "-driver", "boltdb", "-source", src, "-f", file})
+	assert.NoError(t, err)
+
+	conf := path.Join(dir, "service.yml")
+	dst := path.Join(dir, "dst.db")
+	err = ioutil.WriteFile(conf, []byte("database:\n  driver: boltdb\n  source: "+dst+"\n"), 0644)
+	assert.NoError(t, err)
+	err = importCommand([]string{"-c", conf, "-f", file})
+	assert.NoError(t, err)
+
+	db, err = database.New(database.Conf{Driver: "boltdb", Source: dst})
+	assert.NoError(t, err)
+	defer db.Close()
+	kv, err := db.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v"), kv.Value)
+
+	err = importCommand([]string{"-x"})
+	assert.Error(t, err)
+	err = exportCommand([]string{"-driver", "unknown"})
+	assert.Error(t, err)
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := path.Join(dir, "src.db")
+	db, err := database.New(database.Conf{Driver: "boltdb", Source: src})
+	assert.NoError(t, err)
+	expire := time.Now().Unix() + 60
+	ops := []database.Op{}
+	for i := 0; i < 25; i++ {
+		ops = append(ops, database.Op{Type: database.OpSet, KV: database.KV{Key: fmt.Sprintf("k%02d", i), Value: []byte{byte(i)}}})
+	}
+	ops = append(ops, database.Op{Type: database.OpSet, KV: database.KV{Key: "t", Value: []byte("t"), Expire: expire}})
+	err = db.Batch(ops)
+	assert.NoError(t, err)
+	err = db.CreateNamespace("svc")
+	assert.NoError(t, err)
+	ns, err := db.Namespace("svc")
+	assert.NoError(t, err)
+	err = ns.Set(&database.KV{Key: "k00", Value: []byte("s")})
+	assert.NoError(t, err)
+	db.Close()
+
+	dst := path.Join(dir, "sub", "dst.db")
+	args := []string{"-c", path.Join(dir, "none.yml"), "-driver", "boltdb", "-source", src, "-to-driver", "sqlite3", "-to-source", dst, "-batch", "10"}
+	err = migrateCommand(args)
+	assert.NoError(t, err)
+
+	// the destination has data
+	err = migrateCommand(args)
+	assert.EqualError(t, err, "the destination database already has data, use -force to overwrite")
+	err = migrateCommand(append(args, "-force"))
+	assert.NoError(t, err)
+
+	err = migrateCommand([]string{"-to-driver", "boltdb"})
+	assert.EqualError(t, err, "-to-driver and -to-source required")
+	err = migrateCommand([]string{"-driver", "boltdb", "-source", src, "-to-driver", "boltdb", "-to-source", src})
+	assert.EqualError(t, err, "the source and destination are the same database")
+
+	from, err := database.New(database.Conf{Driver: "boltdb", Source: src})
+	assert.NoError(t, err)
+	defer from.Close()
+	to, err := database.New(database.Conf{Driver: "sqlite3", Source: dst})
+	assert.NoError(t, err)
+	defer to.Close()
+
+	kv, err := to.Get("t")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("t"), kv.Value)
+	assert.Equal(t, expire, kv.Expire)
+	ns, err = to.Namespace("svc")
+	assert.NoError(t, err)
+	kv, err = ns.Get("k00")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("s"), kv.Value)
+	// the metadata is kept
+	old, err := from.Get("t")
+	assert.NoError(t, err)
+	kv, err = to.Get("t")
+	assert.NoError(t, err)
+	assert.Equal(t, old.Created, kv.Created)
+	assert.Equal(t, old.Updated, kv.Updated)
+
+	n, err := verify(from, to)
+	assert.NoError(t, err)
+	assert.Equal(t, 27, n)
+
+	// the keys only in the destination are counted
+	err = to.Set(&database.KV{Key: "x", Value: []byte("x")})
+	assert.NoError(t, err)
+	_, err = verify(from, to)
+	assert.EqualError(t, err, "count mismatch: 27 kvs in source, 28 kvs in destination")
+	err = to.Del("x")
+	assert.NoError(t, err)
+
+	err = to.Set(&database.KV{Key: "k01", Value: []byte("x")})
+	assert.NoError(t, err)
+	_, err = verify(from, to)
+	assert.EqualError(t, err, "checksum mismatch between source and destination")
+	err = to.Del("k01")
+	assert.NoError(t, err)
+	_, err = verify(from, to)
+	assert.EqualError(t, err, "count mismatch: 27 kvs in source, 26 kvs in destination")
+}
+
+func TestMigrateEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	key1, key2 := path.Join(dir, "key1"), path.Join(dir, "key2")
+	err = ioutil.WriteFile(key1, []byte(strings.Repeat("01", 32)), 0600)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(key2, []byte(strings.Repeat("02", 32)), 0600)
+	assert.NoError(t, err)
+
+	src := path.Join(dir, "src.db")
+	db, err := database.New(database.Conf{Driver: "boltdb", Source: src, KeyFile: key1})
+	assert.NoError(t, err)
+	err = db.Set(&database.KV{Key: "k", Value: []byte("secret")})
+	assert.NoError(t, err)
+	db.Close()
+
+	conf := path.Join(dir, "service.yml")
+	err = ioutil.WriteFile(conf, []byte("database:\n  driver: boltdb\n  source: "+src+"\n  keyFile: "+key1+"\n  decorators: [readonly]\n"), 0644)
+	assert.NoError(t, err)
+
+	// the destination is encrypted by the key of the source by default
+	dst1 := path.Join(dir, "dst1.db")
+	err = migrateCommand([]string{"-c", conf, "-to-driver", "sqlite3", "-to-source", dst1})
+	assert.NoError(t, err)
+	raw, err := database.New(database.Conf{Driver: "sqlite3", Source: dst1})
+	assert.NoError(t, err)
+	kv, err := raw.Get("k")
+	assert.NoError(t, err)
+	assert.NotContains(t, string(kv.Value), "secret")
+	raw.Close()
+	to, err := database.New(database.Conf{Driver: "sqlite3", Source: dst1, KeyFile: key1})
+	assert.NoError(t, err)
+	kv, err = to.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), kv.Value)
+	to.Close()
+
+	dst2 := path.Join(dir, "dst2.db")
+	err = migrateCommand([]string{"-c", conf, "-to-driver", "sqlite3", "-to-source", dst2, "-to-key-file", key2})
+	assert.NoError(t, err)
+	to, err = database.New(database.Conf{Driver: "sqlite3", Source: dst2, KeyFile: key2})
+	assert.NoError(t, err)
+	kv, err = to.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), kv.Value)
+	to.Close()
+
+	dst3 := path.Join(dir, "dst3.db")
+	err = migrateCommand([]string{"-c", conf, "-to-driver", "sqlite3", "-to-source", dst3, "-plaintext", "-to-key-file", key2})
+	assert.EqualError(t, err, "-plaintext and -to-key-file are exclusive")
+	err = migrateCommand([]string{"-c", conf, "-to-driver", "sqlite3", "-to-source", dst3, "-plaintext"})
+	assert.NoError(t, err)
+	to, err = database.New(database.Conf{Driver: "sqlite3", Source: dst3})
+	assert.NoError(t, err)
+	kv, err = to.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), kv.Value)
+	to.Close()
+}
+
+func TestRotateKeyCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	key1, key2 := path.Join(dir, "key1"), path.Join(dir, "key2")
+	err = ioutil.WriteFile(key1, []byte(strings.Repeat("01", 32)), 0600)
+	assert.NoError(t, err)
+	err = ioutil.WriteFile(key2, []byte(strings.Repeat("02", 32)), 0600)
+	assert.NoError(t, err)
+
+	src := path.Join(dir, "kv.db")
+	db, err := database.New(database.Conf{Driver: "boltdb", Source: src, KeyFile: key1})
+	assert.NoError(t, err)
+	err = db.Set(&database.KV{Key: "k", Value: []byte("v")})
+	assert.NoError(t, err)
+	db.Close()
+
+	conf := path.Join(dir, "service.yml")
+	// the readonly decorator and the quotas do not apply to the rotation
+	err = ioutil.WriteFile(conf, []byte("database:\n  driver: boltdb\n  source: "+src+"\n  keyFile: "+key1+"\n  decorators: [readonly]\n  quota:\n    maxValueSize: 1\n"), 0644)
+	assert.NoError(t, err)
+	err = rotateKeyCommand([]string{"-c", conf})
+	assert.EqualError(t, err, "-new-key required")
+	err = rotateKeyCommand([]string{"-c", conf, "-new-key", key2})
+	assert.NoError(t, err)
+
+	db, err = database.New(database.Conf{Driver: "boltdb", Source: src, KeyFile: key2})
+	assert.NoError(t, err)
+	defer db.Close()
+	kv, err := db.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v"), kv.Value)
+}
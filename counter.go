@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/baetyl/baetyl-state/database"
+	routing "github.com/qiangxue/fasthttp-routing"
+)
+
+// Increment adds the signed ?delta=, 1 by default, to the integer value of the key atomically and responds
+// the new value, the key not found is initialised to 0. The new value must be in [?min=, ?max=] if they are set,
+// otherwise nothing is written and 409 ERR_BOUNDS is responded, so is the value which is not an integer
+// with 409 ERR_NOT_INTEGER
+func (h *KVHandler) Increment(c *routing.Context) error {
+	db, ok := h.scope(c)
+	if !ok || !checkKey(c, c.Param("key")) {
+		return nil
+	}
+	args := c.QueryArgs()
+	param := func(name string) (*int64, bool) {
+		if !args.Has(name) {
+			return nil, true
+		}
+		n, err := strconv.ParseInt(string(args.Peek(name)), 10, 64)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "ERR_PARAM", "invalid "+name)
+			return nil, false
+		}
+		return &n, true
+	}
+	delta, ok := param("delta")
+	if !ok {
+		return nil
+	}
+	if delta == nil {
+		one := int64(1)
+		delta = &one
+	}
+	bounds := &database.Bounds{}
+	if bounds.Min, ok = param("min"); !ok {
+		return nil
+	}
+	if bounds.Max, ok = param("max"); !ok {
+		return nil
+	}
+	if bounds.Min != nil && bounds.Max != nil && *bounds.Min > *bounds.Max {
+		respondError(c, http.StatusBadRequest, "ERR_PARAM", "min greater than max")
+		return nil
+	}
+	n, err := db.Increment(c.Param("key"), *delta, bounds)
+	if err != nil {
+		respondDBError(c, err)
+		return nil
+	}
+	data, err := json.Marshal(CounterResponse{Value: n})
+	if err != nil {
+		respondError(c, 500, "ERR_JSON", err.Error())
+		return nil
+	}
+	respond(c, http.StatusOK, data)
+	return nil
+}
@@ -2,6 +2,11 @@ package database
 
 import (
 	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
 	"time"
 
 	bolt "go.etcd.io/bbolt"
@@ -11,23 +16,115 @@ func init() {
 	Factories["boltdb"] = newBoltDB
 }
 
+var (
+	// sysBucket holds the revision sequence, the storage format and the declarations of indexes
+	sysBucket  = []byte(".sys")
+	formatKey  = []byte("format")
+	indexesKey = []byte("indexes")
+	// defaultBucket holds the kvs of the default namespace,
+	// the other namespaces are stored in the buckets named after them
+	defaultBucket = []byte(".self")
+	// historyBucket holds the versions of keys in the nested buckets named after the buckets of namespaces
+	historyBucket = []byte(".history")
+	// indexBucket holds the entries of indexes in the nested buckets named after the buckets of namespaces,
+	// which hold a bucket for each index and the reverse bucket of the entries of each key
+	indexBucket   = []byte(".index")
+	reverseBucket = []byte(".")
+)
+
+// delExpiredChunk the max count of expired kvs deleted in one write transaction by DelExpired
+const delExpiredChunk = 1000
+
+// boltDb the namespace of BoltDB, all namespaces share the same BoltDB, lock and broker
 type boltDb struct {
 	*bolt.DB
+	ns     string
 	bucket []byte
 	conf   Conf
+	// wmu keeps events published in the order of revision
+	wmu    *sync.Mutex
+	broker *broker
+	comp   *compressor
+	index  *indexer
 }
 
 func newBoltDB(conf Conf) (DB, error) {
+	comp, err := newCompressor(conf)
+	if err != nil {
+		return nil, err
+	}
+	index, err := newIndexer(conf)
+	if err != nil {
+		return nil, err
+	}
 	db, err := bolt.Open(conf.Source, 0600, &bolt.Options{Timeout: time.Second})
 	if err != nil {
 		return nil, err
 	}
 
-	return &boltDb{
+	d := &boltDb{
 		DB:     db,
-		bucket: []byte(".self"),
+		bucket: defaultBucket,
 		conf:   conf,
-	}, nil
+		wmu:    new(sync.Mutex),
+		comp:   comp,
+		index:  index,
+	}
+	err = d.migrate()
+	if err == nil {
+		err = d.DB.Update(func(tx *bolt.Tx) error {
+			return d.reindex(tx, false)
+		})
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	var rev uint64
+	d.View(func(tx *bolt.Tx) error {
+		rev = tx.Bucket(sysBucket).Sequence()
+		return nil
+	})
+	d.broker = newBroker(conf.WatchHistory, rev)
+	return d, nil
+}
+
+// migrate creates the default bucket and converts raw values written by older versions into records with revision 1
+func (d *boltDb) migrate() error {
+	return d.DB.Update(func(tx *bolt.Tx) error {
+		s, err := tx.CreateBucketIfNotExists(sysBucket)
+		if err != nil {
+			return err
+		}
+		b, err := tx.CreateBucketIfNotExists(defaultBucket)
+		if err != nil {
+			return err
+		}
+		if s.Get(formatKey) != nil {
+			return nil
+		}
+		var kvs []KV
+		err = b.ForEach(func(k, v []byte) error {
+			kvs = append(kvs, KV{Key: string(k), Value: v})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(kvs) > 0 {
+			rev, err := s.NextSequence()
+			if err != nil {
+				return err
+			}
+			for i := range kvs {
+				kvs[i].Revision = rev
+				if err = d.put(b, &kvs[i]); err != nil {
+					return err
+				}
+			}
+		}
+		return s.Put(formatKey, []byte{recordFormat})
+	})
 }
 
 // Conf returns the configuration
@@ -35,15 +132,127 @@ func (d *boltDb) Conf() Conf {
 	return d.conf
 }
 
+// Namespace returns the namespace of BoltDB
+func (d *boltDb) Namespace(name string) (DB, error) {
+	if name == "" {
+		return d.namespace("", defaultBucket), nil
+	}
+	if err := checkNamespace(name); err != nil {
+		return nil, err
+	}
+	err := d.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(name)) == nil {
+			return ErrNamespaceNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d.namespace(name, []byte(name)), nil
+}
+
+func (d *boltDb) namespace(name string, bucket []byte) *boltDb {
+	nd := *d
+	nd.ns = name
+	nd.bucket = bucket
+	return &nd
+}
+
+// Namespaces lists all namespaces created in BoltDB
+func (d *boltDb) Namespaces() (names []string, err error) {
+	err = d.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			// the system buckets start with dot
+			if name[0] != '.' {
+				names = append(names, string(name))
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// CreateNamespace creates the namespace in BoltDB if not exists
+func (d *boltDb) CreateNamespace(name string) error {
+	if err := checkNamespace(name); err != nil {
+		return err
+	}
+	return d.DB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(name))
+		return err
+	})
+}
+
+// DropNamespace drops the namespace with all its kvs from BoltDB
+func (d *boltDb) DropNamespace(name string) error {
+	if err := checkNamespace(name); err != nil {
+		return err
+	}
+	return d.write(func(tx *bolt.Tx) ([]Event, error) {
+		b := tx.Bucket([]byte(name))
+		if b == nil {
+			return nil, ErrNamespaceNotFound
+		}
+		var keys []string
+		err := b.ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err = tx.DeleteBucket([]byte(name)); err != nil {
+			return nil, err
+		}
+		for _, nested := range [][]byte{historyBucket, indexBucket} {
+			if pb := tx.Bucket(nested); pb != nil && pb.Bucket([]byte(name)) != nil {
+				if err = pb.DeleteBucket([]byte(name)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if len(keys) == 0 {
+			return nil, nil
+		}
+		rev, err := nextRevision(tx)
+		if err != nil {
+			return nil, err
+		}
+		events := make([]Event, 0, len(keys))
+		for _, k := range keys {
+			events = append(events, Event{Type: EventDel, Namespace: name, KV: KV{Key: k, Revision: rev}})
+		}
+		return events, nil
+	})
+}
+
 // Set put key and value into BoltDB
 func (d *boltDb) Set(kv *KV) error {
-	return d.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists(d.bucket)
+	return d.write(func(tx *bolt.Tx) ([]Event, error) {
+		b, err := d.bucketOf(tx)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		err = b.Put([]byte(kv.Key), kv.Value)
-		return err
+		return d.set(tx, b, kv)
+	})
+}
+
+// CompareAndSet put key and value into BoltDB if the revision matches
+func (d *boltDb) CompareAndSet(kv *KV, rev uint64) error {
+	return d.write(func(tx *bolt.Tx) ([]Event, error) {
+		b, err := d.bucketOf(tx)
+		if err != nil {
+			return nil, err
+		}
+		cur, err := d.revision(b, kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		if cur != rev {
+			return nil, ErrRevisionMismatch
+		}
+		return d.set(tx, b, kv)
 	})
 }
 
@@ -51,16 +260,23 @@ func (d *boltDb) Set(kv *KV) error {
 func (d *boltDb) Get(key string) (kv *KV, err error) {
 	err = d.View(func(tx *bolt.Tx) error {
 		kv = &KV{Key: key}
-		b := tx.Bucket(d.bucket)
-		if b == nil {
-			return nil
+		b, err := d.bucketOf(tx)
+		if err != nil {
+			return err
 		}
 		iv := b.Get([]byte(key))
 		if len(iv) == 0 {
 			return nil
 		}
-		kv.Value = make([]byte, len(iv))
-		copy(kv.Value, iv)
+		var v KV
+		if err := decodeKV(&v, iv); err != nil {
+			return err
+		}
+		if expired(v.Expire, time.Now()) {
+			return nil
+		}
+		v.Key = key
+		kv = &v
 		return nil
 	})
 	return
@@ -68,34 +284,926 @@ func (d *boltDb) Get(key string) (kv *KV, err error) {
 
 // Del deletes key and value from BoltDB
 func (d *boltDb) Del(key string) error {
-	return d.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(d.bucket)
-		if b == nil {
-			return nil
+	return d.write(func(tx *bolt.Tx) ([]Event, error) {
+		b, err := d.bucketOf(tx)
+		if err != nil {
+			return nil, err
+		}
+		return d.del(tx, b, key)
+	})
+}
+
+// CompareAndDel deletes key and value from BoltDB if the revision matches
+func (d *boltDb) CompareAndDel(key string, rev uint64) error {
+	return d.write(func(tx *bolt.Tx) ([]Event, error) {
+		b, err := d.bucketOf(tx)
+		if err != nil {
+			return nil, err
+		}
+		cur, err := d.revision(b, key)
+		if err != nil {
+			return nil, err
 		}
-		return b.Delete([]byte(key))
+		if cur != rev {
+			return nil, ErrRevisionMismatch
+		}
+		return d.del(tx, b, key)
 	})
 }
 
+// Update sets the kv of the key changed by fn in BoltDB
+func (d *boltDb) Update(key string, fn func(kv *KV) error) error {
+	return d.write(func(tx *bolt.Tx) ([]Event, error) {
+		b, err := d.bucketOf(tx)
+		if err != nil {
+			return nil, err
+		}
+		kv := &KV{Key: key}
+		if v := b.Get([]byte(key)); len(v) != 0 {
+			cur := KV{Key: key}
+			if err = decodeKV(&cur, v); err != nil {
+				return nil, err
+			}
+			if !expired(cur.Expire, time.Now()) {
+				kv = &cur
+			}
+		}
+		if err = fn(kv); err != nil {
+			return nil, err
+		}
+		kv.Key = key
+		return d.set(tx, b, kv)
+	})
+}
+
+// Increment adds delta to the counter of the key in BoltDB
+func (d *boltDb) Increment(key string, delta int64, bounds *Bounds) (int64, error) {
+	return increment(d, key, delta, bounds)
+}
+
 // List list kvs with the prefix from BoltDB
-func (d *boltDb) List(prefix string) (kvs []KV, err error) {
+func (d *boltDb) List(prefix string) ([]KV, error) {
+	kvs, _, err := d.ListRange(&ListOptions{Prefix: prefix})
+	return kvs, err
+}
+
+// ListRange list kvs in the range from BoltDB
+func (d *boltDb) ListRange(opts *ListOptions) (kvs []KV, next string, err error) {
 	err = d.View(func(tx *bolt.Tx) error {
-		//var kvs []KV
-		b := tx.Bucket(d.bucket)
-		if b == nil {
+		b, err := d.bucketOf(tx)
+		if err != nil {
+			return err
+		}
+		lower, upper := opts.bounds()
+		c := b.Cursor()
+		var k, v []byte
+		if !opts.Reverse {
+			k, v = c.Seek(lower)
+		} else if upper == nil {
+			k, v = c.Last()
+		} else if k, v = c.Seek(upper); k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+
+		now := time.Now()
+		for ; k != nil; k, v = step(c, opts.Reverse) {
+			if opts.Reverse && bytes.Compare(k, lower) < 0 {
+				break
+			}
+			if !opts.Reverse && upper != nil && bytes.Compare(k, upper) >= 0 {
+				break
+			}
+			kv := KV{Key: string(k)}
+			if opts.KeysOnly {
+				m, _, err := splitRecord(v)
+				if err != nil {
+					return err
+				}
+				m.apply(&kv)
+			} else if err := decodeKV(&kv, v); err != nil {
+				return err
+			}
+			if (!opts.Expired && expired(kv.Expire, now)) || (opts.Filter != nil && !opts.Filter(&kv)) {
+				continue
+			}
+			if opts.Limit > 0 && len(kvs) == opts.Limit {
+				next = kv.Key
+				break
+			}
+			kvs = append(kvs, kv)
+		}
+		return nil
+	})
+	return
+}
+
+// Stats counts the kvs with the prefix in BoltDB, the values are not decoded
+func (d *boltDb) Stats(prefix string) (stats *Stats, err error) {
+	err = d.View(func(tx *bolt.Tx) error {
+		b, err := d.bucketOf(tx)
+		if err != nil {
+			return err
+		}
+		stats = new(Stats)
+		now := time.Now()
+		c := b.Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			m, value, err := splitRecord(v)
+			if err != nil {
+				return err
+			}
+			if expired(m.Expire, now) {
+				continue
+			}
+			stats.Keys++
+			stats.KeyBytes += int64(len(k))
+			stats.ValueBytes += int64(len(value))
+		}
+		return nil
+	})
+	return
+}
+
+// Query looks up the kvs by the index in BoltDB, the entries of the index are sorted by the values then the keys
+func (d *boltDb) Query(q *IndexQuery) (kvs []KV, err error) {
+	lower, upper, err := d.index.bounds(q)
+	if err != nil {
+		return nil, err
+	}
+	err = d.View(func(tx *bolt.Tx) error {
+		b, err := d.bucketOf(tx)
+		if err != nil {
+			return err
+		}
+		ib := tx.Bucket(indexBucket)
+		if ib != nil {
+			ib = ib.Bucket(d.bucket)
+		}
+		if ib != nil {
+			ib = ib.Bucket([]byte(q.Index))
+		}
+		if ib == nil {
 			return nil
 		}
+		now := time.Now()
+		c := ib.Cursor()
+		for k, _ := c.Seek(indexPrefix(lower)); k != nil; k, _ = c.Next() {
+			value, key, ok := splitIndexKey(k)
+			if !ok {
+				continue
+			}
+			if upper != nil && bytes.Compare(value, upper) >= 0 {
+				break
+			}
+			v := b.Get([]byte(key))
+			if v == nil {
+				continue
+			}
+			kv := KV{Key: key}
+			if err := decodeKV(&kv, v); err != nil {
+				return err
+			}
+			if expired(kv.Expire, now) {
+				continue
+			}
+			kvs = append(kvs, kv)
+			if q.Limit > 0 && len(kvs) == q.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// step moves the cursor forward, or backward if reverse
+func step(c *bolt.Cursor, reverse bool) ([]byte, []byte) {
+	if reverse {
+		return c.Prev()
+	}
+	return c.Next()
+}
+
+// DelExpired deletes all expired kvs of all namespaces from BoltDB, the expired keys are found without
+// blocking writers and deleted in chunks of delExpiredChunk, each chunk shares a revision
+func (d *boltDb) DelExpired() (n int, err error) {
+	now := time.Now()
+	// the expired keys are found by a read transaction reading the metadata only, so that writers are not blocked
+	var names [][]byte
+	keys := map[string][][]byte{}
+	err = d.DB.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if name[0] == '.' && !bytes.Equal(name, defaultBucket) {
+				return nil
+			}
+			return b.ForEach(func(k, v []byte) error {
+				m, _, err := splitRecord(v)
+				if err != nil {
+					return err
+				}
+				if expired(m.Expire, now) {
+					if keys[string(name)] == nil {
+						names = append(names, append([]byte{}, name...))
+					}
+					keys[string(name)] = append(keys[string(name)], append([]byte{}, k...))
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range names {
+		ks := keys[string(name)]
+		for len(ks) > 0 {
+			chunk := ks
+			if len(chunk) > delExpiredChunk {
+				chunk = chunk[:delExpiredChunk]
+			}
+			ks = ks[len(chunk):]
+			deleted, err := d.delExpired(name, chunk, now)
+			n += deleted
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// delExpired deletes the keys of the bucket in one transaction if they are still expired,
+// they may be written again after found, returns the count deleted
+func (d *boltDb) delExpired(name []byte, keys [][]byte, now time.Time) (n int, err error) {
+	err = d.write(func(tx *bolt.Tx) ([]Event, error) {
+		b := tx.Bucket(name)
+		if b == nil {
+			// the namespace is dropped meanwhile
+			return nil, nil
+		}
+		ns := string(name)
+		if bytes.Equal(name, defaultBucket) {
+			ns = ""
+		}
+		var rev uint64
+		var events []Event
+		for _, k := range keys {
+			v := b.Get(k)
+			if v == nil {
+				continue
+			}
+			m, _, err := splitRecord(v)
+			if err != nil {
+				return nil, err
+			}
+			if !expired(m.Expire, now) {
+				continue
+			}
+			if rev == 0 {
+				if rev, err = nextRevision(tx); err != nil {
+					return nil, err
+				}
+			}
+			if err = b.Delete(k); err != nil {
+				return nil, err
+			}
+			events = append(events, Event{Type: EventDel, Namespace: ns, KV: KV{Key: string(k), Revision: rev}})
+		}
+		n = len(events)
+		return events, d.derive(tx, events)
+	})
+	return
+}
+
+// DelPrefix deletes all kvs with the prefix from BoltDB in one transaction
+func (d *boltDb) DelPrefix(prefix string) (n int, err error) {
+	err = d.write(func(tx *bolt.Tx) ([]Event, error) {
+		b, err := d.bucketOf(tx)
+		if err != nil {
+			return nil, err
+		}
+		var keys [][]byte
 		c := b.Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		if len(keys) == 0 {
+			return nil, nil
+		}
+		rev, err := nextRevision(tx)
+		if err != nil {
+			return nil, err
+		}
+		events := make([]Event, 0, len(keys))
+		for _, k := range keys {
+			if err = b.Delete(k); err != nil {
+				return nil, err
+			}
+			events = append(events, Event{Type: EventDel, Namespace: d.ns, KV: KV{Key: string(k), Revision: rev}})
+		}
+		n = len(events)
+		return events, d.derive(tx, events)
+	})
+	return
+}
 
-		prefix := []byte(prefix)
+// Batch applies all operations into BoltDB in one transaction
+func (d *boltDb) Batch(ops []Op) error {
+	// an empty batch changes nothing and takes no revision
+	if len(ops) == 0 {
+		return nil
+	}
+	return d.write(func(tx *bolt.Tx) ([]Event, error) {
+		b, err := d.bucketOf(tx)
+		if err != nil {
+			return nil, err
+		}
+		// all operations in one batch share the same revision
+		rev, err := nextRevision(tx)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		var events []Event
+		for i := range ops {
+			op := &ops[i]
+			switch op.Type {
+			case OpSet:
+				if op.Key == "" {
+					return nil, bolt.ErrKeyRequired
+				}
+				op.Revision = rev
+				op.expiry(now)
+				if !op.KeepTime {
+					var created int64
+					if created, err = d.created(b, op.Key, now); err != nil {
+						return nil, err
+					}
+					op.stamp(now, created)
+				}
+				err = d.put(b, &op.KV)
+				events = append(events, Event{Type: EventPut, Namespace: d.ns, KV: op.KV})
+			case OpDel:
+				if b.Get([]byte(op.Key)) == nil {
+					continue
+				}
+				err = b.Delete([]byte(op.Key))
+				events = append(events, Event{Type: EventDel, Namespace: d.ns, KV: KV{Key: op.Key, Revision: rev}})
+			default:
+				err = errUnknownOp
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return events, d.derive(tx, events)
+	})
+}
+
+// History lists the versions of the key kept in BoltDB
+func (d *boltDb) History(key string) (versions []Version, err error) {
+	err = d.View(func(tx *bolt.Tx) error {
+		if _, err := d.bucketOf(tx); err != nil {
+			return err
+		}
+		hb := tx.Bucket(historyBucket)
+		if hb == nil {
+			return nil
+		}
+		nb := hb.Bucket(d.bucket)
+		if nb == nil {
+			return nil
+		}
+		prefix := versionPrefix(key)
+		c := nb.Cursor()
 		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
-			var kv KV
-			kv.Key = string(k)
-			kv.Value = make([]byte, len(v))
-			copy(kv.Value, v)
-			kvs = append(kvs, kv)
+			ver := Version{KV: KV{Key: key}}
+			if err := decodeVersion(&ver, v); err != nil {
+				return err
+			}
+			versions = append(versions, ver)
 		}
 		return nil
 	})
+	for i, j := 0, len(versions)-1; i < j; i, j = i+1, j-1 {
+		versions[i], versions[j] = versions[j], versions[i]
+	}
 	return
 }
+
+// RewriteHistory rewrites the versions kept in BoltDB changed by fn
+func (d *boltDb) RewriteHistory(fn func(v *Version) (bool, error)) (n int, err error) {
+	err = d.write(func(tx *bolt.Tx) ([]Event, error) {
+		if _, err := d.bucketOf(tx); err != nil {
+			return nil, err
+		}
+		hb := tx.Bucket(historyBucket)
+		if hb == nil {
+			return nil, nil
+		}
+		nb := hb.Bucket(d.bucket)
+		if nb == nil {
+			return nil, nil
+		}
+		// the bucket cannot be modified while iterated
+		var keys, values [][]byte
+		err := nb.ForEach(func(k, data []byte) error {
+			l, m := binary.Uvarint(k)
+			if m <= 0 || uint64(len(k)-m) < l {
+				return errRecordFormat
+			}
+			ver := Version{KV: KV{Key: string(k[m : m+int(l)])}}
+			if err := decodeVersion(&ver, data); err != nil {
+				return err
+			}
+			changed, err := fn(&ver)
+			if err != nil || !changed {
+				return err
+			}
+			if data, err = encodeVersion(&ver, d.comp); err != nil {
+				return err
+			}
+			keys, values = append(keys, append([]byte{}, k...)), append(values, data)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for i := range keys {
+			if err = nb.Put(keys[i], values[i]); err != nil {
+				return nil, err
+			}
+		}
+		n = len(keys)
+		return nil, nil
+	})
+	return
+}
+
+// Rewrite rewrites the kvs in BoltDB changed by fn in place, the indexes of them are rebuilt
+func (d *boltDb) Rewrite(fn func(kv *KV) (bool, error)) (n int, err error) {
+	err = d.write(func(tx *bolt.Tx) ([]Event, error) {
+		b, err := d.bucketOf(tx)
+		if err != nil {
+			return nil, err
+		}
+		// the bucket cannot be modified while iterated
+		var kvs []KV
+		err = b.ForEach(func(k, data []byte) error {
+			kv := KV{Key: string(k)}
+			if err := decodeKV(&kv, data); err != nil {
+				return err
+			}
+			changed, err := fn(&kv)
+			if err != nil || !changed {
+				return err
+			}
+			kvs = append(kvs, kv)
+			return nil
+		})
+		if err != nil || len(kvs) == 0 {
+			return nil, err
+		}
+		var nb *bolt.Bucket
+		if d.index != nil {
+			ib, err := tx.CreateBucketIfNotExists(indexBucket)
+			if err != nil {
+				return nil, err
+			}
+			if nb, err = ib.CreateBucketIfNotExists(d.bucket); err != nil {
+				return nil, err
+			}
+		}
+		for i := range kvs {
+			if err = d.put(b, &kvs[i]); err != nil {
+				return nil, err
+			}
+			if nb == nil {
+				continue
+			}
+			if err = d.indexKey(nb, kvs[i].Key, d.index.entries(&kvs[i])); err != nil {
+				return nil, err
+			}
+		}
+		n = len(kvs)
+		return nil, nil
+	})
+	return
+}
+
+// Watch watches the changes of the key or the keys with the prefix in the namespace
+func (d *boltDb) Watch(key string, prefix bool, rev uint64) (*Watcher, error) {
+	return d.broker.watch(d.ns, key, prefix, rev)
+}
+
+// Backup writes a consistent snapshot of BoltDB with all namespaces to w
+func (d *boltDb) Backup(w io.Writer) (n int64, err error) {
+	err = d.View(func(tx *bolt.Tx) error {
+		n, err = tx.WriteTo(w)
+		return err
+	})
+	return
+}
+
+// Restore replaces all namespaces of BoltDB with the snapshot made by Backup in one transaction,
+// the snapshot written by older versions is migrated first, all watchers are closed with ErrCompacted
+func (d *boltDb) Restore(r io.Reader) error {
+	file, err := saveSnapshot(d.conf.Source, r)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file)
+
+	// the snapshot is checked and migrated by opening it as the database
+	conf := d.conf
+	conf.Source = file
+	s, err := newBoltDB(conf)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	var rev uint64
+	err = s.(*boltDb).View(func(stx *bolt.Tx) error {
+		return d.DB.Update(func(tx *bolt.Tx) error {
+			var names [][]byte
+			tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+				names = append(names, append([]byte{}, name...))
+				return nil
+			})
+			for _, name := range names {
+				if err := tx.DeleteBucket(name); err != nil {
+					return err
+				}
+			}
+			err := stx.ForEach(func(name []byte, sb *bolt.Bucket) error {
+				b, err := tx.CreateBucket(name)
+				if err != nil {
+					return err
+				}
+				return copyBucket(b, sb)
+			})
+			if err != nil {
+				return err
+			}
+			rev = tx.Bucket(sysBucket).Sequence()
+			if err = d.trimHistory(tx); err != nil {
+				return err
+			}
+			return d.reindex(tx, true)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	d.broker.reset(rev)
+	return nil
+}
+
+// copyBucket copies the sequence, the kvs and the nested buckets from src to dst
+func copyBucket(dst, src *bolt.Bucket) error {
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+	return src.ForEach(func(k, v []byte) error {
+		if v != nil {
+			return dst.Put(k, v)
+		}
+		b, err := dst.CreateBucket(k)
+		if err != nil {
+			return err
+		}
+		return copyBucket(b, src.Bucket(k))
+	})
+}
+
+// Close closes all watchers and BoltDB with all namespaces
+func (d *boltDb) Close() error {
+	d.broker.close()
+	return d.DB.Close()
+}
+
+// write runs fn in a read-write transaction and publishes the events returned by fn once committed
+func (d *boltDb) write(fn func(tx *bolt.Tx) ([]Event, error)) error {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	var events []Event
+	err := d.DB.Update(func(tx *bolt.Tx) (err error) {
+		events, err = fn(tx)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	d.broker.publish(events...)
+	return nil
+}
+
+// set assigns the next revision to kv and puts it into bucket
+func (d *boltDb) set(tx *bolt.Tx, b *bolt.Bucket, kv *KV) ([]Event, error) {
+	if kv.Key == "" {
+		return nil, bolt.ErrKeyRequired
+	}
+	rev, err := nextRevision(tx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	kv.Revision = rev
+	kv.expiry(now)
+	created, err := d.created(b, kv.Key, now)
+	if err != nil {
+		return nil, err
+	}
+	kv.stamp(now, created)
+	if err = d.put(b, kv); err != nil {
+		return nil, err
+	}
+	events := []Event{{Type: EventPut, Namespace: d.ns, KV: *kv}}
+	return events, d.derive(tx, events)
+}
+
+// del deletes the key from bucket with the next revision if it exists
+func (d *boltDb) del(tx *bolt.Tx, b *bolt.Bucket, key string) ([]Event, error) {
+	if b.Get([]byte(key)) == nil {
+		return nil, nil
+	}
+	rev, err := nextRevision(tx)
+	if err != nil {
+		return nil, err
+	}
+	if err = b.Delete([]byte(key)); err != nil {
+		return nil, err
+	}
+	events := []Event{{Type: EventDel, Namespace: d.ns, KV: KV{Key: key, Revision: rev}}}
+	return events, d.derive(tx, events)
+}
+
+// derive records the history and maintains the indexes of the kvs changed by the events
+func (d *boltDb) derive(tx *bolt.Tx, events []Event) error {
+	if err := d.record(tx, events); err != nil {
+		return err
+	}
+	if d.index == nil || len(events) == 0 {
+		return nil
+	}
+	ib, err := tx.CreateBucketIfNotExists(indexBucket)
+	if err != nil {
+		return err
+	}
+	for i := range events {
+		e := &events[i]
+		name := defaultBucket
+		if e.Namespace != "" {
+			name = []byte(e.Namespace)
+		}
+		nb, err := ib.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+		var entries []indexEntry
+		if e.Type == EventPut {
+			entries = d.index.entries(&e.KV)
+		}
+		if err = d.indexKey(nb, e.Key, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexKey replaces the entries of the key in the index bucket of the namespace with the ones given
+func (d *boltDb) indexKey(nb *bolt.Bucket, key string, entries []indexEntry) error {
+	rb, err := nb.CreateBucketIfNotExists(reverseBucket)
+	if err != nil {
+		return err
+	}
+	if data := rb.Get([]byte(key)); data != nil {
+		var old []indexEntry
+		if err = json.Unmarshal(data, &old); err != nil {
+			return err
+		}
+		for _, e := range old {
+			if b := nb.Bucket([]byte(e.Index)); b != nil {
+				if err = b.Delete(indexKey(e.Value, key)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if len(entries) == 0 {
+		return rb.Delete([]byte(key))
+	}
+	for _, e := range entries {
+		b, err := nb.CreateBucketIfNotExists([]byte(e.Index))
+		if err != nil {
+			return err
+		}
+		if err = b.Put(indexKey(e.Value, key), []byte{}); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return rb.Put([]byte(key), data)
+}
+
+// reindex rebuilds the indexes of all namespaces if their declarations are changed since the last build, or force
+func (d *boltDb) reindex(tx *bolt.Tx, force bool) error {
+	s := tx.Bucket(sysBucket)
+	fp := d.index.fingerprint()
+	if !force && bytes.Equal(s.Get(indexesKey), fp) {
+		return nil
+	}
+	if tx.Bucket(indexBucket) != nil {
+		if err := tx.DeleteBucket(indexBucket); err != nil {
+			return err
+		}
+	}
+	if d.index != nil {
+		// the index bucket is created before iterating the root bucket, which must not be modified meanwhile
+		ib, err := tx.CreateBucket(indexBucket)
+		if err != nil {
+			return err
+		}
+		err = tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if name[0] == '.' && !bytes.Equal(name, defaultBucket) {
+				return nil
+			}
+			nb, err := ib.CreateBucket(name)
+			if err != nil {
+				return err
+			}
+			return b.ForEach(func(k, v []byte) error {
+				kv := KV{Key: string(k)}
+				if err := decodeKV(&kv, v); err != nil {
+					return err
+				}
+				return d.indexKey(nb, kv.Key, d.index.entries(&kv))
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return s.Put(indexesKey, fp)
+}
+
+// record appends the versions changed by the events to the history of their keys,
+// and drops the oldest ones out of Conf.History
+func (d *boltDb) record(tx *bolt.Tx, events []Event) error {
+	if d.conf.History <= 0 || len(events) == 0 {
+		return nil
+	}
+	hb, err := tx.CreateBucketIfNotExists(historyBucket)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for i := range events {
+		e := &events[i]
+		name := defaultBucket
+		if e.Namespace != "" {
+			name = []byte(e.Namespace)
+		}
+		nb, err := hb.CreateBucketIfNotExists(name)
+		if err != nil {
+			return err
+		}
+		v := newVersion(e, now)
+		data, err := encodeVersion(&v, d.comp)
+		if err != nil {
+			return err
+		}
+		prefix := versionPrefix(e.Key)
+		if err = nb.Put(append(prefix, versionSuffix(e.Revision)...), data); err != nil {
+			return err
+		}
+		var keys [][]byte
+		c := nb.Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for len(keys) > d.conf.History {
+			if err = nb.Delete(keys[0]); err != nil {
+				return err
+			}
+			keys = keys[1:]
+		}
+	}
+	return nil
+}
+
+// trimHistory drops the versions out of Conf.History from the history of all keys, e.g. restored from a snapshot
+func (d *boltDb) trimHistory(tx *bolt.Tx) error {
+	hb := tx.Bucket(historyBucket)
+	if hb == nil {
+		return nil
+	}
+	if d.conf.History <= 0 {
+		return tx.DeleteBucket(historyBucket)
+	}
+	return hb.ForEach(func(name, _ []byte) error {
+		nb := hb.Bucket(name)
+		// the versions of a key are adjacent in ascending order of revision, the oldest ones are dropped
+		var drops, keys [][]byte
+		c := nb.Cursor()
+		for k, _ := c.First(); ; k, _ = c.Next() {
+			if len(keys) != 0 && (k == nil || !bytes.Equal(k[:len(k)-8], keys[0][:len(keys[0])-8])) {
+				if len(keys) > d.conf.History {
+					drops = append(drops, keys[:len(keys)-d.conf.History]...)
+				}
+				keys = nil
+			}
+			if k == nil {
+				break
+			}
+			keys = append(keys, append([]byte{}, k...))
+		}
+		for _, k := range drops {
+			if err := nb.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// versionPrefix returns the prefix of the versions of the key in history, which is the length of the key
+// followed by the key, so that the versions of a key are not mixed with the ones of the keys it prefixes
+func versionPrefix(key string) []byte {
+	buf := make([]byte, binary.MaxVarintLen64+len(key), binary.MaxVarintLen64+len(key)+8)
+	n := binary.PutUvarint(buf, uint64(len(key)))
+	n += copy(buf[n:], key)
+	return buf[:n]
+}
+
+// versionSuffix returns the revision in big endian, so that the versions of a key are in order of revision
+func versionSuffix(rev uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], rev)
+	return buf[:]
+}
+
+// bucketOf returns the bucket of the namespace
+func (d *boltDb) bucketOf(tx *bolt.Tx) (*bolt.Bucket, error) {
+	b := tx.Bucket(d.bucket)
+	if b == nil {
+		return nil, ErrNamespaceNotFound
+	}
+	return b, nil
+}
+
+func (d *boltDb) put(b *bolt.Bucket, kv *KV) error {
+	data, err := encodeKV(kv, d.comp)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(kv.Key), data)
+}
+
+// created returns the creation time of key, 0 if not found or expired
+func (d *boltDb) created(b *bolt.Bucket, key string, now time.Time) (int64, error) {
+	v := b.Get([]byte(key))
+	if v == nil {
+		return 0, nil
+	}
+	m, _, err := splitRecord(v)
+	if err != nil {
+		return 0, err
+	}
+	if expired(m.Expire, now) {
+		return 0, nil
+	}
+	return m.Created, nil
+}
+
+// revision returns the current revision of key, 0 if not found or expired
+func (d *boltDb) revision(b *bolt.Bucket, key string) (uint64, error) {
+	v := b.Get([]byte(key))
+	if v == nil {
+		return 0, nil
+	}
+	m, _, err := decodeRecord(v)
+	if err != nil {
+		return 0, err
+	}
+	if expired(m.Expire, time.Now()) {
+		return 0, nil
+	}
+	return m.Revision, nil
+}
+
+func nextRevision(tx *bolt.Tx) (uint64, error) {
+	s, err := tx.CreateBucketIfNotExists(sysBucket)
+	if err != nil {
+		return 0, err
+	}
+	return s.NextSequence()
+}
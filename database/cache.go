@@ -0,0 +1,311 @@
+package database
+
+import (
+	"container/list"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	Decorators["cache"] = newCacheDB
+}
+
+const (
+	defaultCacheEntries = 1024
+	defaultCacheBytes   = 16 << 20
+)
+
+// CacheStats the statistics of the cache
+type CacheStats struct {
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+	Entries int    `json:"entries"`
+	Bytes   int    `json:"bytes"`
+}
+
+// CacheStatsOf returns the statistics of the cache decorating the DB, false if not cached
+func CacheStatsOf(db DB) (CacheStats, bool) {
+	for {
+		if d, ok := db.(*cacheDb); ok {
+			return d.c.stats(), true
+		}
+		u, ok := db.(interface{ Unwrap() DB })
+		if !ok {
+			return CacheStats{}, false
+		}
+		db = u.Unwrap()
+	}
+}
+
+// cacheDb the DB serving Get from the LRU cache shared by all namespaces, the cached kvs
+// are invalidated by the writes through it, the writes bypassing it are not seen until evicted
+type cacheDb struct {
+	DB
+	c  *cache
+	ns string
+}
+
+func newCacheDB(db DB, conf Conf) (DB, error) {
+	return &cacheDb{DB: db, c: newCache(conf.CacheEntries, conf.CacheBytes)}, nil
+}
+
+// Unwrap returns the DB cached
+func (d *cacheDb) Unwrap() DB {
+	return d.DB
+}
+
+// Namespace returns the namespace cached
+func (d *cacheDb) Namespace(name string) (DB, error) {
+	ns, err := d.DB.Namespace(name)
+	if err != nil {
+		return nil, err
+	}
+	return &cacheDb{DB: ns, c: d.c, ns: name}, nil
+}
+
+// DropNamespace drops the namespace and invalidates the cache
+func (d *cacheDb) DropNamespace(name string) error {
+	defer d.c.invalidateAll()
+	return d.DB.DropNamespace(name)
+}
+
+// Get gets the kv from the cache, or loads it from the DB if missed
+func (d *cacheDb) Get(key string) (*KV, error) {
+	return d.c.get(cacheKey{ns: d.ns, key: key}, func() (*KV, error) {
+		return d.DB.Get(key)
+	})
+}
+
+// Set sets the kv and invalidates the key
+func (d *cacheDb) Set(kv *KV) error {
+	defer d.c.invalidate(cacheKey{ns: d.ns, key: kv.Key})
+	return d.DB.Set(kv)
+}
+
+// Del deletes the key and invalidates it
+func (d *cacheDb) Del(key string) error {
+	defer d.c.invalidate(cacheKey{ns: d.ns, key: key})
+	return d.DB.Del(key)
+}
+
+// Batch executes the operations and invalidates their keys
+func (d *cacheDb) Batch(ops []Op) error {
+	defer func() {
+		for _, op := range ops {
+			d.c.invalidate(cacheKey{ns: d.ns, key: op.Key})
+		}
+	}()
+	return d.DB.Batch(ops)
+}
+
+// CompareAndSet sets the kv if the revision matches and invalidates the key
+func (d *cacheDb) CompareAndSet(kv *KV, rev uint64) error {
+	defer d.c.invalidate(cacheKey{ns: d.ns, key: kv.Key})
+	return d.DB.CompareAndSet(kv, rev)
+}
+
+// Update sets the kv changed by fn and invalidates the key
+func (d *cacheDb) Update(key string, fn func(kv *KV) error) error {
+	defer d.c.invalidate(cacheKey{ns: d.ns, key: key})
+	return d.DB.Update(key, fn)
+}
+
+// Increment adds delta to the counter of the key and invalidates it
+func (d *cacheDb) Increment(key string, delta int64, bounds *Bounds) (int64, error) {
+	defer d.c.invalidate(cacheKey{ns: d.ns, key: key})
+	return d.DB.Increment(key, delta, bounds)
+}
+
+// CompareAndDel deletes the key if the revision matches and invalidates it
+func (d *cacheDb) CompareAndDel(key string, rev uint64) error {
+	defer d.c.invalidate(cacheKey{ns: d.ns, key: key})
+	return d.DB.CompareAndDel(key, rev)
+}
+
+// DelPrefix deletes the keys with the prefix and invalidates them
+func (d *cacheDb) DelPrefix(prefix string) (int, error) {
+	defer d.c.invalidatePrefix(d.ns, prefix)
+	return d.DB.DelPrefix(prefix)
+}
+
+// Rewrite rewrites the kvs changed by fn and invalidates the namespace
+func (d *cacheDb) Rewrite(fn func(kv *KV) (bool, error)) (int, error) {
+	defer d.c.invalidatePrefix(d.ns, "")
+	return d.DB.Rewrite(fn)
+}
+
+// Restore restores the database and invalidates the cache
+func (d *cacheDb) Restore(r io.Reader) error {
+	defer d.c.invalidateAll()
+	return d.DB.Restore(r)
+}
+
+type cacheKey struct {
+	ns  string
+	key string
+}
+
+type cacheEntry struct {
+	key  cacheKey
+	kv   *KV
+	size int
+}
+
+// cacheCall the loading of a missed key, which is shared by the concurrent misses of the key
+type cacheCall struct {
+	wg  sync.WaitGroup
+	kv  *KV
+	err error
+}
+
+// cache the LRU cache of kvs bounded by the count of entries and the size of keys and values,
+// the missing keys are cached too
+type cache struct {
+	sync.Mutex
+	maxEntries int
+	maxBytes   int
+	bytes      int
+	// gen increases on each invalidation, the kvs loaded across an invalidation are not cached
+	gen    uint64
+	lru    *list.List
+	items  map[cacheKey]*list.Element
+	calls  map[cacheKey]*cacheCall
+	hits   uint64
+	misses uint64
+}
+
+func newCache(maxEntries, maxBytes int) *cache {
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheEntries
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultCacheBytes
+	}
+	return &cache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		lru:        list.New(),
+		items:      map[cacheKey]*list.Element{},
+		calls:      map[cacheKey]*cacheCall{},
+	}
+}
+
+// get returns a copy of the cached kv, or loads it by load if missed,
+// the concurrent misses of the same key wait for the same loading
+func (c *cache) get(key cacheKey, load func() (*KV, error)) (*KV, error) {
+	c.Lock()
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*cacheEntry)
+		if !expired(e.kv.Expire, time.Now()) {
+			c.lru.MoveToFront(el)
+			c.hits++
+			c.Unlock()
+			return e.kv.clone(), nil
+		}
+		c.remove(el)
+	}
+	c.misses++
+	if call, ok := c.calls[key]; ok {
+		c.Unlock()
+		call.wg.Wait()
+		if call.err != nil {
+			return nil, call.err
+		}
+		return call.kv.clone(), nil
+	}
+	call := new(cacheCall)
+	call.wg.Add(1)
+	c.calls[key] = call
+	gen := c.gen
+	c.Unlock()
+
+	call.kv, call.err = load()
+
+	c.Lock()
+	if c.calls[key] == call {
+		delete(c.calls, key)
+	}
+	if call.err == nil && gen == c.gen {
+		c.add(key, call.kv)
+	}
+	c.Unlock()
+	call.wg.Done()
+	if call.err != nil {
+		return nil, call.err
+	}
+	return call.kv.clone(), nil
+}
+
+// add caches the kv and evicts the least recently used ones out of bounds
+func (c *cache) add(key cacheKey, kv *KV) {
+	e := &cacheEntry{key: key, kv: kv, size: len(key.ns) + len(key.key) + len(kv.Value)}
+	if e.size > c.maxBytes {
+		return
+	}
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	c.items[key] = c.lru.PushFront(e)
+	c.bytes += e.size
+	for c.lru.Len() > c.maxEntries || c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.items, e.key)
+	c.bytes -= e.size
+}
+
+// invalidate drops the cached kv of the key, the loading in progress is not shared any more
+func (c *cache) invalidate(key cacheKey) {
+	c.Lock()
+	defer c.Unlock()
+	c.gen++
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	delete(c.calls, key)
+}
+
+// invalidatePrefix drops the cached kvs with the prefix in the namespace
+func (c *cache) invalidatePrefix(ns, prefix string) {
+	c.Lock()
+	defer c.Unlock()
+	c.gen++
+	for key, el := range c.items {
+		if key.ns == ns && strings.HasPrefix(key.key, prefix) {
+			c.remove(el)
+		}
+	}
+	for key := range c.calls {
+		if key.ns == ns && strings.HasPrefix(key.key, prefix) {
+			delete(c.calls, key)
+		}
+	}
+}
+
+// invalidateAll drops all cached kvs
+func (c *cache) invalidateAll() {
+	c.Lock()
+	defer c.Unlock()
+	c.gen++
+	c.lru.Init()
+	c.items = map[cacheKey]*list.Element{}
+	c.calls = map[cacheKey]*cacheCall{}
+	c.bytes = 0
+}
+
+func (c *cache) stats() CacheStats {
+	c.Lock()
+	defer c.Unlock()
+	return CacheStats{
+		Hits:    c.hits,
+		Misses:  c.misses,
+		Entries: c.lru.Len(),
+		Bytes:   c.bytes,
+	}
+}
@@ -0,0 +1,106 @@
+package database
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// the codecs of stored values, codecNone for the values stored as is
+const (
+	codecNone  byte = 0
+	codecFlate byte = 1
+	codecGzip  byte = 2
+)
+
+// the compressions supported by Conf.Compression
+const (
+	CompressionNone  = ""
+	CompressionFlate = "flate"
+	CompressionGzip  = "gzip"
+)
+
+const defaultCompressMinSize = 128
+
+// compressor compresses the values not smaller than min, the values not getting smaller are kept as is
+type compressor struct {
+	codec byte
+	min   int
+	pool  sync.Pool
+}
+
+// newCompressor creates the compressor configured, nil if compression is disabled
+func newCompressor(conf Conf) (*compressor, error) {
+	c := &compressor{min: conf.CompressMinSize}
+	if c.min <= 0 {
+		c.min = defaultCompressMinSize
+	}
+	switch conf.Compression {
+	case CompressionNone:
+		return nil, nil
+	case CompressionFlate:
+		c.codec = codecFlate
+		c.pool.New = func() interface{} {
+			w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+			return w
+		}
+	case CompressionGzip:
+		c.codec = codecGzip
+		c.pool.New = func() interface{} {
+			return gzip.NewWriter(nil)
+		}
+	default:
+		return nil, fmt.Errorf("compression (%s) not supported", conf.Compression)
+	}
+	return c, nil
+}
+
+type resetWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// compress returns the codec and the value compressed, the compressor can be nil
+func (c *compressor) compress(value []byte) (byte, []byte) {
+	if c == nil || len(value) < c.min {
+		return codecNone, value
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, len(value)/2))
+	w := c.pool.Get().(resetWriter)
+	defer c.pool.Put(w)
+	w.Reset(buf)
+	if _, err := w.Write(value); err != nil {
+		return codecNone, value
+	}
+	if err := w.Close(); err != nil || buf.Len() >= len(value) {
+		return codecNone, value
+	}
+	return c.codec, buf.Bytes()
+}
+
+// decompress returns the value decompressed by the codec
+func decompress(codec byte, value []byte) ([]byte, error) {
+	var r io.Reader
+	switch codec {
+	case codecNone:
+		return value, nil
+	case codecFlate:
+		fr := flate.NewReader(bytes.NewReader(value))
+		defer fr.Close()
+		r = fr
+	case codecGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(value))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	default:
+		return nil, fmt.Errorf("codec (%d) not supported", codec)
+	}
+	return ioutil.ReadAll(r)
+}
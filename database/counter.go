@@ -0,0 +1,55 @@
+package database
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+// errors of counters
+var (
+	// ErrNotInteger returned if the value of the counter is not an integer in decimal
+	ErrNotInteger = errors.New("value is not an integer")
+	// ErrOutOfBounds returned if the value incremented would be out of the bounds or overflow int64
+	ErrOutOfBounds = errors.New("value out of bounds")
+)
+
+// Bounds the inclusive bounds of a counter, nil Min or Max means unbounded
+type Bounds struct {
+	Min *int64
+	Max *int64
+}
+
+// contains returns true if n is in the bounds
+func (b *Bounds) contains(n int64) bool {
+	if b == nil {
+		return true
+	}
+	return (b.Min == nil || n >= *b.Min) && (b.Max == nil || n <= *b.Max)
+}
+
+// increment adds delta to the counter of the key by db.Update, so that it is applied in one transaction
+// of the DB with the values encrypted and the quotas checked as configured
+func increment(db DB, key string, delta int64, bounds *Bounds) (int64, error) {
+	var n int64
+	err := db.Update(key, func(kv *KV) (err error) {
+		n = 0
+		if kv.Revision != 0 {
+			if n, err = strconv.ParseInt(string(kv.Value), 10, 64); err != nil {
+				return ErrNotInteger
+			}
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return ErrOutOfBounds
+		}
+		if n += delta; !bounds.contains(n) {
+			return ErrOutOfBounds
+		}
+		kv.Value = []byte(strconv.FormatInt(n, 10))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
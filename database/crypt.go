@@ -0,0 +1,394 @@
+package database
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// ErrDecryption returned if a value cannot be decrypted by the key, which is
+// encrypted by another key, not encrypted or tampered with
+var ErrDecryption = errors.New("failed to decrypt value")
+
+// LoadKey loads the AES key of 16, 24 or 32 bytes encoded in hex from the file
+func LoadKey(file string) ([]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return nil, fmt.Errorf("key file (%s) invalid: %s", file, err.Error())
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("key file (%s) invalid: key must be 16, 24 or 32 bytes", file)
+}
+
+// sealer encrypts each value by AES-GCM with a random nonce and the kv key as the associated data,
+// so that a value cannot be moved to another key, the sealed value is the nonce followed by the ciphertext.
+// The plaintext is the codec byte followed by the value compressed if configured, since the ciphertext
+// does not compress, the values sealed with or without compression are opened whatever it is
+type sealer struct {
+	aead cipher.AEAD
+	comp *compressor
+}
+
+// newSealer creates the sealer of the key, the compressor can be nil
+func newSealer(key []byte, comp *compressor) (*sealer, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{aead: aead, comp: comp}, nil
+}
+
+func (s *sealer) seal(key string, value []byte) ([]byte, error) {
+	codec, v := s.comp.compress(value)
+	plain := make([]byte, 1+len(v))
+	plain[0] = codec
+	copy(plain[1:], v)
+	n := s.aead.NonceSize()
+	out := make([]byte, n, n+len(plain)+s.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, out); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(out, out, plain, []byte(key)), nil
+}
+
+func (s *sealer) open(key string, value []byte) ([]byte, error) {
+	n := s.aead.NonceSize()
+	if len(value) < n {
+		return nil, ErrDecryption
+	}
+	plain, err := s.aead.Open(nil, value[:n], value[n:], []byte(key))
+	if err != nil || len(plain) == 0 {
+		return nil, ErrDecryption
+	}
+	return decompress(plain[0], plain[1:])
+}
+
+// cryptDb the DB encrypting values before written and decrypting them after read, the values are compressed
+// before encrypted as Conf.Compression, keys, revisions and expiration are stored as is, so are the snapshots of Backup
+type cryptDb struct {
+	DB
+	s    *sealer
+	conf Conf
+}
+
+// newCryptDB wraps the DB to encrypt values by the key, the values are compressed as conf, which is the one of the DB
+func newCryptDB(db DB, key []byte, conf Conf) (DB, error) {
+	comp, err := newCompressor(conf)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSealer(key, comp)
+	if err != nil {
+		return nil, err
+	}
+	return &cryptDb{DB: db, s: s, conf: conf}, nil
+}
+
+// Conf returns the configuration with the compression done by the DB
+func (d *cryptDb) Conf() Conf {
+	return d.conf
+}
+
+// Unwrap returns the DB storing the values encrypted
+func (d *cryptDb) Unwrap() DB {
+	return d.DB
+}
+
+// Namespace returns the namespace encrypted by the same key
+func (d *cryptDb) Namespace(name string) (DB, error) {
+	ns, err := d.DB.Namespace(name)
+	if err != nil {
+		return nil, err
+	}
+	return &cryptDb{DB: ns, s: d.s, conf: d.conf}, nil
+}
+
+// Set encrypts the value and sets it
+func (d *cryptDb) Set(kv *KV) error {
+	return d.sealed(kv, func() error {
+		return d.DB.Set(kv)
+	})
+}
+
+// CompareAndSet encrypts the value and sets it if the revision matches
+func (d *cryptDb) CompareAndSet(kv *KV, rev uint64) error {
+	return d.sealed(kv, func() error {
+		return d.DB.CompareAndSet(kv, rev)
+	})
+}
+
+// Update calls fn with the value decrypted, then encrypts the value changed by fn and sets it
+func (d *cryptDb) Update(key string, fn func(kv *KV) error) error {
+	return d.DB.Update(key, func(kv *KV) (err error) {
+		if kv.Revision != 0 {
+			if kv.Value, err = d.s.open(key, kv.Value); err != nil {
+				return err
+			}
+		}
+		if err = fn(kv); err != nil {
+			return err
+		}
+		kv.Value, err = d.s.seal(key, kv.Value)
+		return err
+	})
+}
+
+// Increment adds delta to the counter of the key, whose value is decrypted and encrypted by Update
+func (d *cryptDb) Increment(key string, delta int64, bounds *Bounds) (int64, error) {
+	return increment(d, key, delta, bounds)
+}
+
+// sealed calls fn with the value of kv encrypted, then restores the value
+func (d *cryptDb) sealed(kv *KV, fn func() error) error {
+	v, err := d.s.seal(kv.Key, kv.Value)
+	if err != nil {
+		return err
+	}
+	plain := kv.Value
+	kv.Value = v
+	defer func() { kv.Value = plain }()
+	return fn()
+}
+
+// Get gets the kv and decrypts the value
+func (d *cryptDb) Get(key string) (*KV, error) {
+	kv, err := d.DB.Get(key)
+	if err != nil || kv.Revision == 0 {
+		return kv, err
+	}
+	if kv.Value, err = d.s.open(key, kv.Value); err != nil {
+		return nil, err
+	}
+	return kv, nil
+}
+
+// List lists the kvs and decrypts the values
+func (d *cryptDb) List(prefix string) ([]KV, error) {
+	kvs, err := d.DB.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	return kvs, d.openAll(kvs)
+}
+
+// ListRange lists the kvs in the range and decrypts the values, the filter is called with the values decrypted
+func (d *cryptDb) ListRange(opts *ListOptions) ([]KV, string, error) {
+	if filter := opts.Filter; filter != nil && !opts.KeysOnly {
+		o := *opts
+		o.Filter = func(kv *KV) bool {
+			v := *kv
+			var err error
+			if v.Value, err = d.s.open(kv.Key, kv.Value); err != nil {
+				return false
+			}
+			return filter(&v)
+		}
+		opts = &o
+	}
+	kvs, next, err := d.DB.ListRange(opts)
+	if err != nil || opts.KeysOnly {
+		return kvs, next, err
+	}
+	return kvs, next, d.openAll(kvs)
+}
+
+// Query looks up the kvs by the index and decrypts the values, only the indexes on labels
+// are useful since the values are indexed after encrypted
+func (d *cryptDb) Query(q *IndexQuery) ([]KV, error) {
+	kvs, err := d.DB.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	return kvs, d.openAll(kvs)
+}
+
+func (d *cryptDb) openAll(kvs []KV) (err error) {
+	for i := range kvs {
+		if kvs[i].Value, err = d.s.open(kvs[i].Key, kvs[i].Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// History lists the versions of the key and decrypts the values
+func (d *cryptDb) History(key string) ([]Version, error) {
+	versions, err := d.DB.History(key)
+	if err != nil {
+		return nil, err
+	}
+	for i := range versions {
+		if versions[i].Deleted {
+			continue
+		}
+		if versions[i].Value, err = d.s.open(key, versions[i].Value); err != nil {
+			return nil, err
+		}
+	}
+	return versions, nil
+}
+
+// RewriteHistory calls fn with the values of versions decrypted, then encrypts the values changed by fn
+func (d *cryptDb) RewriteHistory(fn func(v *Version) (bool, error)) (int, error) {
+	return d.DB.RewriteHistory(func(v *Version) (bool, error) {
+		if v.Deleted {
+			return fn(v)
+		}
+		var err error
+		if v.Value, err = d.s.open(v.Key, v.Value); err != nil {
+			return false, err
+		}
+		changed, err := fn(v)
+		if err != nil || !changed {
+			return changed, err
+		}
+		if v.Value, err = d.s.seal(v.Key, v.Value); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+}
+
+// Rewrite calls fn with the values decrypted, then encrypts the values changed by fn
+func (d *cryptDb) Rewrite(fn func(kv *KV) (bool, error)) (int, error) {
+	return d.DB.Rewrite(func(kv *KV) (bool, error) {
+		var err error
+		if kv.Value, err = d.s.open(kv.Key, kv.Value); err != nil {
+			return false, err
+		}
+		changed, err := fn(kv)
+		if err != nil || !changed {
+			return changed, err
+		}
+		if kv.Value, err = d.s.seal(kv.Key, kv.Value); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+}
+
+// Batch encrypts the values to set and executes the operations
+func (d *cryptDb) Batch(ops []Op) (err error) {
+	sealed := make([]Op, len(ops))
+	for i, op := range ops {
+		if op.Type == OpSet {
+			if op.Value, err = d.s.seal(op.Key, op.Value); err != nil {
+				return err
+			}
+		}
+		sealed[i] = op
+	}
+	return d.DB.Batch(sealed)
+}
+
+// Watch watches the changes with the values of put events decrypted,
+// the watcher is closed with ErrDecryption if a value cannot be decrypted
+func (d *cryptDb) Watch(key string, prefix bool, rev uint64) (*Watcher, error) {
+	w, err := d.DB.Watch(key, prefix, rev)
+	if err != nil {
+		return nil, err
+	}
+	return w.relay(func(e *Event) (err error) {
+		if e.Type == EventPut {
+			e.Value, err = d.s.open(e.Key, e.Value)
+		}
+		return
+	}), nil
+}
+
+// RotateKey re-encrypts the values of all namespaces in the DB not wrapped for encryption
+// from the old key to the new key, and returns the count of values re-encrypted.
+// The old key nil means the values are not encrypted yet. The values already encrypted by the new key
+// are skipped, so that an interrupted rotation can be resumed by running it again. The values are rewritten
+// in place with their revisions and times, without events to watchers or new versions in history.
+// The versions kept in history are re-encrypted as well after the values of each namespace, not counted.
+// The values are compressed before encrypted as the Conf.Compression of the DB
+func RotateKey(db DB, oldKey, newKey []byte) (int, error) {
+	comp, err := newCompressor(db.Conf())
+	if err != nil {
+		return 0, err
+	}
+	var from *sealer
+	if oldKey != nil {
+		if from, err = newSealer(oldKey, comp); err != nil {
+			return 0, err
+		}
+	}
+	to, err := newSealer(newKey, comp)
+	if err != nil {
+		return 0, err
+	}
+	names, err := db.Namespaces()
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, name := range append([]string{""}, names...) {
+		ns, err := db.Namespace(name)
+		if err != nil {
+			return n, err
+		}
+		c, err := ns.Rewrite(func(kv *KV) (bool, error) {
+			value, done, err := reseal(kv.Key, kv.Value, from, to)
+			if err != nil {
+				return false, fmt.Errorf("failed to rotate key (%s) of namespace (%s): %s", kv.Key, name, err.Error())
+			}
+			kv.Value = value
+			return done, nil
+		})
+		n += c
+		if err != nil {
+			return n, err
+		}
+		_, err = ns.RewriteHistory(func(v *Version) (bool, error) {
+			if v.Deleted {
+				return false, nil
+			}
+			value, done, err := reseal(v.Key, v.Value, from, to)
+			if err != nil {
+				return false, fmt.Errorf("failed to rotate key (%s) of namespace (%s) in history: %s", v.Key, name, err.Error())
+			}
+			v.Value = value
+			return done, nil
+		})
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// reseal re-encrypts the value from the old key to the new key, returns false if it is already encrypted by the new key
+func reseal(key string, value []byte, from, to *sealer) ([]byte, bool, error) {
+	if _, err := to.open(key, value); err == nil {
+		return value, false, nil
+	}
+	if from != nil {
+		var err error
+		if value, err = from.open(key, value); err != nil {
+			return nil, false, err
+		}
+	}
+	value, err := to.seal(key, value)
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
@@ -1,40 +1,299 @@
 package database
 
 import (
+	"bytes"
 	"errors"
 	"io"
+	"regexp"
+	"strings"
+	"time"
 )
 
 // Factories of database
 var Factories = map[string]func(conf Conf) (DB, error){}
 
-// DB the backend database
+// DB the backend database, it is the default namespace if not returned by Namespace
 type DB interface {
 	Conf() Conf
 
+	// Namespace returns the namespace which shares the storage, revisions and
+	// watchers with others, but has its own keys. "" is the default namespace
+	Namespace(name string) (DB, error)
+	// Namespaces lists the names of all namespaces created, except the default one, including the reserved ones
+	Namespaces() ([]string, error)
+	// CreateNamespace creates the namespace if not exists
+	CreateNamespace(name string) error
+	// DropNamespace deletes the namespace with all its kvs
+	DropNamespace(name string) error
+
 	Set(kv *KV) error
 	Get(key string) (*KV, error)
 	Del(key string) error
 	List(prefix string) ([]KV, error)
+	// ListRange lists kvs in the range in order, returns the cursor of the next page
+	// if there are more than opts.Limit kvs, otherwise the cursor is empty
+	ListRange(opts *ListOptions) ([]KV, string, error)
+	// Stats counts the kvs with the prefix and sums the sizes of their keys and values without reading the values
+	Stats(prefix string) (*Stats, error)
+	// Query looks up the kvs by the index declared in Conf.Indexes without scanning all kvs
+	Query(q *IndexQuery) ([]KV, error)
+	Batch(ops []Op) error
+
+	// CompareAndSet sets the kv only if the current revision of the key equals rev,
+	// rev 0 means the key must not exist
+	CompareAndSet(kv *KV, rev uint64) error
+	// CompareAndDel deletes the key only if its current revision equals rev
+	CompareAndDel(key string, rev uint64) error
+	// Update calls fn with the current kv of the key, whose revision is 0 if it does not exist, and sets the kv
+	// changed by fn in one transaction, nothing is written if fn returns an error, which is returned
+	Update(key string, fn func(kv *KV) error) error
+	// Increment adds the signed delta to the integer value of the key in decimal in one transaction and returns
+	// the new value, the key not found is initialised to 0. ErrNotInteger is returned if the value is not an integer,
+	// ErrOutOfBounds if the new value would be out of the bounds or overflow, nil bounds means unbounded
+	Increment(key string, delta int64, bounds *Bounds) (int64, error)
+	// DelExpired deletes the expired kvs of all namespaces physically and returns the count,
+	// expired kvs are already invisible to Get and List before deleted
+	DelExpired() (int, error)
+	// DelPrefix deletes all kvs with the prefix in one transaction and returns the count, including
+	// the expired kvs not deleted yet, all deletions share the same revision. "" deletes all kvs
+	DelPrefix(prefix string) (int, error)
+	// History lists the versions of the key kept in descending order of revision, including the current one
+	// and the deletions, the last Conf.History versions are kept for each key, none if it is 0
+	History(key string) ([]Version, error)
+	// RewriteHistory calls fn with each version kept in the history of all keys in one transaction, and stores
+	// the versions fn returns true for as changed, returns the count changed. Nothing is written if fn fails
+	RewriteHistory(fn func(v *Version) (bool, error)) (int, error)
+	// Rewrite calls fn with each kv of the namespace in one transaction, including the expired ones not deleted yet,
+	// and stores the kvs fn returns true for as changed in place, returns the count changed. The revisions and times
+	// are kept without publishing events or recording versions, since only the storage is rewritten, e.g. the values
+	// re-encrypted, fn must not change the other fields. Nothing is written if fn fails
+	Rewrite(fn func(kv *KV) (bool, error)) (int, error)
+	// Watch watches the changes of the key, or all keys with the prefix if prefix is true,
+	// the kept events since revision rev are replayed if rev is not 0
+	Watch(key string, prefix bool, rev uint64) (*Watcher, error)
+
+	// Backup writes a consistent snapshot of the database with all namespaces to w while serving,
+	// returns the size of the snapshot
+	Backup(w io.Writer) (int64, error)
+	// Restore replaces the data of the database with all namespaces by the snapshot made by Backup atomically,
+	// all watchers are closed with ErrCompacted since the history of revisions is replaced
+	Restore(r io.Reader) error
 
+	// Close closes the database with all namespaces
 	io.Closer
 }
 
+// KV the key and value, Revision is assigned by database on each write
+// and increases monotonically across all keys
 type KV struct {
-	Key   string
-	Value []byte
+	Key      string
+	Value    []byte
+	Revision uint64
+	// TTL time to live in seconds, only used when writing, Expire is computed from it if set
+	TTL int64
+	// Expire the unix time in seconds when the kv expires, 0 means never
+	Expire int64
+	// ContentType the media type of the value, set by the writer
+	ContentType string `json:",omitempty"`
+	// Labels the string labels of the kv, set by the writer
+	Labels map[string]string `json:",omitempty"`
+	// Created and Updated the unix time in nanoseconds when the key was created and last written,
+	// assigned by database on each write like Revision
+	Created int64 `json:",omitempty"`
+	Updated int64 `json:",omitempty"`
+}
+
+// expiry computes Expire from TTL before writing
+func (kv *KV) expiry(now time.Time) {
+	if kv.TTL > 0 {
+		kv.Expire = now.Unix() + kv.TTL
+	}
+}
+
+// stamp assigns the time of the write, created is the creation time of the existing kv, 0 if the kv is new
+func (kv *KV) stamp(now time.Time, created int64) {
+	kv.Updated = now.UnixNano()
+	kv.Created = created
+	if created == 0 {
+		kv.Created = kv.Updated
+	}
+}
+
+// expired checks whether the expire time has been reached
+func expired(expire int64, now time.Time) bool {
+	return expire != 0 && expire <= now.Unix()
+}
+
+// ListOptions the options of listing, kvs are listed if their keys have the Prefix and are in [Start, End),
+// an empty Start or End means unbounded. Cursor is the key to continue from (inclusive) returned by
+// the previous page, Limit 0 means no limit, Reverse lists kvs in descending order of keys,
+// KeysOnly lists kvs without their values. Filter skips the kvs it returns false for while iterating,
+// so that the pages are filled with the kvs matched, it is called with the kvs as listed and must not modify them.
+// Expired lists the expired kvs not deleted yet too, which are hidden by default
+type ListOptions struct {
+	Prefix   string
+	Start    string
+	End      string
+	Cursor   string
+	Limit    int
+	Reverse  bool
+	KeysOnly bool
+	Expired  bool
+	Filter   func(kv *KV) bool
+}
+
+// Stats the statistics of the kvs with a prefix, the expired kvs are not counted.
+// ValueBytes is the size of the values as stored by the driver, which are compressed or encrypted if configured
+type Stats struct {
+	Keys       int64 `json:"keys"`
+	KeyBytes   int64 `json:"keyBytes"`
+	ValueBytes int64 `json:"valueBytes"`
+}
+
+// bounds returns the lower (inclusive) and upper (exclusive) bound of keys, nil upper means unbounded
+func (o *ListOptions) bounds() (lower, upper []byte) {
+	lower = []byte(o.Prefix)
+	if o.Start > o.Prefix {
+		lower = []byte(o.Start)
+	}
+	upper = prefixEnd([]byte(o.Prefix))
+	if o.End != "" && (upper == nil || o.End < string(upper)) {
+		upper = []byte(o.End)
+	}
+	if o.Cursor == "" {
+		return
+	}
+	if !o.Reverse && o.Cursor > string(lower) {
+		lower = []byte(o.Cursor)
+	}
+	if o.Reverse {
+		// the cursor is inclusive, the smallest key greater than the cursor is cursor+"\x00"
+		c := append([]byte(o.Cursor), 0)
+		if upper == nil || bytes.Compare(c, upper) < 0 {
+			upper = c
+		}
+	}
+	return
+}
+
+// prefixEnd returns the smallest key greater than all keys with the prefix, nil if there is no such key
+func prefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// all errors of database
+var (
+	// ErrRevisionMismatch returned if the expected revision is not the current one
+	ErrRevisionMismatch = errors.New("revision mismatch")
+	// ErrNamespaceNotFound returned if the namespace is not created
+	ErrNamespaceNotFound = errors.New("namespace not found")
+	// ErrNamespaceInvalid returned if the namespace name is invalid
+	ErrNamespaceInvalid = errors.New("namespace name must be 1-64 letters, digits, '_', '-' or '.' and start with a letter or digit")
+)
+
+var namespaceRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]{0,63}$`)
+
+// queueNamespace the namespace reserved for the state of queues, it is limited by the global quota only
+const queueNamespace = "_queue"
+
+// checkNamespace checks the name of a namespace except the default one, the reserved ones are valid
+func checkNamespace(name string) error {
+	if name != queueNamespace && !namespaceRegexp.MatchString(name) {
+		return ErrNamespaceInvalid
+	}
+	return nil
 }
 
+// ReservedNamespace returns true if the namespace is reserved for internal use, e.g. the state of queues,
+// which is listed by Namespaces but should not be accessed by users. The names of users never start with '_'
+func ReservedNamespace(name string) bool {
+	return strings.HasPrefix(name, "_")
+}
+
+// operation types of batch
+const (
+	OpSet = "set"
+	OpDel = "del"
+)
+
+// Op the operation of batch, Value is ignored when deleting. KeepTime keeps Created and Updated of KV
+// instead of assigning the time of the write, to copy kvs between databases as they are
+type Op struct {
+	Type     string
+	KeepTime bool `json:"-"`
+	KV
+}
+
+var errUnknownOp = errors.New("unknown operation type")
+
 // Conf the configuration of database
 type Conf struct {
-	Driver string
-	Source string
+	Driver string `yaml:"driver" json:"driver"`
+	Source string `yaml:"source" json:"source"`
+	// WatchHistory the number of recent events kept for watchers to resume from
+	WatchHistory int `yaml:"watchHistory" json:"watchHistory" default:"1024"`
+	// CompactRatio the ratio of garbage in the log to trigger compaction, used by the wal driver
+	CompactRatio float64 `yaml:"compactRatio" json:"compactRatio" default:"0.5"`
+	// Compression the compression of stored values, flate or gzip, disabled if empty,
+	// the values stored with or without compression are readable whatever it is.
+	// The values are compressed before encrypted if KeyFile is set too, since the values encrypted do not compress
+	Compression string `yaml:"compression" json:"compression"`
+	// CompressMinSize the values smaller than it are stored without compression
+	CompressMinSize int `yaml:"compressMinSize" json:"compressMinSize" default:"128"`
+	// History the count of versions kept for each key, including the current one, disabled if 0
+	History int `yaml:"history" json:"history"`
+	// KeyFile the file of the AES key encoded in hex to encrypt values, disabled if empty
+	KeyFile string `yaml:"keyFile" json:"keyFile"`
+	// Decorators the names of Decorators wrapping the DB in order, the first one wraps the DB directly
+	Decorators []string `yaml:"decorators" json:"decorators"`
+	// CacheEntries the max count of kvs cached by the cache decorator
+	CacheEntries int `yaml:"cacheEntries" json:"cacheEntries" default:"1024"`
+	// CacheBytes the max size of keys and values cached by the cache decorator
+	CacheBytes int `yaml:"cacheBytes" json:"cacheBytes" default:"16777216"`
+	// Quota the limits of the kvs of all namespaces, Prefix is ignored
+	Quota Quota `yaml:"quota" json:"quota"`
+	// Quotas the limits of the kvs with each prefix in each namespace
+	Quotas []Quota `yaml:"quotas" json:"quotas"`
+	// Indexes the secondary indexes of the kvs in each namespace
+	Indexes []IndexConf `yaml:"indexes" json:"indexes"`
 }
 
-// New KV database by given name
+// New KV database by given name, the DB of the driver is encrypted if Conf.KeyFile is set,
+// then wrapped by the decorators of Conf.Decorators in order
 func New(conf Conf) (DB, error) {
-	if f, ok := Factories[conf.Driver]; ok {
-		return f(conf)
+	f, ok := Factories[conf.Driver]
+	if !ok {
+		return nil, errors.New("no such kind database")
+	}
+	var key []byte
+	dconf := conf
+	if conf.KeyFile != "" {
+		var err error
+		if key, err = LoadKey(conf.KeyFile); err != nil {
+			return nil, err
+		}
+		// the values are compressed by the encryption before encrypted instead of the driver
+		dconf.Compression = CompressionNone
+	}
+	db, err := f(dconf)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		cdb, err := newCryptDB(db, key, conf)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		db = cdb
 	}
-	return nil, errors.New("no such kind database")
+	return decorate(newQuotaDB(db, conf), conf)
 }
@@ -1,14 +1,24 @@
 package database
 
 import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"path"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
 )
 
 func TestNewSqlite(t *testing.T) {
@@ -29,7 +39,7 @@ func TestNewSqlite(t *testing.T) {
 
 func TestSqliteConf(t *testing.T) {
 	conf := Conf{Driver: "sqlite3", Source: path.Join("test", "kv.db")}
-	db := sqldb{nil, conf}
+	db := sqldb{conf: conf}
 	assert.Equal(t, db.Conf(), conf)
 }
 
@@ -51,27 +61,33 @@ func TestNewBoltDB(t *testing.T) {
 
 func TestBoltDbConf(t *testing.T) {
 	conf := Conf{Driver: "boltdb", Source: path.Join("test", "kv.db")}
-	db := sqldb{nil, conf}
+	db := sqldb{conf: conf}
 	assert.Equal(t, db.Conf(), conf)
 }
 
+// driverConfs returns the configurations of the drivers in order, all drivers if none is given,
+// the database of each driver is stored in the directory unless it is in memory
+func driverConfs(dir string, drivers ...string) []Conf {
+	if len(drivers) == 0 {
+		drivers = []string{"sqlite3", "boltdb", "memory", "wal"}
+	}
+	confs := make([]Conf, 0, len(drivers))
+	for _, driver := range drivers {
+		conf := Conf{Driver: driver}
+		if driver != "memory" {
+			conf.Source = path.Join(dir, driver+".db")
+		}
+		confs = append(confs, conf)
+	}
+	return confs
+}
+
 func TestDatabaseKV(t *testing.T) {
 	dir, err := ioutil.TempDir("", t.Name())
 	assert.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	confs := []Conf{
-		{
-			Driver: "sqlite3",
-			Source: path.Join(dir, "kv1.db"),
-		},
-		{
-			Driver: "boltdb",
-			Source: path.Join(dir, "kv2.db"),
-		},
-	}
-
-	for _, conf := range confs {
+	for _, conf := range driverConfs(dir) {
 		db, err := New(conf)
 		assert.NoError(t, err)
 		assert.NotNil(t, db)
@@ -278,76 +294,2613 @@ func TestDatabaseKV(t *testing.T) {
 	}
 }
 
-func BenchmarkDatabaseSQLite(b *testing.B) {
-	dir, err := ioutil.TempDir("", "")
-	assert.NoError(b, err)
+func TestDatabaseBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	db, err := New(Conf{Driver: "sqlite3", Source: path.Join(dir, "t.db")})
-	assert.NoError(b, err)
-	assert.NotNil(b, db)
-	defer db.Close()
+	for _, conf := range driverConfs(dir) {
+		db, err := New(conf)
+		assert.NoError(t, err)
+		assert.NotNil(t, db)
+		defer db.Close()
 
-	// list db
-	vs, err := db.List("/")
-	assert.NoError(b, err)
-	assert.Len(b, vs, 0)
+		err = db.Set(&KV{Key: "/d/rev", Value: []byte("1")})
+		assert.NoError(t, err)
 
-	k1 := "/"
-	b.ResetTimer()
-	b.Run("put", func(b *testing.B) {
-		for i := 0; i < b.N; i++ {
-			key := k1 + strconv.Itoa(i)
-			db.Set(&KV{Key: key, Value: []byte(key)})
-		}
-	})
-	b.Run("get", func(b *testing.B) {
-		for i := 0; i < b.N; i++ {
-			key := k1 + strconv.Itoa(i)
-			db.Get(key)
+		// batch: set and delete
+		err = db.Batch([]Op{
+			{Type: OpSet, KV: KV{Key: "/d/conf", Value: []byte("conf")}},
+			{Type: OpSet, KV: KV{Key: "/d/meta", Value: []byte("meta")}},
+			{Type: OpDel, KV: KV{Key: "/d/rev"}},
+		})
+		assert.NoError(t, err)
+
+		vs, err := db.List("/d/")
+		assert.NoError(t, err)
+		assert.Len(t, vs, 2)
+		assert.Equal(t, "/d/conf", vs[0].Key)
+		assert.Equal(t, []byte("conf"), vs[0].Value)
+		assert.Equal(t, "/d/meta", vs[1].Key)
+		assert.Equal(t, []byte("meta"), vs[1].Value)
+
+		// batch: empty key, nothing applied
+		err = db.Batch([]Op{
+			{Type: OpDel, KV: KV{Key: "/d/conf"}},
+			{Type: OpSet, KV: KV{Value: []byte("data")}},
+		})
+		assert.Error(t, err)
+
+		// batch: unknown operation, nothing applied
+		err = db.Batch([]Op{
+			{Type: OpDel, KV: KV{Key: "/d/conf"}},
+			{Type: "put", KV: KV{Key: "/d/rev"}},
+		})
+		assert.Error(t, err)
+		assert.Equal(t, "unknown operation type", err.Error())
+
+		vs, err = db.List("/d/")
+		assert.NoError(t, err)
+		assert.Len(t, vs, 2)
+
+		// batch: empty, no revision is taken
+		kv := &KV{Key: "/d/rev", Value: []byte("2")}
+		assert.NoError(t, db.Set(kv))
+		rev := kv.Revision
+		err = db.Batch(nil)
+		assert.NoError(t, err)
+		err = db.Batch([]Op{})
+		assert.NoError(t, err)
+		assert.NoError(t, db.Set(kv))
+		assert.Equal(t, rev+1, kv.Revision, conf.Driver)
+	}
+}
+
+func TestDatabaseRevision(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, conf := range driverConfs(dir) {
+		db, err := New(conf)
+		assert.NoError(t, err)
+		assert.NotNil(t, db)
+		defer db.Close()
+
+		// revision increases on each write
+		k1 := &KV{Key: "k1", Value: []byte("v1")}
+		err = db.Set(k1)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), k1.Revision)
+		k2 := &KV{Key: "k2", Value: []byte("v2")}
+		err = db.Set(k2)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(2), k2.Revision)
+
+		v, err := db.Get("k1")
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), v.Revision)
+		v, err = db.Get("kx")
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(0), v.Revision)
+
+		// compare and set
+		err = db.CompareAndSet(&KV{Key: "k1", Value: []byte("v11")}, 2)
+		assert.Equal(t, ErrRevisionMismatch, err)
+		err = db.CompareAndSet(&KV{Key: "k1", Value: []byte("v11")}, 0)
+		assert.Equal(t, ErrRevisionMismatch, err)
+		k1.Value = []byte("v11")
+		err = db.CompareAndSet(k1, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(3), k1.Revision)
+		v, err = db.Get("k1")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("v11"), v.Value)
+		assert.Equal(t, uint64(3), v.Revision)
+
+		// compare and set: create only
+		k3 := &KV{Key: "k3", Value: []byte("v3")}
+		err = db.CompareAndSet(k3, 0)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(4), k3.Revision)
+		err = db.CompareAndSet(k3, 0)
+		assert.Equal(t, ErrRevisionMismatch, err)
+		err = db.CompareAndSet(&KV{}, 0)
+		assert.Error(t, err)
+
+		// compare and delete
+		err = db.CompareAndDel("k1", 1)
+		assert.Equal(t, ErrRevisionMismatch, err)
+		err = db.CompareAndDel("k1", 3)
+		assert.NoError(t, err)
+		err = db.CompareAndDel("k1", 3)
+		assert.Equal(t, ErrRevisionMismatch, err)
+		err = db.CompareAndDel("k1", 0)
+		assert.NoError(t, err)
+
+		// batch shares one revision
+		ops := []Op{
+			{Type: OpSet, KV: KV{Key: "k4"}},
+			{Type: OpSet, KV: KV{Key: "k5"}},
 		}
+		err = db.Batch(ops)
+		assert.NoError(t, err)
+		assert.Equal(t, ops[0].Revision, ops[1].Revision)
+		assert.True(t, ops[0].Revision > k3.Revision)
+
+		vs, err := db.List("k")
+		assert.NoError(t, err)
+		assert.Len(t, vs, 4)
+		assert.Equal(t, k2.Revision, vs[0].Revision)
+		assert.Equal(t, k3.Revision, vs[1].Revision)
+		assert.Equal(t, ops[0].Revision, vs[2].Revision)
+		assert.Equal(t, ops[1].Revision, vs[3].Revision)
+	}
+}
+
+func TestDatabaseMigrateRevision(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// bolt database written by older versions
+	bdb, err := bolt.Open(path.Join(dir, "kv1.db"), 0600, nil)
+	assert.NoError(t, err)
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte(".self"))
+		assert.NoError(t, err)
+		return b.Put([]byte("k1"), []byte("v1"))
 	})
-	b.Run("del", func(b *testing.B) {
-		for i := 0; i < b.N; i++ {
-			key := k1 + strconv.Itoa(i)
-			db.Del(key)
+	assert.NoError(t, err)
+	assert.NoError(t, bdb.Close())
+
+	// sql database written by older versions
+	sdb, err := sql.Open("sqlite3", path.Join(dir, "kv2.db"))
+	assert.NoError(t, err)
+	_, err = sdb.Exec(`CREATE TABLE kv (key TEXT PRIMARY KEY, value BLOB, ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP) WITHOUT ROWID`)
+	assert.NoError(t, err)
+	_, err = sdb.Exec("insert into kv(key,value,ts) values ('k1','v1','2020-01-02 03:04:05')")
+	assert.NoError(t, err)
+	assert.NoError(t, sdb.Close())
+
+	confs := []Conf{
+		{
+			Driver: "boltdb",
+			Source: path.Join(dir, "kv1.db"),
+		},
+		{
+			Driver: "sqlite3",
+			Source: path.Join(dir, "kv2.db"),
+		},
+	}
+	for _, conf := range confs {
+		// open twice, migration is only applied once
+		for i := 0; i < 2; i++ {
+			db, err := New(conf)
+			assert.NoError(t, err)
+			v, err := db.Get("k1")
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("v1"), v.Value)
+			assert.Equal(t, uint64(1), v.Revision)
+			// the sql kvs are created at ts, the bolt kvs have no creation time
+			if conf.Driver == "sqlite3" {
+				created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC).UnixNano()
+				assert.Equal(t, created, v.Created)
+				assert.Equal(t, created, v.Updated)
+			} else {
+				assert.Zero(t, v.Created)
+			}
+			assert.NoError(t, db.Close())
 		}
-	})
+
+		db, err := New(conf)
+		assert.NoError(t, err)
+		kv := &KV{Key: "k2"}
+		err = db.Set(kv)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(2), kv.Revision)
+		err = db.Set(&KV{Key: "k1", Value: []byte("v2")})
+		assert.NoError(t, err)
+		assert.NoError(t, db.Close())
+	}
+
+	// ts is updated on overwrite
+	sdb, err = sql.Open("sqlite3", path.Join(dir, "kv2.db"))
+	assert.NoError(t, err)
+	defer sdb.Close()
+	var ts time.Time
+	assert.NoError(t, sdb.QueryRow("select ts from kv where key='k1'").Scan(&ts))
+	assert.True(t, ts.After(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)), ts)
 }
 
-func BenchmarkDatabaseBoltDB(b *testing.B) {
-	dir, err := ioutil.TempDir("", "")
-	assert.NoError(b, err)
+func TestDatabaseTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
 	defer os.RemoveAll(dir)
 
-	db, err := New(Conf{Driver: "boltdb", Source: path.Join(dir, "boltdb.db")})
-	assert.NoError(b, err)
-	assert.NotNil(b, db)
-	defer db.Close()
+	for _, conf := range driverConfs(dir) {
+		db, err := New(conf)
+		assert.NoError(t, err)
+		assert.NotNil(t, db)
+		defer db.Close()
 
-	// list db
-	vs, err := db.List("/")
-	assert.NoError(b, err)
-	assert.Len(b, vs, 0)
+		now := time.Now().Unix()
+		k1 := &KV{Key: "/t/1", Value: []byte("v1"), TTL: 60}
+		err = db.Set(k1)
+		assert.NoError(t, err)
+		assert.True(t, k1.Expire >= now+60)
 
-	k1 := "/"
-	b.ResetTimer()
-	b.Run("put", func(b *testing.B) {
-		for i := 0; i < b.N; i++ {
-			key := k1 + strconv.Itoa(i)
-			db.Set(&KV{Key: key, Value: []byte(key)})
+		v, err := db.Get(k1.Key)
+		assert.NoError(t, err)
+		assert.Equal(t, k1.Value, v.Value)
+		assert.Equal(t, k1.Expire, v.Expire)
+
+		// expired kvs are invisible
+		k2 := &KV{Key: "/t/2", Value: []byte("v2"), Expire: now - 1}
+		err = db.Set(k2)
+		assert.NoError(t, err)
+		k3 := &KV{Key: "/t/3", Value: []byte("v3")}
+		err = db.Batch([]Op{{Type: OpSet, KV: KV{Key: "/t/4", Expire: now - 1}}, {Type: OpSet, KV: *k3}})
+		assert.NoError(t, err)
+
+		v, err = db.Get(k2.Key)
+		assert.NoError(t, err)
+		assert.Equal(t, k2.Key, v.Key)
+		assert.Empty(t, v.Value)
+		assert.Equal(t, uint64(0), v.Revision)
+
+		vs, err := db.List("/t/")
+		assert.NoError(t, err)
+		assert.Len(t, vs, 2)
+		assert.Equal(t, k1.Key, vs[0].Key)
+		assert.Equal(t, k3.Key, vs[1].Key)
+		assert.Equal(t, int64(0), vs[1].Expire)
+
+		// expired kvs can be created again
+		err = db.CompareAndSet(&KV{Key: k2.Key, Expire: now - 1}, 0)
+		assert.NoError(t, err)
+
+		n, err := db.DelExpired()
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+		n, err = db.DelExpired()
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+
+		vs, err = db.List("/t/")
+		assert.NoError(t, err)
+		assert.Len(t, vs, 2)
+	}
+}
+
+func TestDatabaseDelExpiredChunks(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, conf := range driverConfs(dir, "boltdb", "sqlite3") {
+		t.Run(conf.Driver, func(t *testing.T) {
+			db, err := Factories[conf.Driver](conf)
+			assert.NoError(t, err)
+			defer db.Close()
+			assert.NoError(t, db.CreateNamespace("n"))
+			nsdb, err := db.Namespace("n")
+			assert.NoError(t, err)
+
+			now := time.Now().Unix()
+			var ops []Op
+			for i := 0; i < delExpiredChunk*2+1; i++ {
+				ops = append(ops, Op{Type: OpSet, KV: KV{Key: fmt.Sprintf("e%05d", i), Expire: now - 1}})
+			}
+			ops = append(ops, Op{Type: OpSet, KV: KV{Key: "live", Value: []byte("v")}})
+			assert.NoError(t, db.Batch(ops))
+			assert.NoError(t, nsdb.Batch(ops[:3]))
+
+			kv := &KV{Key: "live", Value: []byte("v")}
+			assert.NoError(t, db.Set(kv))
+			rev := kv.Revision
+			n, err := db.DelExpired()
+			assert.NoError(t, err)
+			assert.Equal(t, delExpiredChunk*2+4, n)
+			// each chunk is deleted in its own transaction with its own revision, 3 chunks of the default namespace and 1 of n
+			assert.NoError(t, db.Set(kv))
+			assert.Equal(t, rev+5, kv.Revision)
+
+			kvs, err := db.List("")
+			assert.NoError(t, err)
+			assert.Len(t, kvs, 1)
+			assert.Equal(t, "live", kvs[0].Key)
+			kvs, err = nsdb.List("")
+			assert.NoError(t, err)
+			assert.Len(t, kvs, 0)
+
+			// the namespace dropped after listed is skipped
+			assert.NoError(t, nsdb.Batch(ops[:3]))
+			assert.NoError(t, db.DropNamespace("n"))
+			switch d := db.(type) {
+			case *sqldb:
+				n, err = d.delExpired("n", now)
+			case *boltDb:
+				n, err = d.delExpired([]byte("n"), [][]byte{[]byte("e00000")}, time.Now())
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, 0, n)
+		})
+	}
+}
+
+func TestDatabaseListRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	confs := driverConfs(dir)
+
+	keys := func(kvs []KV) []string {
+		var res []string
+		for _, kv := range kvs {
+			res = append(res, kv.Key)
 		}
-	})
-	b.Run("get", func(b *testing.B) {
-		for i := 0; i < b.N; i++ {
-			key := k1 + strconv.Itoa(i)
-			db.Get(key)
+		return res
+	}
+
+	for _, conf := range confs {
+		db, err := New(conf)
+		assert.NoError(t, err)
+		assert.NotNil(t, db)
+		defer db.Close()
+
+		for _, k := range []string{"/a/1", "/a/2", "/a/3", "/a/4", "/a/5", "/a_", "/b/1", "/A/1"} {
+			err = db.Set(&KV{Key: k, Value: []byte(k)})
+			assert.NoError(t, err)
 		}
-	})
-	b.Run("del", func(b *testing.B) {
-		for i := 0; i < b.N; i++ {
-			key := k1 + strconv.Itoa(i)
-			db.Del(key)
+		err = db.Set(&KV{Key: "/a/0", Expire: time.Now().Unix() - 1})
+		assert.NoError(t, err)
+
+		// prefix is matched exactly, without wildcards or case folding
+		vs, next, err := db.ListRange(&ListOptions{Prefix: "/a/"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"/a/1", "/a/2", "/a/3", "/a/4", "/a/5"}, keys(vs))
+		assert.Empty(t, next)
+
+		vs, _, err = db.ListRange(&ListOptions{Prefix: "/a/", Start: "/a/2", End: "/a/4"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"/a/2", "/a/3"}, keys(vs))
+
+		vs, _, err = db.ListRange(&ListOptions{Start: "/a/5", End: "/b/2"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"/a/5", "/a_", "/b/1"}, keys(vs))
+
+		vs, _, err = db.ListRange(&ListOptions{Prefix: "/a/", Reverse: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"/a/5", "/a/4", "/a/3", "/a/2", "/a/1"}, keys(vs))
+
+		vs, _, err = db.ListRange(&ListOptions{Reverse: true, Limit: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"/b/1", "/a_"}, keys(vs))
+
+		// pages
+		var all []string
+		opts := &ListOptions{Prefix: "/a/", Limit: 2}
+		for i := 0; i < 3; i++ {
+			vs, next, err = db.ListRange(opts)
+			assert.NoError(t, err)
+			all = append(all, keys(vs)...)
+			opts.Cursor = next
 		}
-	})
+		assert.Empty(t, next)
+		assert.Equal(t, []string{"/a/1", "/a/2", "/a/3", "/a/4", "/a/5"}, all)
+
+		all = nil
+		opts = &ListOptions{Prefix: "/a/", Start: "/a/2", Limit: 3, Reverse: true}
+		vs, next, err = db.ListRange(opts)
+		assert.NoError(t, err)
+		assert.Equal(t, "/a/2", next)
+		all = append(all, keys(vs)...)
+		opts.Cursor = next
+		vs, next, err = db.ListRange(opts)
+		assert.NoError(t, err)
+		assert.Empty(t, next)
+		all = append(all, keys(vs)...)
+		assert.Equal(t, []string{"/a/5", "/a/4", "/a/3", "/a/2"}, all)
+
+		vs, next, err = db.ListRange(&ListOptions{Prefix: "/c/", Limit: 2})
+		assert.NoError(t, err)
+		assert.Len(t, vs, 0)
+		assert.Empty(t, next)
+	}
+}
+
+func TestDatabaseNamespace(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, conf := range driverConfs(dir) {
+		db, err := New(conf)
+		assert.NoError(t, err)
+		assert.NotNil(t, db)
+
+		names, err := db.Namespaces()
+		assert.NoError(t, err)
+		assert.Empty(t, names)
+
+		_, err = db.Namespace("a")
+		assert.Equal(t, ErrNamespaceNotFound, err)
+		_, err = db.Namespace("../a")
+		assert.Equal(t, ErrNamespaceInvalid, err)
+		err = db.CreateNamespace("")
+		assert.Equal(t, ErrNamespaceInvalid, err)
+
+		err = db.CreateNamespace("a")
+		assert.NoError(t, err)
+		// creating twice is fine
+		err = db.CreateNamespace("a")
+		assert.NoError(t, err)
+		err = db.CreateNamespace("b")
+		assert.NoError(t, err)
+		names, err = db.Namespaces()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a", "b"}, names)
+
+		a, err := db.Namespace("a")
+		assert.NoError(t, err)
+		b, err := db.Namespace("b")
+		assert.NoError(t, err)
+		self, err := db.Namespace("")
+		assert.NoError(t, err)
+
+		// the same key is isolated in namespaces
+		err = db.Set(&KV{Key: "k", Value: []byte("self")})
+		assert.NoError(t, err)
+		err = a.Set(&KV{Key: "k", Value: []byte("a"), Expire: time.Now().Unix() - 1})
+		assert.NoError(t, err)
+		err = a.Batch([]Op{{Type: OpSet, KV: KV{Key: "k2", Value: []byte("a2")}}})
+		assert.NoError(t, err)
+		err = b.Set(&KV{Key: "k", Value: []byte("b")})
+		assert.NoError(t, err)
+
+		v, err := self.Get("k")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("self"), v.Value)
+		v, err = a.Get("k2")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("a2"), v.Value)
+		v, err = b.Get("k")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("b"), v.Value)
+		vs, err := a.List("")
+		assert.NoError(t, err)
+		assert.Len(t, vs, 1)
+		vs, err = db.List("")
+		assert.NoError(t, err)
+		assert.Len(t, vs, 1)
+
+		// the expired kvs of all namespaces are deleted
+		w, err := a.Watch("k", false, 0)
+		assert.NoError(t, err)
+		n, err := db.DelExpired()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+		e := <-w.Events()
+		assert.Equal(t, EventDel, e.Type)
+		assert.Equal(t, "a", e.Namespace)
+
+		err = b.Del("k")
+		assert.NoError(t, err)
+		v, err = db.Get("k")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("self"), v.Value)
+
+		// dropping publishes the deletion of all kvs
+		w, err = a.Watch("", true, 0)
+		assert.NoError(t, err)
+		err = db.DropNamespace("a")
+		assert.NoError(t, err)
+		e = <-w.Events()
+		assert.Equal(t, EventDel, e.Type)
+		assert.Equal(t, "k2", e.Key)
+		err = db.DropNamespace("a")
+		assert.Equal(t, ErrNamespaceNotFound, err)
+		err = a.Set(&KV{Key: "k"})
+		assert.Equal(t, ErrNamespaceNotFound, err)
+
+		// namespaces are kept after reopening
+		db.Close()
+		if conf.Driver == "memory" {
+			continue
+		}
+		db, err = New(conf)
+		assert.NoError(t, err)
+		names, err = db.Namespaces()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"b"}, names)
+		db.Close()
+	}
+}
+
+func TestDatabaseBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, conf := range driverConfs(dir) {
+		db, err := New(conf)
+		assert.NoError(t, err)
+		assert.NotNil(t, db)
+
+		err = db.Set(&KV{Key: "k1", Value: []byte("v1")})
+		assert.NoError(t, err)
+		err = db.CreateNamespace("a")
+		assert.NoError(t, err)
+		a, err := db.Namespace("a")
+		assert.NoError(t, err)
+		err = a.Set(&KV{Key: "k2", Value: []byte("v2"), TTL: 60})
+		assert.NoError(t, err)
+
+		buf := new(bytes.Buffer)
+		n, err := db.Backup(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(buf.Len()), n)
+		snapshot := buf.Bytes()
+
+		// changes after backup
+		err = db.Set(&KV{Key: "k1", Value: []byte("v11")})
+		assert.NoError(t, err)
+		err = db.Set(&KV{Key: "k3", Value: []byte("v3")})
+		assert.NoError(t, err)
+		err = db.DropNamespace("a")
+		assert.NoError(t, err)
+		err = db.CreateNamespace("b")
+		assert.NoError(t, err)
+		w, err := db.Watch("", true, 0)
+		assert.NoError(t, err)
+
+		// invalid snapshot changes nothing
+		err = db.Restore(bytes.NewReader([]byte("invalid")))
+		assert.Error(t, err)
+		v, err := db.Get("k1")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("v11"), v.Value)
+
+		err = db.Restore(bytes.NewReader(snapshot))
+		assert.NoError(t, err)
+		for range w.Events() {
+		}
+		assert.Equal(t, ErrCompacted, w.Err())
+
+		names, err := db.Namespaces()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a"}, names)
+		v, err = db.Get("k1")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("v1"), v.Value)
+		assert.Equal(t, uint64(1), v.Revision)
+		v, err = db.Get("k3")
+		assert.NoError(t, err)
+		assert.Nil(t, v.Value)
+		a, err = db.Namespace("a")
+		assert.NoError(t, err)
+		v, err = a.Get("k2")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("v2"), v.Value)
+		assert.NotZero(t, v.Expire)
+
+		// revisions continue from the snapshot
+		_, err = db.Watch("", true, 2)
+		assert.Equal(t, ErrCompacted, err)
+		k := &KV{Key: "k4"}
+		err = db.Set(k)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(3), k.Revision)
+
+		// restored data is kept after reopening
+		db.Close()
+		if conf.Driver == "memory" {
+			continue
+		}
+		db, err = New(conf)
+		assert.NoError(t, err)
+		v, err = db.Get("k1")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("v1"), v.Value)
+		db.Close()
+	}
+
+	// temporary files are removed
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 3)
+}
+
+func TestDatabaseCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	value := bytes.Repeat([]byte(`{"name":"baetyl","kind":"state"}`), 256)
+	for _, driver := range []string{"sqlite3", "boltdb", "wal"} {
+		plain := Conf{Driver: driver, Source: path.Join(dir, driver+"-plain.db")}
+		gzip := Conf{Driver: driver, Source: path.Join(dir, driver+"-gzip.db"), Compression: CompressionGzip}
+		for _, conf := range []Conf{plain, gzip} {
+			db, err := New(conf)
+			assert.NoError(t, err)
+			w, err := db.Watch("k", true, 0)
+			assert.NoError(t, err)
+			for i := 0; i < 100; i++ {
+				err = db.Set(&KV{Key: fmt.Sprintf("k%02d", i), Value: value})
+				assert.NoError(t, err)
+			}
+			e := <-w.Events()
+			assert.Equal(t, value, e.Value)
+			db.Close()
+		}
+		ps, err := os.Stat(plain.Source)
+		assert.NoError(t, err)
+		gs, err := os.Stat(gzip.Source)
+		assert.NoError(t, err)
+		assert.True(t, gs.Size()*4 < ps.Size(), driver)
+
+		// compressed and uncompressed values coexist
+		gzip.Source = plain.Source
+		gzip.Compression = CompressionFlate
+		db, err := New(gzip)
+		assert.NoError(t, err)
+		err = db.Batch([]Op{
+			{Type: OpSet, KV: KV{Key: "k00", Value: append(value, '!')}},
+			{Type: OpSet, KV: KV{Key: "small", Value: []byte("v")}},
+		})
+		assert.NoError(t, err)
+		kvs, err := db.List("k")
+		assert.NoError(t, err)
+		assert.Len(t, kvs, 100)
+		assert.Equal(t, append(value, '!'), kvs[0].Value)
+		assert.Equal(t, value, kvs[1].Value)
+		db.Close()
+
+		db, err = New(plain)
+		assert.NoError(t, err)
+		v, err := db.Get("k00")
+		assert.NoError(t, err)
+		assert.Equal(t, append(value, '!'), v.Value)
+		v, err = db.Get("small")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("v"), v.Value)
+		db.Close()
+
+		_, err = New(Conf{Driver: driver, Source: plain.Source, Compression: "zip"})
+		assert.EqualError(t, err, "compression (zip) not supported")
+	}
+}
+
+func TestCompressor(t *testing.T) {
+	c, err := newCompressor(Conf{})
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+	codec, v := c.compress([]byte("value"))
+	assert.Equal(t, codecNone, codec)
+	assert.Equal(t, []byte("value"), v)
+
+	c, err = newCompressor(Conf{Compression: CompressionFlate, CompressMinSize: 8})
+	assert.NoError(t, err)
+	// small values are kept
+	codec, v = c.compress([]byte("value"))
+	assert.Equal(t, codecNone, codec)
+	assert.Equal(t, []byte("value"), v)
+	// values not getting smaller are kept
+	codec, _ = c.compress([]byte("0123456789"))
+	assert.Equal(t, codecNone, codec)
+
+	value := bytes.Repeat([]byte("value"), 100)
+	codec, v = c.compress(value)
+	assert.Equal(t, codecFlate, codec)
+	assert.True(t, len(v) < len(value))
+	v, err = decompress(codec, v)
+	assert.NoError(t, err)
+	assert.Equal(t, value, v)
+
+	_, err = decompress(9, v)
+	assert.EqualError(t, err, "codec (9) not supported")
+	_, err = decompress(codecGzip, v)
+	assert.Error(t, err)
+}
+
+func TestPrefixEnd(t *testing.T) {
+	assert.Equal(t, []byte("/b"), prefixEnd([]byte("/a")))
+	assert.Equal(t, []byte("/b"), prefixEnd([]byte("/a\xff")))
+	assert.Nil(t, prefixEnd([]byte("\xff\xff")))
+	assert.Nil(t, prefixEnd(nil))
+}
+
+func BenchmarkDatabaseSQLite(b *testing.B) {
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	db, err := New(Conf{Driver: "sqlite3", Source: path.Join(dir, "t.db")})
+	assert.NoError(b, err)
+	assert.NotNil(b, db)
+	defer db.Close()
+
+	// list db
+	vs, err := db.List("/")
+	assert.NoError(b, err)
+	assert.Len(b, vs, 0)
+
+	k1 := "/"
+	b.ResetTimer()
+	b.Run("put", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			key := k1 + strconv.Itoa(i)
+			db.Set(&KV{Key: key, Value: []byte(key)})
+		}
+	})
+	b.Run("get", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			key := k1 + strconv.Itoa(i)
+			db.Get(key)
+		}
+	})
+	b.Run("del", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			key := k1 + strconv.Itoa(i)
+			db.Del(key)
+		}
+	})
+}
+
+func BenchmarkDatabaseBoltDB(b *testing.B) {
+	dir, err := ioutil.TempDir("", "")
+	assert.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	db, err := New(Conf{Driver: "boltdb", Source: path.Join(dir, "boltdb.db")})
+	assert.NoError(b, err)
+	assert.NotNil(b, db)
+	defer db.Close()
+
+	// list db
+	vs, err := db.List("/")
+	assert.NoError(b, err)
+	assert.Len(b, vs, 0)
+
+	k1 := "/"
+	b.ResetTimer()
+	b.Run("put", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			key := k1 + strconv.Itoa(i)
+			db.Set(&KV{Key: key, Value: []byte(key)})
+		}
+	})
+	b.Run("get", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			key := k1 + strconv.Itoa(i)
+			db.Get(key)
+		}
+	})
+	b.Run("del", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			key := k1 + strconv.Itoa(i)
+			db.Del(key)
+		}
+	})
+}
+
+func TestDatabaseEncryption(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := path.Join(dir, "key")
+	err = ioutil.WriteFile(keyFile, []byte("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"), 0600)
+	assert.NoError(t, err)
+
+	for _, conf := range driverConfs(dir) {
+		conf.KeyFile = keyFile
+		db, err := New(conf)
+		assert.NoError(t, err)
+		w, err := db.Watch("k", true, 0)
+		assert.NoError(t, err)
+
+		kv := &KV{Key: "k1", Value: []byte("secret1")}
+		err = db.Set(kv)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("secret1"), kv.Value)
+		err = db.Batch([]Op{
+			{Type: OpSet, KV: KV{Key: "k2", Value: []byte("secret2")}},
+			{Type: OpDel, KV: KV{Key: "k1"}},
+		})
+		assert.NoError(t, err)
+		err = db.CompareAndSet(&KV{Key: "k1", Value: []byte("secret3")}, 0)
+		assert.NoError(t, err)
+
+		v, err := db.Get("k1")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("secret3"), v.Value)
+		v, err = db.Get("k0")
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(0), v.Revision)
+		kvs, err := db.List("k")
+		assert.NoError(t, err)
+		assert.Len(t, kvs, 2)
+		assert.Equal(t, []byte("secret3"), kvs[0].Value)
+		assert.Equal(t, []byte("secret2"), kvs[1].Value)
+
+		for _, ex := range []Event{
+			{Type: EventPut, KV: KV{Key: "k1", Value: []byte("secret1"), Revision: 1}},
+			{Type: EventPut, KV: KV{Key: "k2", Value: []byte("secret2"), Revision: 2}},
+			{Type: EventDel, KV: KV{Key: "k1", Revision: 2}},
+			{Type: EventPut, KV: KV{Key: "k1", Value: []byte("secret3"), Revision: 3}},
+		} {
+			e := <-w.Events()
+			assert.Equal(t, ex.Type, e.Type)
+			assert.Equal(t, ex.KV, unstamped(t, e).KV)
+		}
+		w.Close()
+		for range w.Events() {
+		}
+		assert.NoError(t, w.Err())
+
+		// the values are stored encrypted
+		err = db.CreateNamespace("a")
+		assert.NoError(t, err)
+		a, err := db.Namespace("a")
+		assert.NoError(t, err)
+		err = a.Set(&KV{Key: "k1", Value: []byte("secret4")})
+		assert.NoError(t, err)
+		raw := db.(*cryptDb).DB
+		v, err = raw.Get("k1")
+		assert.NoError(t, err)
+		assert.NotContains(t, string(v.Value), "secret")
+		ra, err := raw.Namespace("a")
+		assert.NoError(t, err)
+		v, err = ra.Get("k1")
+		assert.NoError(t, err)
+		assert.NotContains(t, string(v.Value), "secret")
+
+		// the value cannot be moved to another key
+		err = raw.Set(&KV{Key: "k2", Value: v.Value})
+		assert.NoError(t, err)
+		_, err = db.Get("k2")
+		assert.Equal(t, ErrDecryption, err)
+		w, err = db.Watch("k3", false, 0)
+		assert.NoError(t, err)
+		err = raw.Set(&KV{Key: "k3", Value: []byte("plain")})
+		assert.NoError(t, err)
+		_, ok := <-w.Events()
+		assert.False(t, ok)
+		assert.Equal(t, ErrDecryption, w.Err())
+		db.Close()
+	}
+
+	// the values are compressed before encrypted
+	for _, conf := range driverConfs(dir) {
+		conf.Source += ".gz"
+		conf.KeyFile, conf.Compression = keyFile, CompressionGzip
+		db, err := New(conf)
+		assert.NoError(t, err)
+		value := bytes.Repeat([]byte("secret"), 100)
+		err = db.Set(&KV{Key: "k", Value: value})
+		assert.NoError(t, err)
+		v, err := db.Get("k")
+		assert.NoError(t, err)
+		assert.Equal(t, value, v.Value)
+		v, err = db.(*cryptDb).DB.Get("k")
+		assert.NoError(t, err)
+		assert.True(t, len(v.Value) < 100, len(v.Value))
+		assert.Equal(t, conf, db.Conf())
+		db.Close()
+	}
+	_, err = New(Conf{Driver: "memory", KeyFile: keyFile, Compression: "zip"})
+	assert.EqualError(t, err, "compression (zip) not supported")
+	_, err = New(Conf{Driver: "memory", KeyFile: path.Join(dir, "missing")})
+	assert.Error(t, err)
+	err = ioutil.WriteFile(keyFile, []byte("0001"), 0600)
+	assert.NoError(t, err)
+	_, err = New(Conf{Driver: "memory", KeyFile: keyFile})
+	assert.EqualError(t, err, "key file ("+keyFile+") invalid: key must be 16, 24 or 32 bytes")
+}
+
+func TestRotateKey(t *testing.T) {
+	key1 := bytes.Repeat([]byte{1}, 16)
+	key2 := bytes.Repeat([]byte{2}, 32)
+
+	raw, err := New(Conf{Driver: "memory"})
+	assert.NoError(t, err)
+	defer raw.Close()
+	err = raw.CreateNamespace("a")
+	assert.NoError(t, err)
+	a, err := raw.Namespace("a")
+	assert.NoError(t, err)
+	for i := 0; i < 1500; i++ {
+		err = raw.Set(&KV{Key: fmt.Sprintf("k%04d", i), Value: []byte(fmt.Sprintf("v%d", i)), TTL: 60})
+		assert.NoError(t, err)
+	}
+	err = a.Set(&KV{Key: "k", Value: []byte("a"), ContentType: "text/plain", Labels: map[string]string{"l": "v"}})
+	assert.NoError(t, err)
+
+	// encrypts the plain values
+	n, err := RotateKey(raw, nil, key1)
+	assert.NoError(t, err)
+	assert.Equal(t, 1501, n)
+	db, err := newCryptDB(raw, key1, raw.Conf())
+	assert.NoError(t, err)
+	v, err := db.Get("k1499")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v1499"), v.Value)
+	assert.NotZero(t, v.Expire)
+	expire := v.Expire
+
+	// resumes the interrupted rotation
+	s2, err := newSealer(key2, nil)
+	assert.NoError(t, err)
+	value, err := s2.seal("k0000", []byte("v0"))
+	assert.NoError(t, err)
+	err = raw.Set(&KV{Key: "k0000", Value: value})
+	assert.NoError(t, err)
+	n, err = RotateKey(raw, key1, key2)
+	assert.NoError(t, err)
+	assert.Equal(t, 1500, n)
+	n, err = RotateKey(raw, key1, key2)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	db, err = newCryptDB(raw, key2, raw.Conf())
+	assert.NoError(t, err)
+	kvs, err := db.List("k")
+	assert.NoError(t, err)
+	assert.Len(t, kvs, 1500)
+	assert.Equal(t, []byte("v0"), kvs[0].Value)
+	assert.Equal(t, []byte("v1499"), kvs[1499].Value)
+	a, err = db.Namespace("a")
+	assert.NoError(t, err)
+	v, err = a.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), v.Value)
+	// the metadata is kept
+	assert.Equal(t, "text/plain", v.ContentType)
+	assert.Equal(t, map[string]string{"l": "v"}, v.Labels)
+	v, err = db.Get("k1499")
+	assert.NoError(t, err)
+	assert.Equal(t, expire, v.Expire)
+
+	// the values encrypted by neither key
+	err = raw.Set(&KV{Key: "k0001", Value: []byte("plain")})
+	assert.NoError(t, err)
+	_, err = RotateKey(raw, key1, bytes.Repeat([]byte{3}, 16))
+	assert.EqualError(t, err, "failed to rotate key (k0000) of namespace (): failed to decrypt value")
+}
+
+func TestRotateKeyHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	key1 := bytes.Repeat([]byte{1}, 16)
+	key2 := bytes.Repeat([]byte{2}, 32)
+	for _, conf := range driverConfs(dir) {
+		conf.History = 5
+		raw, err := New(conf)
+		assert.NoError(t, err)
+		assert.NoError(t, raw.CreateNamespace("a"))
+		a, err := raw.Namespace("a")
+		assert.NoError(t, err)
+		for _, db := range []DB{raw, a} {
+			assert.NoError(t, db.Set(&KV{Key: "k", Value: []byte("v1"), Labels: map[string]string{"l": "1"}}))
+			assert.NoError(t, db.Set(&KV{Key: "k", Value: []byte("v2")}))
+			// the versions of the key deleted are rotated as well
+			assert.NoError(t, db.Set(&KV{Key: "d", Value: []byte("d1")}))
+			assert.NoError(t, db.Del("d"))
+		}
+
+		before, err := raw.Get("k")
+		assert.NoError(t, err)
+		w, err := raw.Watch("", true, 0)
+		assert.NoError(t, err)
+		n, err := RotateKey(raw, nil, key1)
+		assert.NoError(t, err, conf.Driver)
+		assert.Equal(t, 2, n)
+		n, err = RotateKey(raw, key1, key2)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, n)
+		n, err = RotateKey(raw, key1, key2)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+
+		// the values are rewritten in place without events
+		select {
+		case e := <-w.Events():
+			assert.Fail(t, "unexpected event", "%s %v", conf.Driver, e)
+		case <-time.After(50 * time.Millisecond):
+		}
+		w.Close()
+		db, err := newCryptDB(raw, key2, raw.Conf())
+		assert.NoError(t, err)
+		after, err := db.Get("k")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("v2"), after.Value)
+		assert.Equal(t, before.Revision, after.Revision)
+		assert.Equal(t, before.Created, after.Created)
+		assert.Equal(t, before.Updated, after.Updated)
+		for _, name := range []string{"", "a"} {
+			ns, err := db.Namespace(name)
+			assert.NoError(t, err)
+			versions, err := ns.History("k")
+			assert.NoError(t, err, conf.Driver)
+			// the rotation records no version
+			assert.Len(t, versions, 2, conf.Driver)
+			assert.Equal(t, []byte("v2"), versions[0].Value)
+			assert.Equal(t, []byte("v1"), versions[1].Value)
+			assert.Equal(t, map[string]string{"l": "1"}, versions[1].Labels)
+			versions, err = ns.History("d")
+			assert.NoError(t, err)
+			assert.Len(t, versions, 2)
+			assert.True(t, versions[0].Deleted)
+			assert.Equal(t, []byte("d1"), versions[1].Value)
+		}
+		raw.Close()
+
+		// the versions rotated are persisted
+		if conf.Driver == "memory" {
+			continue
+		}
+		raw, err = New(conf)
+		assert.NoError(t, err)
+		db, err = newCryptDB(raw, key2, raw.Conf())
+		assert.NoError(t, err)
+		versions, err := db.History("d")
+		assert.NoError(t, err, conf.Driver)
+		assert.Equal(t, []byte("d1"), versions[1].Value)
+		v, err := db.Get("k")
+		assert.NoError(t, err, conf.Driver)
+		assert.Equal(t, []byte("v2"), v.Value)
+		raw.Close()
+	}
+}
+
+type tracedDb struct {
+	DB
+	name  string
+	trace *[]string
+}
+
+func (d *tracedDb) Namespace(name string) (DB, error) {
+	ns, err := d.DB.Namespace(name)
+	if err != nil {
+		return nil, err
+	}
+	return &tracedDb{DB: ns, name: d.name, trace: d.trace}, nil
+}
+
+func (d *tracedDb) Get(key string) (*KV, error) {
+	*d.trace = append(*d.trace, d.name)
+	return d.DB.Get(key)
+}
+
+func TestDatabaseDecorators(t *testing.T) {
+	var trace []string
+	for _, name := range []string{"t1", "t2"} {
+		name := name
+		Decorators[name] = func(db DB, conf Conf) (DB, error) {
+			return &tracedDb{DB: db, name: name, trace: &trace}, nil
+		}
+	}
+	defer delete(Decorators, "t1")
+	defer delete(Decorators, "t2")
+
+	db, err := New(Conf{Driver: "memory", Decorators: []string{"t1", "logging", "t2"}})
+	assert.NoError(t, err)
+	err = db.Set(&KV{Key: "k", Value: []byte("v")})
+	assert.NoError(t, err)
+	err = db.CreateNamespace("a")
+	assert.NoError(t, err)
+	a, err := db.Namespace("a")
+	assert.NoError(t, err)
+	_, err = a.Get("k")
+	assert.NoError(t, err)
+	v, err := db.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v"), v.Value)
+	// the last decorator is the outermost one
+	assert.Equal(t, []string{"t2", "t1", "t2", "t1"}, trace)
+
+	// the readonly decorator guards the namespaces too
+	ro, err := decorate(db, Conf{Decorators: []string{"readonly"}})
+	assert.NoError(t, err)
+	assert.Equal(t, ErrReadOnly, ro.Set(&KV{Key: "k"}))
+	assert.Equal(t, ErrReadOnly, ro.Batch([]Op{{Type: OpDel, KV: KV{Key: "k"}}}))
+	assert.Equal(t, ErrReadOnly, ro.CreateNamespace("b"))
+	assert.Equal(t, ErrReadOnly, ro.Restore(nil))
+	a, err = ro.Namespace("a")
+	assert.NoError(t, err)
+	assert.Equal(t, ErrReadOnly, a.Del("k"))
+	assert.Equal(t, ErrReadOnly, a.CompareAndSet(&KV{Key: "k"}, 0))
+	n, err := a.DelExpired()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	v, err = ro.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v"), v.Value)
+	ro.Close()
+
+	_, err = db.Get("k")
+	assert.Equal(t, errMemClosed, err)
+	_, err = New(Conf{Driver: "memory", Decorators: []string{"readonly", "unknown"}})
+	assert.EqualError(t, err, "decorator (unknown) not supported")
+}
+
+type slowDb struct {
+	DB
+	gets    int32
+	release chan struct{}
+}
+
+func (d *slowDb) Get(key string) (*KV, error) {
+	atomic.AddInt32(&d.gets, 1)
+	<-d.release
+	return d.DB.Get(key)
+}
+
+func TestDatabaseCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	db, err := New(Conf{Driver: "boltdb", Source: path.Join(dir, "kv.db"), Decorators: []string{"cache", "logging"}, CacheEntries: 2})
+	assert.NoError(t, err)
+	defer db.Close()
+	_, ok := CacheStatsOf(db)
+	assert.True(t, ok)
+
+	err = db.Set(&KV{Key: "k1", Value: []byte("v1")})
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		v, err := db.Get("k1")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("v1"), v.Value)
+		// the cached kv is not modified by callers
+		v.Value[0] = 'x'
+	}
+	v, err := db.Get("k0")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), v.Revision)
+	stats, _ := CacheStatsOf(db)
+	assert.Equal(t, CacheStats{Hits: 2, Misses: 2, Entries: 2, Bytes: 6}, stats)
+
+	// invalidated by writes
+	err = db.Set(&KV{Key: "k0", Value: []byte("v0")})
+	assert.NoError(t, err)
+	err = db.Batch([]Op{{Type: OpSet, KV: KV{Key: "k1", Value: []byte("v11")}}})
+	assert.NoError(t, err)
+	v, err = db.Get("k0")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v0"), v.Value)
+	v, err = db.Get("k1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v11"), v.Value)
+	err = db.CompareAndDel("k1", v.Revision)
+	assert.NoError(t, err)
+	v, err = db.Get("k1")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), v.Revision)
+
+	// namespaces are cached separately
+	err = db.CreateNamespace("a")
+	assert.NoError(t, err)
+	a, err := db.Namespace("a")
+	assert.NoError(t, err)
+	v, err = a.Get("k0")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), v.Revision)
+	err = a.Set(&KV{Key: "k0", Value: []byte("a0")})
+	assert.NoError(t, err)
+	v, err = a.Get("k0")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a0"), v.Value)
+	v, err = db.Get("k0")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v0"), v.Value)
+	err = db.DropNamespace("a")
+	assert.NoError(t, err)
+	stats, _ = CacheStatsOf(db)
+	assert.Equal(t, 0, stats.Entries)
+	assert.Equal(t, 0, stats.Bytes)
+
+	// expired kvs are not served
+	err = db.Set(&KV{Key: "k2", Value: []byte("v2"), TTL: 1})
+	assert.NoError(t, err)
+	v, err = db.Get("k2")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v2"), v.Value)
+	cdb := db.(*loggingDb).DB.(*cacheDb)
+	cdb.c.items[cacheKey{key: "k2"}].Value.(*cacheEntry).kv.Expire = time.Now().Unix() - 1
+	v, err = db.Get("k2")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v2"), v.Value)
+	assert.NotEqual(t, time.Now().Unix()-1, v.Expire)
+
+	_, ok = CacheStatsOf(cdb.DB)
+	assert.False(t, ok)
+}
+
+func TestCache(t *testing.T) {
+	// evicts the least recently used kvs out of bounds
+	c := newCache(3, 10)
+	load := func(v string) func() (*KV, error) {
+		return func() (*KV, error) {
+			return &KV{Key: "k", Value: []byte(v), Revision: 1}, nil
+		}
+	}
+	for _, k := range []string{"a", "b", "c", "a", "d"} {
+		_, err := c.get(cacheKey{key: k}, load("v"))
+		assert.NoError(t, err)
+	}
+	assert.Len(t, c.items, 3)
+	assert.NotContains(t, c.items, cacheKey{key: "b"})
+	_, err := c.get(cacheKey{key: "e"}, load("vvvvvvv"))
+	assert.NoError(t, err)
+	assert.Len(t, c.items, 2)
+	assert.Equal(t, 10, c.bytes)
+	_, err = c.get(cacheKey{key: "f"}, load("vvvvvvvvvvv"))
+	assert.NoError(t, err)
+	assert.NotContains(t, c.items, cacheKey{key: "f"})
+	_, err = c.get(cacheKey{key: "g"}, func() (*KV, error) { return nil, errors.New("failed") })
+	assert.EqualError(t, err, "failed")
+	assert.NotContains(t, c.items, cacheKey{key: "g"})
+
+	// coalesces the concurrent misses
+	mem, err := New(Conf{Driver: "memory"})
+	assert.NoError(t, err)
+	defer mem.Close()
+	err = mem.Set(&KV{Key: "k", Value: []byte("v")})
+	assert.NoError(t, err)
+	slow := &slowDb{DB: mem, release: make(chan struct{})}
+	db, err := newCacheDB(slow, Conf{})
+	assert.NoError(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := db.Get("k")
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("v"), v.Value)
+		}()
+	}
+	assert.Eventually(t, func() bool {
+		stats, _ := CacheStatsOf(db)
+		return stats.Misses == 10
+	}, time.Second, time.Millisecond)
+	close(slow.release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&slow.gets))
+
+	// the kv loaded across an invalidation is not cached
+	slow.release = make(chan struct{})
+	err = db.Del("k")
+	assert.NoError(t, err)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		db.Get("k")
+	}()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&slow.gets) == 2
+	}, time.Second, time.Millisecond)
+	err = db.Set(&KV{Key: "k", Value: []byte("v2")})
+	assert.NoError(t, err)
+	close(slow.release)
+	<-done
+	v, err := db.Get("k")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v2"), v.Value)
+}
+
+func TestDatabaseHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, conf := range driverConfs(dir) {
+		conf.History = 3
+		conf.Compression = CompressionGzip
+		conf.CompressMinSize = 8
+		db, err := New(conf)
+		assert.NoError(t, err)
+
+		long := bytes.Repeat([]byte("v"), 100)
+		start := time.Now()
+		for i := 1; i <= 4; i++ {
+			err = db.Set(&KV{Key: "k", Value: []byte(fmt.Sprintf("v%d", i)), TTL: 60})
+			assert.NoError(t, err)
+		}
+		err = db.Batch([]Op{{Type: OpDel, KV: KV{Key: "k"}}, {Type: OpSet, KV: KV{Key: "kk", Value: long}}})
+		assert.NoError(t, err)
+		err = db.Set(&KV{Key: "kx", Expire: time.Now().Unix() - 1})
+		assert.NoError(t, err)
+		_, err = db.DelExpired()
+		assert.NoError(t, err)
+
+		check := func(db DB) {
+			vs, err := db.History("k")
+			assert.NoError(t, err, conf.Driver)
+			assert.Len(t, vs, 3, conf.Driver)
+			if len(vs) != 3 {
+				return
+			}
+			assert.True(t, vs[0].Deleted)
+			assert.Equal(t, uint64(5), vs[0].Revision)
+			assert.Nil(t, vs[0].Value)
+			assert.Equal(t, []byte("v4"), vs[1].Value)
+			assert.Equal(t, uint64(4), vs[1].Revision)
+			assert.NotZero(t, vs[1].Expire)
+			assert.Equal(t, []byte("v3"), vs[2].Value)
+			assert.True(t, vs[2].Time >= start.UnixNano())
+			assert.True(t, vs[0].Time >= vs[1].Time)
+
+			v, err := VersionAt(vs, 4)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("v4"), v.Value)
+			_, err = VersionAt(vs, 2)
+			assert.Equal(t, ErrCompacted, err)
+			v, err = VersionAtTime(vs, time.Unix(0, vs[0].Time))
+			assert.NoError(t, err)
+			assert.True(t, v.Deleted)
+
+			vs, err = db.History("kk")
+			assert.NoError(t, err)
+			assert.Len(t, vs, 1)
+			assert.Equal(t, long, vs[0].Value)
+			vs, err = db.History("kx")
+			assert.NoError(t, err)
+			assert.Len(t, vs, 2)
+			vs, err = db.History("none")
+			assert.NoError(t, err)
+			assert.Empty(t, vs)
+		}
+		check(db)
+
+		// the history of the namespace is dropped with it
+		err = db.CreateNamespace("a")
+		assert.NoError(t, err)
+		a, err := db.Namespace("a")
+		assert.NoError(t, err)
+		err = a.Set(&KV{Key: "k", Value: []byte("a")})
+		assert.NoError(t, err)
+		vs, err := a.History("k")
+		assert.NoError(t, err)
+		assert.Len(t, vs, 1)
+		err = db.DropNamespace("a")
+		assert.NoError(t, err)
+		_, err = a.History("k")
+		assert.Equal(t, ErrNamespaceNotFound, err)
+		err = db.CreateNamespace("a")
+		assert.NoError(t, err)
+		vs, err = a.History("k")
+		assert.NoError(t, err)
+		assert.Empty(t, vs)
+
+		// the history is backed up and restored
+		var buf bytes.Buffer
+		_, err = db.Backup(&buf)
+		assert.NoError(t, err)
+		err = db.Set(&KV{Key: "k", Value: []byte("v6")})
+		assert.NoError(t, err)
+		err = db.Restore(&buf)
+		assert.NoError(t, err)
+		check(db)
+		db.Close()
+		if conf.Driver == "memory" {
+			continue
+		}
+
+		db, err = New(conf)
+		assert.NoError(t, err)
+		check(db)
+		db.Close()
+	}
+}
+
+func TestDatabaseRestoreConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, conf := range driverConfs(dir) {
+		conf.History = 3
+		db, err := New(conf)
+		assert.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			err = db.Set(&KV{Key: "k", Value: []byte{byte(i)}, Labels: map[string]string{"device": "d1"}})
+			assert.NoError(t, err)
+		}
+		err = db.Set(&KV{Key: "k2", Value: []byte("v")})
+		assert.NoError(t, err)
+		var buf bytes.Buffer
+		_, err = db.Backup(&buf)
+		assert.NoError(t, err)
+		db.Close()
+
+		// the snapshot is restored with the history and indexes configured for the database restored
+		live := conf
+		if live.Source != "" {
+			live.Source = path.Join(dir, "live-"+conf.Driver+".db")
+		}
+		for _, history := range []int{1, 0} {
+			live.History = history
+			live.Indexes = []IndexConf{{Name: "device", Label: "device"}}
+			db, err = New(live)
+			assert.NoError(t, err)
+			err = db.Restore(bytes.NewReader(buf.Bytes()))
+			assert.NoError(t, err)
+			vs, err := db.History("k")
+			assert.NoError(t, err)
+			assert.Len(t, vs, history, conf.Driver)
+			if history > 0 {
+				assert.Equal(t, []byte{2}, vs[0].Value)
+			}
+			vs, err = db.History("k2")
+			assert.NoError(t, err)
+			assert.Len(t, vs, history, conf.Driver)
+			kvs, err := db.Query(&IndexQuery{Index: "device", Value: "d1"})
+			assert.NoError(t, err)
+			assert.Len(t, kvs, 1, conf.Driver)
+			db.Close()
+		}
+	}
+}
+
+func TestVersionAt(t *testing.T) {
+	v, err := VersionAt(nil, 1)
+	assert.Equal(t, ErrNoHistory, err)
+	assert.Nil(t, v)
+	_, err = VersionAtTime(nil, time.Now())
+	assert.Equal(t, ErrNoHistory, err)
+
+	vs := []Version{
+		{KV: KV{Key: "k", Revision: 9}, Time: 90},
+		{KV: KV{Key: "k", Revision: 5}, Time: 50},
+	}
+	for rev, ex := range map[uint64]uint64{100: 9, 9: 9, 8: 5, 5: 5} {
+		v, err = VersionAt(vs, rev)
+		assert.NoError(t, err)
+		assert.Equal(t, ex, v.Revision)
+	}
+	_, err = VersionAt(vs, 4)
+	assert.Equal(t, ErrCompacted, err)
+	v, err = VersionAtTime(vs, time.Unix(0, 89))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), v.Revision)
+	_, err = VersionAtTime(vs, time.Unix(0, 49))
+	assert.Equal(t, ErrCompacted, err)
+
+	vs = appendVersion(nil, Version{KV: KV{Revision: 1}}, 2)
+	vs = appendVersion(vs, Version{KV: KV{Revision: 2}}, 2)
+	vs = appendVersion(vs, Version{KV: KV{Revision: 3}}, 2)
+	assert.Len(t, vs, 2)
+	assert.Equal(t, uint64(2), vs[0].Revision)
+}
+
+func TestDatabaseDelPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, conf := range driverConfs(dir) {
+		conf.History = 2
+		conf.Decorators = []string{"cache"}
+		db, err := New(conf)
+		assert.NoError(t, err)
+
+		err = db.CreateNamespace("a")
+		assert.NoError(t, err)
+		a, err := db.Namespace("a")
+		assert.NoError(t, err)
+		for _, key := range []string{"d", "d/1", "d/2", "d/2/x", "d0", "e", "c"} {
+			err = db.Set(&KV{Key: key, Value: []byte(key)})
+			assert.NoError(t, err)
+			err = a.Set(&KV{Key: key, Value: []byte(key)})
+			assert.NoError(t, err)
+		}
+		err = db.Set(&KV{Key: "d/3", Expire: time.Now().Unix() - 1})
+		assert.NoError(t, err)
+		// cached before deleted
+		kv, err := db.Get("d/1")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("d/1"), kv.Value)
+
+		w, err := db.Watch("d/", true, 0)
+		assert.NoError(t, err)
+		n, err := db.DelPrefix("d/")
+		assert.NoError(t, err, conf.Driver)
+		assert.Equal(t, 4, n, conf.Driver)
+		rev := uint64(0)
+		for i := 0; i < n; i++ {
+			e := <-w.Events()
+			assert.Equal(t, EventDel, e.Type)
+			assert.True(t, strings.HasPrefix(e.Key, "d/"))
+			if rev == 0 {
+				rev = e.Revision
+			}
+			assert.Equal(t, rev, e.Revision)
+		}
+		w.Close()
+
+		kv, err = db.Get("d/1")
+		assert.NoError(t, err)
+		assert.Nil(t, kv.Value)
+		kvs, err := db.List("")
+		assert.NoError(t, err)
+		assert.Len(t, kvs, 4)
+		kvs, err = a.List("d/")
+		assert.NoError(t, err)
+		assert.Len(t, kvs, 3)
+		vs, err := db.History("d/2")
+		assert.NoError(t, err)
+		assert.Len(t, vs, 2)
+		assert.True(t, vs[0].Deleted)
+
+		n, err = db.DelPrefix("x")
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+		n, err = a.DelPrefix("")
+		assert.NoError(t, err)
+		assert.Equal(t, 7, n)
+		kvs, err = a.List("")
+		assert.NoError(t, err)
+		assert.Empty(t, kvs)
+
+		err = db.DropNamespace("a")
+		assert.NoError(t, err)
+		_, err = a.DelPrefix("")
+		assert.Equal(t, ErrNamespaceNotFound, err, conf.Driver)
+		db.Close()
+	}
+}
+
+func TestDatabaseStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := path.Join(dir, "key")
+	err = ioutil.WriteFile(keyFile, []byte("000102030405060708090a0b0c0d0e0f"), 0600)
+	assert.NoError(t, err)
+
+	confs := append(driverConfs(dir),
+		Conf{Driver: "sqlite3", Source: path.Join(dir, "kv4.db"), KeyFile: keyFile},
+		Conf{Driver: "boltdb", Source: path.Join(dir, "kv5.db"), KeyFile: keyFile},
+		Conf{Driver: "memory", KeyFile: keyFile},
+	)
+	for _, conf := range confs {
+		db, err := New(conf)
+		assert.NoError(t, err)
+
+		stats, err := db.Stats("")
+		assert.NoError(t, err)
+		assert.Equal(t, Stats{}, *stats)
+
+		err = db.Set(&KV{Key: "a/1", Value: []byte("x")})
+		assert.NoError(t, err)
+		err = db.Set(&KV{Key: "a/22", Value: []byte("yyy")})
+		assert.NoError(t, err)
+		err = db.Set(&KV{Key: "a/3"})
+		assert.NoError(t, err)
+		err = db.Set(&KV{Key: "a/4", Value: []byte("expired"), Expire: time.Now().Unix() - 1})
+		assert.NoError(t, err)
+		err = db.Set(&KV{Key: "b", Value: []byte("zz")})
+		assert.NoError(t, err)
+
+		stats, err = db.Stats("a/")
+		assert.NoError(t, err, conf.Driver)
+		assert.Equal(t, int64(3), stats.Keys)
+		assert.Equal(t, int64(10), stats.KeyBytes)
+		if conf.KeyFile == "" {
+			assert.Equal(t, int64(4), stats.ValueBytes, conf.Driver)
+		} else {
+			assert.True(t, stats.ValueBytes > 4, conf.Driver)
+		}
+		stats, err = db.Stats("")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(4), stats.Keys)
+		assert.Equal(t, int64(11), stats.KeyBytes)
+		stats, err = db.Stats("c")
+		assert.NoError(t, err)
+		assert.Equal(t, Stats{}, *stats)
+
+		kvs, _, err := db.ListRange(&ListOptions{Prefix: "a/", KeysOnly: true})
+		assert.NoError(t, err, conf.Driver)
+		assert.Len(t, kvs, 3)
+		for _, kv := range kvs {
+			assert.Nil(t, kv.Value)
+			assert.NotZero(t, kv.Revision)
+		}
+		assert.Equal(t, "a/22", kvs[1].Key)
+		kvs, next, err := db.ListRange(&ListOptions{KeysOnly: true, Reverse: true, Limit: 1})
+		assert.NoError(t, err)
+		assert.Len(t, kvs, 1)
+		assert.Equal(t, KV{Key: "b", Revision: 5}, unstamped(t, Event{KV: kvs[0]}).KV)
+		assert.Equal(t, "a/3", next)
+
+		_, err = db.Namespace("x")
+		assert.Equal(t, ErrNamespaceNotFound, err)
+		err = db.CreateNamespace("x")
+		assert.NoError(t, err)
+		x, err := db.Namespace("x")
+		assert.NoError(t, err)
+		stats, err = x.Stats("")
+		assert.NoError(t, err)
+		assert.Equal(t, Stats{}, *stats)
+		err = db.DropNamespace("x")
+		assert.NoError(t, err)
+		_, err = x.Stats("")
+		assert.Equal(t, ErrNamespaceNotFound, err, conf.Driver)
+		db.Close()
+	}
+}
+
+func TestDatabaseQuota(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, conf := range driverConfs(dir) {
+		conf.Quota = Quota{MaxKeyLen: 8, MaxKeys: 6}
+		conf.Quotas = []Quota{
+			{Prefix: "a/", MaxValueSize: 4, MaxBytes: 16},
+			{Prefix: "b/", MaxKeys: 2},
+			{Prefix: "c/"},
+		}
+		db, err := New(conf)
+		assert.NoError(t, err)
+
+		usages, ok, err := QuotaUsageOf(db)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, []QuotaUsage{
+			{Quota: conf.Quota, Global: true},
+			{Quota: conf.Quotas[0]},
+			{Quota: conf.Quotas[1]},
+		}, usages)
+
+		err = db.Set(&KV{Key: "123456789"})
+		assert.True(t, errors.Is(err, ErrQuotaExceeded))
+		assert.EqualError(t, err, "quota exceeded: key length (9) exceeds the global limit (8)")
+		err = db.Set(&KV{Key: "a/1", Value: []byte("12345")})
+		assert.EqualError(t, err, "quota exceeded: value size (5) exceeds the limit (4) of prefix (a/)")
+
+		// a/1 and a/2 take 14 bytes
+		err = db.Set(&KV{Key: "a/1", Value: []byte("1234")})
+		assert.NoError(t, err)
+		err = db.Set(&KV{Key: "a/2", Value: []byte("1234")})
+		assert.NoError(t, err)
+		err = db.Set(&KV{Key: "a/3"})
+		assert.EqualError(t, err, "quota exceeded: bytes (17) exceeds the limit (16) of prefix (a/)")
+		// overwriting with a smaller value always succeeds
+		err = db.Set(&KV{Key: "a/1", Value: []byte("1")})
+		assert.NoError(t, err)
+		err = db.Set(&KV{Key: "a/3"})
+		assert.NoError(t, err)
+
+		err = db.Batch([]Op{
+			{Type: OpSet, KV: KV{Key: "b/1"}},
+			{Type: OpSet, KV: KV{Key: "b/2"}},
+			{Type: OpSet, KV: KV{Key: "b/3"}},
+		})
+		assert.EqualError(t, err, "quota exceeded: keys (3) exceeds the limit (2) of prefix (b/)")
+		err = db.Batch([]Op{
+			{Type: OpSet, KV: KV{Key: "b/1"}},
+			{Type: OpSet, KV: KV{Key: "b/2"}},
+			{Type: OpDel, KV: KV{Key: "b/2"}},
+			{Type: OpSet, KV: KV{Key: "b/3"}},
+		})
+		assert.NoError(t, err)
+		err = db.CompareAndSet(&KV{Key: "b/4"}, 0)
+		assert.EqualError(t, err, "quota exceeded: keys (3) exceeds the limit (2) of prefix (b/)")
+		err = db.CompareAndSet(&KV{Key: "b/3", Value: []byte("b")}, 0)
+		assert.Equal(t, ErrRevisionMismatch, err)
+
+		// the global quota counts the kvs of all namespaces, the others count the kvs in each namespace
+		err = db.CreateNamespace("x")
+		assert.NoError(t, err)
+		x, err := db.Namespace("x")
+		assert.NoError(t, err)
+		err = x.Set(&KV{Key: "b/1"})
+		assert.NoError(t, err)
+		err = x.Set(&KV{Key: "b/2"})
+		assert.EqualError(t, err, "quota exceeded: keys (7) exceeds the global limit (6)")
+		err = x.Set(&KV{Key: "b/1", Value: []byte("overwritten")})
+		assert.NoError(t, err)
+
+		usages, _, err = QuotaUsageOf(x)
+		assert.NoError(t, err)
+		assert.Equal(t, Stats{Keys: 6, KeyBytes: 18, ValueBytes: 16}, usages[0].Usage, conf.Driver)
+		assert.Equal(t, Stats{}, usages[1].Usage)
+		assert.Equal(t, Stats{Keys: 1, KeyBytes: 3, ValueBytes: 11}, usages[2].Usage)
+
+		// deletions are never limited
+		err = x.Del("b/1")
+		assert.NoError(t, err)
+		n, err := db.DelPrefix("a/")
+		assert.NoError(t, err)
+		assert.Equal(t, 3, n)
+		usages, _, err = QuotaUsageOf(db)
+		assert.NoError(t, err)
+		assert.Equal(t, Stats{Keys: 2, KeyBytes: 6}, usages[0].Usage)
+
+		// the queues are limited by the global quota only, the sequence and the messages are counted
+		q, err := NewQueue(db, "a", "q")
+		assert.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			_, err = q.Push([]byte("12345"))
+			assert.NoError(t, err)
+		}
+		_, err = q.Push([]byte("m"))
+		assert.EqualError(t, err, "quota exceeded: keys (7) exceeds the global limit (6)")
+		usages, _, err = QuotaUsageOf(db)
+		assert.NoError(t, err)
+		assert.Equal(t, Stats{Keys: 6, KeyBytes: 6 + 7 + 3*26, ValueBytes: 1 + 3*5}, usages[0].Usage)
+		m, err := q.Pop(0)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), m.Seq)
+		_, err = q.Push([]byte("m"))
+		assert.NoError(t, err)
+		db.Close()
+	}
+
+	db, err := New(Conf{Driver: "memory", Quotas: []Quota{{Prefix: "a/"}}})
+	assert.NoError(t, err)
+	defer db.Close()
+	_, ok, err := QuotaUsageOf(db)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestDatabaseQuotaExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, conf := range driverConfs(dir) {
+		conf.Quota = Quota{MaxKeys: 2}
+		db, err := New(conf)
+		assert.NoError(t, err)
+
+		// the expired kv is counted until deleted, overwriting it does not count it twice
+		err = db.Set(&KV{Key: "a", Value: []byte("12"), Expire: time.Now().Unix() - 1})
+		assert.NoError(t, err)
+		err = db.Set(&KV{Key: "b"})
+		assert.NoError(t, err)
+		err = db.Set(&KV{Key: "c"})
+		assert.EqualError(t, err, "quota exceeded: keys (3) exceeds the global limit (2)", conf.Driver)
+		err = db.Set(&KV{Key: "a", Value: []byte("1")})
+		assert.NoError(t, err, conf.Driver)
+		usages, _, err := QuotaUsageOf(db)
+		assert.NoError(t, err)
+		assert.Equal(t, Stats{Keys: 2, KeyBytes: 2, ValueBytes: 1}, usages[0].Usage, conf.Driver)
+
+		err = db.Set(&KV{Key: "b", Expire: time.Now().Unix() - 1})
+		assert.NoError(t, err)
+		n, err := db.DelExpired()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+		usages, _, err = QuotaUsageOf(db)
+		assert.NoError(t, err)
+		assert.Equal(t, Stats{Keys: 1, KeyBytes: 1, ValueBytes: 1}, usages[0].Usage, conf.Driver)
+		err = db.Set(&KV{Key: "c"})
+		assert.NoError(t, err)
+		db.Close()
+	}
+}
+
+func TestDatabaseQuotaEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := path.Join(dir, "key")
+	err = ioutil.WriteFile(keyFile, []byte("000102030405060708090a0b0c0d0e0f"), 0600)
+	assert.NoError(t, err)
+
+	for _, conf := range driverConfs(dir, "sqlite3", "boltdb", "memory") {
+		// the totals count the values as written, not as stored encrypted
+		conf.KeyFile = keyFile
+		conf.Quota = Quota{MaxBytes: 16}
+		db, err := New(conf)
+		assert.NoError(t, err)
+
+		err = db.Set(&KV{Key: "k1", Value: []byte("12345678")})
+		assert.NoError(t, err)
+		err = db.Set(&KV{Key: "k2", Value: []byte("1234")})
+		assert.NoError(t, err, conf.Driver)
+		err = db.Set(&KV{Key: "k3", Value: []byte("1")})
+		assert.EqualError(t, err, "quota exceeded: bytes (19) exceeds the global limit (16)")
+
+		// the deletions reduce the totals
+		err = db.Del("k1")
+		assert.NoError(t, err)
+		kv, err := db.Get("k2")
+		assert.NoError(t, err)
+		err = db.CompareAndDel("k2", kv.Revision)
+		assert.NoError(t, err)
+		err = db.Set(&KV{Key: "k3", Value: []byte("12345678901")})
+		assert.NoError(t, err)
+		usages, _, err := QuotaUsageOf(db)
+		assert.NoError(t, err)
+		assert.Equal(t, Stats{Keys: 1, KeyBytes: 2, ValueBytes: 11}, usages[0].Usage, conf.Driver)
+		db.Close()
+		if conf.Driver == "memory" {
+			continue
+		}
+
+		// the totals are counted again once reopened
+		db, err = New(conf)
+		assert.NoError(t, err)
+		usages, _, err = QuotaUsageOf(db)
+		assert.NoError(t, err)
+		assert.Equal(t, Stats{Keys: 1, KeyBytes: 2, ValueBytes: 11}, usages[0].Usage, conf.Driver)
+		db.Close()
+	}
+}
+
+// unstamped returns the event with the timestamps of its kv cleared, the kvs of put events must be stamped
+func unstamped(t *testing.T, e Event) Event {
+	if e.Type != EventDel {
+		assert.NotZero(t, e.Created)
+		assert.True(t, e.Updated >= e.Created)
+	}
+	e.Created, e.Updated = 0, 0
+	return e
+}
+
+func TestDatabaseMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, conf := range driverConfs(dir) {
+		conf.History = 2
+		db, err := New(conf)
+		assert.NoError(t, err)
+
+		labels := map[string]string{"device": "d1", "kind": "config"}
+		start := time.Now().UnixNano()
+		kv := &KV{Key: "k", Value: []byte(`{}`), ContentType: "application/json", Labels: labels}
+		err = db.Set(kv)
+		assert.NoError(t, err)
+		assert.True(t, kv.Created >= start)
+		assert.Equal(t, kv.Created, kv.Updated)
+		created := kv.Created
+		// the labels are copied
+		labels["kind"] = "changed"
+
+		v, err := db.Get("k")
+		assert.NoError(t, err)
+		assert.Equal(t, "application/json", v.ContentType, conf.Driver)
+		assert.Equal(t, map[string]string{"device": "d1", "kind": "config"}, v.Labels)
+		assert.Equal(t, created, v.Created)
+		assert.Equal(t, created, v.Updated)
+
+		// the creation time is kept when overwritten, the content type and labels are replaced
+		time.Sleep(time.Millisecond)
+		err = db.Batch([]Op{{Type: OpSet, KV: KV{Key: "k", Value: []byte("text")}}})
+		assert.NoError(t, err)
+		kvs, err := db.List("k")
+		assert.NoError(t, err)
+		assert.Len(t, kvs, 1)
+		assert.Equal(t, created, kvs[0].Created)
+		assert.True(t, kvs[0].Updated > created)
+		assert.Empty(t, kvs[0].ContentType)
+		assert.Nil(t, kvs[0].Labels)
+
+		err = db.CompareAndSet(&KV{Key: "k", Value: []byte("{}"), ContentType: "application/json", Labels: map[string]string{"a": "b"}}, kvs[0].Revision)
+		assert.NoError(t, err)
+		kvs, _, err = db.ListRange(&ListOptions{KeysOnly: true})
+		assert.NoError(t, err)
+		assert.Len(t, kvs, 1)
+		assert.Nil(t, kvs[0].Value)
+		assert.Equal(t, "application/json", kvs[0].ContentType)
+		assert.Equal(t, map[string]string{"a": "b"}, kvs[0].Labels)
+		assert.Equal(t, created, kvs[0].Created)
+
+		vs, err := db.History("k")
+		assert.NoError(t, err)
+		assert.Len(t, vs, 2)
+		assert.Equal(t, map[string]string{"a": "b"}, vs[0].Labels)
+		assert.Empty(t, vs[1].ContentType)
+		assert.Equal(t, created, vs[1].Created)
+
+		// the creation time is reset when the key is created again
+		err = db.Del("k")
+		assert.NoError(t, err)
+		kv = &KV{Key: "k"}
+		err = db.Set(kv)
+		assert.NoError(t, err)
+		assert.True(t, kv.Created > created)
+		err = db.Set(&KV{Key: "e", Expire: time.Now().Unix() - 1})
+		assert.NoError(t, err)
+		kv = &KV{Key: "e"}
+		err = db.Set(kv)
+		assert.NoError(t, err)
+		assert.Equal(t, kv.Created, kv.Updated)
+
+		// the times given are kept by the batch to copy kvs
+		err = db.Batch([]Op{{Type: OpSet, KeepTime: true, KV: KV{Key: "c", Created: 1, Updated: 2}}})
+		assert.NoError(t, err)
+		v, err = db.Get("c")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), v.Created, conf.Driver)
+		assert.Equal(t, int64(2), v.Updated, conf.Driver)
+		db.Close()
+
+		if conf.Driver == "memory" {
+			continue
+		}
+		db, err = New(conf)
+		assert.NoError(t, err)
+		err = db.Set(&KV{Key: "k", ContentType: "text/plain", Labels: map[string]string{"a": "b"}})
+		assert.NoError(t, err)
+		db.Close()
+		db, err = New(conf)
+		assert.NoError(t, err)
+		v, err = db.Get("k")
+		assert.NoError(t, err)
+		assert.Equal(t, "text/plain", v.ContentType)
+		assert.Equal(t, map[string]string{"a": "b"}, v.Labels)
+		db.Close()
+	}
+}
+
+func TestDatabaseIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keys := func(kvs []KV) []string {
+		ks := []string{}
+		for _, kv := range kvs {
+			ks = append(ks, kv.Key)
+		}
+		return ks
+	}
+	indexes := []IndexConf{
+		{Name: "device", Label: "device"},
+		{Name: "city", Path: "location.city"},
+		{Name: "temp", Path: "temp", Type: IndexNumber},
+	}
+	for _, conf := range driverConfs(dir) {
+		for _, invalid := range [][]IndexConf{
+			{{Name: "a", Label: "a", Path: "a"}},
+			{{Name: "a"}},
+			{{Name: ".a", Label: "a"}},
+			{{Name: "a", Label: "a"}, {Name: "a", Path: "a"}},
+			{{Name: "a", Label: "a", Type: "date"}},
+		} {
+			conf.Indexes = invalid
+			_, err = New(conf)
+			assert.Error(t, err, conf.Driver)
+		}
+
+		conf.Indexes = indexes
+		db, err := New(conf)
+		assert.NoError(t, err)
+
+		err = db.Set(&KV{Key: "a", Value: []byte(`{"location":{"city":"bj"},"temp":20}`), Labels: map[string]string{"device": "d1"}})
+		assert.NoError(t, err)
+		err = db.Set(&KV{Key: "b", Value: []byte(`{"location":{"city":"sh"},"temp":-5.5}`), Labels: map[string]string{"device": "d2"}})
+		assert.NoError(t, err)
+		err = db.Batch([]Op{
+			{Type: OpSet, KV: KV{Key: "c", Value: []byte(`{"location":{"city":["bj"]},"temp":100}`), Labels: map[string]string{"device": "d1"}}},
+			{Type: OpSet, KV: KV{Key: "d", Value: []byte(`not json`), Labels: map[string]string{"device": "d2"}}},
+			{Type: OpSet, KV: KV{Key: "e", Value: []byte(`{"temp":"hot"}`), Labels: map[string]string{"device": "d1"}, Expire: time.Now().Unix() - 1}},
+		})
+		assert.NoError(t, err)
+
+		kvs, err := db.Query(&IndexQuery{Index: "device", Value: "d1"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a", "c"}, keys(kvs), conf.Driver)
+		assert.Equal(t, []byte(`{"location":{"city":"bj"},"temp":20}`), kvs[0].Value)
+		assert.Equal(t, map[string]string{"device": "d1"}, kvs[0].Labels)
+		kvs, err = db.Query(&IndexQuery{Index: "device", Value: "d1", Limit: 1})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a"}, keys(kvs))
+		kvs, err = db.Query(&IndexQuery{Index: "device", Value: "d"})
+		assert.NoError(t, err)
+		assert.Empty(t, kvs)
+		// the arrays are not indexed
+		kvs, err = db.Query(&IndexQuery{Index: "city", Value: "bj"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a"}, keys(kvs))
+		kvs, err = db.Query(&IndexQuery{Index: "city", Range: true, Start: "c"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"b"}, keys(kvs))
+		// the numbers are in numeric order
+		kvs, err = db.Query(&IndexQuery{Index: "temp", Range: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"b", "a", "c"}, keys(kvs), conf.Driver)
+		kvs, err = db.Query(&IndexQuery{Index: "temp", Range: true, Start: "-6", End: "100"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"b", "a"}, keys(kvs))
+		kvs, err = db.Query(&IndexQuery{Index: "temp", Value: "1e2"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"c"}, keys(kvs))
+
+		_, err = db.Query(&IndexQuery{Index: "none", Value: "v"})
+		assert.Equal(t, ErrIndexNotFound, err)
+		_, err = db.Query(&IndexQuery{Index: "temp", Value: "hot"})
+		assert.Equal(t, ErrIndexValueInvalid, err)
+
+		// the entries are replaced when the kvs are changed
+		err = db.Set(&KV{Key: "a", Value: []byte(`{"temp":200}`), Labels: map[string]string{"device": "d2"}})
+		assert.NoError(t, err)
+		err = db.Del("c")
+		assert.NoError(t, err)
+		kvs, err = db.Query(&IndexQuery{Index: "device", Value: "d1"})
+		assert.NoError(t, err)
+		assert.Empty(t, kvs)
+		kvs, err = db.Query(&IndexQuery{Index: "device", Value: "d2"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a", "b", "d"}, keys(kvs))
+		kvs, err = db.Query(&IndexQuery{Index: "city", Range: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"b"}, keys(kvs))
+		kvs, err = db.Query(&IndexQuery{Index: "temp", Range: true, Start: "0"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a"}, keys(kvs))
+
+		// each namespace has its own entries
+		err = db.CreateNamespace("n")
+		assert.NoError(t, err)
+		ns, err := db.Namespace("n")
+		assert.NoError(t, err)
+		err = ns.Set(&KV{Key: "x", Labels: map[string]string{"device": "d2"}})
+		assert.NoError(t, err)
+		kvs, err = ns.Query(&IndexQuery{Index: "device", Value: "d2"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"x"}, keys(kvs))
+		kvs, err = db.Query(&IndexQuery{Index: "device", Value: "d2"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a", "b", "d"}, keys(kvs))
+
+		// the indexes are rebuilt after restored
+		var buf bytes.Buffer
+		_, err = db.Backup(&buf)
+		assert.NoError(t, err)
+		n, err := db.DelPrefix("")
+		assert.NoError(t, err)
+		assert.Equal(t, 4, n)
+		err = db.DropNamespace("n")
+		assert.NoError(t, err)
+		kvs, err = db.Query(&IndexQuery{Index: "device", Value: "d2"})
+		assert.NoError(t, err)
+		assert.Empty(t, kvs)
+		err = db.Restore(&buf)
+		assert.NoError(t, err)
+		kvs, err = db.Query(&IndexQuery{Index: "device", Value: "d2"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a", "b", "d"}, keys(kvs), conf.Driver)
+		ns, err = db.Namespace("n")
+		assert.NoError(t, err)
+		kvs, err = ns.Query(&IndexQuery{Index: "device", Value: "d2"})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"x"}, keys(kvs))
+		db.Close()
+
+		if conf.Driver == "memory" {
+			continue
+		}
+		// the indexes are rebuilt when their declarations are changed
+		conf.Indexes = []IndexConf{{Name: "device", Path: "temp", Type: IndexNumber}}
+		db, err = New(conf)
+		assert.NoError(t, err)
+		kvs, err = db.Query(&IndexQuery{Index: "device", Range: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"b", "a"}, keys(kvs), conf.Driver)
+		_, err = db.Query(&IndexQuery{Index: "temp", Range: true})
+		assert.Equal(t, ErrIndexNotFound, err)
+		db.Close()
+		conf.Indexes = nil
+		db, err = New(conf)
+		assert.NoError(t, err)
+		_, err = db.Query(&IndexQuery{Index: "device", Range: true})
+		assert.Equal(t, ErrIndexNotFound, err)
+		db.Close()
+	}
+}
+
+func TestDatabaseUpdate(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := path.Join(dir, "key")
+	err = ioutil.WriteFile(keyFile, []byte("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"), 0600)
+	assert.NoError(t, err)
+
+	confs := append(driverConfs(dir),
+		Conf{Driver: "boltdb", Source: path.Join(dir, "kv4.db"), KeyFile: keyFile, Decorators: []string{"cache"}},
+		Conf{Driver: "memory", Quota: Quota{MaxBytes: 32}},
+	)
+	for _, conf := range confs {
+		db, err := New(conf)
+		assert.NoError(t, err)
+
+		// the key not exists is created
+		err = db.Update("k", func(kv *KV) error {
+			assert.Equal(t, "k", kv.Key)
+			assert.Zero(t, kv.Revision)
+			kv.Value = []byte("a")
+			kv.Labels = map[string]string{"l": "v"}
+			return nil
+		})
+		assert.NoError(t, err)
+		kv, err := db.Get("k")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("a"), kv.Value)
+		rev := kv.Revision
+
+		// the current kv is passed to fn, the key cannot be changed
+		err = db.Update("k", func(kv *KV) error {
+			assert.Equal(t, rev, kv.Revision, conf.Driver)
+			assert.Equal(t, []byte("a"), kv.Value)
+			assert.Equal(t, map[string]string{"l": "v"}, kv.Labels)
+			kv.Key = "x"
+			kv.Value = append(kv.Value, 'b')
+			return nil
+		})
+		assert.NoError(t, err)
+		kv, err = db.Get("k")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("ab"), kv.Value)
+		assert.Equal(t, map[string]string{"l": "v"}, kv.Labels)
+		assert.True(t, kv.Revision > rev)
+		rev = kv.Revision
+		kv, err = db.Get("x")
+		assert.NoError(t, err)
+		assert.Zero(t, kv.Revision)
+
+		// nothing is written if fn fails
+		errFn := errors.New("fn failed")
+		err = db.Update("k", func(kv *KV) error {
+			kv.Value = []byte("c")
+			return errFn
+		})
+		assert.Equal(t, errFn, err)
+		kv, err = db.Get("k")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("ab"), kv.Value)
+		assert.Equal(t, rev, kv.Revision)
+
+		// the concurrent updates are serialized
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := db.Update("n", func(kv *KV) error {
+					n, _ := strconv.Atoi(string(kv.Value))
+					kv.Value = []byte(strconv.Itoa(n + 1))
+					return nil
+				})
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+		kv, err = db.Get("n")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("10"), kv.Value)
+
+		if conf.Quota.MaxBytes > 0 {
+			err = db.Update("k", func(kv *KV) error {
+				kv.Value = []byte("0123456789abcdefghijklmnopqrst")
+				return nil
+			})
+			assert.True(t, errors.Is(err, ErrQuotaExceeded), err)
+			kv, err = db.Get("k")
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("ab"), kv.Value)
+			err = db.Update("k", func(kv *KV) error {
+				kv.Value = []byte("abcdefghijk")
+				return nil
+			})
+			assert.NoError(t, err)
+		}
+
+		ns := "n"
+		err = db.CreateNamespace(ns)
+		assert.NoError(t, err)
+		nsdb, err := db.Namespace(ns)
+		assert.NoError(t, err)
+		err = db.DropNamespace(ns)
+		assert.NoError(t, err)
+		err = nsdb.Update("k", func(kv *KV) error { return nil })
+		assert.Equal(t, ErrNamespaceNotFound, err, conf.Driver)
+		db.Close()
+	}
+}
+
+func TestDatabaseIncrement(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := path.Join(dir, "key")
+	err = ioutil.WriteFile(keyFile, []byte("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"), 0600)
+	assert.NoError(t, err)
+
+	confs := append(driverConfs(dir),
+		Conf{Driver: "boltdb", Source: path.Join(dir, "kv4.db"), KeyFile: keyFile, Decorators: []string{"cache"}},
+		Conf{Driver: "memory", Quota: Quota{MaxValueSize: 2}},
+	)
+	bound := func(n int64) *int64 { return &n }
+	for _, conf := range confs {
+		db, err := New(conf)
+		assert.NoError(t, err)
+
+		// the key not exists is initialised to 0
+		n, err := db.Increment("c", 5, nil)
+		assert.NoError(t, err, conf.Driver)
+		assert.Equal(t, int64(5), n)
+		n, err = db.Increment("c", -7, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(-2), n)
+		kv, err := db.Get("c")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("-2"), kv.Value)
+		rev := kv.Revision
+
+		// the bounds are inclusive, nothing is written if the new value is out of them
+		n, err = db.Increment("c", -3, &Bounds{Min: bound(-5)})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(-5), n)
+		n, err = db.Increment("c", -1, &Bounds{Min: bound(-5), Max: bound(5)})
+		assert.Equal(t, ErrOutOfBounds, err)
+		assert.Zero(t, n)
+		n, err = db.Increment("c", 11, &Bounds{Max: bound(5)})
+		assert.Equal(t, ErrOutOfBounds, err)
+		n, err = db.Increment("c", 0, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(-5), n)
+		kv, err = db.Get("c")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("-5"), kv.Value)
+		assert.True(t, kv.Revision > rev)
+
+		// the overflow is out of bounds
+		if conf.Quota.MaxValueSize == 0 {
+			assert.NoError(t, db.Set(&KV{Key: "max", Value: []byte("9223372036854775806")}))
+			n, err = db.Increment("max", 1, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(math.MaxInt64), n)
+			_, err = db.Increment("max", 1, nil)
+			assert.Equal(t, ErrOutOfBounds, err)
+			_, err = db.Increment("c", math.MinInt64, nil)
+			assert.Equal(t, ErrOutOfBounds, err)
+		} else {
+			_, err = db.Increment("c", -100, nil)
+			assert.True(t, errors.Is(err, ErrQuotaExceeded), err)
+		}
+
+		assert.NoError(t, db.Set(&KV{Key: "s", Value: []byte("1x")}))
+		_, err = db.Increment("s", 1, nil)
+		assert.Equal(t, ErrNotInteger, err)
+		kv, err = db.Get("s")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("1x"), kv.Value)
+
+		// the concurrent increments are not lost
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := db.Increment("n", 1, nil)
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+		n, err = db.Increment("n", 0, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(10), n)
+
+		ns := "n"
+		err = db.CreateNamespace(ns)
+		assert.NoError(t, err)
+		nsdb, err := db.Namespace(ns)
+		assert.NoError(t, err)
+		n, err = nsdb.Increment("c", 1, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), n)
+		err = db.DropNamespace(ns)
+		assert.NoError(t, err)
+		_, err = nsdb.Increment("c", 1, nil)
+		assert.Equal(t, ErrNamespaceNotFound, err, conf.Driver)
+		db.Close()
+	}
+}
+
+func TestDatabaseListFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := path.Join(dir, "key")
+	err = ioutil.WriteFile(keyFile, []byte("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"), 0600)
+	assert.NoError(t, err)
+
+	confs := append(driverConfs(dir),
+		Conf{Driver: "boltdb", Source: path.Join(dir, "kv4.db"), KeyFile: keyFile},
+	)
+	for _, conf := range confs {
+		db, err := New(conf)
+		assert.NoError(t, err)
+
+		for i := 0; i < 10; i++ {
+			err = db.Set(&KV{Key: "k" + strconv.Itoa(i), Value: []byte(strconv.Itoa(i))})
+			assert.NoError(t, err)
+		}
+		err = db.Set(&KV{Key: "k9x", Value: []byte("9"), Expire: time.Now().Unix() - 1})
+		assert.NoError(t, err)
+		even := func(kv *KV) bool {
+			n, err := strconv.Atoi(string(kv.Value))
+			return err == nil && n%2 == 0
+		}
+
+		kvs, next, err := db.ListRange(&ListOptions{Prefix: "k", Filter: even})
+		assert.NoError(t, err)
+		assert.Empty(t, next)
+		assert.Len(t, kvs, 5, conf.Driver)
+		for _, kv := range kvs {
+			assert.True(t, even(&kv))
+		}
+
+		// the pages are filled with the kvs matched
+		kvs, next, err = db.ListRange(&ListOptions{Prefix: "k", Filter: even, Limit: 2})
+		assert.NoError(t, err)
+		assert.Equal(t, "k4", next, conf.Driver)
+		assert.Len(t, kvs, 2)
+		assert.Equal(t, "k0", kvs[0].Key)
+		assert.Equal(t, "k2", kvs[1].Key)
+		kvs, next, err = db.ListRange(&ListOptions{Prefix: "k", Filter: even, Limit: 3, Cursor: next})
+		assert.NoError(t, err)
+		assert.Empty(t, next)
+		assert.Len(t, kvs, 3)
+		assert.Equal(t, "k8", kvs[2].Key)
+		kvs, next, err = db.ListRange(&ListOptions{Prefix: "k", Filter: even, Limit: 2, Reverse: true})
+		assert.NoError(t, err)
+		assert.Equal(t, "k4", next)
+		assert.Equal(t, "k8", kvs[0].Key)
+
+		// the filter is called without values if only keys are listed
+		kvs, _, err = db.ListRange(&ListOptions{Prefix: "k", KeysOnly: true, Filter: func(kv *KV) bool {
+			assert.Nil(t, kv.Value)
+			return kv.Key == "k1"
+		}})
+		assert.NoError(t, err)
+		assert.Len(t, kvs, 1)
+		db.Close()
+	}
+}
+
+func TestDatabaseQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := path.Join(dir, "key")
+	err = ioutil.WriteFile(keyFile, []byte("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f\n"), 0600)
+	assert.NoError(t, err)
+
+	confs := append(driverConfs(dir),
+		Conf{Driver: "boltdb", Source: path.Join(dir, "kv4.db"), KeyFile: keyFile, Decorators: []string{"cache"}},
+	)
+	for _, conf := range confs {
+		db, err := New(conf)
+		assert.NoError(t, err)
+
+		_, err = NewQueue(db, "", "a/b")
+		assert.Equal(t, ErrQueueInvalid, err)
+		q, err := NewQueue(db, "", "q")
+		assert.NoError(t, err)
+		assert.Equal(t, "q", q.Name())
+
+		// nothing is written until the first push
+		m, err := q.Pop(time.Minute)
+		assert.NoError(t, err, conf.Driver)
+		assert.Nil(t, m)
+		m, err = q.Peek()
+		assert.NoError(t, err)
+		assert.Nil(t, m)
+		n, err := q.Len()
+		assert.NoError(t, err)
+		assert.Zero(t, n)
+		assert.Equal(t, ErrReceiptInvalid, q.Ack(1, 1))
+		names, err := db.Namespaces()
+		assert.NoError(t, err)
+		assert.Empty(t, names)
+		for i := 1; i <= 3; i++ {
+			m, err = q.Push([]byte("m" + strconv.Itoa(i)))
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(i), m.Seq)
+		}
+		n, err = q.Len()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), n)
+
+		// peek does not pop the message
+		m, err = q.Peek()
+		assert.NoError(t, err)
+		assert.Equal(t, &Message{Seq: 1, Value: []byte("m1")}, m)
+		m, err = q.Pop(time.Minute)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), m.Seq)
+		assert.Equal(t, []byte("m1"), m.Value)
+		assert.Equal(t, 1, m.Deliveries)
+		assert.NotZero(t, m.Receipt)
+		m1 := m
+
+		// the message popped is invisible but still counted until acknowledged
+		m, err = q.Peek()
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(2), m.Seq)
+		n, err = q.Len()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), n)
+		assert.Equal(t, ErrReceiptInvalid, q.Ack(m1.Seq, m1.Receipt+100))
+		assert.Equal(t, ErrReceiptInvalid, q.Ack(m1.Seq, 0))
+		assert.NoError(t, q.Ack(m1.Seq, m1.Receipt))
+		assert.Equal(t, ErrReceiptInvalid, q.Ack(m1.Seq, m1.Receipt))
+		n, err = q.Len()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), n)
+
+		// the message not acknowledged reappears at its position after the visibility timeout
+		m, err = q.Pop(200 * time.Millisecond)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(2), m.Seq)
+		m2 := m
+		m, err = q.Pop(time.Minute)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(3), m.Seq)
+		m, err = q.Pop(time.Minute)
+		assert.NoError(t, err)
+		assert.Nil(t, m)
+		time.Sleep(300 * time.Millisecond)
+		m, err = q.Pop(time.Minute)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(2), m.Seq)
+		assert.Equal(t, []byte("m2"), m.Value)
+		assert.Equal(t, 2, m.Deliveries)
+		// the receipt of the earlier delivery is stale
+		assert.Equal(t, ErrReceiptInvalid, q.Ack(m2.Seq, m2.Receipt))
+		assert.NoError(t, q.Ack(m.Seq, m.Receipt))
+
+		// the message is deleted once popped without visibility timeout
+		m, err = q.Push([]byte("m4"))
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(4), m.Seq)
+		m, err = q.Pop(0)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(4), m.Seq)
+		assert.Zero(t, m.Receipt)
+		n, err = q.Len()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), n)
+
+		// the sequences of concurrent pushes are allocated without gaps
+		var wg sync.WaitGroup
+		var pushed uint64
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 4; j++ {
+					m, err := q.Push([]byte("c"))
+					assert.NoError(t, err)
+					atomic.AddUint64(&pushed, m.Seq)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, uint64((5+24)*20/2), pushed)
+
+		// each message is popped by one consumer only
+		var popped int64
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					m, err := q.Pop(time.Minute)
+					assert.NoError(t, err)
+					if m == nil {
+						return
+					}
+					atomic.AddInt64(&popped, 1)
+					assert.NoError(t, q.Ack(m.Seq, m.Receipt))
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int64(20), popped)
+		n, err = q.Len()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), n)
+
+		// the queues of namespaces are separated
+		err = db.CreateNamespace("n")
+		assert.NoError(t, err)
+		nsdb, err := db.Namespace("n")
+		assert.NoError(t, err)
+		nq, err := NewQueue(nsdb, "n", "q")
+		assert.NoError(t, err)
+		m, err = nq.Push([]byte("n1"))
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(1), m.Seq)
+
+		// the queues are kept in the reserved namespace, not as the kvs of users
+		kvs, err := db.List("")
+		assert.NoError(t, err)
+		assert.Empty(t, kvs)
+		kvs, err = nsdb.List("")
+		assert.NoError(t, err)
+		assert.Empty(t, kvs)
+		names, err = db.Namespaces()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"_queue", "n"}, names)
+		_, err = db.DelPrefix("")
+		assert.NoError(t, err)
+		n, err = q.Len()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), n)
+
+		// the queues of a namespace are dropped only with it
+		nq2, err := NewQueue(nsdb, "n", "q2")
+		assert.NoError(t, err)
+		_, err = nq2.Push([]byte("n2"))
+		assert.NoError(t, err)
+		err = db.DropNamespace("n")
+		assert.NoError(t, err)
+		c, err := DropQueues(db, "n")
+		assert.NoError(t, err)
+		assert.Equal(t, 4, c)
+		n, err = nq.Len()
+		assert.NoError(t, err)
+		assert.Zero(t, n)
+		n, err = q.Len()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), n)
+		db.Close()
+
+		// the messages are persisted
+		if conf.Driver == "memory" {
+			continue
+		}
+		db, err = New(conf)
+		assert.NoError(t, err)
+		q, err = NewQueue(db, "", "q")
+		assert.NoError(t, err)
+		n, err = q.Len()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), n)
+		m, err = q.Push([]byte("m5"))
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(25), m.Seq)
+		db.Close()
+	}
+
+	// the queues are read through the readonly decorator
+	db, err := New(Conf{Driver: "boltdb", Source: path.Join(dir, "kv5.db"), Decorators: []string{"readonly"}})
+	assert.NoError(t, err)
+	defer db.Close()
+	q, err := NewQueue(db, "", "q")
+	assert.NoError(t, err)
+	n, err := q.Len()
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+	m, err := q.Peek()
+	assert.NoError(t, err)
+	assert.Nil(t, m)
+	_, err = q.Push([]byte("m"))
+	assert.Equal(t, ErrReadOnly, err)
 }
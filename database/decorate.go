@@ -0,0 +1,320 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/baetyl/baetyl-go/log"
+)
+
+// Decorators of database, which wrap the DB created by the driver to add cross-cutting behaviors.
+// A decorator embeds the DB wrapped and overrides the methods it cares about, Namespace must
+// be overridden to wrap the namespaces too, Close closes the DB wrapped. Unwrap() DB
+// should be implemented to return the DB wrapped, so that the decorators inside can be found
+var Decorators = map[string]func(db DB, conf Conf) (DB, error){}
+
+func init() {
+	Decorators["logging"] = newLoggingDB
+	Decorators["readonly"] = newReadOnlyDB
+}
+
+// ErrReadOnly returned if writing the database guarded by the readonly decorator
+var ErrReadOnly = errors.New("database is read-only")
+
+// decorate wraps the DB by the decorators of Conf.Decorators in order,
+// the first one wraps the DB directly, the DB is closed if failed
+func decorate(db DB, conf Conf) (DB, error) {
+	for _, name := range conf.Decorators {
+		f, ok := Decorators[name]
+		if !ok {
+			db.Close()
+			return nil, fmt.Errorf("decorator (%s) not supported", name)
+		}
+		d, err := f(db, conf)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		db = d
+	}
+	return db, nil
+}
+
+// readOnlyDb the DB rejecting all writes with ErrReadOnly
+type readOnlyDb struct {
+	DB
+}
+
+func newReadOnlyDB(db DB, _ Conf) (DB, error) {
+	return &readOnlyDb{DB: db}, nil
+}
+
+// Unwrap returns the DB guarded
+func (d *readOnlyDb) Unwrap() DB {
+	return d.DB
+}
+
+// Namespace returns the namespace guarded
+func (d *readOnlyDb) Namespace(name string) (DB, error) {
+	ns, err := d.DB.Namespace(name)
+	if err != nil {
+		return nil, err
+	}
+	return &readOnlyDb{DB: ns}, nil
+}
+
+// CreateNamespace returns ErrReadOnly
+func (d *readOnlyDb) CreateNamespace(name string) error {
+	return ErrReadOnly
+}
+
+// DropNamespace returns ErrReadOnly
+func (d *readOnlyDb) DropNamespace(name string) error {
+	return ErrReadOnly
+}
+
+// Set returns ErrReadOnly
+func (d *readOnlyDb) Set(kv *KV) error {
+	return ErrReadOnly
+}
+
+// Del returns ErrReadOnly
+func (d *readOnlyDb) Del(key string) error {
+	return ErrReadOnly
+}
+
+// Batch returns ErrReadOnly
+func (d *readOnlyDb) Batch(ops []Op) error {
+	return ErrReadOnly
+}
+
+// CompareAndSet returns ErrReadOnly
+func (d *readOnlyDb) CompareAndSet(kv *KV, rev uint64) error {
+	return ErrReadOnly
+}
+
+// CompareAndDel returns ErrReadOnly
+func (d *readOnlyDb) CompareAndDel(key string, rev uint64) error {
+	return ErrReadOnly
+}
+
+// Update returns ErrReadOnly
+func (d *readOnlyDb) Update(key string, fn func(kv *KV) error) error {
+	return ErrReadOnly
+}
+
+// Increment returns ErrReadOnly
+func (d *readOnlyDb) Increment(key string, delta int64, bounds *Bounds) (int64, error) {
+	return 0, ErrReadOnly
+}
+
+// RewriteHistory returns ErrReadOnly
+func (d *readOnlyDb) RewriteHistory(fn func(v *Version) (bool, error)) (int, error) {
+	return 0, ErrReadOnly
+}
+
+// Rewrite returns ErrReadOnly
+func (d *readOnlyDb) Rewrite(fn func(kv *KV) (bool, error)) (int, error) {
+	return 0, ErrReadOnly
+}
+
+// DelExpired deletes nothing, the expired kvs are invisible anyway
+func (d *readOnlyDb) DelExpired() (int, error) {
+	return 0, nil
+}
+
+// DelPrefix returns ErrReadOnly
+func (d *readOnlyDb) DelPrefix(prefix string) (int, error) {
+	return 0, ErrReadOnly
+}
+
+// Restore returns ErrReadOnly
+func (d *readOnlyDb) Restore(r io.Reader) error {
+	return ErrReadOnly
+}
+
+// loggingDb the DB logging each operation with its duration in debug level,
+// the failed operations are logged in error level
+type loggingDb struct {
+	DB
+	log *log.Logger
+}
+
+func newLoggingDB(db DB, conf Conf) (DB, error) {
+	return &loggingDb{DB: db, log: log.With(log.Any("database", conf.Driver))}, nil
+}
+
+func (d *loggingDb) logged(op string, start time.Time, err error, fields ...log.Field) {
+	fields = append(fields, log.Any("op", op), log.Any("cost", time.Since(start)))
+	if err != nil {
+		d.log.Error("database operation failed", append(fields, log.Error(err))...)
+		return
+	}
+	d.log.Debug("database operation done", fields...)
+}
+
+// Unwrap returns the DB logged
+func (d *loggingDb) Unwrap() DB {
+	return d.DB
+}
+
+// Namespace returns the namespace logged with its name
+func (d *loggingDb) Namespace(name string) (ns DB, err error) {
+	defer func(start time.Time) { d.logged("namespace", start, err, log.Any("namespace", name)) }(time.Now())
+	if ns, err = d.DB.Namespace(name); err != nil {
+		return nil, err
+	}
+	return &loggingDb{DB: ns, log: d.log.With(log.Any("namespace", name))}, nil
+}
+
+// CreateNamespace creates the namespace with logging
+func (d *loggingDb) CreateNamespace(name string) (err error) {
+	defer func(start time.Time) { d.logged("create namespace", start, err, log.Any("namespace", name)) }(time.Now())
+	return d.DB.CreateNamespace(name)
+}
+
+// DropNamespace drops the namespace with logging
+func (d *loggingDb) DropNamespace(name string) (err error) {
+	defer func(start time.Time) { d.logged("drop namespace", start, err, log.Any("namespace", name)) }(time.Now())
+	return d.DB.DropNamespace(name)
+}
+
+// Set sets the kv with logging
+func (d *loggingDb) Set(kv *KV) (err error) {
+	defer func(start time.Time) { d.logged("set", start, err, log.Any("key", kv.Key)) }(time.Now())
+	return d.DB.Set(kv)
+}
+
+// Get gets the kv with logging
+func (d *loggingDb) Get(key string) (kv *KV, err error) {
+	defer func(start time.Time) { d.logged("get", start, err, log.Any("key", key)) }(time.Now())
+	return d.DB.Get(key)
+}
+
+// Del deletes the key with logging
+func (d *loggingDb) Del(key string) (err error) {
+	defer func(start time.Time) { d.logged("del", start, err, log.Any("key", key)) }(time.Now())
+	return d.DB.Del(key)
+}
+
+// List lists the kvs with logging
+func (d *loggingDb) List(prefix string) (kvs []KV, err error) {
+	defer func(start time.Time) {
+		d.logged("list", start, err, log.Any("prefix", prefix), log.Any("count", len(kvs)))
+	}(time.Now())
+	return d.DB.List(prefix)
+}
+
+// ListRange lists the kvs in the range with logging
+func (d *loggingDb) ListRange(opts *ListOptions) (kvs []KV, next string, err error) {
+	defer func(start time.Time) {
+		d.logged("list range", start, err, log.Any("prefix", opts.Prefix), log.Any("count", len(kvs)))
+	}(time.Now())
+	return d.DB.ListRange(opts)
+}
+
+// Stats counts the kvs with the prefix with logging
+func (d *loggingDb) Stats(prefix string) (stats *Stats, err error) {
+	defer func(start time.Time) { d.logged("stats", start, err, log.Any("prefix", prefix)) }(time.Now())
+	return d.DB.Stats(prefix)
+}
+
+// Query looks up the kvs by the index with logging
+func (d *loggingDb) Query(q *IndexQuery) (kvs []KV, err error) {
+	defer func(start time.Time) {
+		d.logged("query", start, err, log.Any("index", q.Index), log.Any("count", len(kvs)))
+	}(time.Now())
+	return d.DB.Query(q)
+}
+
+// Batch executes the operations with logging
+func (d *loggingDb) Batch(ops []Op) (err error) {
+	defer func(start time.Time) { d.logged("batch", start, err, log.Any("count", len(ops))) }(time.Now())
+	return d.DB.Batch(ops)
+}
+
+// CompareAndSet sets the kv if the revision matches with logging
+func (d *loggingDb) CompareAndSet(kv *KV, rev uint64) (err error) {
+	defer func(start time.Time) {
+		d.logged("compare and set", start, err, log.Any("key", kv.Key), log.Any("revision", rev))
+	}(time.Now())
+	return d.DB.CompareAndSet(kv, rev)
+}
+
+// CompareAndDel deletes the key if the revision matches with logging
+func (d *loggingDb) CompareAndDel(key string, rev uint64) (err error) {
+	defer func(start time.Time) {
+		d.logged("compare and del", start, err, log.Any("key", key), log.Any("revision", rev))
+	}(time.Now())
+	return d.DB.CompareAndDel(key, rev)
+}
+
+// Update sets the kv changed by fn with logging
+func (d *loggingDb) Update(key string, fn func(kv *KV) error) (err error) {
+	defer func(start time.Time) { d.logged("update", start, err, log.Any("key", key)) }(time.Now())
+	return d.DB.Update(key, fn)
+}
+
+// Increment adds delta to the counter of the key with logging
+func (d *loggingDb) Increment(key string, delta int64, bounds *Bounds) (n int64, err error) {
+	defer func(start time.Time) {
+		d.logged("increment", start, err, log.Any("key", key), log.Any("delta", delta), log.Any("value", n))
+	}(time.Now())
+	return d.DB.Increment(key, delta, bounds)
+}
+
+// DelExpired deletes the expired kvs with logging
+func (d *loggingDb) DelExpired() (n int, err error) {
+	defer func(start time.Time) { d.logged("del expired", start, err, log.Any("count", n)) }(time.Now())
+	return d.DB.DelExpired()
+}
+
+// DelPrefix deletes the keys with the prefix with logging
+func (d *loggingDb) DelPrefix(prefix string) (n int, err error) {
+	defer func(start time.Time) {
+		d.logged("del prefix", start, err, log.Any("prefix", prefix), log.Any("count", n))
+	}(time.Now())
+	return d.DB.DelPrefix(prefix)
+}
+
+// History lists the versions of the key with logging
+func (d *loggingDb) History(key string) (versions []Version, err error) {
+	defer func(start time.Time) {
+		d.logged("history", start, err, log.Any("key", key), log.Any("count", len(versions)))
+	}(time.Now())
+	return d.DB.History(key)
+}
+
+// RewriteHistory rewrites the versions changed by fn with logging
+func (d *loggingDb) RewriteHistory(fn func(v *Version) (bool, error)) (n int, err error) {
+	defer func(start time.Time) { d.logged("rewrite history", start, err, log.Any("count", n)) }(time.Now())
+	return d.DB.RewriteHistory(fn)
+}
+
+// Rewrite rewrites the kvs changed by fn with logging
+func (d *loggingDb) Rewrite(fn func(kv *KV) (bool, error)) (n int, err error) {
+	defer func(start time.Time) { d.logged("rewrite", start, err, log.Any("count", n)) }(time.Now())
+	return d.DB.Rewrite(fn)
+}
+
+// Watch watches the changes with logging
+func (d *loggingDb) Watch(key string, prefix bool, rev uint64) (w *Watcher, err error) {
+	defer func(start time.Time) {
+		d.logged("watch", start, err, log.Any("key", key), log.Any("prefix", prefix), log.Any("revision", rev))
+	}(time.Now())
+	return d.DB.Watch(key, prefix, rev)
+}
+
+// Backup backs up the database with logging
+func (d *loggingDb) Backup(w io.Writer) (n int64, err error) {
+	defer func(start time.Time) { d.logged("backup", start, err, log.Any("size", n)) }(time.Now())
+	return d.DB.Backup(w)
+}
+
+// Restore restores the database with logging
+func (d *loggingDb) Restore(r io.Reader) (err error) {
+	defer func(start time.Time) { d.logged("restore", start, err) }(time.Now())
+	return d.DB.Restore(r)
+}
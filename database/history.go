@@ -0,0 +1,59 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrNoHistory returned if the key has no versions kept, e.g. Conf.History is 0 or the key was written
+// before the history was enabled, so its version at a revision is unknown
+var ErrNoHistory = errors.New("no history of the key")
+
+// Version a version of the key kept in its history, which is written at Time in unix nanoseconds,
+// Deleted is true if the key is deleted at the revision, then Value is empty
+type Version struct {
+	KV
+	Time    int64
+	Deleted bool
+}
+
+// newVersion returns the version of the key changed by the event at the time
+func newVersion(e *Event, now time.Time) Version {
+	v := Version{KV: e.KV, Time: now.UnixNano(), Deleted: e.Type == EventDel}
+	v.TTL = 0
+	return v
+}
+
+// VersionAt returns the version of the key at the revision from its history in descending order of revision,
+// ErrNoHistory if the key has no history, ErrCompacted if the revision is older than the versions kept
+func VersionAt(history []Version, rev uint64) (*Version, error) {
+	return versionAt(history, func(v *Version) bool { return v.Revision <= rev })
+}
+
+// VersionAtTime returns the version of the key at the time from its history in descending order of revision,
+// ErrNoHistory if the key has no history, ErrCompacted if the time is earlier than the versions kept
+func VersionAtTime(history []Version, t time.Time) (*Version, error) {
+	return versionAt(history, func(v *Version) bool { return v.Time <= t.UnixNano() })
+}
+
+func versionAt(history []Version, before func(v *Version) bool) (*Version, error) {
+	if len(history) == 0 {
+		return nil, ErrNoHistory
+	}
+	i := sort.Search(len(history), func(i int) bool { return before(&history[i]) })
+	if i == len(history) {
+		return nil, ErrCompacted
+	}
+	return &history[i], nil
+}
+
+// appendVersion appends the version to the versions in ascending order of revision,
+// and drops the oldest ones if there are more than max
+func appendVersion(versions []Version, v Version, max int) []Version {
+	versions = append(versions, v)
+	if len(versions) > max {
+		versions = versions[len(versions)-max:]
+	}
+	return versions
+}
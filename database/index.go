@@ -0,0 +1,326 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the types of indexed values
+const (
+	IndexString = "string"
+	IndexNumber = "number"
+)
+
+// errors of indexes
+var (
+	// ErrIndexNotFound returned if the index queried is not declared by Conf.Indexes
+	ErrIndexNotFound = errors.New("index not found")
+	// ErrIndexValueInvalid returned if the value queried is not of the type of the index
+	ErrIndexValueInvalid = errors.New("index value invalid")
+)
+
+// IndexConf the declaration of a secondary index on the Label of kvs, or on the field at Path of
+// the JSON values. The indexes are maintained in the transaction of each write, and rebuilt once
+// the declarations are changed. Only the scalar fields are indexed, and the values encrypted
+// by Conf.KeyFile cannot be indexed by Path since they are encrypted before stored
+type IndexConf struct {
+	Name  string `yaml:"name" json:"name"`
+	Label string `yaml:"label" json:"label,omitempty"`
+	// Path the names of the fields separated by dots, e.g. status or location.city
+	Path string `yaml:"path" json:"path,omitempty"`
+	// Type the type of the values indexed, string by default or number, which decides the order of values.
+	// The strings, booleans and numbers are indexed as strings, only the numbers are indexed as numbers
+	Type string `yaml:"type" json:"type,omitempty"`
+}
+
+// IndexQuery looks up the kvs by the index, whose indexed value equals Value, or is in the range
+// [Start, End) if Range is true, an empty Start or End means unbounded. The kvs are returned in the order
+// of indexed values then keys, at most Limit kvs are returned if it is not 0
+type IndexQuery struct {
+	Index string
+	Value string
+	Range bool
+	Start string
+	End   string
+	Limit int
+}
+
+// indexEntry the value of the kv indexed by the index, the value is encoded in the order of the index type
+type indexEntry struct {
+	Index string `json:"i"`
+	Value []byte `json:"v"`
+}
+
+// indexer computes the index entries of kvs
+type indexer struct {
+	confs []IndexConf
+	names map[string]*IndexConf
+	// paths the paths of each index in the JSON values, nil for the indexes on labels
+	paths map[string][]string
+}
+
+// newIndexer returns the indexer of Conf.Indexes, nil if no index is declared
+func newIndexer(conf Conf) (*indexer, error) {
+	if len(conf.Indexes) == 0 {
+		return nil, nil
+	}
+	x := &indexer{names: map[string]*IndexConf{}, paths: map[string][]string{}}
+	for i := range conf.Indexes {
+		c := conf.Indexes[i]
+		if c.Type == "" {
+			c.Type = IndexString
+		}
+		switch {
+		case !namespaceRegexp.MatchString(c.Name):
+			return nil, fmt.Errorf("index (%s) invalid: name invalid", c.Name)
+		case x.names[c.Name] != nil:
+			return nil, fmt.Errorf("index (%s) invalid: name duplicated", c.Name)
+		case (c.Label == "") == (c.Path == ""):
+			return nil, fmt.Errorf("index (%s) invalid: either label or path required", c.Name)
+		case c.Type != IndexString && c.Type != IndexNumber:
+			return nil, fmt.Errorf("index (%s) invalid: type (%s) not supported", c.Name, c.Type)
+		}
+		x.confs = append(x.confs, c)
+		x.names[c.Name] = &x.confs[len(x.confs)-1]
+		if c.Path != "" {
+			x.paths[c.Name] = strings.Split(c.Path, ".")
+		}
+	}
+	return x, nil
+}
+
+// fingerprint returns the declarations of indexes in JSON, the indexes are rebuilt once it is changed
+func (x *indexer) fingerprint() []byte {
+	if x == nil {
+		return []byte("[]")
+	}
+	data, _ := json.Marshal(x.confs)
+	return data
+}
+
+// entries returns the entries of kv in the order of indexes declared
+func (x *indexer) entries(kv *KV) []indexEntry {
+	if x == nil {
+		return nil
+	}
+	var doc interface{}
+	var parsed bool
+	var entries []indexEntry
+	for i := range x.confs {
+		c := &x.confs[i]
+		var v interface{}
+		if c.Label != "" {
+			l, ok := kv.Labels[c.Label]
+			if !ok {
+				continue
+			}
+			v = l
+		} else {
+			if !parsed {
+				parsed = true
+				d := json.NewDecoder(bytes.NewReader(kv.Value))
+				d.UseNumber()
+				if d.Decode(&doc) != nil {
+					doc = nil
+				}
+			}
+			v = lookup(doc, x.paths[c.Name])
+		}
+		if value, ok := encodeIndexValue(c.Type, v); ok {
+			entries = append(entries, indexEntry{Index: c.Name, Value: value})
+		}
+	}
+	return entries
+}
+
+// lookup returns the field at the path of the JSON document, nil if not found
+func lookup(doc interface{}, path []string) interface{} {
+	for _, name := range path {
+		m, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		doc = m[name]
+	}
+	return doc
+}
+
+// encodeIndexValue encodes the scalar value in the order of the type, false if it cannot be indexed
+func encodeIndexValue(typ string, v interface{}) ([]byte, bool) {
+	if typ == IndexNumber {
+		n, ok := v.(json.Number)
+		if !ok {
+			return nil, false
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return nil, false
+		}
+		return encodeNumber(f), true
+	}
+	switch s := v.(type) {
+	case string:
+		return []byte(s), true
+	case json.Number:
+		return []byte(s), true
+	case bool:
+		return []byte(strconv.FormatBool(s)), true
+	}
+	return nil, false
+}
+
+// encodeNumber encodes the number into 8 bytes whose byte order is the numeric order
+func encodeNumber(f float64) []byte {
+	b := make([]byte, 8)
+	u := math.Float64bits(f)
+	if u>>63 == 1 {
+		u = ^u
+	} else {
+		u |= 1 << 63
+	}
+	binary.BigEndian.PutUint64(b, u)
+	return b
+}
+
+// bounds returns the lower (inclusive) and upper (exclusive) bound of the encoded values queried,
+// nil upper means unbounded
+func (x *indexer) bounds(q *IndexQuery) (lower, upper []byte, err error) {
+	var c *IndexConf
+	if x != nil {
+		c = x.names[q.Index]
+	}
+	if c == nil {
+		return nil, nil, ErrIndexNotFound
+	}
+	encode := func(s string) ([]byte, error) {
+		if c.Type != IndexNumber {
+			return []byte(s), nil
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, ErrIndexValueInvalid
+		}
+		return encodeNumber(f), nil
+	}
+	if !q.Range {
+		if lower, err = encode(q.Value); err != nil {
+			return nil, nil, err
+		}
+		// the smallest value greater than the value queried
+		return lower, append(append([]byte{}, lower...), 0), nil
+	}
+	lower = []byte{}
+	if q.Start != "" {
+		if lower, err = encode(q.Start); err != nil {
+			return nil, nil, err
+		}
+	}
+	if q.End != "" {
+		if upper, err = encode(q.End); err != nil {
+			return nil, nil, err
+		}
+	}
+	return lower, upper, nil
+}
+
+// indexKey encodes the entry of the key as the escaped value, the terminator and the key,
+// so that the entries are sorted by the values then the keys. 0x00 in the value is escaped as 0x00 0xff,
+// the terminator is 0x00 0x01
+func indexKey(value []byte, key string) []byte {
+	b := make([]byte, 0, len(value)+len(key)+2)
+	for _, c := range value {
+		b = append(b, c)
+		if c == 0 {
+			b = append(b, 0xff)
+		}
+	}
+	b = append(b, 0, 1)
+	return append(b, key...)
+}
+
+// indexPrefix returns the escaped value without the terminator, which all entries of the value or greater start from
+func indexPrefix(value []byte) []byte {
+	k := indexKey(value, "")
+	return k[:len(k)-2]
+}
+
+// splitIndexKey decodes the value and the key of the entry
+func splitIndexKey(b []byte) (value []byte, key string, ok bool) {
+	for i := 0; i+1 < len(b); i++ {
+		if b[i] != 0 {
+			value = append(value, b[i])
+			continue
+		}
+		switch b[i+1] {
+		case 1:
+			return value, string(b[i+2:]), true
+		case 0xff:
+			value = append(value, 0)
+			i++
+		default:
+			return nil, "", false
+		}
+	}
+	return nil, "", false
+}
+
+// memIndex the entries of the kvs of a namespace in memory
+type memIndex struct {
+	// keys the sorted entries of each index encoded by indexKey
+	keys map[string][]string
+	// entries the entries of each key
+	entries map[string][]indexEntry
+}
+
+func newMemIndex() *memIndex {
+	return &memIndex{keys: map[string][]string{}, entries: map[string][]indexEntry{}}
+}
+
+// set replaces the entries of the key, the key is removed from the index if entries is empty
+func (m *memIndex) set(key string, entries []indexEntry) {
+	for _, e := range m.entries[key] {
+		keys := m.keys[e.Index]
+		k := string(indexKey(e.Value, key))
+		if i := sort.SearchStrings(keys, k); i < len(keys) && keys[i] == k {
+			m.keys[e.Index] = append(keys[:i], keys[i+1:]...)
+		}
+	}
+	delete(m.entries, key)
+	if len(entries) == 0 {
+		return
+	}
+	m.entries[key] = entries
+	for _, e := range entries {
+		keys := m.keys[e.Index]
+		k := string(indexKey(e.Value, key))
+		i := sort.SearchStrings(keys, k)
+		keys = append(keys, "")
+		copy(keys[i+1:], keys[i:])
+		keys[i] = k
+		m.keys[e.Index] = keys
+	}
+}
+
+// lookup returns the keys whose values of the index are in [lower, upper) in the order of values then keys
+func (m *memIndex) lookup(index string, lower, upper []byte) []string {
+	keys := m.keys[index]
+	var found []string
+	for i := sort.SearchStrings(keys, string(indexPrefix(lower))); i < len(keys); i++ {
+		value, key, ok := splitIndexKey([]byte(keys[i]))
+		if !ok {
+			continue
+		}
+		if upper != nil && bytes.Compare(value, upper) >= 0 {
+			break
+		}
+		found = append(found, key)
+	}
+	return found
+}
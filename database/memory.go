@@ -0,0 +1,861 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	Factories["memory"] = newMemDB
+}
+
+var (
+	errKeyRequired = errors.New("key required")
+	errMemClosed   = errors.New("database not open")
+)
+
+// memDb the namespace of memory DB, all namespaces share the same store,
+// the kvs are lost once closed, Conf.Source is ignored
+type memDb struct {
+	store *memStore
+	ns    string
+	conf  Conf
+}
+
+func newMemDB(conf Conf) (DB, error) {
+	store, err := newMemStore(conf, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &memDb{store: store, conf: conf}, nil
+}
+
+// memStore the kvs of all namespaces kept in memory, the default namespace is named empty
+type memStore struct {
+	sync.RWMutex
+	rev    uint64
+	spaces map[string]*memSpace
+	broker *broker
+	// history the count of versions kept for each key
+	history int
+	index   *indexer
+	// commit is called with the changes of each write before they are applied,
+	// the write fails without any change if it returns an error
+	commit func(c *memChange) error
+}
+
+func newMemStore(conf Conf, rev uint64) (*memStore, error) {
+	index, err := newIndexer(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &memStore{
+		rev:     rev,
+		spaces:  map[string]*memSpace{"": new(memSpace)},
+		broker:  newBroker(conf.WatchHistory, rev),
+		history: conf.History,
+		index:   index,
+	}, nil
+}
+
+// memChange the changes of one write, the namespaces created go first and the namespaces dropped go last.
+// The events are recorded into the history of keys at Time, the changes without Time are the snapshot
+// of the store, whose history is set by History. Rewritten are the kvs rewritten in place, which are neither
+// published nor recorded
+type memChange struct {
+	Revision  uint64       `json:"rev"`
+	Time      int64        `json:"time,omitempty"`
+	Created   []string     `json:"created,omitempty"`
+	History   []memHistory `json:"history,omitempty"`
+	Events    []Event      `json:"events,omitempty"`
+	Rewritten []Event      `json:"rewritten,omitempty"`
+	Dropped   []string     `json:"dropped,omitempty"`
+}
+
+// entries returns the count of namespaces and kvs changed
+func (c *memChange) entries() int {
+	return len(c.Created) + len(c.Events) + len(c.Rewritten) + len(c.Dropped)
+}
+
+// memHistory the versions of a key in ascending order of revision
+type memHistory struct {
+	Namespace string    `json:"ns,omitempty"`
+	Key       string    `json:"key"`
+	Versions  []Version `json:"versions"`
+}
+
+// apply applies the changes committed to the store
+func (s *memStore) apply(c *memChange) {
+	for _, name := range c.Created {
+		if s.spaces[name] == nil {
+			s.spaces[name] = new(memSpace)
+		}
+	}
+	for _, h := range c.History {
+		if space := s.spaces[h.Namespace]; space != nil && s.history > 0 {
+			space.setHistory(h.Key, h.Versions, s.history)
+		}
+	}
+	for i := range c.Events {
+		e := &c.Events[i]
+		space := s.spaces[e.Namespace]
+		if space == nil {
+			continue
+		}
+		if e.Type == EventPut {
+			space.put(e.KV)
+		} else {
+			space.del(e.Key)
+		}
+		s.indexKey(space, e)
+		if c.Time != 0 && s.history > 0 {
+			space.record(newVersion(e, time.Unix(0, c.Time)), s.history)
+		}
+	}
+	for i := range c.Rewritten {
+		e := &c.Rewritten[i]
+		if space := s.spaces[e.Namespace]; space != nil {
+			space.put(e.KV)
+			s.indexKey(space, e)
+		}
+	}
+	for _, name := range c.Dropped {
+		delete(s.spaces, name)
+	}
+	if c.Revision > s.rev {
+		s.rev = c.Revision
+	}
+}
+
+// indexKey maintains the indexes of the key changed by the event
+func (s *memStore) indexKey(space *memSpace, e *Event) {
+	if s.index == nil {
+		return
+	}
+	if space.index == nil {
+		space.index = newMemIndex()
+	}
+	var entries []indexEntry
+	if e.Type == EventPut {
+		entries = s.index.entries(&e.KV)
+	}
+	space.index.set(e.Key, entries)
+}
+
+// reset replaces all namespaces of the store and rebuilds their indexes, all watchers are closed with ErrCompacted
+func (s *memStore) reset(spaces map[string]*memSpace, rev uint64) {
+	for _, space := range spaces {
+		space.index = nil
+		for i := range space.kvs {
+			s.indexKey(space, &Event{Type: EventPut, KV: space.kvs[i]})
+		}
+	}
+	s.spaces = spaces
+	s.rev = rev
+	s.broker.reset(rev)
+}
+
+// write runs fn with a transaction, commits and applies its changes, then publishes the events
+func (s *memStore) write(fn func(tx *memTx) error) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.spaces == nil {
+		return errMemClosed
+	}
+	tx := &memTx{store: s, now: time.Now()}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	c := &tx.change
+	if c.entries() == 0 && len(c.History) == 0 && c.Revision == 0 {
+		return nil
+	}
+	c.Time = tx.now.UnixNano()
+	if s.commit != nil {
+		if err := s.commit(c); err != nil {
+			return err
+		}
+	}
+	s.apply(c)
+	s.broker.publish(c.Events...)
+	return nil
+}
+
+// read runs fn with the kvs of the namespace under the read lock
+func (s *memStore) read(ns string, fn func(space *memSpace) error) error {
+	s.RLock()
+	defer s.RUnlock()
+	if s.spaces == nil {
+		return errMemClosed
+	}
+	space := s.spaces[ns]
+	if space == nil {
+		return ErrNamespaceNotFound
+	}
+	return fn(space)
+}
+
+// memSpace the kvs of a namespace sorted by key, the versions of keys in ascending order of revision,
+// and the entries of indexes if any
+type memSpace struct {
+	kvs     []KV
+	history map[string][]Version
+	index   *memIndex
+}
+
+// search returns the index of the first kv whose key is not less than key
+func (m *memSpace) search(key string) int {
+	return sort.Search(len(m.kvs), func(i int) bool { return m.kvs[i].Key >= key })
+}
+
+func (m *memSpace) get(key string) *KV {
+	if i := m.search(key); i < len(m.kvs) && m.kvs[i].Key == key {
+		return &m.kvs[i]
+	}
+	return nil
+}
+
+func (m *memSpace) put(kv KV) {
+	kv.TTL = 0
+	i := m.search(kv.Key)
+	if i < len(m.kvs) && m.kvs[i].Key == kv.Key {
+		m.kvs[i] = kv
+		return
+	}
+	m.kvs = append(m.kvs, KV{})
+	copy(m.kvs[i+1:], m.kvs[i:])
+	m.kvs[i] = kv
+}
+
+func (m *memSpace) del(key string) {
+	if i := m.search(key); i < len(m.kvs) && m.kvs[i].Key == key {
+		m.kvs = append(m.kvs[:i], m.kvs[i+1:]...)
+	}
+}
+
+// record appends the version to the history of its key, keeps max versions at most
+func (m *memSpace) record(v Version, max int) {
+	if m.history == nil {
+		m.history = map[string][]Version{}
+	}
+	m.history[v.Key] = appendVersion(m.history[v.Key], v, max)
+}
+
+// setHistory replaces the history of the key, keeps max versions at most
+func (m *memSpace) setHistory(key string, versions []Version, max int) {
+	if m.history == nil {
+		m.history = map[string][]Version{}
+	}
+	if len(versions) > max {
+		versions = versions[len(versions)-max:]
+	}
+	m.history[key] = versions
+}
+
+// snapshot returns a copy of the space which shares the kvs and versions with it,
+// since they are never modified in place
+func (m *memSpace) snapshot() *memSpace {
+	s := &memSpace{kvs: append([]KV{}, m.kvs...)}
+	if len(m.history) != 0 {
+		s.history = make(map[string][]Version, len(m.history))
+		for k, v := range m.history {
+			s.history[k] = v
+		}
+	}
+	return s
+}
+
+// histories returns the history of all keys in order
+func (m *memSpace) histories(ns string) []memHistory {
+	hs := make([]memHistory, 0, len(m.history))
+	for k, v := range m.history {
+		hs = append(hs, memHistory{Namespace: ns, Key: k, Versions: v})
+	}
+	sort.Slice(hs, func(i, j int) bool { return hs[i].Key < hs[j].Key })
+	return hs
+}
+
+// memTx a write transaction, the changes are visible to itself before applied to the store
+type memTx struct {
+	store   *memStore
+	now     time.Time
+	change  memChange
+	pending map[string]map[string]*KV
+}
+
+// exists returns true if the namespace exists
+func (tx *memTx) exists(ns string) bool {
+	for _, name := range tx.change.Created {
+		if name == ns {
+			return true
+		}
+	}
+	return tx.store.spaces[ns] != nil
+}
+
+// get returns the kv stored or set in the transaction, the expired kv is returned as well
+func (tx *memTx) get(ns, key string) *KV {
+	if kv, ok := tx.pending[ns][key]; ok {
+		return kv
+	}
+	if space := tx.store.spaces[ns]; space != nil {
+		return space.get(key)
+	}
+	return nil
+}
+
+// revision returns the revision of the key, 0 if not exists or expired
+func (tx *memTx) revision(ns, key string) uint64 {
+	kv := tx.get(ns, key)
+	if kv == nil || expired(kv.Expire, tx.now) {
+		return 0
+	}
+	return kv.Revision
+}
+
+// nextRevision allocates the revision of the transaction once
+func (tx *memTx) nextRevision() uint64 {
+	if tx.change.Revision == 0 {
+		tx.change.Revision = tx.store.rev + 1
+	}
+	return tx.change.Revision
+}
+
+func (tx *memTx) stage(ns, key string, kv *KV) {
+	if tx.pending == nil {
+		tx.pending = map[string]map[string]*KV{}
+	}
+	if tx.pending[ns] == nil {
+		tx.pending[ns] = map[string]*KV{}
+	}
+	tx.pending[ns][key] = kv
+}
+
+// set assigns the revision of the transaction to kv and sets it, the time of the write is stamped unless keep is true
+func (tx *memTx) set(ns string, kv *KV, keep bool) error {
+	if kv.Key == "" {
+		return errKeyRequired
+	}
+	kv.Revision = tx.nextRevision()
+	kv.expiry(tx.now)
+	if !keep {
+		var created int64
+		if old := tx.get(ns, kv.Key); old != nil && !expired(old.Expire, tx.now) {
+			created = old.Created
+		}
+		kv.stamp(tx.now, created)
+	}
+	v := kv.clone()
+	tx.stage(ns, v.Key, v)
+	tx.change.Events = append(tx.change.Events, Event{Type: EventPut, Namespace: ns, KV: *v})
+	return nil
+}
+
+// del deletes the key with the revision of the transaction if it exists
+func (tx *memTx) del(ns, key string) {
+	if tx.get(ns, key) == nil {
+		return
+	}
+	tx.stage(ns, key, nil)
+	tx.change.Events = append(tx.change.Events, Event{Type: EventDel, Namespace: ns, KV: KV{Key: key, Revision: tx.nextRevision()}})
+}
+
+// Conf returns the configuration
+func (d *memDb) Conf() Conf {
+	return d.conf
+}
+
+// Namespace returns the namespace of memory DB
+func (d *memDb) Namespace(name string) (DB, error) {
+	if name != "" {
+		if err := checkNamespace(name); err != nil {
+			return nil, err
+		}
+	}
+	err := d.store.read(name, func(*memSpace) error { return nil })
+	if err != nil {
+		return nil, err
+	}
+	nd := *d
+	nd.ns = name
+	return &nd, nil
+}
+
+// Namespaces lists all namespaces created in memory DB
+func (d *memDb) Namespaces() ([]string, error) {
+	d.store.RLock()
+	defer d.store.RUnlock()
+	if d.store.spaces == nil {
+		return nil, errMemClosed
+	}
+	var names []string
+	for name := range d.store.spaces {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// CreateNamespace creates the namespace in memory DB if not exists
+func (d *memDb) CreateNamespace(name string) error {
+	if err := checkNamespace(name); err != nil {
+		return err
+	}
+	return d.store.write(func(tx *memTx) error {
+		if !tx.exists(name) {
+			tx.change.Created = append(tx.change.Created, name)
+		}
+		return nil
+	})
+}
+
+// DropNamespace drops the namespace with all its kvs from memory DB
+func (d *memDb) DropNamespace(name string) error {
+	if err := checkNamespace(name); err != nil {
+		return err
+	}
+	return d.store.write(func(tx *memTx) error {
+		space := tx.store.spaces[name]
+		if space == nil {
+			return ErrNamespaceNotFound
+		}
+		for _, kv := range space.kvs {
+			tx.del(name, kv.Key)
+		}
+		tx.change.Dropped = append(tx.change.Dropped, name)
+		return nil
+	})
+}
+
+// Set put key and value into memory DB
+func (d *memDb) Set(kv *KV) error {
+	return d.store.write(func(tx *memTx) error {
+		if !tx.exists(d.ns) {
+			return ErrNamespaceNotFound
+		}
+		return tx.set(d.ns, kv, false)
+	})
+}
+
+// CompareAndSet put key and value into memory DB if the revision matches
+func (d *memDb) CompareAndSet(kv *KV, rev uint64) error {
+	return d.store.write(func(tx *memTx) error {
+		if !tx.exists(d.ns) {
+			return ErrNamespaceNotFound
+		}
+		if tx.revision(d.ns, kv.Key) != rev {
+			return ErrRevisionMismatch
+		}
+		return tx.set(d.ns, kv, false)
+	})
+}
+
+// Get gets value by key from memory DB
+func (d *memDb) Get(key string) (kv *KV, err error) {
+	err = d.store.read(d.ns, func(space *memSpace) error {
+		kv = &KV{Key: key}
+		if v := space.get(key); v != nil && !expired(v.Expire, time.Now()) {
+			kv = v.clone()
+		}
+		return nil
+	})
+	return
+}
+
+// Del deletes key and value from memory DB
+func (d *memDb) Del(key string) error {
+	return d.store.write(func(tx *memTx) error {
+		if !tx.exists(d.ns) {
+			return ErrNamespaceNotFound
+		}
+		tx.del(d.ns, key)
+		return nil
+	})
+}
+
+// CompareAndDel deletes key and value from memory DB if the revision matches
+func (d *memDb) CompareAndDel(key string, rev uint64) error {
+	return d.store.write(func(tx *memTx) error {
+		if !tx.exists(d.ns) {
+			return ErrNamespaceNotFound
+		}
+		if tx.revision(d.ns, key) != rev {
+			return ErrRevisionMismatch
+		}
+		tx.del(d.ns, key)
+		return nil
+	})
+}
+
+// Update sets the kv of the key changed by fn in memory DB
+func (d *memDb) Update(key string, fn func(kv *KV) error) error {
+	return d.store.write(func(tx *memTx) error {
+		if !tx.exists(d.ns) {
+			return ErrNamespaceNotFound
+		}
+		kv := &KV{Key: key}
+		if v := tx.get(d.ns, key); v != nil && !expired(v.Expire, tx.now) {
+			kv = v.clone()
+		}
+		if err := fn(kv); err != nil {
+			return err
+		}
+		kv.Key = key
+		return tx.set(d.ns, kv, false)
+	})
+}
+
+// Increment adds delta to the counter of the key in memory DB
+func (d *memDb) Increment(key string, delta int64, bounds *Bounds) (int64, error) {
+	return increment(d, key, delta, bounds)
+}
+
+// List list kvs with the prefix from memory DB
+func (d *memDb) List(prefix string) ([]KV, error) {
+	kvs, _, err := d.ListRange(&ListOptions{Prefix: prefix})
+	return kvs, err
+}
+
+// ListRange list kvs in the range from memory DB
+func (d *memDb) ListRange(opts *ListOptions) (kvs []KV, next string, err error) {
+	err = d.store.read(d.ns, func(space *memSpace) error {
+		lower, upper := opts.bounds()
+		begin, end := space.search(string(lower)), len(space.kvs)
+		if upper != nil {
+			end = space.search(string(upper))
+		}
+		now := time.Now()
+		for n := begin; n < end; n++ {
+			i := n
+			if opts.Reverse {
+				i = end - 1 - (n - begin)
+			}
+			kv := &space.kvs[i]
+			if !opts.Expired && expired(kv.Expire, now) {
+				continue
+			}
+			if opts.KeysOnly {
+				v := *kv
+				v.Value = nil
+				kv = &v
+			}
+			if opts.Filter != nil && !opts.Filter(kv) {
+				continue
+			}
+			if opts.Limit > 0 && len(kvs) == opts.Limit {
+				next = kv.Key
+				break
+			}
+			kvs = append(kvs, *kv.clone())
+		}
+		return nil
+	})
+	return
+}
+
+// Stats counts the kvs with the prefix in memory DB
+func (d *memDb) Stats(prefix string) (stats *Stats, err error) {
+	err = d.store.read(d.ns, func(space *memSpace) error {
+		stats = new(Stats)
+		now := time.Now()
+		for i := space.search(prefix); i < len(space.kvs) && strings.HasPrefix(space.kvs[i].Key, prefix); i++ {
+			kv := &space.kvs[i]
+			if expired(kv.Expire, now) {
+				continue
+			}
+			stats.Keys++
+			stats.KeyBytes += int64(len(kv.Key))
+			stats.ValueBytes += int64(len(kv.Value))
+		}
+		return nil
+	})
+	return
+}
+
+// Query looks up the kvs by the index in memory DB
+func (d *memDb) Query(q *IndexQuery) (kvs []KV, err error) {
+	lower, upper, err := d.store.index.bounds(q)
+	if err != nil {
+		return nil, err
+	}
+	err = d.store.read(d.ns, func(space *memSpace) error {
+		if space.index == nil {
+			return nil
+		}
+		now := time.Now()
+		for _, key := range space.index.lookup(q.Index, lower, upper) {
+			kv := space.get(key)
+			if kv == nil || expired(kv.Expire, now) {
+				continue
+			}
+			kvs = append(kvs, *kv.clone())
+			if q.Limit > 0 && len(kvs) == q.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// DelExpired deletes all expired kvs of all namespaces from memory DB
+func (d *memDb) DelExpired() (n int, err error) {
+	err = d.store.write(func(tx *memTx) error {
+		for ns, space := range tx.store.spaces {
+			for i := range space.kvs {
+				if expired(space.kvs[i].Expire, tx.now) {
+					tx.del(ns, space.kvs[i].Key)
+				}
+			}
+		}
+		n = len(tx.change.Events)
+		return nil
+	})
+	return
+}
+
+// DelPrefix deletes all kvs with the prefix from memory DB at once
+func (d *memDb) DelPrefix(prefix string) (n int, err error) {
+	err = d.store.write(func(tx *memTx) error {
+		if !tx.exists(d.ns) {
+			return ErrNamespaceNotFound
+		}
+		if space := tx.store.spaces[d.ns]; space != nil {
+			for i := space.search(prefix); i < len(space.kvs) && strings.HasPrefix(space.kvs[i].Key, prefix); i++ {
+				tx.del(d.ns, space.kvs[i].Key)
+			}
+		}
+		n = len(tx.change.Events)
+		return nil
+	})
+	return
+}
+
+// Batch applies all operations into memory DB at once
+func (d *memDb) Batch(ops []Op) error {
+	// an empty batch changes nothing and takes no revision
+	if len(ops) == 0 {
+		return nil
+	}
+	return d.store.write(func(tx *memTx) error {
+		if !tx.exists(d.ns) {
+			return ErrNamespaceNotFound
+		}
+		// all operations in one batch share the same revision
+		tx.nextRevision()
+		for i := range ops {
+			op := &ops[i]
+			switch op.Type {
+			case OpSet:
+				if err := tx.set(d.ns, &op.KV, op.KeepTime); err != nil {
+					return err
+				}
+			case OpDel:
+				tx.del(d.ns, op.Key)
+			default:
+				return errUnknownOp
+			}
+		}
+		return nil
+	})
+}
+
+// History lists the versions of the key kept in memory DB
+func (d *memDb) History(key string) (versions []Version, err error) {
+	err = d.store.read(d.ns, func(space *memSpace) error {
+		h := space.history[key]
+		versions = make([]Version, len(h))
+		for i := range h {
+			v := h[len(h)-1-i]
+			v.Value, v.Labels = copyBytes(v.Value), copyLabels(v.Labels)
+			versions[i] = v
+		}
+		return nil
+	})
+	return
+}
+
+// RewriteHistory rewrites the versions kept in memory DB changed by fn
+func (d *memDb) RewriteHistory(fn func(v *Version) (bool, error)) (n int, err error) {
+	err = d.store.write(func(tx *memTx) error {
+		space := tx.store.spaces[d.ns]
+		if space == nil {
+			return ErrNamespaceNotFound
+		}
+		count := 0
+		for _, h := range space.histories(d.ns) {
+			// the versions are never modified in place, since they are shared by snapshots
+			versions := make([]Version, len(h.Versions))
+			changed := false
+			for i := range h.Versions {
+				v := h.Versions[i]
+				v.Value, v.Labels = copyBytes(v.Value), copyLabels(v.Labels)
+				ok, err := fn(&v)
+				if err != nil {
+					return err
+				}
+				if ok {
+					changed = true
+					count++
+				}
+				versions[i] = v
+			}
+			if changed {
+				h.Versions = versions
+				tx.change.History = append(tx.change.History, h)
+			}
+		}
+		n = count
+		return nil
+	})
+	return
+}
+
+// Rewrite rewrites the kvs in memory DB changed by fn in place
+func (d *memDb) Rewrite(fn func(kv *KV) (bool, error)) (n int, err error) {
+	err = d.store.write(func(tx *memTx) error {
+		space := tx.store.spaces[d.ns]
+		if space == nil {
+			return ErrNamespaceNotFound
+		}
+		for i := range space.kvs {
+			// the kvs are never modified in place, since they are shared by snapshots
+			kv := *space.kvs[i].clone()
+			ok, err := fn(&kv)
+			if err != nil {
+				return err
+			}
+			if ok {
+				tx.change.Rewritten = append(tx.change.Rewritten, Event{Type: EventPut, Namespace: d.ns, KV: kv})
+			}
+		}
+		n = len(tx.change.Rewritten)
+		return nil
+	})
+	return
+}
+
+// Watch watches the changes of the key or the keys with the prefix in the namespace
+func (d *memDb) Watch(key string, prefix bool, rev uint64) (*Watcher, error) {
+	return d.store.broker.watch(d.ns, key, prefix, rev)
+}
+
+// memSnapshot the snapshot of memory DB, the kvs are keyed by namespace
+type memSnapshot struct {
+	Revision   uint64          `json:"rev"`
+	Namespaces map[string][]KV `json:"namespaces"`
+	History    []memHistory    `json:"history,omitempty"`
+}
+
+// Backup writes a snapshot of memory DB with all namespaces to w in JSON
+func (d *memDb) Backup(w io.Writer) (int64, error) {
+	snap := memSnapshot{Namespaces: map[string][]KV{}}
+	d.store.RLock()
+	if d.store.spaces == nil {
+		d.store.RUnlock()
+		return 0, errMemClosed
+	}
+	snap.Revision = d.store.rev
+	for name, space := range d.store.spaces {
+		// the values are never modified in place, so it is safe to share them
+		snap.Namespaces[name] = append([]KV{}, space.kvs...)
+		snap.History = append(snap.History, space.histories(name)...)
+	}
+	d.store.RUnlock()
+
+	cw := &countWriter{w: w}
+	err := json.NewEncoder(cw).Encode(&snap)
+	return cw.n, err
+}
+
+// Restore replaces all namespaces of memory DB with the snapshot made by Backup,
+// all watchers are closed with ErrCompacted
+func (d *memDb) Restore(r io.Reader) error {
+	spaces, rev, err := readMemSnapshot(r, d.store.history)
+	if err != nil {
+		return err
+	}
+	d.store.Lock()
+	defer d.store.Unlock()
+	if d.store.spaces == nil {
+		return errMemClosed
+	}
+	d.store.reset(spaces, rev)
+	return nil
+}
+
+// readMemSnapshot reads and checks the snapshot of memory DB, the last history versions of each key are kept
+func readMemSnapshot(r io.Reader, history int) (map[string]*memSpace, uint64, error) {
+	var snap memSnapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return nil, 0, err
+	}
+	spaces := map[string]*memSpace{"": new(memSpace)}
+	for name, kvs := range snap.Namespaces {
+		if name != "" {
+			if err := checkNamespace(name); err != nil {
+				return nil, 0, err
+			}
+		}
+		space := &memSpace{kvs: kvs}
+		sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+		for i := range kvs {
+			if kvs[i].Key == "" || (i > 0 && kvs[i].Key == kvs[i-1].Key) {
+				return nil, 0, errors.New("invalid snapshot: empty or duplicate key")
+			}
+		}
+		spaces[name] = space
+	}
+	for _, h := range snap.History {
+		space := spaces[h.Namespace]
+		if space == nil || h.Key == "" {
+			return nil, 0, errors.New("invalid snapshot: history of unknown namespace or empty key")
+		}
+		if history > 0 {
+			space.setHistory(h.Key, h.Versions, history)
+		}
+	}
+	return spaces, snap.Revision, nil
+}
+
+// Close closes all watchers and drops all kvs of memory DB
+func (d *memDb) Close() error {
+	d.store.Lock()
+	defer d.store.Unlock()
+	d.store.broker.close()
+	d.store.spaces = nil
+	return nil
+}
+
+// clone returns a copy of kv which shares nothing with it
+func (kv *KV) clone() *KV {
+	v := *kv
+	v.Value = copyBytes(kv.Value)
+	v.Labels = copyLabels(kv.Labels)
+	return &v
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if len(labels) == 0 {
+		return nil
+	}
+	c := make(map[string]string, len(labels))
+	for k, v := range labels {
+		c[k] = v
+	}
+	return c
+}
+
+func copyBytes(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
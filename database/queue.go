@@ -0,0 +1,247 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the labels of the kvs of messages
+const (
+	// queueVisibleLabel the time in unix nanoseconds since when the message can be popped again
+	queueVisibleLabel = "visible"
+	// queueDeliveriesLabel the count of times the message has been popped
+	queueDeliveriesLabel = "deliveries"
+)
+
+// errors of queues
+var (
+	// ErrQueueInvalid returned if the name of the queue is invalid
+	ErrQueueInvalid = errors.New("queue name must be 1-64 letters, digits, '_', '-' or '.' and start with a letter or digit")
+	// ErrReceiptInvalid returned if the message acknowledged is not found, or it has been popped again
+	// after its visibility timeout, so the receipt is stale
+	ErrReceiptInvalid = errors.New("message not found or receipt invalid")
+)
+
+// Message the message of a queue, Seq orders the messages pushed. Receipt is the revision of the message
+// when it was popped, which is required to acknowledge it, and Deliveries counts the times it has been popped
+type Message struct {
+	Seq        uint64 `json:"seq"`
+	Value      []byte `json:"value,omitempty"`
+	Receipt    uint64 `json:"receipt,omitempty"`
+	Deliveries int    `json:"deliveries,omitempty"`
+}
+
+// Queue a durable FIFO queue stored as the kvs with the prefix <namespace>/<name>/ in the namespace reserved
+// for queues, so that it is persisted by the driver with the values encrypted as configured, but hidden from
+// the kvs of users and limited by the global quota only. The messages are kept with ordered sequence keys until acknowledged.
+// A message popped is invisible until its visibility timeout elapses, then it reappears at its position
+// if it is not acknowledged, e.g. the consumer crashed
+type Queue struct {
+	db     DB
+	name   string
+	prefix string
+}
+
+// NewQueue returns the queue of the name in the namespace, "" is the default one, the db can be any namespace
+// of the database. Nothing is written until the first push, which creates the queue with the namespace reserved
+// for queues if not exists, so that the queues can be read through the DB guarded by the readonly decorator
+func NewQueue(db DB, namespace, name string) (*Queue, error) {
+	if !namespaceRegexp.MatchString(name) {
+		return nil, ErrQueueInvalid
+	}
+	return &Queue{db: db, name: name, prefix: namespace + "/" + name + "/"}, nil
+}
+
+// DropQueues deletes all queues of the namespace, e.g. after the namespace is dropped, returns the count of kvs deleted
+func DropQueues(db DB, namespace string) (int, error) {
+	qdb, err := db.Namespace(queueNamespace)
+	if err == ErrNamespaceNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return qdb.DelPrefix(namespace + "/")
+}
+
+// Name returns the name of the queue
+func (q *Queue) Name() string {
+	return q.name
+}
+
+// space returns the namespace reserved for queues, which is created if not exists and create is true,
+// otherwise nil is returned if it does not exist
+func (q *Queue) space(create bool) (DB, error) {
+	qdb, err := q.db.Namespace(queueNamespace)
+	if err != ErrNamespaceNotFound {
+		return qdb, err
+	}
+	if !create {
+		return nil, nil
+	}
+	if err = q.db.CreateNamespace(queueNamespace); err != nil {
+		return nil, err
+	}
+	return q.db.Namespace(queueNamespace)
+}
+
+// seqKey the key of the counter of sequences
+func (q *Queue) seqKey() string {
+	return q.prefix + "seq"
+}
+
+// messagePrefix the prefix of the keys of messages
+func (q *Queue) messagePrefix() string {
+	return q.prefix + "m/"
+}
+
+// messageKey the key of the message, the sequence is padded so that the keys are ordered by sequences
+func (q *Queue) messageKey(seq uint64) string {
+	return fmt.Sprintf("%s%020d", q.messagePrefix(), seq)
+}
+
+// queuePushes serializes the pushes to all queues, so that the sequences are written in the order allocated
+var queuePushes sync.Mutex
+
+// Push appends the value to the queue and returns the message with its sequence. The sequence is allocated
+// and the message is written in one batch, so that the messages are visible in order without any gap
+func (q *Queue) Push(value []byte) (*Message, error) {
+	queuePushes.Lock()
+	defer queuePushes.Unlock()
+	qdb, err := q.space(true)
+	if err != nil {
+		return nil, err
+	}
+	kv, err := qdb.Get(q.seqKey())
+	if err != nil {
+		return nil, err
+	}
+	var seq uint64
+	if kv.Revision != 0 {
+		if seq, err = strconv.ParseUint(string(kv.Value), 10, 64); err != nil {
+			return nil, fmt.Errorf("sequence (%s) invalid", kv.Value)
+		}
+	}
+	seq++
+	err = qdb.Batch([]Op{
+		{Type: OpSet, KV: KV{Key: q.seqKey(), Value: []byte(strconv.FormatUint(seq, 10))}},
+		{Type: OpSet, KV: KV{Key: q.messageKey(seq), Value: value}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Seq: seq, Value: value}, nil
+}
+
+// Peek returns the first message visible without popping it, nil if there is none
+func (q *Queue) Peek() (*Message, error) {
+	qdb, err := q.space(false)
+	if err != nil || qdb == nil {
+		return nil, err
+	}
+	kv, err := q.head(qdb, time.Now())
+	if err != nil || kv == nil {
+		return nil, err
+	}
+	return q.message(kv)
+}
+
+// Pop pops the first message visible, which is invisible for the timeout until it is acknowledged by Ack,
+// otherwise it reappears. The message is deleted once popped if timeout is 0. Nil is returned if there is none
+func (q *Queue) Pop(timeout time.Duration) (*Message, error) {
+	qdb, err := q.space(false)
+	if err != nil || qdb == nil {
+		return nil, err
+	}
+	for {
+		now := time.Now()
+		kv, err := q.head(qdb, now)
+		if err != nil || kv == nil {
+			return nil, err
+		}
+		m, err := q.message(kv)
+		if err != nil {
+			return nil, err
+		}
+		m.Deliveries++
+		if timeout <= 0 {
+			err = qdb.CompareAndDel(kv.Key, kv.Revision)
+		} else {
+			rev := kv.Revision
+			kv.Labels = map[string]string{
+				queueVisibleLabel:    strconv.FormatInt(now.Add(timeout).UnixNano(), 10),
+				queueDeliveriesLabel: strconv.Itoa(m.Deliveries),
+			}
+			if err = qdb.CompareAndSet(kv, rev); err == nil {
+				m.Receipt = kv.Revision
+			}
+		}
+		// the message is popped by another consumer meanwhile, tries the next one
+		if err == ErrRevisionMismatch {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+}
+
+// Ack acknowledges the message popped with the receipt, and deletes it from the queue
+func (q *Queue) Ack(seq, receipt uint64) error {
+	qdb, err := q.space(false)
+	if err != nil {
+		return err
+	}
+	if receipt == 0 || qdb == nil {
+		return ErrReceiptInvalid
+	}
+	err = qdb.CompareAndDel(q.messageKey(seq), receipt)
+	if err == ErrRevisionMismatch {
+		return ErrReceiptInvalid
+	}
+	return err
+}
+
+// Len returns the count of messages not acknowledged, including the ones popped and invisible
+func (q *Queue) Len() (int64, error) {
+	qdb, err := q.space(false)
+	if err != nil || qdb == nil {
+		return 0, err
+	}
+	stats, err := qdb.Stats(q.messagePrefix())
+	if err != nil {
+		return 0, err
+	}
+	return stats.Keys, nil
+}
+
+// head returns the kv of the first message visible at now, nil if there is none
+func (q *Queue) head(qdb DB, now time.Time) (*KV, error) {
+	kvs, _, err := qdb.ListRange(&ListOptions{
+		Prefix: q.messagePrefix(),
+		Limit:  1,
+		Filter: func(kv *KV) bool {
+			visible, _ := strconv.ParseInt(kv.Labels[queueVisibleLabel], 10, 64)
+			return visible <= now.UnixNano()
+		},
+	})
+	if err != nil || len(kvs) == 0 {
+		return nil, err
+	}
+	return &kvs[0], nil
+}
+
+// message decodes the message from its kv
+func (q *Queue) message(kv *KV) (*Message, error) {
+	seq, err := strconv.ParseUint(strings.TrimPrefix(kv.Key, q.messagePrefix()), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("message key (%s) invalid", kv.Key)
+	}
+	deliveries, _ := strconv.Atoi(kv.Labels[queueDeliveriesLabel])
+	return &Message{Seq: seq, Value: kv.Value, Deliveries: deliveries}, nil
+}
@@ -0,0 +1,534 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// ErrQuotaExceeded returned if a write exceeds the limits of Conf.Quota or Conf.Quotas,
+// the error returned wraps it with the limit exceeded
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota the limits of kvs, 0 means unlimited. Conf.Quota limits the kvs of all namespaces,
+// Conf.Quotas limit the kvs with their Prefix in each namespace. MaxKeyLen and MaxValueSize
+// limit each kv written, MaxKeys and MaxBytes limit the totals, which are counted in the sizes of
+// keys and values as written before compressed or encrypted. The totals are scanned once and then kept
+// up to date by the writes, the kvs expired are counted until they are deleted by DelExpired
+type Quota struct {
+	Prefix       string `yaml:"prefix" json:"prefix,omitempty"`
+	MaxKeyLen    int    `yaml:"maxKeyLen" json:"maxKeyLen,omitempty"`
+	MaxValueSize int    `yaml:"maxValueSize" json:"maxValueSize,omitempty"`
+	MaxKeys      int64  `yaml:"maxKeys" json:"maxKeys,omitempty"`
+	MaxBytes     int64  `yaml:"maxBytes" json:"maxBytes,omitempty"`
+}
+
+// QuotaUsage the quota with the current usage, Global is true for Conf.Quota.
+// Usage counts the sizes of keys and values as written, unlike Stats which counts them as stored,
+// the expired kvs are counted until deleted by the reaper
+type QuotaUsage struct {
+	Quota
+	Global bool  `json:"global,omitempty"`
+	Usage  Stats `json:"usage"`
+}
+
+func (q *Quota) enabled() bool {
+	return q.MaxKeyLen > 0 || q.MaxValueSize > 0 || q.totals()
+}
+
+// totals returns true if the totals are limited
+func (q *Quota) totals() bool {
+	return q.MaxKeys > 0 || q.MaxBytes > 0
+}
+
+// QuotaUsageOf returns the quotas enforced on the DB with their usage in the namespace of the DB,
+// the global quota goes first, false if no quota is enforced
+func QuotaUsageOf(db DB) ([]QuotaUsage, bool, error) {
+	for {
+		if d, ok := db.(*quotaDb); ok {
+			usages, err := d.usages()
+			return usages, true, err
+		}
+		u, ok := db.(interface{ Unwrap() DB })
+		if !ok {
+			return nil, false, nil
+		}
+		db = u.Unwrap()
+	}
+}
+
+// quotas the quotas shared by all namespaces, the writes through them are serialized
+// to check and keep the totals, which are cached for each quota in each namespace.
+// The totals include the expired kvs until they are deleted physically
+type quotas struct {
+	sync.Mutex
+	root   DB
+	global *Quota
+	prefix []*Quota
+	totals map[quotaScope]*Stats
+}
+
+// quotaScope the scope of the totals of a quota, the global one is counted in all namespaces
+type quotaScope struct {
+	ns    string
+	quota *Quota
+}
+
+// quotaDb the DB rejecting the writes exceeding the quotas with ErrQuotaExceeded
+type quotaDb struct {
+	DB
+	ns string
+	q  *quotas
+}
+
+// newQuotaDB wraps the DB if any quota is configured
+func newQuotaDB(db DB, conf Conf) DB {
+	q := &quotas{root: db, totals: map[quotaScope]*Stats{}}
+	if conf.Quota.enabled() {
+		global := conf.Quota
+		q.global = &global
+	}
+	for i := range conf.Quotas {
+		if conf.Quotas[i].enabled() {
+			quota := conf.Quotas[i]
+			q.prefix = append(q.prefix, &quota)
+		}
+	}
+	if q.global == nil && len(q.prefix) == 0 {
+		return db
+	}
+	return &quotaDb{DB: db, q: q}
+}
+
+// Unwrap returns the DB wrapped
+func (d *quotaDb) Unwrap() DB {
+	return d.DB
+}
+
+// Namespace returns the namespace limited by the same quotas, the reserved ones are limited by the global one only
+func (d *quotaDb) Namespace(name string) (DB, error) {
+	ns, err := d.DB.Namespace(name)
+	if err != nil {
+		return nil, err
+	}
+	return &quotaDb{DB: ns, ns: name, q: d.q}, nil
+}
+
+// DropNamespace drops the namespace and recounts the totals
+func (d *quotaDb) DropNamespace(name string) error {
+	d.q.Lock()
+	defer d.q.Unlock()
+	defer d.q.reset()
+	return d.DB.DropNamespace(name)
+}
+
+// Set sets the kv if no quota is exceeded
+func (d *quotaDb) Set(kv *KV) error {
+	d.q.Lock()
+	defer d.q.Unlock()
+	deltas, err := d.check([]Op{{Type: OpSet, KV: *kv}}, nil)
+	if err != nil {
+		return err
+	}
+	if err = d.DB.Set(kv); err != nil {
+		return err
+	}
+	d.apply(deltas)
+	return nil
+}
+
+// Del deletes the key and reduces the totals
+func (d *quotaDb) Del(key string) error {
+	d.q.Lock()
+	defer d.q.Unlock()
+	deltas, err := d.check([]Op{{Type: OpDel, KV: KV{Key: key}}}, nil)
+	if err != nil {
+		return err
+	}
+	if err = d.DB.Del(key); err != nil {
+		return err
+	}
+	d.apply(deltas)
+	return nil
+}
+
+// CompareAndSet sets the kv if the revision matches and no quota is exceeded
+func (d *quotaDb) CompareAndSet(kv *KV, rev uint64) error {
+	d.q.Lock()
+	defer d.q.Unlock()
+	deltas, err := d.check([]Op{{Type: OpSet, KV: *kv}}, nil)
+	if err != nil {
+		return err
+	}
+	if err = d.DB.CompareAndSet(kv, rev); err != nil {
+		return err
+	}
+	d.apply(deltas)
+	return nil
+}
+
+// CompareAndDel deletes the key if the revision matches and reduces the totals
+func (d *quotaDb) CompareAndDel(key string, rev uint64) error {
+	d.q.Lock()
+	defer d.q.Unlock()
+	deltas, err := d.check([]Op{{Type: OpDel, KV: KV{Key: key}}}, nil)
+	if err != nil {
+		return err
+	}
+	if err = d.DB.CompareAndDel(key, rev); err != nil {
+		return err
+	}
+	d.apply(deltas)
+	return nil
+}
+
+// Batch applies the operations if no quota is exceeded after all of them
+func (d *quotaDb) Batch(ops []Op) error {
+	d.q.Lock()
+	defer d.q.Unlock()
+	deltas, err := d.check(ops, nil)
+	if err != nil {
+		return err
+	}
+	if err = d.DB.Batch(ops); err != nil {
+		return err
+	}
+	d.apply(deltas)
+	return nil
+}
+
+// DelPrefix deletes the kvs with the prefix and recounts the totals
+func (d *quotaDb) DelPrefix(prefix string) (int, error) {
+	d.q.Lock()
+	defer d.q.Unlock()
+	n, err := d.DB.DelPrefix(prefix)
+	if n > 0 {
+		d.q.reset()
+	}
+	return n, err
+}
+
+// DelExpired deletes the expired kvs and recounts the totals, which count them until deleted
+func (d *quotaDb) DelExpired() (int, error) {
+	d.q.Lock()
+	defer d.q.Unlock()
+	n, err := d.DB.DelExpired()
+	if n > 0 {
+		d.q.reset()
+	}
+	return n, err
+}
+
+// Rewrite rewrites the kvs changed by fn and recounts the totals, which are not limited
+// since the values are rewritten as they are
+func (d *quotaDb) Rewrite(fn func(kv *KV) (bool, error)) (int, error) {
+	d.q.Lock()
+	defer d.q.Unlock()
+	n, err := d.DB.Rewrite(fn)
+	if n > 0 {
+		d.q.reset()
+	}
+	return n, err
+}
+
+// Restore restores the snapshot and recounts the totals
+func (d *quotaDb) Restore(r io.Reader) error {
+	d.q.Lock()
+	defer d.q.Unlock()
+	defer d.q.reset()
+	return d.DB.Restore(r)
+}
+
+// Update sets the kv changed by fn if no quota is exceeded. The totals and the size stored are read before
+// the transaction of the update, in which the DB cannot be read, they are stable since the writes through
+// the quotas are serialized
+func (d *quotaDb) Update(key string, fn func(kv *KV) error) error {
+	d.q.Lock()
+	defer d.q.Unlock()
+	old, totals := int64(-1), false
+	for _, quota := range d.matched(key) {
+		if !quota.totals() {
+			continue
+		}
+		if _, err := d.usage(quota); err != nil {
+			return err
+		}
+		totals = true
+	}
+	if totals {
+		var err error
+		if old, err = d.stored(key); err != nil {
+			return err
+		}
+	}
+	var deltas map[*Quota]*quotaDelta
+	err := d.DB.Update(key, func(kv *KV) error {
+		if err := fn(kv); err != nil {
+			return err
+		}
+		op := Op{Type: OpSet, KV: *kv}
+		op.Key = key
+		var err error
+		deltas, err = d.check([]Op{op}, map[string]int64{key: old})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	d.apply(deltas)
+	return nil
+}
+
+// Increment adds delta to the counter of the key if no quota is exceeded
+func (d *quotaDb) Increment(key string, delta int64, bounds *Bounds) (int64, error) {
+	return increment(d, key, delta, bounds)
+}
+
+// matched returns the quotas applied to the key, the global one goes first.
+// The kvs of the reserved namespaces, e.g. the messages of queues, are limited by the global quota only
+func (d *quotaDb) matched(key string) []*Quota {
+	var qs []*Quota
+	if d.q.global != nil {
+		qs = append(qs, d.q.global)
+	}
+	if ReservedNamespace(d.ns) {
+		return qs
+	}
+	for _, quota := range d.q.prefix {
+		if strings.HasPrefix(key, quota.Prefix) {
+			qs = append(qs, quota)
+		}
+	}
+	return qs
+}
+
+// check checks the kvs written by the operations against the quotas, the totals are checked
+// only if the operations increase them, so that the writes reducing the usage always succeed.
+// The sizes of the values are queried unless given, the changes of the totals are returned to apply once written
+func (d *quotaDb) check(ops []Op, sizes map[string]int64) (map[*Quota]*quotaDelta, error) {
+	deltas := map[*Quota]*quotaDelta{}
+	var order []*Quota
+	// sizes the size of the value of each key written, -1 if not exists
+	if sizes == nil {
+		sizes = map[string]int64{}
+	}
+	for i := range ops {
+		op := &ops[i]
+		qs := d.matched(op.Key)
+		if op.Type == OpSet {
+			for _, quota := range qs {
+				// the keys of the reserved namespaces are not chosen by users
+				if quota.MaxKeyLen > 0 && len(op.Key) > quota.MaxKeyLen && !ReservedNamespace(d.ns) {
+					return nil, d.q.exceeded(quota, "key length", int64(len(op.Key)), int64(quota.MaxKeyLen))
+				}
+				if quota.MaxValueSize > 0 && len(op.Value) > quota.MaxValueSize {
+					return nil, d.q.exceeded(quota, "value size", int64(len(op.Value)), int64(quota.MaxValueSize))
+				}
+			}
+		}
+		var totals []*Quota
+		for _, quota := range qs {
+			if quota.totals() {
+				totals = append(totals, quota)
+			}
+		}
+		if len(totals) == 0 {
+			continue
+		}
+		old, ok := sizes[op.Key]
+		if !ok {
+			var err error
+			if old, err = d.stored(op.Key); err != nil {
+				return nil, err
+			}
+		}
+		size := int64(-1)
+		if op.Type == OpSet {
+			size = int64(len(op.Value))
+		}
+		sizes[op.Key] = size
+		for _, quota := range totals {
+			delta, ok := deltas[quota]
+			if !ok {
+				delta = new(quotaDelta)
+				deltas[quota] = delta
+				order = append(order, quota)
+			}
+			keys := quotaKeys(size) - quotaKeys(old)
+			delta.keys += keys
+			delta.keyBytes += keys * int64(len(op.Key))
+			delta.valueBytes += quotaBytes(size) - quotaBytes(old)
+		}
+	}
+	for _, quota := range order {
+		delta := deltas[quota]
+		bytes := delta.keyBytes + delta.valueBytes
+		if (quota.MaxKeys == 0 || delta.keys <= 0) && (quota.MaxBytes == 0 || bytes <= 0) {
+			continue
+		}
+		usage, err := d.usage(quota)
+		if err != nil {
+			return nil, err
+		}
+		if n := usage.Keys + delta.keys; quota.MaxKeys > 0 && delta.keys > 0 && n > quota.MaxKeys {
+			return nil, d.q.exceeded(quota, "keys", n, quota.MaxKeys)
+		}
+		if n := usage.KeyBytes + usage.ValueBytes + bytes; quota.MaxBytes > 0 && bytes > 0 && n > quota.MaxBytes {
+			return nil, d.q.exceeded(quota, "bytes", n, quota.MaxBytes)
+		}
+	}
+	return deltas, nil
+}
+
+// stored returns the size of the value of the key as written, -1 if not exists. The expired kv not deleted yet
+// is included like the totals, so that it is not counted twice when overwritten
+func (d *quotaDb) stored(key string) (int64, error) {
+	kvs, _, err := d.DB.ListRange(&ListOptions{Start: key, End: key + "\x00", Expired: true})
+	if err != nil {
+		return 0, err
+	}
+	if len(kvs) == 0 {
+		return -1, nil
+	}
+	return int64(len(kvs[0].Value)), nil
+}
+
+// quotaDelta the changes of the totals made by a write
+type quotaDelta struct {
+	keys       int64
+	keyBytes   int64
+	valueBytes int64
+}
+
+// quotaKeys returns 1 if the value of the size exists
+func quotaKeys(size int64) int64 {
+	if size < 0 {
+		return 0
+	}
+	return 1
+}
+
+// quotaBytes returns the size of the value, 0 if not exists
+func quotaBytes(size int64) int64 {
+	if size < 0 {
+		return 0
+	}
+	return size
+}
+
+// scope returns the scope of the totals of the quota in the namespace
+func (d *quotaDb) scope(quota *Quota) quotaScope {
+	if quota == d.q.global {
+		return quotaScope{quota: quota}
+	}
+	return quotaScope{ns: d.ns, quota: quota}
+}
+
+// apply applies the changes of the totals written, the totals not counted yet are counted on use
+func (d *quotaDb) apply(deltas map[*Quota]*quotaDelta) {
+	for quota, delta := range deltas {
+		usage, ok := d.q.totals[d.scope(quota)]
+		if !ok {
+			continue
+		}
+		usage.Keys += delta.keys
+		usage.KeyBytes += delta.keyBytes
+		usage.ValueBytes += delta.valueBytes
+	}
+}
+
+// reset drops the totals cached after the kvs are deleted in bulk, they are counted again on use,
+// the quotas must be locked
+func (q *quotas) reset() {
+	q.totals = map[quotaScope]*Stats{}
+}
+
+func (q *quotas) exceeded(quota *Quota, what string, n, max int64) error {
+	if quota == q.global {
+		return fmt.Errorf("%w: %s (%d) exceeds the global limit (%d)", ErrQuotaExceeded, what, n, max)
+	}
+	return fmt.Errorf("%w: %s (%d) exceeds the limit (%d) of prefix (%s)", ErrQuotaExceeded, what, n, max, quota.Prefix)
+}
+
+// usage returns the totals of the quota cached, which are counted on the first use. The global one
+// sums up the kvs of all namespaces, the others count the kvs with their prefix in the namespace
+func (d *quotaDb) usage(quota *Quota) (*Stats, error) {
+	scope := d.scope(quota)
+	if usage, ok := d.q.totals[scope]; ok {
+		return usage, nil
+	}
+	usage := new(Stats)
+	if quota != d.q.global {
+		if err := count(d.DB, quota.Prefix, usage); err != nil {
+			return nil, err
+		}
+		d.q.totals[scope] = usage
+		return usage, nil
+	}
+	if err := count(d.q.root, "", usage); err != nil {
+		return nil, err
+	}
+	names, err := d.q.root.Namespaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		ns, err := d.q.root.Namespace(name)
+		if err == ErrNamespaceNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err = count(ns, "", usage); err != nil && err != ErrNamespaceNotFound {
+			return nil, err
+		}
+	}
+	d.q.totals[scope] = usage
+	return usage, nil
+}
+
+// countPage the count of kvs listed in a page when the totals are counted
+const countPage = 1000
+
+// count adds up the kvs with the prefix in the sizes of keys and values as written, including the expired ones
+func count(db DB, prefix string, usage *Stats) error {
+	opts := &ListOptions{Prefix: prefix, Limit: countPage, Expired: true}
+	for {
+		kvs, next, err := db.ListRange(opts)
+		if err != nil {
+			return err
+		}
+		for i := range kvs {
+			usage.Keys++
+			usage.KeyBytes += int64(len(kvs[i].Key))
+			usage.ValueBytes += int64(len(kvs[i].Value))
+		}
+		if next == "" {
+			return nil
+		}
+		opts.Cursor = next
+	}
+}
+
+// usages returns all quotas with their usage in the namespace
+func (d *quotaDb) usages() ([]QuotaUsage, error) {
+	var qs []*Quota
+	if d.q.global != nil {
+		qs = append(qs, d.q.global)
+	}
+	qs = append(qs, d.q.prefix...)
+	d.q.Lock()
+	defer d.q.Unlock()
+	usages := make([]QuotaUsage, 0, len(qs))
+	for _, quota := range qs {
+		usage, err := d.usage(quota)
+		if err != nil {
+			return nil, err
+		}
+		usages = append(usages, QuotaUsage{Quota: *quota, Global: quota == d.q.global, Usage: *usage})
+	}
+	return usages, nil
+}
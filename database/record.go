@@ -0,0 +1,138 @@
+package database
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
+
+const recordFormat byte = 1
+
+var errRecordFormat = errors.New("unsupported record format")
+
+// meta the metadata stored along with the value
+type meta struct {
+	Revision uint64 `json:"rev"`
+	Expire   int64  `json:"exp,omitempty"`
+	// Codec the codec of the value, the value is stored as is if not set
+	Codec byte `json:"codec,omitempty"`
+	// Time and Deleted are only set for the versions in history
+	Time    int64 `json:"time,omitempty"`
+	Deleted bool  `json:"del,omitempty"`
+	// the metadata of the kv
+	ContentType string            `json:"type,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Created     int64             `json:"crt,omitempty"`
+	Updated     int64             `json:"upd,omitempty"`
+}
+
+// metaOf returns the metadata of kv with the codec of its value
+func metaOf(kv *KV, codec byte) *meta {
+	return &meta{
+		Revision:    kv.Revision,
+		Expire:      kv.Expire,
+		Codec:       codec,
+		ContentType: kv.ContentType,
+		Labels:      kv.Labels,
+		Created:     kv.Created,
+		Updated:     kv.Updated,
+	}
+}
+
+// apply sets the metadata of kv
+func (m *meta) apply(kv *KV) {
+	kv.Revision = m.Revision
+	kv.Expire = m.Expire
+	kv.ContentType = m.ContentType
+	kv.Labels = m.Labels
+	kv.Created = m.Created
+	kv.Updated = m.Updated
+}
+
+// encodeKV encodes the value and metadata of kv, the value is compressed if c is not nil
+func encodeKV(kv *KV, c *compressor) ([]byte, error) {
+	codec, value := c.compress(kv.Value)
+	return encodeRecord(metaOf(kv, codec), value)
+}
+
+// encodeVersion encodes the value and metadata of the version, the value is compressed if c is not nil
+func encodeVersion(v *Version, c *compressor) ([]byte, error) {
+	codec, value := c.compress(v.Value)
+	m := metaOf(&v.KV, codec)
+	m.Time, m.Deleted = v.Time, v.Deleted
+	return encodeRecord(m, value)
+}
+
+// decodeVersion decodes the value and metadata into the version, the value is decompressed if compressed
+func decodeVersion(v *Version, data []byte) error {
+	m, value, err := decodeRecord(data)
+	if err != nil {
+		return err
+	}
+	if v.Value, err = decompress(m.Codec, value); err != nil {
+		return err
+	}
+	m.apply(&v.KV)
+	v.Time, v.Deleted = m.Time, m.Deleted
+	return nil
+}
+
+// decodeKV decodes the value and metadata into kv, the value is decompressed if compressed
+func decodeKV(kv *KV, data []byte) error {
+	m, value, err := decodeRecord(data)
+	if err != nil {
+		return err
+	}
+	if value, err = decompress(m.Codec, value); err != nil {
+		return err
+	}
+	kv.Value = value
+	m.apply(kv)
+	return nil
+}
+
+// encodeRecord encodes metadata and value as: format(1 byte) + len(meta) (uvarint) + meta (json) + value
+func encodeRecord(m *meta, value []byte) ([]byte, error) {
+	mb, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1+binary.MaxVarintLen64+len(mb)+len(value))
+	buf[0] = recordFormat
+	n := 1 + binary.PutUvarint(buf[1:], uint64(len(mb)))
+	n += copy(buf[n:], mb)
+	n += copy(buf[n:], value)
+	return buf[:n], nil
+}
+
+// decodeRecord decodes metadata and value, the returned value is copied
+func decodeRecord(data []byte) (*meta, []byte, error) {
+	m, v, err := splitRecord(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	var value []byte
+	if len(v) > 0 {
+		value = make([]byte, len(v))
+		copy(value, v)
+	}
+	return m, value, nil
+}
+
+// splitRecord decodes metadata and returns the value as is, which refers to data
+func splitRecord(data []byte) (*meta, []byte, error) {
+	if len(data) == 0 || data[0] != recordFormat {
+		return nil, nil, errRecordFormat
+	}
+	l, n := binary.Uvarint(data[1:])
+	if n <= 0 || uint64(len(data)-1-n) < l {
+		return nil, nil, errRecordFormat
+	}
+	data = data[1+n:]
+	m := new(meta)
+	err := json.Unmarshal(data[:l], m)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, data[l:], nil
+}
@@ -0,0 +1,42 @@
+package database
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// tempFile creates an empty temporary file next to the database, so that it is on the same device
+func tempFile(source string) (*os.File, error) {
+	return ioutil.TempFile(filepath.Dir(source), filepath.Base(source)+".snapshot-")
+}
+
+// saveSnapshot saves the snapshot into a temporary file and returns its path
+func saveSnapshot(source string, r io.Reader) (string, error) {
+	f, err := tempFile(source)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// countWriter counts the bytes written
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -1,44 +1,423 @@
 package database
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	// registers the sqlite3 driver of database/sql
+	_ "github.com/mattn/go-sqlite3"
 )
 
 var placeholderValue = "(?)"
 var placeholderKeyValue = "(?,?)"
 var schema = map[string][]string{
 	"sqlite3": []string{
-		`CREATE TABLE IF NOT EXISTS kv (
+		`CREATE TABLE IF NOT EXISTS sys (
+			name TEXT PRIMARY KEY,
+			value INTEGER) WITHOUT ROWID`,
+		`CREATE TABLE IF NOT EXISTS namespaces (
+			name TEXT PRIMARY KEY) WITHOUT ROWID`,
+		`CREATE TABLE IF NOT EXISTS history (
+			ns TEXT NOT NULL,
+			key TEXT NOT NULL,
+			rev INTEGER NOT NULL,
+			time INTEGER NOT NULL,
+			value BLOB,
+			expire INTEGER NOT NULL DEFAULT 0,
+			codec INTEGER NOT NULL DEFAULT 0,
+			deleted INTEGER NOT NULL DEFAULT 0,
+			created INTEGER NOT NULL DEFAULT 0,
+			updated INTEGER NOT NULL DEFAULT 0,
+			ctype TEXT NOT NULL DEFAULT '',
+			labels TEXT,
+			PRIMARY KEY(ns, key, rev)) WITHOUT ROWID`,
+		`CREATE TABLE IF NOT EXISTS index_entries (
+			ns TEXT NOT NULL,
+			name TEXT NOT NULL,
+			value BLOB NOT NULL,
+			key TEXT NOT NULL,
+			PRIMARY KEY(ns, name, value, key)) WITHOUT ROWID`,
+		`CREATE INDEX IF NOT EXISTS index_entries_key ON index_entries(ns, key)`,
+	},
+}
+
+// tableSchema the schema of the kv table of each namespace, %[1]s is the table name, %[2]s is the prefix of index names
+var tableSchema = map[string][]string{
+	"sqlite3": []string{
+		`CREATE TABLE IF NOT EXISTS "%[1]s" (
 			key TEXT PRIMARY KEY,
 			value BLOB,
-			ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP) WITHOUT ROWID`,
+			ts TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			rev INTEGER NOT NULL DEFAULT 0,
+			expire INTEGER NOT NULL DEFAULT 0,
+			codec INTEGER NOT NULL DEFAULT 0,
+			created INTEGER NOT NULL DEFAULT 0,
+			updated INTEGER NOT NULL DEFAULT 0,
+			ctype TEXT NOT NULL DEFAULT '',
+			labels TEXT) WITHOUT ROWID`,
+	},
+}
+
+// columns added after the first release, they are added to existing tables when opening
+var columns = map[string][]struct {
+	name, def string
+}{
+	"sqlite3": {
+		{"rev", "INTEGER NOT NULL DEFAULT 0"},
+		{"expire", "INTEGER NOT NULL DEFAULT 0"},
+		{"codec", "INTEGER NOT NULL DEFAULT 0"},
+		{"created", "INTEGER NOT NULL DEFAULT 0"},
+		{"updated", "INTEGER NOT NULL DEFAULT 0"},
+		{"ctype", "TEXT NOT NULL DEFAULT ''"},
+		{"labels", "TEXT"},
 	},
 }
 
+// indexes created after the columns are migrated
+var indexes = map[string][]string{
+	"sqlite3": []string{
+		`CREATE INDEX IF NOT EXISTS "%[2]s_expire" ON "%[1]s"(expire) WHERE expire>0`,
+	},
+}
+
+// the statements on the kv table, %[1]s is the table name
+const (
+	// sqlSet keeps ts, the write time of the tables of older versions, up to date on each write as well
+	sqlSet = `insert into "%[1]s"(key,value,rev,expire,codec,created,updated,ctype,labels) values (?,?,?,?,?,?,?,?,?)
+		on conflict(key) do update set value=excluded.value, ts=CURRENT_TIMESTAMP, rev=excluded.rev, expire=excluded.expire,
+		codec=excluded.codec, created=excluded.created, updated=excluded.updated, ctype=excluded.ctype, labels=excluded.labels`
+	sqlGet     = `select ` + sqlColumns + ` from "%[1]s" where key=? and (expire=0 or expire>?)`
+	sqlDel     = `delete from "%[1]s" where key=?`
+	sqlRev     = `select rev from "%[1]s" where key=? and (expire=0 or expire>?)`
+	sqlCreated = `select created from "%[1]s" where key=? and (expire=0 or expire>?)`
+	// sqlRewrite rewrites the value in place, the other columns are kept
+	sqlRewrite = `update "%[1]s" set value=?, codec=? where key=?`
+	// sqlColumns the columns of kv scanned by scanKV
+	sqlColumns = `value, rev, expire, codec, ctype, labels, created, updated`
+)
+
+// the statements on the history table
+const (
+	sqlRecord = `insert or replace into history(ns,key,rev,time,value,expire,codec,deleted,ctype,labels,created,updated) values (?,?,?,?,?,?,?,?,?,?,?,?)`
+	// sqlTrim deletes the versions of the key older than the latest ones kept
+	sqlTrim = `delete from history where ns=? and key=? and rev<=(select rev from history where ns=? and key=? order by rev desc limit 1 offset ?)`
+	// sqlTrimAll trims the history of all keys
+	sqlTrimAll = `delete from main.history where rev<=(select h.rev from main.history h where h.ns=history.ns and h.key=history.key order by h.rev desc limit 1 offset ?)`
+)
+
+// the statements on the table of index entries, the declarations of indexes built are kept in sys as text
+const (
+	sqlIndexDel = `delete from index_entries where ns=? and key=?`
+	sqlIndexPut = `insert or replace into index_entries(ns,name,value,key) values (?,?,?,?)`
+	sqlIndexes  = `select value from sys where name='indexes'`
+)
+
+// defaultTable the kv table of the default namespace, the other namespaces are stored in the tables named ns_<namespace>
+const defaultTable = "kv"
+
 func init() {
 	Factories["sqlite3"] = newSql
 }
 
-// sqldb the backend SQL DB to persist values
+// sqldb the namespace of SQL DB, all namespaces share the same SQL DB, lock and broker
 type sqldb struct {
 	*sql.DB
-	conf Conf
+	ns    string
+	table string
+	conf  Conf
+	// wmu keeps events published in the order of revision
+	wmu    *sync.Mutex
+	broker *broker
+	comp   *compressor
+	index  *indexer
 }
 
 // New creates a new sql database
 func newSql(conf Conf) (DB, error) {
+	comp, err := newCompressor(conf)
+	if err != nil {
+		return nil, err
+	}
+	index, err := newIndexer(conf)
+	if err != nil {
+		return nil, err
+	}
 	db, err := sql.Open(conf.Driver, conf.Source)
 	if err != nil {
 		return nil, err
 	}
+	// sqlite allows only one writer, serializes all transactions to avoid busy errors
+	db.SetMaxOpenConns(1)
 	for _, v := range schema[conf.Driver] {
 		if _, err = db.Exec(v); err != nil {
 			db.Close()
 			return nil, err
 		}
 	}
-	return &sqldb{DB: db, conf: conf}, nil
+	d := &sqldb{DB: db, table: defaultTable, conf: conf, wmu: new(sync.Mutex), comp: comp, index: index}
+	if err = d.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	var rev uint64
+	err = db.QueryRow("select value from sys where name='revision'").Scan(&rev)
+	if err != nil && err != sql.ErrNoRows {
+		db.Close()
+		return nil, err
+	}
+	d.broker = newBroker(conf.WatchHistory, rev)
+	return d, nil
+}
+
+// migrate creates the table of the default namespace and adds missing columns
+// to the tables created by older versions, the existing rows are set to revision 1
+func (d *sqldb) migrate() error {
+	names, err := d.Namespaces()
+	if err != nil {
+		return err
+	}
+	tables := []string{defaultTable}
+	for _, name := range names {
+		tables = append(tables, namespaceTable(name))
+	}
+	for _, table := range tables {
+		if err = d.createTable(d.DB, table); err != nil {
+			return err
+		}
+		if err = d.migrateTable(table); err != nil {
+			return err
+		}
+		if err = d.createIndexes(d.DB, table); err != nil {
+			return err
+		}
+	}
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	if err = d.reindex(tx, false); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *sqldb) migrateTable(table string) error {
+	rows, err := d.DB.Query(fmt.Sprintf(`pragma table_info("%s")`, table))
+	if err != nil {
+		return err
+	}
+	exists := map[string]bool{}
+	for rows.Next() {
+		var cid, notnull, pk int
+		var name, typ string
+		var dflt sql.NullString
+		if err = rows.Scan(&cid, &name, &typ, &notnull, &dflt, &pk); err != nil {
+			rows.Close()
+			return err
+		}
+		exists[name] = true
+	}
+	rows.Close()
+
+	for _, c := range columns[d.conf.Driver] {
+		if exists[c.name] {
+			continue
+		}
+		if _, err = d.Exec(fmt.Sprintf(`ALTER TABLE "%s" ADD COLUMN %s %s`, table, c.name, c.def)); err != nil {
+			return err
+		}
+		// the kvs written by older versions are created at ts, and updated at least since then
+		if c.name == "created" || c.name == "updated" {
+			if _, err = d.Exec(fmt.Sprintf(`update "%s" set %s=coalesce(strftime('%%s',ts)*1000000000,0)`, table, c.name)); err != nil {
+				return err
+			}
+		}
+		if c.name == "rev" {
+			if _, err = d.Exec(fmt.Sprintf(`update "%s" set rev=1`, table)); err != nil {
+				return err
+			}
+			if _, err = d.Exec("insert or ignore into sys(name,value) values ('revision',1)"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// createTable creates the kv table if not exists
+func (d *sqldb) createTable(e execer, table string) error {
+	for _, v := range tableSchema[d.conf.Driver] {
+		if _, err := e.Exec(fmt.Sprintf(v, table, table)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createIndexes creates the indexes of the kv table if not exist
+func (d *sqldb) createIndexes(e execer, table string) error {
+	for _, v := range indexes[d.conf.Driver] {
+		if _, err := e.Exec(fmt.Sprintf(v, table, table)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execer executes statements, implemented by sql.DB and sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func namespaceTable(name string) string {
+	return "ns_" + name
+}
+
+// Namespace returns the namespace of SQL DB
+func (d *sqldb) Namespace(name string) (DB, error) {
+	if name == "" {
+		return d.namespace("", defaultTable), nil
+	}
+	if err := checkNamespace(name); err != nil {
+		return nil, err
+	}
+	var n int
+	err := d.QueryRow("select count(*) from namespaces where name=?", name).Scan(&n)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, ErrNamespaceNotFound
+	}
+	return d.namespace(name, namespaceTable(name)), nil
+}
+
+func (d *sqldb) namespace(name, table string) *sqldb {
+	nd := *d
+	nd.ns = name
+	nd.table = table
+	return &nd
+}
+
+// Namespaces lists all namespaces created in SQL DB
+func (d *sqldb) Namespaces() ([]string, error) {
+	rows, err := d.DB.Query("select name from namespaces order by name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// CreateNamespace creates the namespace in SQL DB if not exists
+func (d *sqldb) CreateNamespace(name string) error {
+	if err := checkNamespace(name); err != nil {
+		return err
+	}
+	return d.write(func(tx *sql.Tx) ([]Event, error) {
+		if _, err := tx.Exec("insert or ignore into namespaces(name) values (?)", name); err != nil {
+			return nil, err
+		}
+		if err := d.createTable(tx, namespaceTable(name)); err != nil {
+			return nil, err
+		}
+		if err := d.createIndexes(tx, namespaceTable(name)); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	})
+}
+
+// DropNamespace drops the namespace with all its kvs from SQL DB
+func (d *sqldb) DropNamespace(name string) error {
+	if err := checkNamespace(name); err != nil {
+		return err
+	}
+	return d.write(func(tx *sql.Tx) ([]Event, error) {
+		res, err := tx.Exec("delete from namespaces where name=?", name)
+		if err != nil {
+			return nil, err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			if err == nil {
+				err = ErrNamespaceNotFound
+			}
+			return nil, err
+		}
+		table := namespaceTable(name)
+		keys, err := queryStrings(tx, fmt.Sprintf(`select key from "%s"`, table))
+		if err != nil {
+			return nil, err
+		}
+		if _, err = tx.Exec(fmt.Sprintf(`DROP TABLE "%s"`, table)); err != nil {
+			return nil, err
+		}
+		if _, err = tx.Exec("delete from history where ns=?", name); err != nil {
+			return nil, err
+		}
+		if _, err = tx.Exec("delete from index_entries where ns=?", name); err != nil || len(keys) == 0 {
+			return nil, err
+		}
+		rev, err := nextSQLRevision(tx)
+		if err != nil {
+			return nil, err
+		}
+		events := make([]Event, 0, len(keys))
+		for _, k := range keys {
+			events = append(events, Event{Type: EventDel, Namespace: name, KV: KV{Key: k, Revision: rev}})
+		}
+		return events, nil
+	})
+}
+
+// queryStrings returns the strings of the first column queried
+func queryStrings(tx *sql.Tx, query string, args ...interface{}) ([]string, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// tableError returns ErrNamespaceNotFound if the table of the namespace is dropped
+func (d *sqldb) tableError(err error) error {
+	if err != nil && d.ns != "" && strings.HasPrefix(err.Error(), "no such table") {
+		return ErrNamespaceNotFound
+	}
+	return err
+}
+
+// q returns the statement on the kv table of the namespace
+func (d *sqldb) q(stmt string) string {
+	return fmt.Sprintf(stmt, d.table)
 }
 
 // Conf returns the configuration
@@ -51,27 +430,39 @@ func (d *sqldb) Set(kv *KV) error {
 	if kv.Key == "" {
 		return errors.New("key required")
 	}
-	stmt, err := d.Prepare("insert into kv(key,value) values (?,?) on conflict(key) do update set value=excluded.value")
-	if err != nil {
-		return err
+	return d.write(func(tx *sql.Tx) ([]Event, error) {
+		return d.set(tx, kv)
+	})
+}
+
+// CompareAndSet put key and value into SQL DB if the revision matches
+func (d *sqldb) CompareAndSet(kv *KV, rev uint64) error {
+	if kv.Key == "" {
+		return errors.New("key required")
 	}
-	defer stmt.Close()
-	_, err = stmt.Exec(kv.Key, kv.Value)
-	return err
+	return d.write(func(tx *sql.Tx) ([]Event, error) {
+		cur, err := d.revision(tx, kv.Key)
+		if err != nil {
+			return nil, err
+		}
+		if cur != rev {
+			return nil, ErrRevisionMismatch
+		}
+		return d.set(tx, kv)
+	})
 }
 
 // Get gets value by key from SQL DB
 func (d *sqldb) Get(key string) (*KV, error) {
-	rows, err := d.Query("select value from kv where key=?", key)
+	rows, err := d.DB.Query(d.q(sqlGet), key, time.Now().Unix())
 	if err != nil {
-		return nil, err
+		return nil, d.tableError(err)
 	}
 	defer rows.Close()
 
 	kv := &KV{Key: key}
 	if rows.Next() {
-		err = rows.Scan(&kv.Value)
-		if err != nil {
+		if err = scanKV(rows, kv, false); err != nil {
 			return nil, err
 		}
 		return kv, nil
@@ -81,26 +472,817 @@ func (d *sqldb) Get(key string) (*KV, error) {
 
 // Del deletes key and value from SQL DB
 func (d *sqldb) Del(key string) error {
-	_, err := d.Exec("delete from kv where key=?", key)
-	return err
+	return d.write(func(tx *sql.Tx) ([]Event, error) {
+		return d.del(tx, key)
+	})
+}
+
+// CompareAndDel deletes key and value from SQL DB if the revision matches
+func (d *sqldb) CompareAndDel(key string, rev uint64) error {
+	return d.write(func(tx *sql.Tx) ([]Event, error) {
+		cur, err := d.revision(tx, key)
+		if err != nil {
+			return nil, err
+		}
+		if cur != rev {
+			return nil, ErrRevisionMismatch
+		}
+		return d.del(tx, key)
+	})
+}
+
+// Update sets the kv of the key changed by fn in SQL DB
+func (d *sqldb) Update(key string, fn func(kv *KV) error) error {
+	if key == "" {
+		return errors.New("key required")
+	}
+	return d.write(func(tx *sql.Tx) ([]Event, error) {
+		rows, err := tx.Query(d.q(sqlGet), key, time.Now().Unix())
+		if err != nil {
+			return nil, err
+		}
+		kv := &KV{Key: key}
+		if rows.Next() {
+			err = scanKV(rows, kv, false)
+		}
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		if err = fn(kv); err != nil {
+			return nil, err
+		}
+		kv.Key = key
+		return d.set(tx, kv)
+	})
+}
+
+// Increment adds delta to the counter of the key in SQL DB
+func (d *sqldb) Increment(key string, delta int64, bounds *Bounds) (int64, error) {
+	return increment(d, key, delta, bounds)
 }
 
 // List list kvs with the prefix
 func (d *sqldb) List(prefix string) ([]KV, error) {
-	rows, err := d.Query("select key, value from kv where key like ?", prefix+"%")
+	kvs, _, err := d.ListRange(&ListOptions{Prefix: prefix})
+	return kvs, err
+}
+
+// ListRange list kvs in the range
+func (d *sqldb) ListRange(opts *ListOptions) ([]KV, string, error) {
+	lower, upper := opts.bounds()
+	columns := sqlColumns
+	if opts.KeysOnly {
+		columns = "NULL" + strings.TrimPrefix(columns, "value")
+	}
+	query := d.q(`select key, ` + columns + ` from "%s" where key>=?`)
+	args := []interface{}{string(lower)}
+	if !opts.Expired {
+		query += " and (expire=0 or expire>?)"
+		args = append(args, time.Now().Unix())
+	}
+	if upper != nil {
+		query += " and key<?"
+		args = append(args, string(upper))
+	}
+	if opts.Reverse {
+		query += " order by key desc"
+	} else {
+		query += " order by key"
+	}
+	if opts.Limit > 0 && opts.Filter == nil {
+		// one more kv is queried as the cursor of next page
+		query += " limit ?"
+		args = append(args, opts.Limit+1)
+	}
+	rows, err := d.DB.Query(query, args...)
+	if err != nil {
+		return nil, "", d.tableError(err)
+	}
+	defer rows.Close()
+
+	var kvs []KV
+	for rows.Next() {
+		var kv KV
+		if err = scanKV(rows, &kv, true); err != nil {
+			return nil, "", err
+		}
+		if opts.Filter != nil && !opts.Filter(&kv) {
+			continue
+		}
+		kvs = append(kvs, kv)
+		if opts.Limit > 0 && len(kvs) > opts.Limit {
+			break
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", err
+	}
+	if opts.Limit > 0 && len(kvs) > opts.Limit {
+		return kvs[:opts.Limit], kvs[opts.Limit].Key, nil
+	}
+	return kvs, "", nil
+}
+
+// Stats counts the kvs with the prefix in SQL DB, the values are not queried
+func (d *sqldb) Stats(prefix string) (*Stats, error) {
+	query := d.q(`select count(*), coalesce(sum(length(cast(key as blob))),0), coalesce(sum(length(cast(value as blob))),0)
+		from "%s" where key>=? and (expire=0 or expire>?)`)
+	args := []interface{}{prefix, time.Now().Unix()}
+	if end := prefixEnd([]byte(prefix)); end != nil {
+		query += " and key<?"
+		args = append(args, string(end))
+	}
+	stats := new(Stats)
+	err := d.QueryRow(query, args...).Scan(&stats.Keys, &stats.KeyBytes, &stats.ValueBytes)
+	if err != nil {
+		return nil, d.tableError(err)
+	}
+	return stats, nil
+}
+
+// Query looks up the kvs by the index in SQL DB, the entries of the index are joined with the kvs
+func (d *sqldb) Query(q *IndexQuery) ([]KV, error) {
+	lower, upper, err := d.index.bounds(q)
 	if err != nil {
 		return nil, err
 	}
+	query := d.q(`select t.key, t.` + strings.Replace(sqlColumns, ", ", ", t.", -1) + ` from index_entries i join "%s" t on t.key=i.key
+		where i.ns=? and i.name=? and i.value>=? and (t.expire=0 or t.expire>?)`)
+	args := []interface{}{d.ns, q.Index, lower, time.Now().Unix()}
+	if upper != nil {
+		query += " and i.value<?"
+		args = append(args, upper)
+	}
+	query += " order by i.value, i.key"
+	if q.Limit > 0 {
+		query += " limit ?"
+		args = append(args, q.Limit)
+	}
+	rows, err := d.DB.Query(query, args...)
+	if err != nil {
+		return nil, d.tableError(err)
+	}
 	defer rows.Close()
 
 	var kvs []KV
 	for rows.Next() {
 		var kv KV
-		err = rows.Scan(&kv.Key, &kv.Value)
-		if err != nil {
+		if err = scanKV(rows, &kv, true); err != nil {
 			return nil, err
 		}
 		kvs = append(kvs, kv)
 	}
-	return kvs, nil
+	return kvs, rows.Err()
+}
+
+// DelExpired deletes all expired kvs of all namespaces from SQL DB in chunks of delExpiredChunk,
+// each chunk is deleted in its own transaction sharing a revision, so that readers are not blocked for long
+func (d *sqldb) DelExpired() (n int, err error) {
+	names, err := d.Namespaces()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().Unix()
+	for _, name := range append([]string{""}, names...) {
+		for {
+			deleted, err := d.delExpired(name, now)
+			n += deleted
+			if err != nil {
+				return n, err
+			}
+			if deleted < delExpiredChunk {
+				break
+			}
+		}
+	}
+	return n, nil
+}
+
+// delExpired deletes a chunk of the expired kvs of the namespace in one transaction, the namespace
+// is looked up in the transaction since it may be dropped meanwhile, returns the count deleted
+func (d *sqldb) delExpired(name string, now int64) (n int, err error) {
+	err = d.write(func(tx *sql.Tx) ([]Event, error) {
+		table := defaultTable
+		if name != "" {
+			found, err := queryStrings(tx, "select name from namespaces where name=?", name)
+			if err != nil || len(found) == 0 {
+				return nil, err
+			}
+			table = namespaceTable(name)
+		}
+		chunk := fmt.Sprintf(`select key from "%s" where expire>0 and expire<=? order by key limit ?`, table)
+		keys, err := queryStrings(tx, chunk, now, delExpiredChunk)
+		if err != nil || len(keys) == 0 {
+			return nil, err
+		}
+		if _, err = tx.Exec(fmt.Sprintf(`delete from "%s" where key in (%s)`, table, chunk), now, delExpiredChunk); err != nil {
+			return nil, err
+		}
+		rev, err := nextSQLRevision(tx)
+		if err != nil {
+			return nil, err
+		}
+		events := make([]Event, 0, len(keys))
+		for _, key := range keys {
+			events = append(events, Event{Type: EventDel, Namespace: name, KV: KV{Key: key, Revision: rev}})
+		}
+		n = len(events)
+		return events, d.derive(tx, events)
+	})
+	return
+}
+
+// DelPrefix deletes all kvs with the prefix from SQL DB in one transaction
+func (d *sqldb) DelPrefix(prefix string) (n int, err error) {
+	cond := "key>=?"
+	args := []interface{}{prefix}
+	if end := prefixEnd([]byte(prefix)); end != nil {
+		cond += " and key<?"
+		args = append(args, string(end))
+	}
+	err = d.write(func(tx *sql.Tx) ([]Event, error) {
+		keys, err := queryStrings(tx, d.q(`select key from "%s" where `+cond), args...)
+		if err != nil || len(keys) == 0 {
+			return nil, err
+		}
+		if _, err = tx.Exec(d.q(`delete from "%s" where `+cond), args...); err != nil {
+			return nil, err
+		}
+		rev, err := nextSQLRevision(tx)
+		if err != nil {
+			return nil, err
+		}
+		events := make([]Event, 0, len(keys))
+		for _, key := range keys {
+			events = append(events, Event{Type: EventDel, Namespace: d.ns, KV: KV{Key: key, Revision: rev}})
+		}
+		n = len(events)
+		return events, d.derive(tx, events)
+	})
+	return
+}
+
+// Batch applies all operations into SQL DB in one transaction
+func (d *sqldb) Batch(ops []Op) error {
+	// an empty batch changes nothing and takes no revision
+	if len(ops) == 0 {
+		return nil
+	}
+	return d.write(func(tx *sql.Tx) ([]Event, error) {
+		// all operations in one batch share the same revision
+		rev, err := nextSQLRevision(tx)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		var events []Event
+		for i := range ops {
+			op := &ops[i]
+			switch op.Type {
+			case OpSet:
+				if op.Key == "" {
+					return nil, errors.New("key required")
+				}
+				op.Revision = rev
+				op.expiry(now)
+				err = d.put(tx, &op.KV, now, op.KeepTime)
+				events = append(events, Event{Type: EventPut, Namespace: d.ns, KV: op.KV})
+			case OpDel:
+				var res sql.Result
+				res, err = tx.Exec(d.q(sqlDel), op.Key)
+				if err == nil {
+					if n, _ := res.RowsAffected(); n > 0 {
+						events = append(events, Event{Type: EventDel, Namespace: d.ns, KV: KV{Key: op.Key, Revision: rev}})
+					}
+				}
+			default:
+				err = errUnknownOp
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return events, d.derive(tx, events)
+	})
+}
+
+// History lists the versions of the key kept in SQL DB
+func (d *sqldb) History(key string) ([]Version, error) {
+	if d.ns != "" {
+		var n int
+		if err := d.QueryRow("select count(*) from namespaces where name=?", d.ns).Scan(&n); err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, ErrNamespaceNotFound
+		}
+	}
+	rows, err := d.DB.Query("select time, deleted, "+sqlColumns+" from history where ns=? and key=? order by rev desc", d.ns, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []Version
+	for rows.Next() {
+		v := Version{KV: KV{Key: key}}
+		if err = scanKV(rows, &v.KV, false, &v.Time, &v.Deleted); err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// RewriteHistory rewrites the versions kept in SQL DB changed by fn
+func (d *sqldb) RewriteHistory(fn func(v *Version) (bool, error)) (n int, err error) {
+	err = d.write(func(tx *sql.Tx) ([]Event, error) {
+		if d.ns != "" {
+			var c int
+			if err := tx.QueryRow("select count(*) from namespaces where name=?", d.ns).Scan(&c); err != nil {
+				return nil, err
+			}
+			if c == 0 {
+				return nil, ErrNamespaceNotFound
+			}
+		}
+		rows, err := tx.Query("select time, deleted, key, "+sqlColumns+" from history where ns=? order by key, rev", d.ns)
+		if err != nil {
+			return nil, err
+		}
+		var changed []Version
+		for rows.Next() {
+			var v Version
+			if err = scanKV(rows, &v.KV, true, &v.Time, &v.Deleted); err != nil {
+				break
+			}
+			var ok bool
+			if ok, err = fn(&v); err != nil {
+				break
+			}
+			if ok {
+				changed = append(changed, v)
+			}
+		}
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		for _, v := range changed {
+			labels, err := encodeLabels(v.Labels)
+			if err != nil {
+				return nil, err
+			}
+			codec, value := d.comp.compress(v.Value)
+			_, err = tx.Exec(sqlRecord, d.ns, v.Key, v.Revision, v.Time, value, v.Expire, codec, v.Deleted,
+				v.ContentType, labels, v.Created, v.Updated)
+			if err != nil {
+				return nil, err
+			}
+		}
+		n = len(changed)
+		return nil, nil
+	})
+	return
+}
+
+// Rewrite rewrites the values in SQL DB changed by fn in place, the indexes of them are rebuilt
+func (d *sqldb) Rewrite(fn func(kv *KV) (bool, error)) (n int, err error) {
+	err = d.write(func(tx *sql.Tx) ([]Event, error) {
+		rows, err := tx.Query(d.q(`select key, ` + sqlColumns + ` from "%[1]s" order by key`))
+		if err != nil {
+			return nil, err
+		}
+		var changed []KV
+		for rows.Next() {
+			var kv KV
+			if err = scanKV(rows, &kv, true); err != nil {
+				break
+			}
+			var ok bool
+			if ok, err = fn(&kv); err != nil {
+				break
+			}
+			if ok {
+				changed = append(changed, kv)
+			}
+		}
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		for i := range changed {
+			kv := &changed[i]
+			codec, value := d.comp.compress(kv.Value)
+			if _, err = tx.Exec(d.q(sqlRewrite), value, codec, kv.Key); err != nil {
+				return nil, err
+			}
+			if d.index == nil {
+				continue
+			}
+			if err = putIndexEntries(tx, d.ns, kv.Key, d.index.entries(kv)); err != nil {
+				return nil, err
+			}
+		}
+		n = len(changed)
+		return nil, nil
+	})
+	return
+}
+
+// Watch watches the changes of the key or the keys with the prefix in the namespace
+func (d *sqldb) Watch(key string, prefix bool, rev uint64) (*Watcher, error) {
+	return d.broker.watch(d.ns, key, prefix, rev)
+}
+
+// Backup writes a consistent snapshot of SQL DB with all namespaces to w,
+// the snapshot is made by VACUUM INTO a temporary file next to the database
+func (d *sqldb) Backup(w io.Writer) (int64, error) {
+	f, err := tempFile(d.conf.Source)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err = d.Exec("VACUUM INTO ?", f.Name()); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, f)
+}
+
+// Restore replaces all namespaces of SQL DB with the snapshot made by Backup in one transaction,
+// the snapshot written by older versions is migrated first, all watchers are closed with ErrCompacted
+func (d *sqldb) Restore(r io.Reader) error {
+	file, err := saveSnapshot(d.conf.Source, r)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file)
+
+	// the snapshot is checked and migrated by opening it as the database
+	conf := d.conf
+	conf.Source = file
+	s, err := newSql(conf)
+	if err != nil {
+		return err
+	}
+	names, err := s.Namespaces()
+	s.Close()
+	if err != nil {
+		return err
+	}
+
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	// the snapshot is attached to the only connection, which is held until restored
+	ctx := context.Background()
+	conn, err := d.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err = conn.ExecContext(ctx, "ATTACH DATABASE ? AS snapshot", file); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "DETACH DATABASE snapshot")
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	rev, err := d.restore(tx, names)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	d.broker.reset(rev)
+	return nil
+}
+
+// restore copies all tables from the attached snapshot, returns the revision of the snapshot
+func (d *sqldb) restore(tx *sql.Tx, names []string) (uint64, error) {
+	olds, err := queryStrings(tx, "select name from main.namespaces")
+	if err != nil {
+		return 0, err
+	}
+	for _, name := range olds {
+		if _, err = tx.Exec(fmt.Sprintf(`DROP TABLE main."%s"`, namespaceTable(name))); err != nil {
+			return 0, err
+		}
+	}
+	for _, stmt := range []string{
+		"delete from main.namespaces",
+		"delete from main.sys",
+		"delete from main.history",
+		`delete from main."kv"`,
+		"insert into main.namespaces(name) select name from snapshot.namespaces",
+		"insert into main.sys(name,value) select name, value from snapshot.sys",
+		"insert into main.history(ns,key,rev,time,value,expire,codec,deleted,ctype,labels,created,updated) select ns,key,rev,time,value,expire,codec,deleted,ctype,labels,created,updated from snapshot.history",
+	} {
+		if _, err = tx.Exec(stmt); err != nil {
+			return 0, err
+		}
+	}
+	tables := []string{defaultTable}
+	for _, name := range names {
+		table := namespaceTable(name)
+		if err = d.createTable(tx, table); err != nil {
+			return 0, err
+		}
+		if err = d.createIndexes(tx, table); err != nil {
+			return 0, err
+		}
+		tables = append(tables, table)
+	}
+	for _, table := range tables {
+		_, err = tx.Exec(fmt.Sprintf(`insert into main."%[1]s"(key,value,ts,rev,expire,codec,created,updated,ctype,labels)
+			select key,value,ts,rev,expire,codec,created,updated,ctype,labels from snapshot."%[1]s"`, table))
+		if err != nil {
+			return 0, err
+		}
+	}
+	// the versions out of Conf.History are dropped, the offset 0 drops all
+	history := d.conf.History
+	if history < 0 {
+		history = 0
+	}
+	if _, err = tx.Exec(sqlTrimAll, history); err != nil {
+		return 0, err
+	}
+	var rev uint64
+	err = tx.QueryRow("select value from main.sys where name='revision'").Scan(&rev)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	return rev, d.reindex(tx, true)
+}
+
+// Close closes all watchers and SQL DB with all namespaces
+func (d *sqldb) Close() error {
+	d.broker.close()
+	return d.DB.Close()
+}
+
+// write runs fn in a transaction, commits and publishes the events returned by fn if no error, otherwise rollbacks
+func (d *sqldb) write(fn func(tx *sql.Tx) ([]Event, error)) error {
+	d.wmu.Lock()
+	defer d.wmu.Unlock()
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	events, err := fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return d.tableError(err)
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	d.broker.publish(events...)
+	return nil
+}
+
+// set assigns the next revision to kv and puts it into table
+func (d *sqldb) set(tx *sql.Tx, kv *KV) ([]Event, error) {
+	rev, err := nextSQLRevision(tx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	kv.Revision = rev
+	kv.expiry(now)
+	if err = d.put(tx, kv, now, false); err != nil {
+		return nil, err
+	}
+	events := []Event{{Type: EventPut, Namespace: d.ns, KV: *kv}}
+	return events, d.derive(tx, events)
+}
+
+// put stamps kv with the creation time of the existing kv unless keep is true and puts it into table,
+// the value is compressed if configured
+func (d *sqldb) put(tx *sql.Tx, kv *KV, now time.Time, keep bool) error {
+	if !keep {
+		var created int64
+		err := tx.QueryRow(d.q(sqlCreated), kv.Key, now.Unix()).Scan(&created)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		kv.stamp(now, created)
+	}
+	labels, err := encodeLabels(kv.Labels)
+	if err != nil {
+		return err
+	}
+	codec, value := d.comp.compress(kv.Value)
+	_, err = tx.Exec(d.q(sqlSet), kv.Key, value, kv.Revision, kv.Expire, codec, kv.Created, kv.Updated, kv.ContentType, labels)
+	return err
+}
+
+// scanKV scans the columns of sqlColumns following the dest into kv, the value is decompressed unless it is null
+func scanKV(rows *sql.Rows, kv *KV, keyed bool, dest ...interface{}) error {
+	var codec byte
+	var labels sql.NullString
+	if keyed {
+		dest = append(dest, &kv.Key)
+	}
+	dest = append(dest, &kv.Value, &kv.Revision, &kv.Expire, &codec, &kv.ContentType, &labels, &kv.Created, &kv.Updated)
+	err := rows.Scan(dest...)
+	if err != nil {
+		return err
+	}
+	if kv.Labels, err = decodeLabels(labels); err != nil {
+		return err
+	}
+	if kv.Value != nil {
+		kv.Value, err = decompress(codec, kv.Value)
+	}
+	return err
+}
+
+// encodeLabels encodes the labels in JSON, null if empty
+func encodeLabels(labels map[string]string) (interface{}, error) {
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(labels)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// decodeLabels decodes the labels in JSON
+func decodeLabels(s sql.NullString) (map[string]string, error) {
+	if !s.Valid || s.String == "" {
+		return nil, nil
+	}
+	var labels map[string]string
+	err := json.Unmarshal([]byte(s.String), &labels)
+	return labels, err
+}
+
+// del deletes the key from table with the next revision if it exists
+func (d *sqldb) del(tx *sql.Tx, key string) ([]Event, error) {
+	res, err := tx.Exec(d.q(sqlDel), key)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return nil, err
+	}
+	rev, err := nextSQLRevision(tx)
+	if err != nil {
+		return nil, err
+	}
+	events := []Event{{Type: EventDel, Namespace: d.ns, KV: KV{Key: key, Revision: rev}}}
+	return events, d.derive(tx, events)
+}
+
+// derive records the history and maintains the indexes of the kvs changed by the events
+func (d *sqldb) derive(tx *sql.Tx, events []Event) error {
+	if err := d.record(tx, events); err != nil {
+		return err
+	}
+	if d.index == nil {
+		return nil
+	}
+	for i := range events {
+		e := &events[i]
+		var entries []indexEntry
+		if e.Type == EventPut {
+			entries = d.index.entries(&e.KV)
+		}
+		if err := putIndexEntries(tx, e.Namespace, e.Key, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putIndexEntries replaces the entries of the key in the namespace with the ones given
+func putIndexEntries(tx *sql.Tx, ns, key string, entries []indexEntry) error {
+	if _, err := tx.Exec(sqlIndexDel, ns, key); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if _, err := tx.Exec(sqlIndexPut, ns, e.Index, e.Value, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reindex rebuilds the indexes of all namespaces if their declarations are changed since the last build, or force
+func (d *sqldb) reindex(tx *sql.Tx, force bool) error {
+	var built string
+	err := tx.QueryRow(sqlIndexes).Scan(&built)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	fp := string(d.index.fingerprint())
+	if !force && built == fp {
+		return nil
+	}
+	if _, err = tx.Exec("delete from index_entries"); err != nil {
+		return err
+	}
+	if d.index != nil {
+		names, err := queryStrings(tx, "select name from namespaces")
+		if err != nil {
+			return err
+		}
+		for _, name := range append([]string{""}, names...) {
+			table := defaultTable
+			if name != "" {
+				table = namespaceTable(name)
+			}
+			// the kvs are read before written since the transaction has only one connection
+			rows, err := tx.Query(fmt.Sprintf(`select key, `+sqlColumns+` from "%s"`, table))
+			if err != nil {
+				return err
+			}
+			var kvs []KV
+			for rows.Next() {
+				var kv KV
+				if err = scanKV(rows, &kv, true); err != nil {
+					rows.Close()
+					return err
+				}
+				kvs = append(kvs, kv)
+			}
+			rows.Close()
+			if err = rows.Err(); err != nil {
+				return err
+			}
+			for i := range kvs {
+				if err = putIndexEntries(tx, name, kvs[i].Key, d.index.entries(&kvs[i])); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	_, err = tx.Exec("insert or replace into sys(name,value) values ('indexes',?)", fp)
+	return err
+}
+
+// record appends the versions changed by the events to the history of their keys,
+// and drops the oldest ones out of Conf.History
+func (d *sqldb) record(tx *sql.Tx, events []Event) error {
+	if d.conf.History <= 0 {
+		return nil
+	}
+	now := time.Now()
+	for i := range events {
+		e := &events[i]
+		v := newVersion(e, now)
+		labels, err := encodeLabels(v.Labels)
+		if err != nil {
+			return err
+		}
+		codec, value := d.comp.compress(v.Value)
+		_, err = tx.Exec(sqlRecord, e.Namespace, v.Key, v.Revision, v.Time, value, v.Expire, codec, v.Deleted,
+			v.ContentType, labels, v.Created, v.Updated)
+		if err != nil {
+			return err
+		}
+		if _, err = tx.Exec(sqlTrim, e.Namespace, v.Key, e.Namespace, v.Key, d.conf.History); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// revision returns the current revision of key, 0 if not found
+func (d *sqldb) revision(tx *sql.Tx, key string) (uint64, error) {
+	var rev uint64
+	err := tx.QueryRow(d.q(sqlRev), key, time.Now().Unix()).Scan(&rev)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return rev, err
+}
+
+func nextSQLRevision(tx *sql.Tx) (uint64, error) {
+	_, err := tx.Exec("insert into sys(name,value) values ('revision',1) on conflict(name) do update set value=value+1")
+	if err != nil {
+		return 0, err
+	}
+	var rev uint64
+	err = tx.QueryRow("select value from sys where name='revision'").Scan(&rev)
+	return rev, err
 }
@@ -0,0 +1,460 @@
+package database
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/baetyl/baetyl-go/log"
+)
+
+func init() {
+	Factories["wal"] = newWalDB
+}
+
+const (
+	// walHeaderSize the size of the record header, the length and the checksum of the payload and the checksum of them
+	walHeaderSize = 12
+	// walMaxRecord the max size of a record, the larger length is treated as a broken record
+	walMaxRecord = 1 << 30
+	// walSnapshotChunk the count of kvs in one record of the snapshot written by compaction
+	walSnapshotChunk = 1024
+	// walMinCompact the min count of entries in the log to compact
+	walMinCompact       = 1024
+	defaultCompactRatio = 0.5
+)
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+// walDb the namespace of the log-structured DB, the kvs are indexed in memory and each write
+// is appended to the log file as a record before applied, the log is replayed on startup
+// and compacted in the background once the garbage ratio crosses Conf.CompactRatio
+type walDb struct {
+	*memDb
+	log *walLog
+}
+
+// walLog the log file shared by all namespaces, the record is the length and the CRC-32C checksum
+// of the payload and the CRC-32C checksum of both in little endian, followed by the payload,
+// which is the change of a write in JSON, or the codec byte followed by the JSON compressed
+type walLog struct {
+	*walFile
+	store *memStore
+	path  string
+	ratio float64
+	// cmu serializes compaction and restoring, must be locked before the store
+	cmu        sync.Mutex
+	compacting bool
+	pending    []*memChange
+	compactc   chan struct{}
+	done       chan struct{}
+	wg         sync.WaitGroup
+	once       sync.Once
+	// err the failure of the log, all writes are rejected once failed
+	err error
+}
+
+func newWalDB(conf Conf) (DB, error) {
+	comp, err := newCompressor(conf)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(conf.Source, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	store, err := newMemStore(conf, 0)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	wf := &walFile{f: f, comp: comp}
+	if err = wf.replay(store); err != nil {
+		f.Close()
+		return nil, err
+	}
+	// the temporary file left by an interrupted compaction is useless
+	os.Remove(conf.Source + ".compact")
+
+	ratio := conf.CompactRatio
+	if ratio <= 0 || ratio >= 1 {
+		ratio = defaultCompactRatio
+	}
+	l := &walLog{
+		walFile:  wf,
+		store:    store,
+		path:     conf.Source,
+		ratio:    ratio,
+		compactc: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	store.broker = newBroker(conf.WatchHistory, store.rev)
+	store.commit = l.commit
+	d := &walDb{
+		memDb: &memDb{store: store, conf: conf},
+		log:   l,
+	}
+	l.wg.Add(1)
+	go d.compacting()
+	return d, nil
+}
+
+// Namespace returns the namespace of the log-structured DB
+func (d *walDb) Namespace(name string) (DB, error) {
+	ns, err := d.memDb.Namespace(name)
+	if err != nil {
+		return nil, err
+	}
+	return &walDb{memDb: ns.(*memDb), log: d.log}, nil
+}
+
+// Restore replaces all namespaces with the snapshot made by Backup,
+// the log is replaced by the snapshot atomically, all watchers are closed with ErrCompacted
+func (d *walDb) Restore(r io.Reader) error {
+	spaces, rev, err := readMemSnapshot(r, d.store.history)
+	if err != nil {
+		return err
+	}
+	l, s := d.log, d.store
+	l.cmu.Lock()
+	defer l.cmu.Unlock()
+	s.Lock()
+	defer s.Unlock()
+	if s.spaces == nil {
+		return errMemClosed
+	}
+	wf, err := writeWalSnapshot(l.path+".compact", spaces, rev, l.comp)
+	if err != nil {
+		return err
+	}
+	if err = l.swap(wf); err != nil {
+		return err
+	}
+	s.reset(spaces, rev)
+	return nil
+}
+
+// Close stops compaction, closes all watchers and the log file
+func (d *walDb) Close() (err error) {
+	l := d.log
+	l.once.Do(func() {
+		close(l.done)
+		l.wg.Wait()
+		d.memDb.Close()
+		err = l.f.Close()
+	})
+	return
+}
+
+// commit appends the change to the log, called by the store with lock held. The record is truncated
+// if not synced, since the change is not applied, the log fails all writes if it can not be truncated
+func (l *walLog) commit(c *memChange) error {
+	if l.err != nil {
+		return l.err
+	}
+	size, entries := l.size, l.entries
+	if err := l.write(c); err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		if terr := l.f.Truncate(size); terr != nil {
+			l.err = fmt.Errorf("log failed since the record not synced can not be truncated: %s", terr.Error())
+		}
+		l.size, l.entries = size, entries
+		return err
+	}
+	if l.compacting {
+		l.pending = append(l.pending, c)
+	} else if l.needCompact(l.store) {
+		select {
+		case l.compactc <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// compacting compacts the log once the garbage ratio crosses the threshold until closed
+func (d *walDb) compacting() {
+	defer d.log.wg.Done()
+	for {
+		select {
+		case <-d.log.compactc:
+			d.compact()
+		case <-d.log.done:
+			return
+		}
+	}
+}
+
+// needCompact returns true if the ratio of the entries in the log not alive crosses the threshold,
+// the store must be locked
+func (l *walLog) needCompact(s *memStore) bool {
+	if l.compacting || l.entries < walMinCompact {
+		return false
+	}
+	live := len(s.spaces)
+	for _, space := range s.spaces {
+		live += len(space.kvs)
+	}
+	return float64(l.entries-live) >= l.ratio*float64(l.entries)
+}
+
+// compact writes the snapshot of the store into a new log, then appends the changes
+// committed meanwhile and replaces the old log with it
+func (d *walDb) compact() error {
+	l, s := d.log, d.store
+	l.cmu.Lock()
+	defer l.cmu.Unlock()
+
+	s.Lock()
+	if s.spaces == nil || !l.needCompact(s) {
+		s.Unlock()
+		return nil
+	}
+	spaces := make(map[string]*memSpace, len(s.spaces))
+	for name, space := range s.spaces {
+		spaces[name] = space.snapshot()
+	}
+	rev := s.rev
+	l.compacting, l.pending = true, nil
+	s.Unlock()
+
+	wf, err := writeWalSnapshot(l.path+".compact", spaces, rev, l.comp)
+
+	s.Lock()
+	defer s.Unlock()
+	pending := l.pending
+	l.compacting, l.pending = false, nil
+	if err != nil {
+		return err
+	}
+	for _, c := range pending {
+		if err = wf.write(c); err != nil {
+			wf.f.Close()
+			os.Remove(wf.f.Name())
+			return err
+		}
+	}
+	return l.swap(wf)
+}
+
+// swap replaces the log by the new file written next to it, the store must be locked
+func (l *walLog) swap(wf *walFile) error {
+	if err := wf.f.Sync(); err != nil {
+		wf.f.Close()
+		os.Remove(wf.f.Name())
+		return err
+	}
+	if err := os.Rename(wf.f.Name(), l.path); err != nil {
+		wf.f.Close()
+		os.Remove(wf.f.Name())
+		return err
+	}
+	// makes the rename durable
+	if dir, err := os.Open(filepath.Dir(l.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	l.f.Close()
+	// the new log has no record not synced
+	l.walFile, l.err = wf, nil
+	return nil
+}
+
+// writeWalSnapshot writes the kvs and the history of all namespaces as a new log into the file
+func writeWalSnapshot(path string, spaces map[string]*memSpace, rev uint64, comp *compressor) (*walFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	wf := &walFile{f: f, comp: comp}
+	names := make([]string, 0, len(spaces))
+	for name := range spaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	c := &memChange{Revision: rev}
+	for _, name := range names {
+		if name != "" {
+			c.Created = append(c.Created, name)
+		}
+	}
+	// flush writes the change once it is full
+	flush := func() error {
+		if len(c.History)+len(c.Events) < walSnapshotChunk {
+			return nil
+		}
+		if err := wf.write(c); err != nil {
+			return err
+		}
+		c = &memChange{Revision: rev}
+		return nil
+	}
+WRITE:
+	for _, name := range names {
+		for _, h := range spaces[name].histories(name) {
+			c.History = append(c.History, h)
+			if err = flush(); err != nil {
+				break WRITE
+			}
+		}
+		for _, kv := range spaces[name].kvs {
+			c.Events = append(c.Events, Event{Type: EventPut, Namespace: name, KV: kv})
+			if err = flush(); err != nil {
+				break WRITE
+			}
+		}
+	}
+	if err == nil && (len(c.Created) != 0 || len(c.History) != 0 || len(c.Events) != 0 || wf.size == 0) {
+		err = wf.write(c)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return wf, nil
+}
+
+// walFile the log file opened for appending
+type walFile struct {
+	f    *os.File
+	size int64
+	// entries the count of namespaces and events in the log
+	entries int
+	comp    *compressor
+}
+
+// write appends the change as a record, the partial record is truncated if failed
+func (wf *walFile) write(c *memChange) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if codec, v := wf.comp.compress(data); codec != codecNone {
+		data = append([]byte{codec}, v...)
+	}
+	buf := make([]byte, walHeaderSize+len(data))
+	binary.LittleEndian.PutUint32(buf, uint32(len(data)))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.Checksum(data, walTable))
+	binary.LittleEndian.PutUint32(buf[8:], crc32.Checksum(buf[:8], walTable))
+	copy(buf[walHeaderSize:], data)
+	if _, err = wf.f.WriteAt(buf, wf.size); err != nil {
+		wf.f.Truncate(wf.size)
+		return err
+	}
+	wf.size += int64(len(buf))
+	wf.entries += c.entries()
+	return nil
+}
+
+// replay applies all records in the log to the store, the torn record at the end of the log,
+// which was not committed, is truncated with the zeros filled after it. A broken record followed
+// by valid ones fails the replay, the log is kept as it is to recover the records committed after it
+func (wf *walFile) replay(s *memStore) error {
+	info, err := wf.f.Stat()
+	if err != nil {
+		return err
+	}
+	for {
+		c, n, err := wf.read(info.Size())
+		if err == errWalTorn {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		s.apply(c)
+		wf.size += n
+		wf.entries += c.entries()
+	}
+	if wf.size == info.Size() {
+		return nil
+	}
+	log.L().Warn("the torn record at the end of the log is truncated",
+		log.Any("source", wf.f.Name()), log.Any("offset", wf.size), log.Any("size", info.Size()-wf.size))
+	return wf.f.Truncate(wf.size)
+}
+
+var errWalTorn = errors.New("torn record")
+
+// read reads the record at the end of the log, returns the change and the size of the record.
+// The length is trusted only after the header checksum matches, errWalTorn is returned if there is
+// no complete record before the end of the file, or the record is broken and no valid record follows
+func (wf *walFile) read(end int64) (*memChange, int64, error) {
+	rest := end - wf.size
+	if rest < walHeaderSize {
+		return nil, 0, errWalTorn
+	}
+	var header [walHeaderSize]byte
+	if _, err := wf.f.ReadAt(header[:], wf.size); err != nil {
+		return nil, 0, err
+	}
+	if crc32.Checksum(header[:8], walTable) != binary.LittleEndian.Uint32(header[8:]) {
+		return nil, 0, wf.broken(end, "header checksum mismatch")
+	}
+	// the length is checked before allocated, the payload is never empty
+	n := binary.LittleEndian.Uint32(header[:])
+	if n == 0 || n > walMaxRecord {
+		return nil, 0, wf.broken(end, "invalid length")
+	}
+	if int64(n) > rest-walHeaderSize {
+		return nil, 0, wf.broken(end, "length beyond the end of the log")
+	}
+	data := make([]byte, n)
+	if _, err := wf.f.ReadAt(data, wf.size+walHeaderSize); err != nil {
+		return nil, 0, err
+	}
+	if crc32.Checksum(data, walTable) != binary.LittleEndian.Uint32(header[4:]) {
+		return nil, 0, wf.broken(end, "checksum mismatch")
+	}
+	// the JSON starts with {, otherwise it is compressed
+	if data[0] != '{' {
+		v, err := decompress(data[0], data[1:])
+		if err != nil {
+			return nil, 0, wf.corrupted(err.Error())
+		}
+		data = v
+	}
+	c := new(memChange)
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, 0, wf.corrupted(err.Error())
+	}
+	return c, walHeaderSize + int64(n), nil
+}
+
+// broken returns errWalTorn for the broken record at the end of the log if no valid record follows it,
+// e.g. the record not written completely or the zeros filled after it, otherwise the error of corruption
+func (wf *walFile) broken(end int64, reason string) error {
+	data := make([]byte, end-wf.size)
+	if _, err := wf.f.ReadAt(data, wf.size); err != nil {
+		return err
+	}
+	for i := 1; i+walHeaderSize < len(data); i++ {
+		header := data[i : i+walHeaderSize]
+		if crc32.Checksum(header[:8], walTable) != binary.LittleEndian.Uint32(header[8:]) {
+			continue
+		}
+		n := int(binary.LittleEndian.Uint32(header))
+		if n == 0 || n > len(data)-i-walHeaderSize {
+			continue
+		}
+		if crc32.Checksum(data[i+walHeaderSize:i+walHeaderSize+n], walTable) == binary.LittleEndian.Uint32(header[4:]) {
+			return wf.corrupted(reason)
+		}
+	}
+	return errWalTorn
+}
+
+// corrupted returns the error of the corrupted record at the end of the log
+func (wf *walFile) corrupted(reason string) error {
+	return fmt.Errorf("corrupted record at offset %d of the log (%s): %s", wf.size, wf.f.Name(), reason)
+}
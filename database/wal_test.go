@@ -0,0 +1,189 @@
+package database
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := Conf{Driver: "wal", Source: path.Join(dir, "kv.wal")}
+	db, err := New(conf)
+	assert.NoError(t, err)
+	err = db.Set(&KV{Key: "k1", Value: []byte("v1")})
+	assert.NoError(t, err)
+	err = db.CreateNamespace("a")
+	assert.NoError(t, err)
+	a, err := db.Namespace("a")
+	assert.NoError(t, err)
+	err = a.Batch([]Op{{Type: OpSet, KV: KV{Key: "k2", Value: []byte("v2")}}, {Type: OpDel, KV: KV{Key: "k3"}}})
+	assert.NoError(t, err)
+	db.Close()
+
+	stat, err := os.Stat(conf.Source)
+	assert.NoError(t, err)
+	size := stat.Size()
+
+	check := func() {
+		db, err := New(conf)
+		assert.NoError(t, err)
+		defer db.Close()
+		v, err := db.Get("k1")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("v1"), v.Value)
+		a, err := db.Namespace("a")
+		assert.NoError(t, err)
+		v, err = a.Get("k2")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("v2"), v.Value)
+		assert.Equal(t, uint64(2), v.Revision)
+		// the log is truncated to the last complete record
+		stat, err := os.Stat(conf.Source)
+		assert.NoError(t, err)
+		assert.Equal(t, size, stat.Size())
+	}
+
+	// torn header
+	f, err := os.OpenFile(conf.Source, os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NoError(t, err)
+	_, err = f.Write([]byte{1, 2, 3})
+	assert.NoError(t, err)
+	f.Close()
+	check()
+
+	// torn payload
+	db, err = New(conf)
+	assert.NoError(t, err)
+	err = db.Set(&KV{Key: "k4", Value: []byte("v4")})
+	assert.NoError(t, err)
+	db.Close()
+	err = os.Truncate(conf.Source, size+10)
+	assert.NoError(t, err)
+	check()
+
+	// corrupted payload
+	db, err = New(conf)
+	assert.NoError(t, err)
+	err = db.Set(&KV{Key: "k4", Value: []byte("v4")})
+	assert.NoError(t, err)
+	db.Close()
+	data, err := ioutil.ReadFile(conf.Source)
+	assert.NoError(t, err)
+	data[len(data)-2] ^= 0xff
+	err = ioutil.WriteFile(conf.Source, data, 0600)
+	assert.NoError(t, err)
+	check()
+
+	// corrupted header with a length beyond the end of the file, which is not allocated
+	f, err = os.OpenFile(conf.Source, os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NoError(t, err)
+	header := []byte{0xff, 0xff, 0xff, 0x3f, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(header[8:], crc32.Checksum(header[:8], walTable))
+	_, err = f.Write(append(header, '{'))
+	assert.NoError(t, err)
+	f.Close()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	check()
+	runtime.ReadMemStats(&after)
+	assert.True(t, after.TotalAlloc-before.TotalAlloc < 1<<26, after.TotalAlloc-before.TotalAlloc)
+
+	// zeros filled after the last record
+	f, err = os.OpenFile(conf.Source, os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NoError(t, err)
+	_, err = f.Write(make([]byte, 4096))
+	assert.NoError(t, err)
+	f.Close()
+	check()
+
+	// revisions continue after recovery
+	db, err = New(conf)
+	assert.NoError(t, err)
+	k := &KV{Key: "k5"}
+	err = db.Set(k)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), k.Revision)
+	db.Close()
+
+	// corrupted payload or length followed by committed records fails the recovery without truncating
+	data, err = ioutil.ReadFile(conf.Source)
+	assert.NoError(t, err)
+	for i, reason := range map[int]string{walHeaderSize + 2: "checksum mismatch", 3: "header checksum mismatch"} {
+		corrupted := append([]byte{}, data...)
+		corrupted[i] ^= 0xff
+		err = ioutil.WriteFile(conf.Source, corrupted, 0600)
+		assert.NoError(t, err)
+		_, err = New(conf)
+		assert.EqualError(t, err, "corrupted record at offset 0 of the log ("+conf.Source+"): "+reason)
+		stat, err = os.Stat(conf.Source)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(data)), stat.Size())
+	}
+}
+
+func TestWalCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := Conf{Driver: "wal", Source: path.Join(dir, "kv.wal"), CompactRatio: 0.5}
+	db, err := New(conf)
+	assert.NoError(t, err)
+	err = db.CreateNamespace("a")
+	assert.NoError(t, err)
+	a, err := db.Namespace("a")
+	assert.NoError(t, err)
+	err = a.Set(&KV{Key: "a", Value: []byte("a"), TTL: 60})
+	assert.NoError(t, err)
+
+	// overwrites the same keys to make garbage
+	for i := 0; i < 40; i++ {
+		var ops []Op
+		for j := 0; j < 100; j++ {
+			ops = append(ops, Op{Type: OpSet, KV: KV{Key: fmt.Sprintf("k%02d", j), Value: []byte(fmt.Sprintf("v%d", i))}})
+		}
+		err = db.Batch(ops)
+		assert.NoError(t, err)
+	}
+	log := db.(*walDb).log
+	assert.Eventually(t, func() bool {
+		db.(*walDb).store.RLock()
+		defer db.(*walDb).store.RUnlock()
+		return log.entries < 1024
+	}, 5*time.Second, 10*time.Millisecond)
+
+	err = db.Set(&KV{Key: "k00", Value: []byte("last")})
+	assert.NoError(t, err)
+	db.Close()
+	_, err = os.Stat(conf.Source + ".compact")
+	assert.True(t, os.IsNotExist(err))
+
+	db, err = New(conf)
+	assert.NoError(t, err)
+	defer db.Close()
+	kvs, err := db.List("k")
+	assert.NoError(t, err)
+	assert.Len(t, kvs, 100)
+	assert.Equal(t, []byte("last"), kvs[0].Value)
+	assert.Equal(t, uint64(42), kvs[0].Revision)
+	assert.Equal(t, []byte("v39"), kvs[99].Value)
+	assert.Equal(t, uint64(41), kvs[99].Revision)
+	a, err = db.Namespace("a")
+	assert.NoError(t, err)
+	v, err := a.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), v.Value)
+	assert.NotZero(t, v.Expire)
+}
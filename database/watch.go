@@ -0,0 +1,229 @@
+package database
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// event types
+const (
+	EventPut = "put"
+	EventDel = "del"
+)
+
+const (
+	defaultWatchHistory = 1024
+	watcherBuffer       = 256
+)
+
+// all errors of watching
+var (
+	// ErrCompacted returned if the events since the revision are not kept any more
+	ErrCompacted = errors.New("required revision has been compacted")
+	// ErrWatcherOverflow set if the watcher is dropped because it does not consume events in time
+	ErrWatcherOverflow = errors.New("watcher is too slow to receive events")
+	// ErrWatcherClosed set if the watcher is closed by the database
+	ErrWatcherClosed = errors.New("watcher is closed")
+)
+
+// Event the change of a key in the namespace, Revision is the revision of the change,
+// Value is empty for delete events
+type Event struct {
+	Type      string
+	Namespace string
+	KV
+}
+
+// Watcher receives the events of a key or the keys with a prefix in a namespace
+type Watcher struct {
+	ns     string
+	key    string
+	prefix bool
+	events chan Event
+	broker *broker
+	err    error
+	// inner the watcher whose events are relayed, nil if dispatched by the broker directly
+	inner *Watcher
+	done  chan struct{}
+}
+
+// Events returns the channel of events, which is closed if the watcher is closed
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Err returns the reason why the events channel is closed
+func (w *Watcher) Err() error {
+	w.broker.Lock()
+	defer w.broker.Unlock()
+	for w.err == nil && w.inner != nil {
+		w = w.inner
+	}
+	return w.err
+}
+
+// Close stops watching
+func (w *Watcher) Close() {
+	w.broker.Lock()
+	defer w.broker.Unlock()
+	for ; w.inner != nil; w = w.inner {
+		select {
+		case <-w.done:
+		default:
+			close(w.done)
+		}
+	}
+	w.broker.remove(w, nil)
+}
+
+// relay returns the watcher receiving the events of w converted by fn,
+// it is closed once w is closed, or with the error if fn fails
+func (w *Watcher) relay(fn func(e *Event) error) *Watcher {
+	r := &Watcher{
+		events: make(chan Event, watcherBuffer),
+		broker: w.broker,
+		inner:  w,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(r.events)
+		for e := range w.events {
+			if err := fn(&e); err != nil {
+				r.broker.Lock()
+				r.err = err
+				r.broker.Unlock()
+				w.Close()
+				return
+			}
+			select {
+			case r.events <- e:
+			case <-r.done:
+				return
+			}
+		}
+	}()
+	return r
+}
+
+func (w *Watcher) match(e *Event) bool {
+	if w.ns != e.Namespace {
+		return false
+	}
+	if w.prefix {
+		return strings.HasPrefix(e.Key, w.key)
+	}
+	return w.key == e.Key
+}
+
+// broker keeps the recent events and dispatches new events to watchers
+type broker struct {
+	sync.Mutex
+	history   []Event
+	size      int
+	compacted uint64
+	watchers  map[*Watcher]struct{}
+}
+
+// newBroker creates a broker which keeps size recent events,
+// the events before revision rev are treated as compacted
+func newBroker(size int, rev uint64) *broker {
+	if size <= 0 {
+		size = defaultWatchHistory
+	}
+	return &broker{
+		size:      size,
+		compacted: rev,
+		watchers:  map[*Watcher]struct{}{},
+	}
+}
+
+// publish records the events of a committed write and dispatches them,
+// must be called in the order of revision
+func (b *broker) publish(events ...Event) {
+	if len(events) == 0 {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	for _, e := range events {
+		b.history = append(b.history, e)
+		for w := range b.watchers {
+			if !w.match(&e) {
+				continue
+			}
+			select {
+			case w.events <- e:
+			default:
+				b.remove(w, ErrWatcherOverflow)
+			}
+		}
+	}
+	if n := len(b.history) - b.size; n > 0 {
+		b.compacted = b.history[n-1].Revision
+		b.history = append(b.history[:0], b.history[n:]...)
+	}
+}
+
+// watch creates a watcher, the kept events since revision rev are replayed if rev is not 0
+func (b *broker) watch(ns, key string, prefix bool, rev uint64) (*Watcher, error) {
+	b.Lock()
+	defer b.Unlock()
+	if b.watchers == nil {
+		return nil, ErrWatcherClosed
+	}
+	if rev != 0 && rev <= b.compacted {
+		return nil, ErrCompacted
+	}
+	w := &Watcher{
+		ns:     ns,
+		key:    key,
+		prefix: prefix,
+		broker: b,
+	}
+	var replay []Event
+	if rev != 0 {
+		for i := range b.history {
+			if e := b.history[i]; e.Revision >= rev && w.match(&e) {
+				replay = append(replay, e)
+			}
+		}
+	}
+	w.events = make(chan Event, watcherBuffer+len(replay))
+	for _, e := range replay {
+		w.events <- e
+	}
+	b.watchers[w] = struct{}{}
+	return w, nil
+}
+
+// reset closes all watchers with ErrCompacted and drops the kept events,
+// used if the database is replaced, the events before revision rev are treated as compacted
+func (b *broker) reset(rev uint64) {
+	b.Lock()
+	defer b.Unlock()
+	for w := range b.watchers {
+		b.remove(w, ErrCompacted)
+	}
+	b.history = nil
+	b.compacted = rev
+}
+
+// close closes all watchers
+func (b *broker) close() {
+	b.Lock()
+	defer b.Unlock()
+	for w := range b.watchers {
+		b.remove(w, ErrWatcherClosed)
+	}
+	b.watchers = nil
+}
+
+func (b *broker) remove(w *Watcher, err error) {
+	if _, ok := b.watchers[w]; !ok {
+		return
+	}
+	delete(b.watchers, w)
+	w.err = err
+	close(w.events)
+}
@@ -0,0 +1,145 @@
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDatabaseWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, conf := range driverConfs(dir) {
+		db, err := New(conf)
+		assert.NoError(t, err)
+		assert.NotNil(t, db)
+
+		wk, err := db.Watch("/w/1", false, 0)
+		assert.NoError(t, err)
+		wp, err := db.Watch("/w/", true, 0)
+		assert.NoError(t, err)
+
+		err = db.Set(&KV{Key: "/w/1", Value: []byte("v1")})
+		assert.NoError(t, err)
+		err = db.Set(&KV{Key: "/x/1", Value: []byte("x1")})
+		assert.NoError(t, err)
+		err = db.Batch([]Op{
+			{Type: OpSet, KV: KV{Key: "/w/2", Value: []byte("v2")}},
+			{Type: OpDel, KV: KV{Key: "/w/1"}},
+			{Type: OpDel, KV: KV{Key: "/w/3"}},
+		})
+		assert.NoError(t, err)
+		// deleting a missing key publishes nothing
+		err = db.Del("/w/3")
+		assert.NoError(t, err)
+		err = db.Del("/w/2")
+		assert.NoError(t, err)
+
+		e := <-wk.Events()
+		assert.Equal(t, EventPut, e.Type)
+		assert.Equal(t, "/w/1", e.Key)
+		assert.Equal(t, []byte("v1"), e.Value)
+		assert.Equal(t, uint64(1), e.Revision)
+		e = <-wk.Events()
+		assert.Equal(t, EventDel, e.Type)
+		assert.Equal(t, "/w/1", e.Key)
+		assert.Equal(t, uint64(3), e.Revision)
+		assert.Len(t, wk.Events(), 0)
+
+		expected := []Event{
+			{Type: EventPut, KV: KV{Key: "/w/1", Value: []byte("v1"), Revision: 1}},
+			{Type: EventPut, KV: KV{Key: "/w/2", Value: []byte("v2"), Revision: 3}},
+			{Type: EventDel, KV: KV{Key: "/w/1", Revision: 3}},
+			{Type: EventDel, KV: KV{Key: "/w/2", Revision: 4}},
+		}
+		for _, ex := range expected {
+			select {
+			case e := <-wp.Events():
+				assert.Equal(t, ex, unstamped(t, e))
+			case <-time.After(time.Second):
+				assert.FailNow(t, "event expected")
+			}
+		}
+
+		// resume from revision
+		wr, err := db.Watch("/w/", true, 3)
+		assert.NoError(t, err)
+		assert.Len(t, wr.Events(), 3)
+		wr.Close()
+		for range wr.Events() {
+		}
+		assert.NoError(t, wr.Err())
+
+		// expired keys are deleted with events
+		err = db.Set(&KV{Key: "/w/4", Expire: time.Now().Unix() - 1})
+		assert.NoError(t, err)
+		n, err := db.DelExpired()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+		<-wp.Events()
+		e = <-wp.Events()
+		assert.Equal(t, EventDel, e.Type)
+		assert.Equal(t, "/w/4", e.Key)
+		assert.Equal(t, uint64(6), e.Revision)
+
+		// watchers are closed with database
+		db.Close()
+		_, ok := <-wp.Events()
+		assert.False(t, ok)
+		assert.Equal(t, ErrWatcherClosed, wp.Err())
+		if conf.Driver == "memory" {
+			continue
+		}
+
+		// events before reopening are compacted
+		db, err = New(conf)
+		assert.NoError(t, err)
+		_, err = db.Watch("/w/", true, 6)
+		assert.Equal(t, ErrCompacted, err)
+		w, err := db.Watch("/w/", true, 7)
+		assert.NoError(t, err)
+		err = db.Set(&KV{Key: "/w/5"})
+		assert.NoError(t, err)
+		e = <-w.Events()
+		assert.Equal(t, uint64(7), e.Revision)
+		db.Close()
+	}
+}
+
+func TestBroker(t *testing.T) {
+	b := newBroker(2, 0)
+	b.publish(Event{Type: EventPut, KV: KV{Key: "a", Revision: 1}})
+	b.publish(Event{Type: EventPut, KV: KV{Key: "b", Revision: 2}})
+	b.publish(Event{Type: EventPut, KV: KV{Key: "a", Revision: 3}})
+
+	_, err := b.watch("", "a", false, 1)
+	assert.Equal(t, ErrCompacted, err)
+	w, err := b.watch("", "a", false, 2)
+	assert.NoError(t, err)
+	assert.Len(t, w.Events(), 1)
+	e := <-w.Events()
+	assert.Equal(t, uint64(3), e.Revision)
+
+	w.Close()
+
+	// slow watcher is dropped
+	w, err = b.watch("", "a", false, 0)
+	assert.NoError(t, err)
+	for i := 0; i <= watcherBuffer; i++ {
+		b.publish(Event{Type: EventPut, KV: KV{Key: "a", Revision: uint64(4 + i)}})
+	}
+	assert.Len(t, w.Events(), watcherBuffer)
+	for range w.Events() {
+	}
+	assert.Equal(t, ErrWatcherOverflow, w.Err())
+	w.Close()
+
+	b.close()
+	_, err = b.watch("", "a", false, 0)
+	assert.Equal(t, ErrWatcherClosed, err)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/baetyl/baetyl-state/database"
+)
+
+const (
+	exportPageSize  = 1000
+	importBatchSize = 1000
+)
+
+// dumpLine one kv in the JSON Lines file, the value is encoded in base64,
+// the kvs of the default namespace have no namespace
+type dumpLine struct {
+	Namespace   string            `json:"namespace,omitempty"`
+	Key         string            `json:"key"`
+	Value       []byte            `json:"value"`
+	Expire      int64             `json:"expire,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+// newDumpLine returns the line of the kv in the namespace
+func newDumpLine(name string, kv *database.KV) *dumpLine {
+	return &dumpLine{
+		Namespace:   name,
+		Key:         kv.Key,
+		Value:       kv.Value,
+		Expire:      kv.Expire,
+		ContentType: kv.ContentType,
+		Labels:      kv.Labels,
+	}
+}
+
+// export writes the kvs with the prefix of all namespaces as JSON Lines, returns the count
+func export(db database.DB, w io.Writer, prefix string) (int, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	n := 0
+	err := walk(db, prefix, func(name string, kv *database.KV) error {
+		n++
+		return enc.Encode(newDumpLine(name, kv))
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, bw.Flush()
+}
+
+// walk calls fn with the kvs with the prefix of all namespaces in order, the default namespace goes first
+func walk(db database.DB, prefix string, fn func(name string, kv *database.KV) error) error {
+	names, err := db.Namespaces()
+	if err != nil {
+		return err
+	}
+	for _, name := range append([]string{""}, names...) {
+		ns, err := db.Namespace(name)
+		if err != nil {
+			return err
+		}
+		opts := &database.ListOptions{Prefix: prefix, Limit: exportPageSize}
+		for {
+			kvs, next, err := ns.ListRange(opts)
+			if err != nil {
+				return err
+			}
+			for i := range kvs {
+				if err = fn(name, &kvs[i]); err != nil {
+					return err
+				}
+			}
+			if next == "" {
+				break
+			}
+			opts.Cursor = next
+		}
+	}
+	return nil
+}
+
+// importOptions the options of importing, the existing keys are overwritten by default
+type importOptions struct {
+	prefix       string
+	skipExisting bool
+	// batchSize the count of kvs set in one batch, importBatchSize if not set
+	batchSize int
+	// keepTime keeps the created and updated time of the kvs set in batches instead of the time of importing
+	keepTime bool
+}
+
+type importResult struct {
+	imported int
+	skipped  int
+}
+
+// importLines loads the JSON Lines written by export, the missing namespaces are created
+func importLines(db database.DB, r io.Reader, opts importOptions) (importResult, error) {
+	im := &importer{db: db, opts: opts}
+	br := bufio.NewReader(r)
+	for num := 1; ; num++ {
+		data, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return im.res, err
+		}
+		if len(strings.TrimSpace(string(data))) != 0 {
+			var line dumpLine
+			if uerr := json.Unmarshal(data, &line); uerr != nil {
+				return im.res, fmt.Errorf("line %d: %s", num, uerr.Error())
+			}
+			if aerr := im.add(&line); aerr != nil {
+				return im.res, fmt.Errorf("line %d: %s", num, aerr.Error())
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return im.res, im.flush()
+}
+
+// importer imports kvs, the consecutive kvs of the same namespace are set in batches if overwriting
+type importer struct {
+	db   database.DB
+	opts importOptions
+	ns   database.DB
+	name string
+	ops  []database.Op
+	res  importResult
+}
+
+func (im *importer) add(line *dumpLine) error {
+	if line.Key == "" {
+		return errors.New("key required")
+	}
+	if !strings.HasPrefix(line.Key, im.opts.prefix) || (line.Expire > 0 && line.Expire <= time.Now().Unix()) {
+		im.res.skipped++
+		return nil
+	}
+	return im.put(line.Namespace, database.KV{Key: line.Key, Value: line.Value, Expire: line.Expire, ContentType: line.ContentType, Labels: line.Labels})
+}
+
+// put sets the kv into the namespace, which is created if not exists
+func (im *importer) put(name string, kv database.KV) error {
+	if im.ns == nil || name != im.name {
+		if err := im.flush(); err != nil {
+			return err
+		}
+		ns, err := namespaceOf(im.db, name)
+		if err != nil {
+			return err
+		}
+		im.ns, im.name = ns, name
+	}
+	if !im.opts.skipExisting {
+		im.ops = append(im.ops, database.Op{Type: database.OpSet, KeepTime: im.opts.keepTime, KV: kv})
+		size := im.opts.batchSize
+		if size <= 0 {
+			size = importBatchSize
+		}
+		if len(im.ops) < size {
+			return nil
+		}
+		return im.flush()
+	}
+	// the existing keys are skipped by the precondition that the key must not exist
+	err := im.ns.CompareAndSet(&kv, 0)
+	switch err {
+	case nil:
+		im.res.imported++
+	case database.ErrRevisionMismatch:
+		im.res.skipped++
+	default:
+		return err
+	}
+	return nil
+}
+
+func (im *importer) flush() error {
+	if len(im.ops) == 0 {
+		return nil
+	}
+	if err := im.ns.Batch(im.ops); err != nil {
+		return err
+	}
+	im.res.imported += len(im.ops)
+	im.ops = im.ops[:0]
+	return nil
+}
+
+// namespaceOf returns the namespace, which is created if not exists
+func namespaceOf(db database.DB, name string) (database.DB, error) {
+	if name == "" {
+		return db, nil
+	}
+	if err := db.CreateNamespace(name); err != nil {
+		return nil, err
+	}
+	return db.Namespace(name)
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// filterExpr a boolean expression evaluated against the JSON values of kvs, e.g.
+// $.status == "on" && ($.temp >= 20 || !exists($.location.city)).
+// The paths start with $ followed by .name, ["name"] or [index], the comparisons are
+// ==, !=, <, <=, > and >= with a string, number, true, false or null, numbers and strings are ordered
+// by value, the comparisons on the fields not found are false, and the values not JSON match nothing
+type filterExpr interface {
+	eval(doc interface{}) bool
+}
+
+type orExpr struct{ l, r filterExpr }
+
+func (e *orExpr) eval(doc interface{}) bool { return e.l.eval(doc) || e.r.eval(doc) }
+
+type andExpr struct{ l, r filterExpr }
+
+func (e *andExpr) eval(doc interface{}) bool { return e.l.eval(doc) && e.r.eval(doc) }
+
+type notExpr struct{ e filterExpr }
+
+func (e *notExpr) eval(doc interface{}) bool { return !e.e.eval(doc) }
+
+type existsExpr struct{ path []string }
+
+func (e *existsExpr) eval(doc interface{}) bool {
+	_, err := getValue(doc, e.path)
+	return err == nil
+}
+
+type compareExpr struct {
+	path  []string
+	op    string
+	value interface{}
+}
+
+func (e *compareExpr) eval(doc interface{}) bool {
+	v, err := getValue(doc, e.path)
+	if err != nil {
+		return false
+	}
+	switch e.op {
+	case "==":
+		return equalJSON(v, e.value)
+	case "!=":
+		return !equalJSON(v, e.value)
+	}
+	c, ok := compareJSON(v, e.value)
+	if !ok {
+		return false
+	}
+	switch e.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+// compareJSON compares two numbers or two strings, false if they are not comparable
+func compareJSON(a, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return 0, false
+		}
+		fx, errx := x.Float64()
+		fy, erry := y.Float64()
+		if errx != nil || erry != nil {
+			return 0, false
+		}
+		switch {
+		case fx < fy:
+			return -1, true
+		case fx > fy:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	}
+	return 0, false
+}
+
+// filterParser the recursive descent parser of filter expressions
+type filterParser struct {
+	s   string
+	pos int
+}
+
+// parseFilter parses the filter expression
+func parseFilter(s string) (filterExpr, error) {
+	p := &filterParser{s: s}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.skip(); p.pos < len(p.s) {
+		return nil, p.errorf("unexpected %q", p.s[p.pos:])
+	}
+	return e, nil
+}
+
+func (p *filterParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("invalid filter at %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+// skip skips the spaces
+func (p *filterParser) skip() {
+	for p.pos < len(p.s) && strings.IndexByte(" \t\r\n", p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+}
+
+// consume consumes the token if it is next
+func (p *filterParser) consume(token string) bool {
+	p.skip()
+	if strings.HasPrefix(p.s[p.pos:], token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) or() (filterExpr, error) {
+	l, err := p.and()
+	for err == nil && p.consume("||") {
+		var r filterExpr
+		if r, err = p.and(); err == nil {
+			l = &orExpr{l: l, r: r}
+		}
+	}
+	return l, err
+}
+
+func (p *filterParser) and() (filterExpr, error) {
+	l, err := p.unary()
+	for err == nil && p.consume("&&") {
+		var r filterExpr
+		if r, err = p.unary(); err == nil {
+			l = &andExpr{l: l, r: r}
+		}
+	}
+	return l, err
+}
+
+func (p *filterParser) unary() (filterExpr, error) {
+	switch {
+	case p.consume("!"):
+		e, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{e: e}, nil
+	case p.consume("("):
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.consume(")") {
+			return nil, p.errorf("')' expected")
+		}
+		return e, nil
+	case p.consume("exists"):
+		if !p.consume("(") {
+			return nil, p.errorf("'(' expected")
+		}
+		path, err := p.path()
+		if err != nil {
+			return nil, err
+		}
+		if !p.consume(")") {
+			return nil, p.errorf("')' expected")
+		}
+		return &existsExpr{path: path}, nil
+	}
+	path, err := p.path()
+	if err != nil {
+		return nil, err
+	}
+	e := &compareExpr{path: path}
+	// the longer operators go first
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if p.consume(op) {
+			e.op = op
+			break
+		}
+	}
+	if e.op == "" {
+		return nil, p.errorf("comparison expected")
+	}
+	if e.value, err = p.literal(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// path parses the path starting with $
+func (p *filterParser) path() ([]string, error) {
+	if !p.consume("$") {
+		return nil, p.errorf("path starting with $ expected")
+	}
+	path := []string{}
+	for p.pos < len(p.s) {
+		switch p.s[p.pos] {
+		case '.':
+			p.pos++
+			start := p.pos
+			for p.pos < len(p.s) && isNameChar(p.s[p.pos]) {
+				p.pos++
+			}
+			if start == p.pos {
+				return nil, p.errorf("field name expected")
+			}
+			path = append(path, p.s[start:p.pos])
+		case '[':
+			p.pos++
+			p.skip()
+			if p.pos < len(p.s) && (p.s[p.pos] == '"' || p.s[p.pos] == '\'') {
+				name, err := p.str()
+				if err != nil {
+					return nil, err
+				}
+				path = append(path, name)
+			} else {
+				start := p.pos
+				for p.pos < len(p.s) && p.s[p.pos] >= '0' && p.s[p.pos] <= '9' {
+					p.pos++
+				}
+				if start == p.pos {
+					return nil, p.errorf("index or quoted field name expected")
+				}
+				path = append(path, p.s[start:p.pos])
+			}
+			if !p.consume("]") {
+				return nil, p.errorf("']' expected")
+			}
+		default:
+			return path, nil
+		}
+	}
+	return path, nil
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || c == '-' || (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// literal parses a string, number, true, false or null
+func (p *filterParser) literal() (interface{}, error) {
+	p.skip()
+	if p.pos < len(p.s) && (p.s[p.pos] == '"' || p.s[p.pos] == '\'') {
+		return p.str()
+	}
+	for _, w := range []struct {
+		token string
+		value interface{}
+	}{{"true", true}, {"false", false}, {"null", nil}} {
+		if p.consume(w.token) {
+			return w.value, nil
+		}
+	}
+	start := p.pos
+	for p.pos < len(p.s) && strings.IndexByte("+-.0123456789eE", p.s[p.pos]) >= 0 {
+		p.pos++
+	}
+	n := p.s[start:p.pos]
+	if _, err := strconv.ParseFloat(n, 64); n == "" || err != nil {
+		p.pos = start
+		return nil, p.errorf("string, number, true, false or null expected")
+	}
+	return json.Number(n), nil
+}
+
+// str parses a string quoted by " or ', the escapes of JSON strings are supported
+func (p *filterParser) str() (string, error) {
+	q := p.s[p.pos]
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := p.pos + 1; i < len(p.s); i++ {
+		switch c := p.s[i]; {
+		case c == q:
+			b.WriteByte('"')
+			var s string
+			if err := json.Unmarshal([]byte(b.String()), &s); err != nil {
+				return "", p.errorf("invalid string: %s", err.Error())
+			}
+			p.pos = i + 1
+			return s, nil
+		case c == '\\' && i+1 < len(p.s) && p.s[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case c == '\\' && i+1 < len(p.s):
+			b.WriteByte(c)
+			b.WriteByte(p.s[i+1])
+			i++
+		case c == '"':
+			b.WriteString(`\"`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+// parseFields parses the fields projected separated by commas, each is a path of field names
+// like $.a.b or a.b
+func parseFields(s string) ([][]string, error) {
+	var fields [][]string
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if !strings.HasPrefix(f, "$") {
+			f = "$." + f
+		}
+		p := &filterParser{s: f}
+		path, err := p.path()
+		if err == nil && p.pos < len(p.s) {
+			err = p.errorf("unexpected %q", p.s[p.pos:])
+		}
+		if err != nil || len(path) == 0 {
+			return nil, fmt.Errorf("invalid field (%s)", strings.TrimPrefix(f, "$."))
+		}
+		fields = append(fields, path)
+	}
+	return fields, nil
+}
+
+// project returns the document with the fields only, keeping their paths, the fields not found are omitted,
+// nil if the document is not an object
+func project(doc interface{}, fields [][]string) interface{} {
+	if _, ok := doc.(map[string]interface{}); !ok {
+		return nil
+	}
+	out := map[string]interface{}{}
+	for _, path := range fields {
+		v, err := getValue(doc, path)
+		if err != nil {
+			continue
+		}
+		m := out
+		for _, name := range path[:len(path)-1] {
+			child, ok := m[name].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				m[name] = child
+			}
+			m = child
+		}
+		m[path[len(path)-1]] = v
+	}
+	return out
+}
+
+// projectValue projects the JSON value to the fields, nil if the value is not a JSON object
+func projectValue(value []byte, fields [][]string) ([]byte, error) {
+	doc, err := decodeJSON(value)
+	if err != nil {
+		return nil, nil
+	}
+	if doc = project(doc, fields); doc == nil {
+		return nil, nil
+	}
+	return encodeJSON(doc)
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/baetyl/baetyl-go/log"
 	"github.com/baetyl/baetyl-state/database"
@@ -12,34 +16,95 @@ import (
 
 // KVHandler kv http handler
 type KVHandler struct {
-	db  database.DB
-	log *log.Logger
+	db   database.DB
+	done chan struct{}
+	log  *log.Logger
+	// maxSnapshotSize the max size of the snapshot to restore, unlimited if 0
+	maxSnapshotSize int
 }
 
 // NewKVHandler new kv handler
 func NewKVHandler(db database.DB, log *log.Logger) *KVHandler {
 	return &KVHandler{
-		db:  db,
-		log: log,
+		db:   db,
+		done: make(chan struct{}),
+		log:  log,
 	}
 }
 
+// Close stops all pending watch requests
+func (h *KVHandler) Close() {
+	close(h.done)
+}
+
 func (h *KVHandler) initRouter() fasthttp.RequestHandler {
 	router := routing.New()
+	// the routes added first take precedence, so reserved paths go before /<key>,
+	// the keys starting with '_' are reserved for them and rejected when written
+	router.Post("/_batch", h.Batch)
+	router.Get("/_watch", h.Watch)
+	router.Get("/_backup", h.Backup)
+	router.Post("/_restore", h.Restore)
+	router.Get("/_cache", h.CacheStats)
+	router.Get("/_stats", h.Stats)
+	router.Get("/_quota", h.QuotaUsage)
+	router.Get("/_query", h.Query)
+	router.Get("/_history/<key>", h.History)
+	router.Post("/_rollback/<key>", h.Rollback)
+	router.Post("/_incr/<key>", h.Increment)
+	router.Get("/_queues/<queue>", h.QueueLength)
+	router.Post("/_queues/<queue>", h.QueuePush)
+	router.Post("/_queues/<queue>/_pop", h.QueuePop)
+	router.Get("/_queues/<queue>/_peek", h.QueuePeek)
+	router.Post("/_queues/<queue>/_ack/<seq>", h.QueueAck)
+	router.Get("/_namespaces", h.ListNamespaces)
+	router.Put("/_namespaces/<namespace>", h.CreateNamespace)
+	router.Delete("/_namespaces/<namespace>", h.DropNamespace)
+	// the kvs of a namespace are accessed with the same routes under /_namespaces/<namespace>
+	ns := router.Group("/_namespaces/<namespace>")
+	ns.Post("/_batch", h.Batch)
+	ns.Get("/_watch", h.Watch)
+	ns.Get("/_stats", h.Stats)
+	ns.Get("/_quota", h.QuotaUsage)
+	ns.Get("/_query", h.Query)
+	ns.Get("/_history/<key>", h.History)
+	ns.Post("/_rollback/<key>", h.Rollback)
+	ns.Post("/_incr/<key>", h.Increment)
+	ns.Get("/_queues/<queue>", h.QueueLength)
+	ns.Post("/_queues/<queue>", h.QueuePush)
+	ns.Post("/_queues/<queue>/_pop", h.QueuePop)
+	ns.Get("/_queues/<queue>/_peek", h.QueuePeek)
+	ns.Post("/_queues/<queue>/_ack/<seq>", h.QueueAck)
+	ns.Get("/", h.List)
+	ns.Get("/<key>", h.Get)
+	ns.Post("/", h.Set)
+	ns.Patch("/<key>", h.Patch)
+	ns.Delete("/", h.DeletePrefix)
+	ns.Delete("/<key>", h.Delete)
 	router.Get("/", h.List)
 	router.Get("/<key>", h.Get)
 	router.Post("/", h.Set)
+	router.Patch("/<key>", h.Patch)
+	router.Delete("/", h.DeletePrefix)
 	router.Delete("/<key>", h.Delete)
 
 	return router.HandleRequest
 }
 
-// Get Get
+// Get Get, the kv at a past revision is responded if ?rev= or ?time= is set
 func (h *KVHandler) Get(c *routing.Context) error {
+	db, ok := h.scope(c)
+	if !ok {
+		return nil
+	}
 	key := c.Param("key")
-	_kv, err := h.db.Get(key)
+	if args := c.QueryArgs(); args.Has("rev") || args.Has("time") {
+		h.getAt(c, db, key)
+		return nil
+	}
+	_kv, err := db.Get(key)
 	if err != nil {
-		respondError(c, 500, "ERR_DB", err.Error())
+		respondDBError(c, err)
 		return nil
 	}
 	data, err := json.Marshal(_kv)
@@ -47,49 +112,207 @@ func (h *KVHandler) Get(c *routing.Context) error {
 		respondError(c, 500, "ERR_JSON", err.Error())
 		return nil
 	}
+	if _kv.Revision != 0 {
+		setETag(c, _kv.Revision)
+	}
 	respond(c, http.StatusOK, data)
 	return nil
 }
 
 // Set Set
 func (h *KVHandler) Set(c *routing.Context) error {
+	db, ok := h.scope(c)
+	if !ok {
+		return nil
+	}
 	kv := new(database.KV)
 	err := json.Unmarshal(c.Request.Body(), kv)
 	if err != nil {
 		respondError(c, 500, "ERR_JSON", err.Error())
 		return nil
 	}
-	err = h.db.Set(kv)
+	if !checkKey(c, kv.Key) {
+		return nil
+	}
+	rev, cond, err := precondition(c)
 	if err != nil {
-		respondError(c, 500, "ERR_DB", err.Error())
+		respondError(c, http.StatusBadRequest, "ERR_HEADER", err.Error())
+		return nil
+	}
+	if cond {
+		err = db.CompareAndSet(kv, rev)
+	} else {
+		err = db.Set(kv)
+	}
+	if err != nil {
+		respondDBError(c, err)
 		return nil
 	}
 
+	setETag(c, kv.Revision)
 	respond(c, http.StatusOK, []byte(""))
 	return nil
 }
 
 // Delete Delete
 func (h *KVHandler) Delete(c *routing.Context) error {
+	db, ok := h.scope(c)
+	if !ok {
+		return nil
+	}
 	key := c.Param("key")
-	err := h.db.Del(key)
+	rev, cond, err := precondition(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "ERR_HEADER", err.Error())
+		return nil
+	}
+	if cond {
+		err = db.CompareAndDel(key, rev)
+	} else {
+		err = db.Del(key)
+	}
 	if err != nil {
-		respondError(c, 500, "ERR_DB", err.Error())
+		respondDBError(c, err)
 		return nil
 	}
 	respond(c, http.StatusOK, []byte(""))
 	return nil
 }
 
-// List List
+// DeletePrefix deletes all kvs with the ?prefix= in one transaction and responds the count,
+// ?confirm=true is required since all kvs are deleted if the prefix is empty
+func (h *KVHandler) DeletePrefix(c *routing.Context) error {
+	db, ok := h.scope(c)
+	if !ok {
+		return nil
+	}
+	args := c.QueryArgs()
+	if !args.GetBool("confirm") {
+		respondError(c, http.StatusBadRequest, "ERR_PARAM", "confirm=true required")
+		return nil
+	}
+	n, err := db.DelPrefix(string(args.Peek("prefix")))
+	if err != nil {
+		respondDBError(c, err)
+		return nil
+	}
+	data, err := json.Marshal(DeleteResponse{Deleted: n})
+	if err != nil {
+		respondError(c, 500, "ERR_JSON", err.Error())
+		return nil
+	}
+	respond(c, http.StatusOK, data)
+	return nil
+}
+
+// List lists kvs with the ?prefix=, the range [?start=, ?end=), ?reverse=true and ?keys=true
+// to list kvs without values are supported.
+// ?filter= lists the kvs whose JSON values match the filter expression, ?fields= projects the JSON values
+// to the fields separated by commas, the values not JSON objects are responded as null.
+// If ?limit= or ?cursor= is set, a page of kvs is responded with the cursor of the next page
 func (h *KVHandler) List(c *routing.Context) error {
-	key := string(c.QueryArgs().Peek("prefix"))
-	_kvs, err := h.db.List(key)
+	db, ok := h.scope(c)
+	if !ok {
+		return nil
+	}
+	args := c.QueryArgs()
+	opts := &database.ListOptions{
+		Prefix:   string(args.Peek("prefix")),
+		Start:    string(args.Peek("start")),
+		End:      string(args.Peek("end")),
+		Reverse:  args.GetBool("reverse"),
+		KeysOnly: args.GetBool("keys"),
+	}
+	paged := args.Has("limit") || args.Has("cursor")
+	if args.Has("limit") {
+		limit, err := args.GetUint("limit")
+		if err != nil || limit == 0 {
+			respondError(c, http.StatusBadRequest, "ERR_PARAM", "invalid limit")
+			return nil
+		}
+		opts.Limit = limit
+	}
+	if cursor := args.Peek("cursor"); len(cursor) != 0 {
+		key, err := base64.RawURLEncoding.DecodeString(string(cursor))
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "ERR_PARAM", "invalid cursor")
+			return nil
+		}
+		opts.Cursor = string(key)
+	}
+	if filter := args.Peek("filter"); len(filter) != 0 {
+		if opts.KeysOnly {
+			respondError(c, http.StatusBadRequest, "ERR_PARAM", "filter is not supported with keys")
+			return nil
+		}
+		expr, err := parseFilter(string(filter))
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "ERR_FILTER", err.Error())
+			return nil
+		}
+		opts.Filter = func(kv *database.KV) bool {
+			doc, err := decodeJSON(kv.Value)
+			return err == nil && expr.eval(doc)
+		}
+	}
+	var fields [][]string
+	if f := args.Peek("fields"); len(f) != 0 {
+		if opts.KeysOnly {
+			respondError(c, http.StatusBadRequest, "ERR_PARAM", "fields is not supported with keys")
+			return nil
+		}
+		var err error
+		if fields, err = parseFields(string(f)); err != nil {
+			respondError(c, http.StatusBadRequest, "ERR_FILTER", err.Error())
+			return nil
+		}
+	}
+	_kvs, next, err := db.ListRange(opts)
+	if err != nil {
+		respondDBError(c, err)
+		return nil
+	}
+	if fields != nil {
+		for i := range _kvs {
+			if _kvs[i].Value, err = projectValue(_kvs[i].Value, fields); err != nil {
+				respondError(c, 500, "ERR_JSON", err.Error())
+				return nil
+			}
+		}
+	}
+	var data []byte
+	if paged {
+		page := ListResponse{KVs: _kvs}
+		if next != "" {
+			page.Next = base64.RawURLEncoding.EncodeToString([]byte(next))
+		}
+		if page.KVs == nil {
+			page.KVs = []database.KV{}
+		}
+		data, err = json.Marshal(page)
+	} else {
+		data, err = json.Marshal(_kvs)
+	}
+	if err != nil {
+		respondError(c, 500, "ERR_JSON", err.Error())
+		return nil
+	}
+	respond(c, http.StatusOK, data)
+	return nil
+}
+
+// Stats responds the count and sizes of kvs with the ?prefix=
+func (h *KVHandler) Stats(c *routing.Context) error {
+	db, ok := h.scope(c)
+	if !ok {
+		return nil
+	}
+	stats, err := db.Stats(string(c.QueryArgs().Peek("prefix")))
 	if err != nil {
-		respondError(c, 500, "ERR_DB", err.Error())
+		respondDBError(c, err)
 		return nil
 	}
-	data, err := json.Marshal(_kvs)
+	data, err := json.Marshal(stats)
 	if err != nil {
 		respondError(c, 500, "ERR_JSON", err.Error())
 		return nil
@@ -97,3 +320,64 @@ func (h *KVHandler) List(c *routing.Context) error {
 	respond(c, http.StatusOK, data)
 	return nil
 }
+
+// Batch applies a list of set/del operations, all or nothing
+func (h *KVHandler) Batch(c *routing.Context) error {
+	db, ok := h.scope(c)
+	if !ok {
+		return nil
+	}
+	var ops []database.Op
+	err := json.Unmarshal(c.Request.Body(), &ops)
+	if err != nil {
+		respondError(c, 500, "ERR_JSON", err.Error())
+		return nil
+	}
+	for i := range ops {
+		if ops[i].Type == database.OpSet && !checkKey(c, ops[i].Key) {
+			return nil
+		}
+	}
+	err = db.Batch(ops)
+	if err != nil {
+		respondDBError(c, err)
+		return nil
+	}
+	respond(c, http.StatusOK, []byte(""))
+	return nil
+}
+
+// checkKey responds 400 ERR_KEY_RESERVED if the key to write starts with '_', which is reserved
+// for the routes like /_batch, so that the key can always be read by /<key>. The keys deleted are not
+// checked, so that the keys starting with '_' written by the former versions can still be deleted
+func checkKey(c *routing.Context, key string) bool {
+	if strings.HasPrefix(key, "_") {
+		respondError(c, http.StatusBadRequest, "ERR_KEY_RESERVED", "key ("+key+") starting with '_' is reserved")
+		return false
+	}
+	return true
+}
+
+// precondition parses the expected revision from If-Match header,
+// If-None-Match: * means the key must not exist, which is revision 0
+func precondition(c *routing.Context) (uint64, bool, error) {
+	if m := c.Request.Header.Peek("If-Match"); len(m) != 0 {
+		tag := strings.TrimPrefix(string(m), "W/")
+		rev, err := strconv.ParseUint(strings.Trim(tag, `"`), 10, 64)
+		if err != nil || rev == 0 {
+			return 0, false, errors.New("invalid If-Match header, revision expected")
+		}
+		return rev, true, nil
+	}
+	if m := c.Request.Header.Peek("If-None-Match"); len(m) != 0 {
+		if string(m) != "*" {
+			return 0, false, errors.New("invalid If-None-Match header, only * supported")
+		}
+		return 0, true, nil
+	}
+	return 0, false, nil
+}
+
+func setETag(c *routing.Context, rev uint64) {
+	c.Response.Header.Set("ETag", `"`+strconv.FormatUint(rev, 10)+`"`)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/baetyl/baetyl-state/database"
+	routing "github.com/qiangxue/fasthttp-routing"
+)
+
+// History lists the versions of the key kept in descending order of revision
+func (h *KVHandler) History(c *routing.Context) error {
+	db, ok := h.scope(c)
+	if !ok {
+		return nil
+	}
+	versions, err := db.History(c.Param("key"))
+	if err != nil {
+		respondDBError(c, err)
+		return nil
+	}
+	if versions == nil {
+		versions = []database.Version{}
+	}
+	data, err := json.Marshal(versions)
+	if err != nil {
+		respondError(c, 500, "ERR_JSON", err.Error())
+		return nil
+	}
+	respond(c, http.StatusOK, data)
+	return nil
+}
+
+// Rollback sets the key back to its version at ?rev= or ?time= with the content type, labels and expiration,
+// the key is deleted if it was deleted then. 404 ERR_HISTORY is responded if the key has no history,
+// and 409 ERR_EXPIRED if the version has expired already, nothing is changed
+func (h *KVHandler) Rollback(c *routing.Context) error {
+	db, ok := h.scope(c)
+	if !ok {
+		return nil
+	}
+	key := c.Param("key")
+	v, ok := h.versionAt(c, db, key)
+	if !ok {
+		return nil
+	}
+	if !v.Deleted && v.Expire != 0 && v.Expire <= time.Now().Unix() {
+		respondError(c, http.StatusConflict, "ERR_EXPIRED", "the version has expired")
+		return nil
+	}
+	cur, err := db.Get(key)
+	if err != nil {
+		respondDBError(c, err)
+		return nil
+	}
+	if v.Deleted {
+		err = db.CompareAndDel(key, cur.Revision)
+	} else {
+		kv := &database.KV{Key: key, Value: v.Value, Expire: v.Expire, ContentType: v.ContentType, Labels: v.Labels}
+		if err = db.CompareAndSet(kv, cur.Revision); err == nil {
+			setETag(c, kv.Revision)
+		}
+	}
+	if err != nil {
+		respondDBError(c, err)
+		return nil
+	}
+	respond(c, http.StatusOK, []byte(""))
+	return nil
+}
+
+// getAt responds the kv of the key at ?rev= or ?time=, the kv has no revision if the key was deleted then
+func (h *KVHandler) getAt(c *routing.Context, db database.DB, key string) {
+	v, ok := h.versionAt(c, db, key)
+	if !ok {
+		return
+	}
+	kv := &database.KV{Key: key}
+	if !v.Deleted {
+		kv = &v.KV
+	}
+	data, err := json.Marshal(kv)
+	if err != nil {
+		respondError(c, 500, "ERR_JSON", err.Error())
+		return
+	}
+	respond(c, http.StatusOK, data)
+}
+
+// versionAt returns the version of the key at ?rev= or ?time= in RFC 3339 from its history,
+// the error is responded if ok is false, e.g. 404 ERR_HISTORY if the key has no history
+func (h *KVHandler) versionAt(c *routing.Context, db database.DB, key string) (*database.Version, bool) {
+	args := c.QueryArgs()
+	var rev uint64
+	var at time.Time
+	switch {
+	case args.Has("rev"):
+		n, err := args.GetUint("rev")
+		if err != nil || n == 0 {
+			respondError(c, http.StatusBadRequest, "ERR_PARAM", "invalid rev")
+			return nil, false
+		}
+		rev = uint64(n)
+	case args.Has("time"):
+		t, err := time.Parse(time.RFC3339Nano, string(args.Peek("time")))
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "ERR_PARAM", "invalid time")
+			return nil, false
+		}
+		at = t
+	default:
+		respondError(c, http.StatusBadRequest, "ERR_PARAM", "rev or time required")
+		return nil, false
+	}
+	versions, err := db.History(key)
+	if err != nil {
+		respondDBError(c, err)
+		return nil, false
+	}
+	var v *database.Version
+	if rev != 0 {
+		v, err = database.VersionAt(versions, rev)
+	} else {
+		v, err = database.VersionAtTime(versions, at)
+	}
+	switch err {
+	case nil:
+		return v, true
+	case database.ErrCompacted:
+		respondError(c, http.StatusGone, "ERR_COMPACTED", err.Error())
+	case database.ErrNoHistory:
+		respondError(c, http.StatusNotFound, "ERR_HISTORY", err.Error())
+	default:
+		respondDBError(c, err)
+	}
+	return nil, false
+}
@@ -4,23 +4,35 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"time"
 
 	"github.com/baetyl/baetyl-go/http"
 	"github.com/baetyl/baetyl-go/log"
+	"github.com/baetyl/baetyl-go/utils"
 	"github.com/baetyl/baetyl-state/database"
 )
 
+const defaultReapInterval = time.Minute
+
 //Config config of state
 type Config struct {
 	Database database.Conf     `yaml:"database" json:"database" default:"{\"driver\":\"boltdb\",\"source\":\"var/lib/baetyl/state.db\"}"`
 	Server   http.ServerConfig `yaml:"server" json:"server"`
+	// ReapInterval the interval to delete expired keys physically
+	ReapInterval time.Duration `yaml:"reapInterval" json:"reapInterval" default:"1m"`
+	// MaxSnapshotSize the max size of the snapshot to restore, unlimited if 0 by default. The request body
+	// is buffered in memory by the server, whose size is limited by server.maxRequestBodySize (4MiB if 0) as well,
+	// which must be larger than the database to restore its backup
+	MaxSnapshotSize int `yaml:"maxSnapshotSize" json:"maxSnapshotSize"`
 }
 
 // Server server to handle message
 type Server struct {
-	svr *http.Server
-	db  database.DB
-	log *log.Logger
+	svr     *http.Server
+	db      database.DB
+	handler *KVHandler
+	tomb    utils.Tomb
+	log     *log.Logger
 }
 
 // NewServer new server
@@ -33,10 +45,7 @@ func NewServer(cfg Config) (*Server, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to make db directory: %s", err.Error())
 	}
-	dbConf := database.Conf{
-		Driver: cfg.Database.Driver,
-		Source: cfg.Database.Source,
-	}
+	dbConf := cfg.Database
 	db, err := database.New(dbConf)
 	if err != nil {
 		return nil, err
@@ -44,18 +53,51 @@ func NewServer(cfg Config) (*Server, error) {
 	server.db = db
 	server.log.Info("db inited", log.Any("driver", dbConf.Driver), log.Any("source", dbConf.Source))
 
-	handler := NewKVHandler(db, log.With(log.Any("main", "handler")))
-	server.svr = http.NewServer(cfg.Server, handler.initRouter())
+	server.handler = NewKVHandler(db, log.With(log.Any("main", "handler")))
+	server.handler.maxSnapshotSize = cfg.MaxSnapshotSize
+	server.svr = http.NewServer(cfg.Server, server.handler.initRouter())
 	server.svr.Start()
+
+	interval := cfg.ReapInterval
+	if interval <= 0 {
+		interval = defaultReapInterval
+	}
+	server.tomb.Go(func() error {
+		return server.reaping(interval)
+	})
 	return server, nil
 }
 
+// reaping deletes expired keys periodically until server closed
+func (s *Server) reaping(interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			n, err := s.db.DelExpired()
+			if err != nil {
+				s.log.Error("failed to delete expired keys", log.Error(err))
+			} else if n > 0 {
+				s.log.Debug("expired keys deleted", log.Any("count", n))
+			}
+		case <-s.tomb.Dying():
+			return nil
+		}
+	}
+}
+
 // Close Close
 func (s *Server) Close() {
+	if s.handler != nil {
+		s.handler.Close()
+	}
 	if s.svr != nil {
 		s.svr.Close()
 		s.log.Info("server has closed")
 	}
+	s.tomb.Kill(nil)
+	s.tomb.Wait()
 	if s.db != nil {
 		s.db.Close()
 		s.log.Info("db has closed")
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/baetyl/baetyl-go/http"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -404,6 +411,103 @@ func TestHttpKVFail(t *testing.T) {
 	err = client.Do(req4, resp4)
 	assert.NoError(t, err)
 	assert.Equal(t, resp4.StatusCode(), 500)
+
+	req5 := fasthttp.AcquireRequest()
+	resp5 := fasthttp.AcquireResponse()
+	url5 := fmt.Sprintf("%s/%s", conf.cliConf.Address, "_batch")
+	req5.SetRequestURI(url5)
+	req5.Header.SetMethod("POST")
+	req5.SetBody([]byte(`[{"Type":"del","Key":"key1"}]`))
+	err = client.Do(req5, resp5)
+	assert.NoError(t, err)
+	assert.Equal(t, resp5.StatusCode(), 500)
+}
+
+func TestBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := struct {
+		serverConf Config
+		cliConf    mockClientConfig
+	}{
+		serverConf: Config{
+			Database: database.Conf{
+				Driver: "boltdb",
+				Source: path.Join(dir, "kv3.db"),
+			},
+			Server: http.ServerConfig{
+				Address: "127.0.0.1:50090",
+			},
+		},
+		cliConf: mockClientConfig{
+			Address: "http://127.0.0.1:50090",
+		},
+	}
+	server, err := NewServer(conf.serverConf)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, server)
+	defer server.Close()
+	time.Sleep(time.Second)
+
+	ops := []database.Op{
+		{Type: database.OpSet, KV: database.KV{Key: "key1", Value: []byte("value1")}},
+		{Type: database.OpSet, KV: database.KV{Key: "key2", Value: []byte("value2")}},
+	}
+	data, err := json.Marshal(ops)
+	assert.NoError(t, err)
+
+	client := &fasthttp.Client{}
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	url := fmt.Sprintf("%s/%s", conf.cliConf.Address, "_batch")
+	req.SetRequestURI(url)
+	req.Header.SetMethod("POST")
+	req.SetBody(data)
+	err = client.Do(req, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode(), 200)
+
+	ops = []database.Op{
+		{Type: database.OpDel, KV: database.KV{Key: "key1"}},
+		{Type: database.OpSet, KV: database.KV{Value: []byte("value3")}},
+	}
+	data, err = json.Marshal(ops)
+	assert.NoError(t, err)
+
+	req2 := fasthttp.AcquireRequest()
+	resp2 := fasthttp.AcquireResponse()
+	req2.SetRequestURI(url)
+	req2.Header.SetMethod("POST")
+	req2.SetBody(data)
+	err = client.Do(req2, resp2)
+	assert.NoError(t, err)
+	assert.Equal(t, resp2.StatusCode(), 500)
+
+	req3 := fasthttp.AcquireRequest()
+	resp3 := fasthttp.AcquireResponse()
+	req3.SetRequestURI(url)
+	req3.Header.SetMethod("POST")
+	req3.SetBody([]byte("{"))
+	err = client.Do(req3, resp3)
+	assert.NoError(t, err)
+	assert.Equal(t, resp3.StatusCode(), 500)
+
+	req4 := fasthttp.AcquireRequest()
+	resp4 := fasthttp.AcquireResponse()
+	req4.SetRequestURI(conf.cliConf.Address)
+	req4.URI().SetQueryString("prefix=key")
+	req4.Header.SetMethod("GET")
+	err = client.Do(req4, resp4)
+	assert.NoError(t, err)
+	assert.Equal(t, resp4.StatusCode(), 200)
+	var kvs []database.KV
+	err = json.Unmarshal(resp4.Body(), &kvs)
+	assert.NoError(t, err)
+	assert.Len(t, kvs, 2)
+	assert.Equal(t, "key1", kvs[0].Key)
+	assert.Equal(t, []byte("value1"), kvs[0].Value)
 }
 
 func TestAddress(t *testing.T) {
@@ -509,6 +613,36 @@ func (d *mockDB) Conf() database.Conf {
 	return database.Conf{}
 }
 
+// Namespace returns the namespace
+func (d *mockDB) Namespace(name string) (database.DB, error) {
+	return nil, errors.New("custom error")
+}
+
+// Namespaces lists namespaces
+func (d *mockDB) Namespaces() ([]string, error) {
+	return nil, errors.New("custom error")
+}
+
+// CreateNamespace creates the namespace
+func (d *mockDB) CreateNamespace(name string) error {
+	return errors.New("custom error")
+}
+
+// DropNamespace drops the namespace
+func (d *mockDB) DropNamespace(name string) error {
+	return errors.New("custom error")
+}
+
+// Backup writes a snapshot
+func (d *mockDB) Backup(w io.Writer) (int64, error) {
+	return 0, errors.New("custom error")
+}
+
+// Restore restores from a snapshot
+func (d *mockDB) Restore(r io.Reader) error {
+	return errors.New("custom error")
+}
+
 // Set put key and value into SQL DB
 func (d *mockDB) Set(kv *database.KV) error {
 	return errors.New("custom error")
@@ -529,6 +663,71 @@ func (d *mockDB) List(prefix string) ([]database.KV, error) {
 	return nil, errors.New("custom error")
 }
 
+// ListRange list kvs in the range
+func (d *mockDB) ListRange(opts *database.ListOptions) ([]database.KV, string, error) {
+	return nil, "", errors.New("custom error")
+}
+
+// Stats counts kvs with the prefix
+func (d *mockDB) Stats(prefix string) (*database.Stats, error) {
+	return nil, errors.New("custom error")
+}
+
+func (d *mockDB) Update(key string, fn func(kv *database.KV) error) error {
+	return errors.New("custom error")
+}
+
+func (d *mockDB) Increment(key string, delta int64, bounds *database.Bounds) (int64, error) {
+	return 0, errors.New("custom error")
+}
+
+func (d *mockDB) RewriteHistory(fn func(v *database.Version) (bool, error)) (int, error) {
+	return 0, errors.New("custom error")
+}
+
+func (d *mockDB) Rewrite(fn func(kv *database.KV) (bool, error)) (int, error) {
+	return 0, errors.New("custom error")
+}
+
+func (d *mockDB) Query(q *database.IndexQuery) ([]database.KV, error) {
+	return nil, errors.New("custom error")
+}
+
+// Batch applies operations in one transaction
+func (d *mockDB) Batch(ops []database.Op) error {
+	return errors.New("custom error")
+}
+
+// CompareAndSet sets kv if revision matches
+func (d *mockDB) CompareAndSet(kv *database.KV, rev uint64) error {
+	return errors.New("custom error")
+}
+
+// CompareAndDel deletes key if revision matches
+func (d *mockDB) CompareAndDel(key string, rev uint64) error {
+	return errors.New("custom error")
+}
+
+// DelExpired deletes expired kvs
+func (d *mockDB) DelExpired() (int, error) {
+	return 0, errors.New("custom error")
+}
+
+// DelPrefix deletes kvs with the prefix
+func (d *mockDB) DelPrefix(prefix string) (int, error) {
+	return 0, errors.New("custom error")
+}
+
+// History lists versions of key
+func (d *mockDB) History(key string) ([]database.Version, error) {
+	return nil, errors.New("custom error")
+}
+
+// Watch watches changes
+func (d *mockDB) Watch(key string, prefix bool, rev uint64) (*database.Watcher, error) {
+	return nil, errors.New("custom error")
+}
+
 func (d *mockDB) Close() error {
 	return nil
 }
@@ -538,3 +737,1469 @@ type mockClientConfig struct {
 	Address           string `yaml:"address" json:"address"`
 	utils.Certificate `yaml:",inline" json:",inline"`
 }
+
+func TestRevision(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := struct {
+		serverConf Config
+		cliConf    mockClientConfig
+	}{
+		serverConf: Config{
+			Database: database.Conf{
+				Driver: "boltdb",
+				Source: path.Join(dir, "kv3.db"),
+			},
+			Server: http.ServerConfig{
+				Address: "127.0.0.1:50100",
+			},
+		},
+		cliConf: mockClientConfig{
+			Address: "http://127.0.0.1:50100",
+		},
+	}
+	server, err := NewServer(conf.serverConf)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, server)
+	defer server.Close()
+	time.Sleep(time.Second)
+
+	client := &fasthttp.Client{}
+	data, err := json.Marshal(database.KV{Key: "key1", Value: []byte("value1")})
+	assert.NoError(t, err)
+
+	// create only
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	req.SetRequestURI(conf.cliConf.Address)
+	req.Header.SetMethod("POST")
+	req.Header.Set("If-None-Match", "*")
+	req.SetBody(data)
+	err = client.Do(req, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode())
+	assert.Equal(t, `"1"`, string(resp.Header.Peek("ETag")))
+
+	resp.Reset()
+	err = client.Do(req, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, 412, resp.StatusCode())
+
+	// get returns etag
+	req2 := fasthttp.AcquireRequest()
+	resp2 := fasthttp.AcquireResponse()
+	req2.SetRequestURI(fmt.Sprintf("%s/%s", conf.cliConf.Address, "key1"))
+	req2.Header.SetMethod("GET")
+	err = client.Do(req2, resp2)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp2.StatusCode())
+	assert.Equal(t, `"1"`, string(resp2.Header.Peek("ETag")))
+	kv := new(database.KV)
+	err = json.Unmarshal(resp2.Body(), kv)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), kv.Revision)
+
+	// update with stale and current revision
+	req3 := fasthttp.AcquireRequest()
+	resp3 := fasthttp.AcquireResponse()
+	req3.SetRequestURI(conf.cliConf.Address)
+	req3.Header.SetMethod("POST")
+	req3.Header.Set("If-Match", `"1"`)
+	req3.SetBody(data)
+	err = client.Do(req3, resp3)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp3.StatusCode())
+	assert.Equal(t, `"2"`, string(resp3.Header.Peek("ETag")))
+
+	resp3.Reset()
+	err = client.Do(req3, resp3)
+	assert.NoError(t, err)
+	assert.Equal(t, 412, resp3.StatusCode())
+	errResp := new(ErrorResponse)
+	err = json.Unmarshal(resp3.Body(), errResp)
+	assert.NoError(t, err)
+	assert.Equal(t, "ERR_REVISION", errResp.ErrCode)
+
+	req3.Header.Set("If-Match", "abc")
+	resp3.Reset()
+	err = client.Do(req3, resp3)
+	assert.NoError(t, err)
+	assert.Equal(t, 400, resp3.StatusCode())
+
+	// delete with stale and current revision
+	req4 := fasthttp.AcquireRequest()
+	resp4 := fasthttp.AcquireResponse()
+	req4.SetRequestURI(fmt.Sprintf("%s/%s", conf.cliConf.Address, "key1"))
+	req4.Header.SetMethod("DELETE")
+	req4.Header.Set("If-Match", `"1"`)
+	err = client.Do(req4, resp4)
+	assert.NoError(t, err)
+	assert.Equal(t, 412, resp4.StatusCode())
+
+	req4.Header.Set("If-Match", `W/"2"`)
+	resp4.Reset()
+	err = client.Do(req4, resp4)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp4.StatusCode())
+
+	resp2.Reset()
+	err = client.Do(req2, resp2)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp2.StatusCode())
+	assert.Empty(t, resp2.Header.Peek("ETag"))
+}
+
+func TestTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := struct {
+		serverConf Config
+		cliConf    mockClientConfig
+	}{
+		serverConf: Config{
+			Database: database.Conf{
+				Driver: "boltdb",
+				Source: path.Join(dir, "kv3.db"),
+			},
+			Server: http.ServerConfig{
+				Address: "127.0.0.1:50110",
+			},
+			ReapInterval: 100 * time.Millisecond,
+		},
+		cliConf: mockClientConfig{
+			Address: "http://127.0.0.1:50110",
+		},
+	}
+	server, err := NewServer(conf.serverConf)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, server)
+	defer server.Close()
+	time.Sleep(time.Second)
+
+	client := &fasthttp.Client{}
+	data, err := json.Marshal(database.KV{Key: "key1", Value: []byte("value1"), TTL: 1})
+	assert.NoError(t, err)
+
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	req.SetRequestURI(conf.cliConf.Address)
+	req.Header.SetMethod("POST")
+	req.SetBody(data)
+	err = client.Do(req, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode())
+
+	req2 := fasthttp.AcquireRequest()
+	resp2 := fasthttp.AcquireResponse()
+	req2.SetRequestURI(fmt.Sprintf("%s/%s", conf.cliConf.Address, "key1"))
+	req2.Header.SetMethod("GET")
+	err = client.Do(req2, resp2)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp2.StatusCode())
+	kv := new(database.KV)
+	err = json.Unmarshal(resp2.Body(), kv)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value1"), kv.Value)
+	assert.NotZero(t, kv.Expire)
+
+	time.Sleep(2 * time.Second)
+
+	resp2.Reset()
+	err = client.Do(req2, resp2)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp2.StatusCode())
+	kv = new(database.KV)
+	err = json.Unmarshal(resp2.Body(), kv)
+	assert.NoError(t, err)
+	assert.Empty(t, kv.Value)
+
+	// already deleted by reaper
+	n, err := server.db.DelExpired()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := struct {
+		serverConf Config
+		cliConf    mockClientConfig
+	}{
+		serverConf: Config{
+			Database: database.Conf{
+				Driver: "boltdb",
+				Source: path.Join(dir, "kv3.db"),
+			},
+			Server: http.ServerConfig{
+				Address: "127.0.0.1:50120",
+			},
+		},
+		cliConf: mockClientConfig{
+			Address: "http://127.0.0.1:50120",
+		},
+	}
+	server, err := NewServer(conf.serverConf)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, server)
+	defer server.Close()
+	time.Sleep(time.Second)
+
+	client := &fasthttp.Client{}
+	set := func(key, value string) {
+		data, err := json.Marshal(database.KV{Key: key, Value: []byte(value)})
+		assert.NoError(t, err)
+		req := fasthttp.AcquireRequest()
+		resp := fasthttp.AcquireResponse()
+		req.SetRequestURI(conf.cliConf.Address)
+		req.Header.SetMethod("POST")
+		req.SetBody(data)
+		err = client.Do(req, resp)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode())
+	}
+
+	// long-poll: timeout without events
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	req.SetRequestURI(fmt.Sprintf("%s/_watch", conf.cliConf.Address))
+	req.URI().SetQueryString("key=key1&timeout=100ms")
+	req.Header.SetMethod("GET")
+	err = client.Do(req, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode())
+	assert.Equal(t, "[]", string(resp.Body()))
+
+	// long-poll: wait for events
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		set("key1", "value1")
+	}()
+	req.URI().SetQueryString("prefix=key&timeout=5s")
+	resp.Reset()
+	err = client.Do(req, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode())
+	var events []database.Event
+	err = json.Unmarshal(resp.Body(), &events)
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, database.EventPut, events[0].Type)
+	assert.Equal(t, "key1", events[0].Key)
+	assert.Equal(t, []byte("value1"), events[0].Value)
+	assert.Equal(t, uint64(1), events[0].Revision)
+
+	// long-poll: resume from revision
+	set("key2", "value2")
+	req.URI().SetQueryString("prefix=&rev=1")
+	resp.Reset()
+	err = client.Do(req, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode())
+	events = nil
+	err = json.Unmarshal(resp.Body(), &events)
+	assert.NoError(t, err)
+	assert.Len(t, events, 2)
+
+	// bad requests
+	for _, q := range []string{"", "key=key1&rev=x", "key=key1&timeout=1h"} {
+		req.URI().SetQueryString(q)
+		resp.Reset()
+		err = client.Do(req, resp)
+		assert.NoError(t, err)
+		assert.Equal(t, 400, resp.StatusCode())
+	}
+
+	// server-sent events, resume after event 1
+	conn, err := net.Dial("tcp", "127.0.0.1:50120")
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /_watch?prefix=key HTTP/1.1\r\nHost: 127.0.0.1\r\nAccept: text/event-stream\r\nLast-Event-ID: 1\r\n\r\n"))
+	assert.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 200 OK\r\n", line)
+	set("key3", "value3")
+	var lines []string
+	for len(lines) < 2 {
+		line, err = reader.ReadString('\n')
+		assert.NoError(t, err)
+		if strings.HasPrefix(line, "id: ") {
+			lines = append(lines, strings.TrimSpace(line))
+		}
+	}
+	assert.Equal(t, []string{"id: 2:0", "id: 3:0"}, lines)
+	conn.Close()
+
+	// server-sent events, resume in the middle of a batch sharing revision 4
+	err = server.db.Batch([]database.Op{
+		{Type: database.OpSet, KV: database.KV{Key: "key4", Value: []byte("value4")}},
+		{Type: database.OpSet, KV: database.KV{Key: "key5", Value: []byte("value5")}},
+		{Type: database.OpSet, KV: database.KV{Key: "key6", Value: []byte("value6")}},
+	})
+	assert.NoError(t, err)
+	conn, err = net.Dial("tcp", "127.0.0.1:50120")
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET /_watch?prefix=key HTTP/1.1\r\nHost: 127.0.0.1\r\nAccept: text/event-stream\r\nLast-Event-ID: 4:0\r\n\r\n"))
+	assert.NoError(t, err)
+	reader = bufio.NewReader(conn)
+	lines = nil
+	for len(lines) < 2 {
+		line, err = reader.ReadString('\n')
+		assert.NoError(t, err)
+		if strings.HasPrefix(line, "id: ") || strings.HasPrefix(line, "data: ") {
+			lines = append(lines, strings.TrimSpace(line))
+		}
+	}
+	assert.Equal(t, "id: 4:1", lines[0])
+	assert.Contains(t, lines[1], `"Key":"key5"`)
+
+	// long-poll: resume in the middle of a batch
+	req.URI().SetQueryString("prefix=key")
+	req.Header.Set("Last-Event-ID", "4:1")
+	resp.Reset()
+	err = client.Do(req, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode())
+	events = nil
+	err = json.Unmarshal(resp.Body(), &events)
+	assert.NoError(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, "key6", events[0].Key)
+
+	req.Header.Set("Last-Event-ID", "4:x")
+	resp.Reset()
+	err = client.Do(req, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, 400, resp.StatusCode())
+}
+
+func TestListPage(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := struct {
+		serverConf Config
+		cliConf    mockClientConfig
+	}{
+		serverConf: Config{
+			Database: database.Conf{
+				Driver: "boltdb",
+				Source: path.Join(dir, "kv3.db"),
+			},
+			Server: http.ServerConfig{
+				Address: "127.0.0.1:50130",
+			},
+		},
+		cliConf: mockClientConfig{
+			Address: "http://127.0.0.1:50130",
+		},
+	}
+	server, err := NewServer(conf.serverConf)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, server)
+	defer server.Close()
+	time.Sleep(time.Second)
+
+	ops := []database.Op{}
+	for _, k := range []string{"key1", "key2", "key3", "xey1"} {
+		ops = append(ops, database.Op{Type: database.OpSet, KV: database.KV{Key: k}})
+	}
+	err = server.db.Batch(ops)
+	assert.NoError(t, err)
+
+	client := &fasthttp.Client{}
+	list := func(query string) (int, *ListResponse) {
+		req := fasthttp.AcquireRequest()
+		resp := fasthttp.AcquireResponse()
+		req.SetRequestURI(conf.cliConf.Address)
+		req.URI().SetQueryString(query)
+		req.Header.SetMethod("GET")
+		err := client.Do(req, resp)
+		assert.NoError(t, err)
+		page := new(ListResponse)
+		if resp.StatusCode() == 200 {
+			assert.NoError(t, json.Unmarshal(resp.Body(), page))
+		}
+		return resp.StatusCode(), page
+	}
+
+	code, page := list("prefix=key&limit=2")
+	assert.Equal(t, 200, code)
+	assert.Len(t, page.KVs, 2)
+	assert.Equal(t, "key1", page.KVs[0].Key)
+	assert.Equal(t, "key2", page.KVs[1].Key)
+	assert.NotEmpty(t, page.Next)
+
+	code, page = list("prefix=key&limit=2&cursor=" + page.Next)
+	assert.Equal(t, 200, code)
+	assert.Len(t, page.KVs, 1)
+	assert.Equal(t, "key3", page.KVs[0].Key)
+	assert.Empty(t, page.Next)
+
+	code, page = list("start=key2&end=xey1&reverse=true&limit=5")
+	assert.Equal(t, 200, code)
+	assert.Len(t, page.KVs, 2)
+	assert.Equal(t, "key3", page.KVs[0].Key)
+	assert.Equal(t, "key2", page.KVs[1].Key)
+
+	code, page = list("prefix=zey&limit=5")
+	assert.Equal(t, 200, code)
+	assert.NotNil(t, page.KVs)
+	assert.Len(t, page.KVs, 0)
+
+	code, _ = list("limit=x")
+	assert.Equal(t, 400, code)
+	code, _ = list("limit=0")
+	assert.Equal(t, 400, code)
+	code, _ = list("cursor=!!")
+	assert.Equal(t, 400, code)
+}
+
+// testServer the server started by a test, serving the database in a temporary directory
+type testServer struct {
+	t      *testing.T
+	dir    string
+	cfg    Config
+	server *Server
+	client *fasthttp.Client
+}
+
+// newTestServer starts the server listening on the port of localhost with the database configured,
+// which is stored in kv.db of a temporary directory if its source is not set. Close stops the server
+// and removes the directory
+func newTestServer(t *testing.T, port int, conf database.Conf) *testServer {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	if conf.Source == "" && conf.Driver != "memory" {
+		conf.Source = path.Join(dir, "kv.db")
+	}
+	s := &testServer{
+		t:   t,
+		dir: dir,
+		cfg: Config{
+			Database: conf,
+			Server: http.ServerConfig{
+				Address: fmt.Sprintf("127.0.0.1:%d", port),
+			},
+		},
+		client: &fasthttp.Client{},
+	}
+	s.start()
+	return s
+}
+
+// start starts the server and waits for it to serve
+func (s *testServer) start() {
+	server, err := NewServer(s.cfg)
+	if !assert.NoError(s.t, err) {
+		s.t.FailNow()
+	}
+	s.server = server
+	time.Sleep(time.Second)
+}
+
+// restart restarts the server with the configuration of the database changed by fn
+func (s *testServer) restart(fn func(conf *database.Conf)) {
+	s.server.Close()
+	fn(&s.cfg.Database)
+	s.start()
+}
+
+// Close stops the server and removes the directory of the database
+func (s *testServer) Close() {
+	s.server.Close()
+	os.RemoveAll(s.dir)
+}
+
+// do sends the request with the body and returns the status code and the body of the response
+func (s *testServer) do(method, uri, body string) (int, []byte) {
+	resp := s.request(method, uri, body, nil)
+	return resp.StatusCode(), resp.Body()
+}
+
+// request sends the request with the body and the headers, and returns the response
+func (s *testServer) request(method, uri, body string, header map[string]string) *fasthttp.Response {
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	req.SetRequestURI("http://" + s.cfg.Server.Address + uri)
+	req.Header.SetMethod(method)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	req.SetBodyString(body)
+	req.SetConnectionClose()
+	assert.NoError(s.t, s.client.Do(req, resp))
+	return resp
+}
+
+func TestReservedKeys(t *testing.T) {
+	s := newTestServer(t, 50280, database.Conf{Driver: "boltdb"})
+	defer s.Close()
+
+	reserved := `{"errCode":"ERR_KEY_RESERVED","message":"key (_batch) starting with '_' is reserved"}`
+	code, body := s.do("POST", "/", `{"key":"_batch","value":"djE="}`)
+	assert.Equal(t, 400, code)
+	assert.Equal(t, reserved, string(body))
+	code, _ = s.do("PUT", "/_namespaces/a", "")
+	assert.Equal(t, 200, code)
+	code, body = s.do("POST", "/_namespaces/a/", `{"key":"_batch"}`)
+	assert.Equal(t, 400, code)
+	assert.Equal(t, reserved, string(body))
+	code, body = s.do("POST", "/_batch", `[{"Type":"set","Key":"k"},{"Type":"set","Key":"_batch"}]`)
+	assert.Equal(t, 400, code)
+	assert.Equal(t, reserved, string(body))
+	code, _ = s.do("GET", "/k", "")
+	assert.Equal(t, 200, code)
+	code, _ = s.do("POST", "/_incr/_batch", "")
+	assert.Equal(t, 400, code)
+	code, _ = s.do("PATCH", "/_batch", "")
+	assert.Equal(t, 400, code)
+
+	// the keys starting with '_' written before can still be deleted
+	for _, key := range []string{"_batch", "_legacy", "_watch", "_namespaces"} {
+		assert.NoError(t, s.server.db.Set(&database.KV{Key: key, Value: []byte("v")}))
+		code, _ = s.do("DELETE", "/"+key, "")
+		assert.Equal(t, 200, code, key)
+		kv, err := s.server.db.Get(key)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(0), kv.Revision, key)
+	}
+	assert.NoError(t, s.server.db.Set(&database.KV{Key: "_legacy", Value: []byte("v")}))
+	code, _ = s.do("POST", "/_batch", `[{"Type":"del","Key":"_legacy"}]`)
+	assert.Equal(t, 200, code)
+	kv, err := s.server.db.Get("_legacy")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), kv.Revision)
+	code, _ = s.do("POST", "/", `{"key":"a_b"}`)
+	assert.Equal(t, 200, code)
+}
+
+func TestNamespace(t *testing.T) {
+	s := newTestServer(t, 50140, database.Conf{Driver: "boltdb"})
+	defer s.Close()
+
+	code, body := s.do("GET", "/_namespaces", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "[]", string(body))
+
+	// unknown and invalid namespaces
+	code, _ = s.do("GET", "/_namespaces/svc1/key1", "")
+	assert.Equal(t, 404, code)
+	code, _ = s.do("PUT", "/_namespaces/.svc", "")
+	assert.Equal(t, 400, code)
+	code, _ = s.do("DELETE", "/_namespaces/svc1", "")
+	assert.Equal(t, 404, code)
+
+	code, _ = s.do("PUT", "/_namespaces/svc1", "")
+	assert.Equal(t, 200, code)
+	code, _ = s.do("PUT", "/_namespaces/svc2", "")
+	assert.Equal(t, 200, code)
+	code, body = s.do("GET", "/_namespaces", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `["svc1","svc2"]`, string(body))
+
+	// the same key is isolated in namespaces
+	code, _ = s.do("POST", "/", `{"key":"key1","value":"ZGVmYXVsdA=="}`)
+	assert.Equal(t, 200, code)
+	code, _ = s.do("POST", "/_namespaces/svc1/", `{"key":"key1","value":"c3ZjMQ=="}`)
+	assert.Equal(t, 200, code)
+	code, _ = s.do("POST", "/_namespaces/svc2/_batch", `[{"Type":"set","Key":"key2","Value":"c3ZjMg=="}]`)
+	assert.Equal(t, 200, code)
+
+	kv := new(database.KV)
+	code, body = s.do("GET", "/key1", "")
+	assert.Equal(t, 200, code)
+	assert.NoError(t, json.Unmarshal(body, kv))
+	assert.Equal(t, "default", string(kv.Value))
+	code, body = s.do("GET", "/_namespaces/svc1/key1", "")
+	assert.Equal(t, 200, code)
+	assert.NoError(t, json.Unmarshal(body, kv))
+	assert.Equal(t, "svc1", string(kv.Value))
+
+	var kvs []database.KV
+	code, body = s.do("GET", "/_namespaces/svc2/", "")
+	assert.Equal(t, 200, code)
+	assert.NoError(t, json.Unmarshal(body, &kvs))
+	assert.Len(t, kvs, 1)
+	assert.Equal(t, "key2", kvs[0].Key)
+
+	code, body = s.do("GET", "/_namespaces/svc1/_watch?key=key1&rev=1&timeout=1s", "")
+	assert.Equal(t, 200, code)
+	var events []database.Event
+	assert.NoError(t, json.Unmarshal(body, &events))
+	assert.Len(t, events, 1)
+	assert.Equal(t, "svc1", events[0].Namespace)
+
+	code, _ = s.do("DELETE", "/_namespaces/svc1/key1", "")
+	assert.Equal(t, 200, code)
+	code, body = s.do("GET", "/key1", "")
+	assert.Equal(t, 200, code)
+	assert.NoError(t, json.Unmarshal(body, kv))
+	assert.Equal(t, "default", string(kv.Value))
+
+	code, _ = s.do("DELETE", "/_namespaces/svc2", "")
+	assert.Equal(t, 200, code)
+	code, _ = s.do("GET", "/_namespaces/svc2/", "")
+	assert.Equal(t, 404, code)
+	code, body = s.do("GET", "/_namespaces", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `["svc1"]`, string(body))
+}
+
+func TestBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	conf := struct {
+		serverConf Config
+		cliConf    mockClientConfig
+	}{
+		serverConf: Config{
+			Database: database.Conf{
+				Driver: "boltdb",
+				Source: path.Join(dir, "kv3.db"),
+			},
+			Server: http.ServerConfig{
+				Address: "127.0.0.1:50150",
+			},
+		},
+		cliConf: mockClientConfig{
+			Address: "http://127.0.0.1:50150",
+		},
+	}
+	server, err := NewServer(conf.serverConf)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, server)
+	defer server.Close()
+	time.Sleep(time.Second)
+
+	err = server.db.Set(&database.KV{Key: "key1", Value: []byte("value1")})
+	assert.NoError(t, err)
+
+	client := &fasthttp.Client{}
+	req := fasthttp.AcquireRequest()
+	resp := fasthttp.AcquireResponse()
+	req.SetRequestURI(conf.cliConf.Address + "/_backup")
+	req.Header.SetMethod("GET")
+	err = client.Do(req, resp)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode())
+	assert.Equal(t, "application/octet-stream", string(resp.Header.ContentType()))
+	snapshot := append([]byte{}, resp.Body()...)
+	assert.NotEmpty(t, snapshot)
+
+	err = server.db.Set(&database.KV{Key: "key1", Value: []byte("value2")})
+	assert.NoError(t, err)
+
+	restore := func(body []byte) int {
+		req := fasthttp.AcquireRequest()
+		resp := fasthttp.AcquireResponse()
+		req.SetRequestURI(conf.cliConf.Address + "/_restore")
+		req.Header.SetMethod("POST")
+		req.SetBody(body)
+		err := client.Do(req, resp)
+		assert.NoError(t, err)
+		return resp.StatusCode()
+	}
+	assert.Equal(t, 400, restore(nil))
+	assert.Equal(t, 500, restore([]byte("invalid")))
+	// the snapshot is unlimited by default
+	assert.Zero(t, server.handler.maxSnapshotSize)
+	server.handler.maxSnapshotSize = len(snapshot) - 1
+	assert.Equal(t, 413, restore(snapshot))
+	server.handler.maxSnapshotSize = len(snapshot)
+	assert.Equal(t, 200, restore(snapshot))
+
+	kv, err := server.db.Get("key1")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value1"), kv.Value)
+}
+
+func TestCacheStats(t *testing.T) {
+	s := newTestServer(t, 50160, database.Conf{
+		Driver:     "boltdb",
+		Decorators: []string{"cache"},
+	})
+	defer s.Close()
+
+	code, _ := s.do("GET", "/k", "")
+	assert.Equal(t, 200, code)
+	code, _ = s.do("GET", "/k", "")
+	assert.Equal(t, 200, code)
+	code, body := s.do("GET", "/_cache", "")
+	assert.Equal(t, 200, code)
+	assert.JSONEq(t, `{"hits":1,"misses":1,"entries":1,"bytes":1}`, string(body))
+
+	s.restart(func(conf *database.Conf) { conf.Decorators = nil })
+	code, body = s.do("GET", "/_cache", "")
+	assert.Equal(t, 404, code)
+	assert.Equal(t, `{"errCode":"ERR_CACHE","message":"cache is not enabled"}`, string(body))
+}
+
+func TestHistory(t *testing.T) {
+	s := newTestServer(t, 50170, database.Conf{Driver: "boltdb", History: 3})
+	defer s.Close()
+
+	code, body := s.do("GET", "/_history/k", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "[]", string(body))
+
+	// "djE=" "djI=" "djM=" "djQ=" are v1 v2 v3 v4 in base64
+	for _, v := range []string{"djE=", "djI=", "djM=", "djQ="} {
+		code, _ = s.do("POST", "/", `{"Key":"k","Value":"`+v+`"}`)
+		assert.Equal(t, 200, code)
+	}
+	code, _ = s.do("DELETE", "/k", "")
+	assert.Equal(t, 200, code)
+
+	code, body = s.do("GET", "/_history/k", "")
+	assert.Equal(t, 200, code)
+	var versions []database.Version
+	assert.NoError(t, json.Unmarshal(body, &versions))
+	assert.Len(t, versions, 3)
+	assert.Equal(t, uint64(5), versions[0].Revision)
+	assert.True(t, versions[0].Deleted)
+	assert.Equal(t, []byte("v3"), versions[2].Value)
+
+	code, body = s.do("GET", "/k?rev=4", "")
+	assert.Equal(t, 200, code)
+	assert.JSONEq(t, `{"Key":"k","Value":"djQ=","Revision":4,"TTL":0,"Expire":0}`, unstamped(t, body))
+	code, body = s.do("GET", "/k?rev=5", "")
+	assert.Equal(t, 200, code)
+	assert.JSONEq(t, `{"Key":"k","Value":null,"Revision":0,"TTL":0,"Expire":0}`, string(body))
+	at := time.Unix(0, versions[1].Time).Format(time.RFC3339Nano)
+	code, body = s.do("GET", "/k?time="+at, "")
+	assert.Equal(t, 200, code)
+	assert.JSONEq(t, `{"Key":"k","Value":"djQ=","Revision":4,"TTL":0,"Expire":0}`, unstamped(t, body))
+	code, body = s.do("GET", "/k?rev=2", "")
+	assert.Equal(t, 410, code)
+	assert.Equal(t, `{"errCode":"ERR_COMPACTED","message":"required revision has been compacted"}`, string(body))
+	code, body = s.do("GET", "/k?rev=x", "")
+	assert.Equal(t, 400, code)
+	assert.Equal(t, `{"errCode":"ERR_PARAM","message":"invalid rev"}`, string(body))
+	code, body = s.do("GET", "/k?time=x", "")
+	assert.Equal(t, 400, code)
+	assert.Equal(t, `{"errCode":"ERR_PARAM","message":"invalid time"}`, string(body))
+
+	code, body = s.do("POST", "/_rollback/k", "")
+	assert.Equal(t, 400, code)
+	assert.Equal(t, `{"errCode":"ERR_PARAM","message":"rev or time required"}`, string(body))
+	code, _ = s.do("POST", "/_rollback/k?rev=3", "")
+	assert.Equal(t, 200, code)
+	code, body = s.do("GET", "/k", "")
+	assert.Equal(t, 200, code)
+	assert.JSONEq(t, `{"Key":"k","Value":"djM=","Revision":6,"TTL":0,"Expire":0}`, unstamped(t, body))
+	code, _ = s.do("POST", "/_rollback/k?rev=5", "")
+	assert.Equal(t, 200, code)
+	code, body = s.do("GET", "/k", "")
+	assert.Equal(t, 200, code)
+	assert.JSONEq(t, `{"Key":"k","Value":null,"Revision":0,"TTL":0,"Expire":0}`, string(body))
+
+	// the expiration of the version is restored, the version expired already is not
+	expire := time.Now().Unix() + 100
+	for _, kv := range []string{
+		`{"Key":"e","Value":"djE=","Expire":` + strconv.FormatInt(expire, 10) + `}`,
+		`{"Key":"e","Value":"djI=","Expire":` + strconv.FormatInt(time.Now().Unix()-1, 10) + `}`,
+		`{"Key":"e","Value":"djM="}`,
+	} {
+		code, _ = s.do("POST", "/", kv)
+		assert.Equal(t, 200, code)
+	}
+	code, body = s.do("GET", "/_history/e", "")
+	assert.Equal(t, 200, code)
+	assert.NoError(t, json.Unmarshal(body, &versions))
+	assert.Len(t, versions, 3)
+	code, body = s.do("POST", "/_rollback/e?rev="+strconv.FormatUint(versions[1].Revision, 10), "")
+	assert.Equal(t, 409, code)
+	assert.Equal(t, `{"errCode":"ERR_EXPIRED","message":"the version has expired"}`, string(body))
+	code, body = s.do("GET", "/e", "")
+	assert.Equal(t, 200, code)
+	assert.JSONEq(t, `{"Key":"e","Value":"djM=","Revision":`+strconv.FormatUint(versions[0].Revision, 10)+`,"TTL":0,"Expire":0}`, unstamped(t, body))
+	code, _ = s.do("POST", "/_rollback/e?rev="+strconv.FormatUint(versions[2].Revision, 10), "")
+	assert.Equal(t, 200, code)
+	code, body = s.do("GET", "/e", "")
+	assert.Equal(t, 200, code)
+	assert.JSONEq(t, `{"Key":"e","Value":"djE=","Revision":`+strconv.FormatUint(versions[0].Revision+1, 10)+`,"TTL":0,"Expire":`+strconv.FormatInt(expire, 10)+`}`, unstamped(t, body))
+
+	code, _ = s.do("PUT", "/_namespaces/a", "")
+	assert.Equal(t, 200, code)
+	code, body = s.do("GET", "/_namespaces/a/_history/k", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "[]", string(body))
+	code, _ = s.do("GET", "/_namespaces/b/_history/k", "")
+	assert.Equal(t, 404, code)
+}
+
+func TestHistoryDisabled(t *testing.T) {
+	s := newTestServer(t, 50270, database.Conf{Driver: "boltdb", History: 0})
+	defer s.Close()
+
+	code, _ := s.do("POST", "/", `{"Key":"k","Value":"djE="}`)
+	assert.Equal(t, 200, code)
+
+	// the key without history is neither read as deleted nor rolled back
+	code, body := s.do("GET", "/k?rev=1", "")
+	assert.Equal(t, 404, code)
+	assert.Equal(t, `{"errCode":"ERR_HISTORY","message":"no history of the key"}`, string(body))
+	code, body = s.do("POST", "/_rollback/k?rev=1", "")
+	assert.Equal(t, 404, code)
+	assert.Equal(t, `{"errCode":"ERR_HISTORY","message":"no history of the key"}`, string(body))
+	code, body = s.do("GET", "/k", "")
+	assert.Equal(t, 200, code)
+	assert.JSONEq(t, `{"Key":"k","Value":"djE=","Revision":1,"TTL":0,"Expire":0}`, unstamped(t, body))
+}
+
+func TestDeletePrefix(t *testing.T) {
+	s := newTestServer(t, 50180, database.Conf{Driver: "boltdb"})
+	defer s.Close()
+
+	for _, key := range []string{"dev1/a", "dev1/b", "dev10/a", "dev2/a"} {
+		code, _ := s.do("POST", "/", `{"Key":"`+key+`"}`)
+		assert.Equal(t, 200, code)
+	}
+	code, body := s.do("DELETE", "/?prefix=dev1/", "")
+	assert.Equal(t, 400, code)
+	assert.Equal(t, `{"errCode":"ERR_PARAM","message":"confirm=true required"}`, string(body))
+	code, body = s.do("DELETE", "/?prefix=dev1/&confirm=false", "")
+	assert.Equal(t, 400, code)
+
+	code, body = s.do("DELETE", "/?prefix=dev1/&confirm=true", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"deleted":2}`, string(body))
+	code, body = s.do("GET", "/?prefix=dev", "")
+	assert.Equal(t, 200, code)
+	var kvs []database.KV
+	assert.NoError(t, json.Unmarshal(body, &kvs))
+	assert.Len(t, kvs, 2)
+	code, body = s.do("DELETE", "/?prefix=dev1/&confirm=true", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"deleted":0}`, string(body))
+
+	code, _ = s.do("PUT", "/_namespaces/a", "")
+	assert.Equal(t, 200, code)
+	code, _ = s.do("POST", "/_namespaces/a/", `{"Key":"dev1/a"}`)
+	assert.Equal(t, 200, code)
+	code, body = s.do("DELETE", "/_namespaces/a/?confirm=true", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"deleted":1}`, string(body))
+	code, _ = s.do("DELETE", "/_namespaces/b/?confirm=true", "")
+	assert.Equal(t, 404, code)
+	code, body = s.do("DELETE", "/?confirm=true", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"deleted":2}`, string(body))
+}
+
+func TestStats(t *testing.T) {
+	s := newTestServer(t, 50190, database.Conf{Driver: "sqlite3"})
+	defer s.Close()
+
+	// "dmFsdWU=" is "value" in base64
+	for _, key := range []string{"dev1/a", "dev1/b", "dev2/a"} {
+		code, _ := s.do("POST", "/", `{"Key":"`+key+`","Value":"dmFsdWU="}`)
+		assert.Equal(t, 200, code)
+	}
+	code, body := s.do("GET", "/_stats?prefix=dev1/", "")
+	assert.Equal(t, 200, code)
+	assert.JSONEq(t, `{"keys":2,"keyBytes":12,"valueBytes":10}`, string(body))
+	code, body = s.do("GET", "/_stats", "")
+	assert.Equal(t, 200, code)
+	assert.JSONEq(t, `{"keys":3,"keyBytes":18,"valueBytes":15}`, string(body))
+
+	code, body = s.do("GET", "/?prefix=dev1/&keys=true", "")
+	assert.Equal(t, 200, code)
+	assert.JSONEq(t, `[{"Key":"dev1/a","Value":null,"Revision":1,"TTL":0,"Expire":0},{"Key":"dev1/b","Value":null,"Revision":2,"TTL":0,"Expire":0}]`, unstamped(t, body))
+	code, body = s.do("GET", "/?keys=true&limit=1&reverse=true", "")
+	assert.Equal(t, 200, code)
+	assert.JSONEq(t, `{"kvs":[{"Key":"dev2/a","Value":null,"Revision":3,"TTL":0,"Expire":0}],"next":"ZGV2MS9i"}`, unstamped(t, body))
+
+	code, _ = s.do("PUT", "/_namespaces/a", "")
+	assert.Equal(t, 200, code)
+	code, body = s.do("GET", "/_namespaces/a/_stats", "")
+	assert.Equal(t, 200, code)
+	assert.JSONEq(t, `{"keys":0,"keyBytes":0,"valueBytes":0}`, string(body))
+	code, _ = s.do("GET", "/_namespaces/b/_stats", "")
+	assert.Equal(t, 404, code)
+}
+
+func TestQuota(t *testing.T) {
+	s := newTestServer(t, 50200, database.Conf{
+		Driver: "boltdb",
+		Quota:  database.Quota{MaxKeys: 2},
+		Quotas: []database.Quota{{Prefix: "a/", MaxValueSize: 4}},
+	})
+	defer s.Close()
+
+	// "dmFsdWU=" is "value" in base64
+	code, body := s.do("POST", "/", `{"Key":"a/1","Value":"dmFsdWU="}`)
+	assert.Equal(t, 413, code)
+	assert.Equal(t, `{"errCode":"ERR_QUOTA","message":"quota exceeded: value size (5) exceeds the limit (4) of prefix (a/)"}`, string(body))
+	code, _ = s.do("POST", "/", `{"Key":"b/1","Value":"dmFsdWU="}`)
+	assert.Equal(t, 200, code)
+	code, _ = s.do("POST", "/", `{"Key":"b/2"}`)
+	assert.Equal(t, 200, code)
+	code, body = s.do("POST", "/_batch", `[{"Type":"set","Key":"b/3"}]`)
+	assert.Equal(t, 413, code)
+	assert.Equal(t, `{"errCode":"ERR_QUOTA","message":"quota exceeded: keys (3) exceeds the global limit (2)"}`, string(body))
+
+	code, body = s.do("GET", "/_quota", "")
+	assert.Equal(t, 200, code)
+	assert.JSONEq(t, `[{"maxKeys":2,"global":true,"usage":{"keys":2,"keyBytes":6,"valueBytes":5}},{"prefix":"a/","maxValueSize":4,"usage":{"keys":0,"keyBytes":0,"valueBytes":0}}]`, string(body))
+	code, _ = s.do("PUT", "/_namespaces/x", "")
+	assert.Equal(t, 200, code)
+	code, body = s.do("GET", "/_namespaces/x/_quota", "")
+	assert.Equal(t, 200, code)
+	assert.JSONEq(t, `[{"maxKeys":2,"global":true,"usage":{"keys":2,"keyBytes":6,"valueBytes":5}},{"prefix":"a/","maxValueSize":4,"usage":{"keys":0,"keyBytes":0,"valueBytes":0}}]`, string(body))
+
+	s.restart(func(conf *database.Conf) {
+		conf.Quota = database.Quota{}
+		conf.Quotas = nil
+	})
+	code, body = s.do("GET", "/_quota", "")
+	assert.Equal(t, 404, code)
+	assert.Equal(t, `{"errCode":"ERR_QUOTA","message":"quota is not enabled"}`, string(body))
+}
+
+// unstamped returns the JSON with the timestamps of all kvs removed, the kvs having revision must be stamped
+func unstamped(t *testing.T, data []byte) string {
+	var v interface{}
+	assert.NoError(t, json.Unmarshal(data, &v))
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch o := v.(type) {
+		case []interface{}:
+			for _, e := range o {
+				walk(e)
+			}
+		case map[string]interface{}:
+			if rev, ok := o["Revision"]; ok && rev != float64(0) {
+				assert.Contains(t, o, "Created")
+				assert.Contains(t, o, "Updated")
+			}
+			delete(o, "Created")
+			delete(o, "Updated")
+			for _, e := range o {
+				walk(e)
+			}
+		}
+	}
+	walk(v)
+	data, err := json.Marshal(v)
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestMetadata(t *testing.T) {
+	s := newTestServer(t, 50210, database.Conf{Driver: "sqlite3", History: 2})
+	defer s.Close()
+
+	// "e30=" is "{}" in base64
+	code, _ := s.do("POST", "/", `{"Key":"k","Value":"e30=","ContentType":"application/json","Labels":{"device":"d1"}}`)
+	assert.Equal(t, 200, code)
+	code, body := s.do("GET", "/k", "")
+	assert.Equal(t, 200, code)
+	var kv database.KV
+	assert.NoError(t, json.Unmarshal(body, &kv))
+	assert.Equal(t, "application/json", kv.ContentType)
+	assert.Equal(t, map[string]string{"device": "d1"}, kv.Labels)
+	assert.NotZero(t, kv.Created)
+	assert.Equal(t, kv.Created, kv.Updated)
+	assert.JSONEq(t, `{"Key":"k","Value":"e30=","Revision":1,"TTL":0,"Expire":0,"ContentType":"application/json","Labels":{"device":"d1"}}`, unstamped(t, body))
+
+	code, _ = s.do("POST", "/", `{"Key":"k","Value":"e30="}`)
+	assert.Equal(t, 200, code)
+	code, body = s.do("GET", "/?prefix=k", "")
+	assert.Equal(t, 200, code)
+	assert.JSONEq(t, `[{"Key":"k","Value":"e30=","Revision":2,"TTL":0,"Expire":0}]`, unstamped(t, body))
+	var kvs []database.KV
+	assert.NoError(t, json.Unmarshal(body, &kvs))
+	assert.Equal(t, kv.Created, kvs[0].Created)
+	assert.True(t, kvs[0].Updated > kv.Updated)
+
+	// the content type and labels are rolled back with the value
+	code, _ = s.do("POST", "/_rollback/k?rev=1", "")
+	assert.Equal(t, 200, code)
+	code, body = s.do("GET", "/k", "")
+	assert.Equal(t, 200, code)
+	assert.JSONEq(t, `{"Key":"k","Value":"e30=","Revision":3,"TTL":0,"Expire":0,"ContentType":"application/json","Labels":{"device":"d1"}}`, unstamped(t, body))
+}
+
+func TestQuery(t *testing.T) {
+	s := newTestServer(t, 50220, database.Conf{
+		Driver: "boltdb",
+		Indexes: []database.IndexConf{
+			{Name: "device", Label: "device"},
+			{Name: "temp", Path: "temp", Type: database.IndexNumber},
+		},
+	})
+	defer s.Close()
+
+	// "eyJ0ZW1wIjoyMH0=" is {"temp":20}, "eyJ0ZW1wIjotNX0=" is {"temp":-5}
+	code, _ := s.do("POST", "/_batch", `[{"Type":"set","Key":"a","Value":"eyJ0ZW1wIjoyMH0=","Labels":{"device":"d1"}},
+		{"Type":"set","Key":"b","Value":"eyJ0ZW1wIjotNX0=","Labels":{"device":"d2"}},
+		{"Type":"set","Key":"c","Labels":{"device":"d1"}}]`)
+	assert.Equal(t, 200, code)
+
+	code, body := s.do("GET", "/_query?index=device&eq=d1", "")
+	assert.Equal(t, 200, code)
+	assert.JSONEq(t, `[{"Key":"a","Value":"eyJ0ZW1wIjoyMH0=","Revision":1,"TTL":0,"Expire":0,"Labels":{"device":"d1"}},
+		{"Key":"c","Value":null,"Revision":1,"TTL":0,"Expire":0,"Labels":{"device":"d1"}}]`, unstamped(t, body))
+	code, body = s.do("GET", "/_query?index=device&eq=d1&limit=1", "")
+	assert.Equal(t, 200, code)
+	var kvs []database.KV
+	assert.NoError(t, json.Unmarshal(body, &kvs))
+	assert.Len(t, kvs, 1)
+	assert.Equal(t, "a", kvs[0].Key)
+	code, body = s.do("GET", "/_query?index=temp&start=-10&end=20", "")
+	assert.Equal(t, 200, code)
+	kvs = nil
+	assert.NoError(t, json.Unmarshal(body, &kvs))
+	assert.Len(t, kvs, 1)
+	assert.Equal(t, "b", kvs[0].Key)
+	code, body = s.do("GET", "/_query?index=temp", "")
+	assert.Equal(t, 200, code)
+	kvs = nil
+	assert.NoError(t, json.Unmarshal(body, &kvs))
+	assert.Len(t, kvs, 2)
+	assert.Equal(t, "b", kvs[0].Key)
+	assert.Equal(t, "a", kvs[1].Key)
+
+	code, body = s.do("GET", "/_query?index=none&eq=d1", "")
+	assert.Equal(t, 404, code)
+	assert.Equal(t, `{"errCode":"ERR_INDEX","message":"index not found"}`, string(body))
+	code, body = s.do("GET", "/_query?index=temp&eq=hot", "")
+	assert.Equal(t, 400, code)
+	assert.Equal(t, `{"errCode":"ERR_INDEX","message":"index value invalid"}`, string(body))
+	code, _ = s.do("GET", "/_query?eq=d1", "")
+	assert.Equal(t, 400, code)
+	code, _ = s.do("GET", "/_query?index=device&eq=d1&limit=0", "")
+	assert.Equal(t, 400, code)
+
+	code, _ = s.do("PUT", "/_namespaces/a", "")
+	assert.Equal(t, 200, code)
+	code, _ = s.do("POST", "/_namespaces/a/", `{"Key":"x","Labels":{"device":"d1"}}`)
+	assert.Equal(t, 200, code)
+	code, body = s.do("GET", "/_namespaces/a/_query?index=device&eq=d1", "")
+	assert.Equal(t, 200, code)
+	kvs = nil
+	assert.NoError(t, json.Unmarshal(body, &kvs))
+	assert.Len(t, kvs, 1)
+	assert.Equal(t, "x", kvs[0].Key)
+	code, _ = s.do("GET", "/_namespaces/b/_query?index=device&eq=d1", "")
+	assert.Equal(t, 404, code)
+}
+
+func TestPatch(t *testing.T) {
+	s := newTestServer(t, 50230, database.Conf{Driver: "sqlite3"})
+	defer s.Close()
+
+	// do sends the request with the content type, and returns the ETag responded as well
+	do := func(method, uri, contentType, body string) (int, []byte, string) {
+		var header map[string]string
+		if contentType != "" {
+			header = map[string]string{"Content-Type": contentType}
+		}
+		resp := s.request(method, uri, body, header)
+		return resp.StatusCode(), resp.Body(), string(resp.Header.Peek("ETag"))
+	}
+	value := func(key string) string {
+		code, body, _ := do("GET", "/"+key, "", "")
+		assert.Equal(t, 200, code)
+		var kv database.KV
+		assert.NoError(t, json.Unmarshal(body, &kv))
+		return string(kv.Value)
+	}
+	set := func(key, value string) {
+		data, _ := json.Marshal(database.KV{Key: key, Value: []byte(value), ContentType: "application/json"})
+		code, _, _ := do("POST", "/", "", string(data))
+		assert.Equal(t, 200, code)
+	}
+
+	set("k", `{"a":"b","c":{"d":"e","f":"g"},"n":1.50}`)
+	code, _, etag := do("PATCH", "/k", "application/merge-patch+json", `{"a":"z","c":{"f":null},"x":[1,2]}`)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `"2"`, etag)
+	assert.JSONEq(t, `{"a":"z","c":{"d":"e"},"n":1.50,"x":[1,2]}`, value("k"))
+	// the numbers are kept as they are
+	assert.Contains(t, value("k"), `1.50`)
+	code, body, _ := do("GET", "/k", "", "")
+	assert.Equal(t, 200, code)
+	assert.Contains(t, string(body), `"ContentType":"application/json"`)
+
+	code, _, etag = do("PATCH", "/k", "application/json-patch+json; charset=utf-8", `[
+		{"op":"test","path":"/a","value":"z"},
+		{"op":"add","path":"/x/1","value":9},
+		{"op":"add","path":"/x/-","value":{"m":"~/"}},
+		{"op":"remove","path":"/c/d"},
+		{"op":"replace","path":"/n","value":2},
+		{"op":"move","from":"/a","path":"/c/a"},
+		{"op":"copy","from":"/x/3/m","path":"/m~1~0"},
+		{"op":"test","path":"/x","value":[1,9,2,{"m":"~/"}]}]`)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `"3"`, etag)
+	assert.JSONEq(t, `{"c":{"a":"z"},"n":2,"x":[1,9,2,{"m":"~/"}],"m/~":"~/"}`, value("k"))
+
+	// the patch is applied all or nothing
+	code, body, _ = do("PATCH", "/k", "application/json-patch+json", `[{"op":"remove","path":"/n"},{"op":"test","path":"/c/a","value":"y"}]`)
+	assert.Equal(t, 409, code)
+	assert.Equal(t, `{"errCode":"ERR_PATCH","message":"operation 1: patch cannot be applied: test of (/c/a) failed"}`, string(body))
+	code, body, _ = do("PATCH", "/k", "application/json-patch+json", `[{"op":"remove","path":"/x/4"}]`)
+	assert.Equal(t, 409, code)
+	assert.Equal(t, `{"errCode":"ERR_PATCH","message":"operation 0: patch cannot be applied: path (/x/4) not found"}`, string(body))
+	code, _, _ = do("PATCH", "/k", "application/json-patch+json", `[{"op":"move","from":"/c","path":"/c/b"}]`)
+	assert.Equal(t, 409, code)
+	assert.JSONEq(t, `{"c":{"a":"z"},"n":2,"x":[1,9,2,{"m":"~/"}],"m/~":"~/"}`, value("k"))
+
+	// the whole document is replaced
+	code, _, _ = do("PATCH", "/k", "application/json-patch+json", `[{"op":"replace","path":"","value":[1]}]`)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `[1]`, value("k"))
+	code, _, _ = do("PATCH", "/k", "application/merge-patch+json", `{"a":"<b>"}`)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"a":"<b>"}`, value("k"))
+
+	// the precondition is checked in the same transaction
+	code, _, _ = do("PATCH", "/k", "application/merge-patch+json", `{"a":1}`)
+	assert.Equal(t, 200, code)
+	req := func(rev string) int {
+		return s.request("PATCH", "/k", `{"a":2}`, map[string]string{
+			"Content-Type": "application/merge-patch+json",
+			"If-Match":     rev,
+		}).StatusCode()
+	}
+	assert.Equal(t, 412, req(`"5"`))
+	assert.Equal(t, 200, req(`"6"`))
+	assert.Equal(t, `{"a":2}`, value("k"))
+
+	set("text", `not json`)
+	code, body, _ = do("PATCH", "/text", "application/merge-patch+json", `{"a":1}`)
+	assert.Equal(t, 409, code)
+	assert.Equal(t, `{"errCode":"ERR_NOT_JSON","message":"value is not JSON"}`, string(body))
+	assert.Equal(t, `not json`, value("text"))
+	code, body, _ = do("PATCH", "/none", "application/merge-patch+json", `{"a":1}`)
+	assert.Equal(t, 404, code)
+	assert.Equal(t, `{"errCode":"ERR_KEY","message":"key not found"}`, string(body))
+	code, _, _ = do("PATCH", "/k", "application/json", `{"a":1}`)
+	assert.Equal(t, 415, code)
+	code, _, _ = do("PATCH", "/k", "application/merge-patch+json", `{"a":`)
+	assert.Equal(t, 400, code)
+	code, _, _ = do("PATCH", "/k", "application/json-patch+json", `[{"op":"add","path":"/a"}]`)
+	assert.Equal(t, 400, code)
+	code, _, _ = do("PATCH", "/k", "application/json-patch+json", `[{"op":"get","path":"/a"}]`)
+	assert.Equal(t, 400, code)
+	code, _, _ = do("PATCH", "/k", "application/json-patch+json", `[{"op":"copy","path":"/a"}]`)
+	assert.Equal(t, 400, code)
+	code, _, _ = do("PATCH", "/k", "application/json-patch+json", `[{"op":"remove","path":"a"}]`)
+	assert.Equal(t, 400, code)
+
+	code, _, _ = do("PUT", "/_namespaces/a", "", "")
+	assert.Equal(t, 200, code)
+	code, _, _ = do("POST", "/_namespaces/a/", "", `{"Key":"k","Value":"e30="}`)
+	assert.Equal(t, 200, code)
+	code, _, _ = do("PATCH", "/_namespaces/a/k", "application/merge-patch+json", `{"a":1}`)
+	assert.Equal(t, 200, code)
+	code, body, _ = do("GET", "/_namespaces/a/k", "", "")
+	assert.Equal(t, 200, code)
+	var kv database.KV
+	assert.NoError(t, json.Unmarshal(body, &kv))
+	assert.Equal(t, `{"a":1}`, string(kv.Value))
+	code, _, _ = do("PATCH", "/_namespaces/b/k", "application/merge-patch+json", `{"a":1}`)
+	assert.Equal(t, 404, code)
+}
+
+func TestFilter(t *testing.T) {
+	s := newTestServer(t, 50240, database.Conf{Driver: "sqlite3"})
+	defer s.Close()
+	set := func(prefix, key, value string) {
+		data, _ := json.Marshal(database.KV{Key: key, Value: []byte(value)})
+		code, _ := s.do("POST", prefix+"/", string(data))
+		assert.Equal(t, 200, code)
+	}
+	list := func(uri string) []string {
+		code, body := s.do("GET", uri, "")
+		assert.Equal(t, 200, code, string(body))
+		var kvs []database.KV
+		assert.NoError(t, json.Unmarshal(body, &kvs))
+		res := []string{}
+		for _, kv := range kvs {
+			res = append(res, kv.Key+"="+string(kv.Value))
+		}
+		return res
+	}
+	keys := func(filter string) []string {
+		res := []string{}
+		for _, kv := range list("/?prefix=d&filter=" + url.QueryEscape(filter)) {
+			res = append(res, strings.SplitN(kv, "=", 2)[0])
+		}
+		return res
+	}
+
+	set("", "d1", `{"status":"on","temp":21.5,"location":{"city":"bj"},"tags":["a","b"]}`)
+	set("", "d2", `{"status":"off","temp":18,"location":{"city":"sh"}}`)
+	set("", "d3", `{"status":"on","temp":25,"name":"x y"}`)
+	set("", "d4", `not json`)
+	set("", "d5", `[1,2]`)
+	set("", "e1", `{"status":"on"}`)
+
+	assert.Equal(t, []string{"d1", "d3"}, keys(`$.status == "on"`))
+	assert.Equal(t, []string{"d2"}, keys(`$.status != 'on'`))
+	assert.Equal(t, []string{"d1", "d3"}, keys(`$.temp > 20`))
+	assert.Equal(t, []string{"d2", "d3"}, keys(`$.temp <= 18 || $.temp >= 25.0`))
+	assert.Equal(t, []string{"d1"}, keys(`$.status == "on" && exists($.location.city)`))
+	// the values not JSON match nothing, even negated
+	assert.Equal(t, []string{"d3", "d5"}, keys(`!exists($.location)`))
+	assert.Equal(t, []string{"d1", "d3"}, keys(`($.temp < 20 || $.status == "on") && !($.status == "off")`))
+	assert.Equal(t, []string{"d1"}, keys(`$.tags[1] == "b"`))
+	assert.Equal(t, []string{"d3"}, keys(`$["name"] == "x y"`))
+	assert.Equal(t, []string{"d2"}, keys(`$.location.city > "c"`))
+	assert.Equal(t, []string{"d5"}, keys(`$[0] == 1`))
+	// the values not comparable never match
+	assert.Equal(t, []string{}, keys(`$.status > 1`))
+
+	// the pages are filled with the kvs matched
+	code, body := s.do("GET", "/?filter="+url.QueryEscape(`$.status == "on"`)+"&limit=2", "")
+	assert.Equal(t, 200, code)
+	var page ListResponse
+	assert.NoError(t, json.Unmarshal(body, &page))
+	assert.Len(t, page.KVs, 2)
+	assert.Equal(t, "d1", page.KVs[0].Key)
+	assert.Equal(t, "d3", page.KVs[1].Key)
+	assert.NotEmpty(t, page.Next)
+	code, body = s.do("GET", "/?filter="+url.QueryEscape(`$.status == "on"`)+"&limit=2&cursor="+page.Next, "")
+	assert.Equal(t, 200, code)
+	page = ListResponse{}
+	assert.NoError(t, json.Unmarshal(body, &page))
+	assert.Len(t, page.KVs, 1)
+	assert.Equal(t, "e1", page.KVs[0].Key)
+	assert.Empty(t, page.Next)
+
+	// the values are projected to the fields
+	assert.Equal(t, []string{
+		`d1={"location":{"city":"bj"},"status":"on"}`,
+		`d2={"location":{"city":"sh"},"status":"off"}`,
+		`d3={"status":"on"}`,
+		`d4=`,
+		`d5=`,
+	}, list("/?prefix=d&fields="+url.QueryEscape("status, $.location.city")))
+	assert.Equal(t, []string{`d3={"temp":25}`}, list("/?prefix=d&fields=temp&filter="+url.QueryEscape(`$.temp >= 25`)))
+
+	for _, q := range []string{
+		"filter=" + url.QueryEscape(`$.status`),
+		"filter=" + url.QueryEscape(`status == "on"`),
+		"filter=" + url.QueryEscape(`$.status == on`),
+		"filter=" + url.QueryEscape(`($.temp > 1`),
+		"filter=" + url.QueryEscape(`$.temp > 1 &&`),
+		"filter=" + url.QueryEscape(`$.name == "x`),
+		"fields=" + url.QueryEscape(`a,`),
+		"fields=" + url.QueryEscape(`a b`),
+	} {
+		code, body := s.do("GET", "/?"+q, "")
+		assert.Equal(t, 400, code, q)
+		assert.Contains(t, string(body), `"errCode":"ERR_FILTER"`, q)
+	}
+	code, body = s.do("GET", "/?keys=true&filter="+url.QueryEscape(`$.a == 1`), "")
+	assert.Equal(t, 400, code)
+	assert.Equal(t, `{"errCode":"ERR_PARAM","message":"filter is not supported with keys"}`, string(body))
+
+	code, _ = s.do("PUT", "/_namespaces/a", "")
+	assert.Equal(t, 200, code)
+	set("/_namespaces/a", "k1", `{"n":1}`)
+	set("/_namespaces/a", "k2", `{"n":2}`)
+	assert.Equal(t, []string{`k2={}`}, list("/_namespaces/a/?filter="+url.QueryEscape(`$.n == 2`)+"&fields=m"))
+}
+
+func TestIncrement(t *testing.T) {
+	s := newTestServer(t, 50250, database.Conf{Driver: "sqlite3"})
+	defer s.Close()
+
+	code, body := s.do("POST", "/_incr/c", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"value":1}`, string(body))
+	code, body = s.do("POST", "/_incr/c?delta=-3", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"value":-2}`, string(body))
+	code, body = s.do("GET", "/c", "")
+	assert.Equal(t, 200, code)
+	var kv database.KV
+	assert.NoError(t, json.Unmarshal(body, &kv))
+	assert.Equal(t, "-2", string(kv.Value))
+
+	// the bounds are inclusive
+	code, body = s.do("POST", "/_incr/c?delta=2&min=-5&max=0", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"value":0}`, string(body))
+	code, body = s.do("POST", "/_incr/c?max=0", "")
+	assert.Equal(t, 409, code)
+	assert.Equal(t, `{"errCode":"ERR_BOUNDS","message":"value out of bounds"}`, string(body))
+	code, body = s.do("POST", "/_incr/c?delta=-6&min=-5", "")
+	assert.Equal(t, 409, code)
+	code, body = s.do("POST", "/_incr/c?delta=0", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"value":0}`, string(body))
+	code, body = s.do("POST", "/_incr/max?delta=9223372036854775807", "")
+	assert.Equal(t, 200, code)
+	code, body = s.do("POST", "/_incr/max", "")
+	assert.Equal(t, 409, code)
+	assert.Equal(t, `{"errCode":"ERR_BOUNDS","message":"value out of bounds"}`, string(body))
+
+	code, _ = s.do("POST", "/", `{"Key":"s","Value":"YQ=="}`)
+	assert.Equal(t, 200, code)
+	code, body = s.do("POST", "/_incr/s", "")
+	assert.Equal(t, 409, code)
+	assert.Equal(t, `{"errCode":"ERR_NOT_INTEGER","message":"value is not an integer"}`, string(body))
+
+	for _, q := range []string{"delta=a", "delta=1.5", "min=x", "max=", "min=2&max=1"} {
+		code, _ = s.do("POST", "/_incr/c?"+q, "")
+		assert.Equal(t, 400, code, q)
+	}
+
+	// the concurrent increments are not lost
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, _ := s.do("POST", "/_incr/n?delta=2", "")
+			assert.Equal(t, 200, code)
+		}()
+	}
+	wg.Wait()
+	code, body = s.do("POST", "/_incr/n?delta=0", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"value":20}`, string(body))
+
+	code, _ = s.do("PUT", "/_namespaces/a", "")
+	assert.Equal(t, 200, code)
+	code, body = s.do("POST", "/_namespaces/a/_incr/c?delta=5", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"value":5}`, string(body))
+	code, _ = s.do("POST", "/_namespaces/b/_incr/c", "")
+	assert.Equal(t, 404, code)
+}
+
+func TestQueue(t *testing.T) {
+	s := newTestServer(t, 50260, database.Conf{Driver: "sqlite3"})
+	defer s.Close()
+	pop := func(uri string) database.Message {
+		code, body := s.do("POST", uri, "")
+		assert.Equal(t, 200, code, string(body))
+		var m database.Message
+		assert.NoError(t, json.Unmarshal(body, &m))
+		return m
+	}
+
+	code, body := s.do("GET", "/_queues/q", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"length":0}`, string(body))
+	code, body = s.do("POST", "/_queues/q/_pop", "")
+	assert.Equal(t, 204, code)
+	assert.Empty(t, body)
+	code, body = s.do("POST", "/_queues/q", "m1")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"seq":1}`, string(body))
+	code, body = s.do("POST", "/_queues/q", "m2")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"seq":2}`, string(body))
+	code, body = s.do("GET", "/_queues/q", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"length":2}`, string(body))
+
+	code, body = s.do("GET", "/_queues/q/_peek", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"seq":1,"value":"bTE="}`, string(body))
+	m := pop("/_queues/q/_pop?timeout=200ms")
+	assert.Equal(t, uint64(1), m.Seq)
+	assert.Equal(t, "m1", string(m.Value))
+	assert.Equal(t, 1, m.Deliveries)
+	assert.NotZero(t, m.Receipt)
+	m1 := m
+
+	// the message not acknowledged reappears after the visibility timeout
+	m = pop("/_queues/q/_pop")
+	assert.Equal(t, uint64(2), m.Seq)
+	code, _ = s.do("POST", "/_queues/q/_pop", "")
+	assert.Equal(t, 204, code)
+	time.Sleep(300 * time.Millisecond)
+	m = pop("/_queues/q/_pop")
+	assert.Equal(t, uint64(1), m.Seq)
+	assert.Equal(t, 2, m.Deliveries)
+	code, body = s.do("POST", fmt.Sprintf("/_queues/q/_ack/1?receipt=%d", m1.Receipt), "")
+	assert.Equal(t, 409, code)
+	assert.Equal(t, `{"errCode":"ERR_RECEIPT","message":"message not found or receipt invalid"}`, string(body))
+	code, _ = s.do("POST", fmt.Sprintf("/_queues/q/_ack/1?receipt=%d", m.Receipt), "")
+	assert.Equal(t, 200, code)
+	code, body = s.do("GET", "/_queues/q", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"length":1}`, string(body))
+
+	// the message is deleted once popped without visibility timeout
+	code, _ = s.do("POST", "/_queues/q", "m3")
+	assert.Equal(t, 200, code)
+	m = pop("/_queues/q/_pop?timeout=0")
+	assert.Equal(t, uint64(3), m.Seq)
+	assert.Zero(t, m.Receipt)
+	code, body = s.do("GET", "/_queues/q", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"length":1}`, string(body))
+
+	for _, uri := range []string{"/_queues/q/_pop?timeout=x", "/_queues/q/_pop?timeout=-1s", "/_queues/q/_ack/x?receipt=1",
+		"/_queues/q/_ack/1", "/_queues/q/_ack/1?receipt=0", "/_queues/.q"} {
+		code, _ = s.do("POST", uri, "")
+		assert.Equal(t, 400, code, uri)
+	}
+
+	code, _ = s.do("PUT", "/_namespaces/a", "")
+	assert.Equal(t, 200, code)
+	code, body = s.do("POST", "/_namespaces/a/_queues/q", "n1")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"seq":1}`, string(body))
+	m = pop("/_namespaces/a/_queues/q/_pop")
+	assert.Equal(t, "n1", string(m.Value))
+	code, _ = s.do("GET", "/_namespaces/b/_queues/q", "")
+	assert.Equal(t, 404, code)
+
+	// the queues are hidden from the kvs and namespaces of users
+	code, body = s.do("GET", "/", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `null`, string(body))
+	code, body = s.do("DELETE", "/?confirm=true", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"deleted":0}`, string(body))
+	code, body = s.do("GET", "/_queues/q", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"length":1}`, string(body))
+	code, body = s.do("GET", "/_namespaces", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `["a"]`, string(body))
+	for _, req := range [][2]string{{"PUT", "/_namespaces/_queue"}, {"DELETE", "/_namespaces/_queue"}, {"GET", "/_namespaces/_queue/"},
+		{"POST", "/_namespaces/_queue/_queues/q"}} {
+		code, _ = s.do(req[0], req[1], "")
+		assert.Equal(t, 400, code, req[1])
+	}
+
+	// the queues are dropped with their namespace
+	code, _ = s.do("POST", "/_namespaces/a/_queues/q", "n2")
+	assert.Equal(t, 200, code)
+	code, _ = s.do("DELETE", "/_namespaces/a", "")
+	assert.Equal(t, 200, code)
+	code, _ = s.do("DELETE", "/_namespaces/a", "")
+	assert.Equal(t, 404, code)
+	code, body = s.do("GET", "/_queues/q", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"length":1}`, string(body))
+	code, _ = s.do("PUT", "/_namespaces/a", "")
+	assert.Equal(t, 200, code)
+	code, body = s.do("GET", "/_namespaces/a/_queues/q", "")
+	assert.Equal(t, 200, code)
+	assert.Equal(t, `{"length":0}`, string(body))
+}
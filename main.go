@@ -1,10 +1,15 @@
 package main
 
 import (
+	"os"
+
 	"github.com/baetyl/baetyl-go/context"
 )
 
 func main() {
+	if runCommand(os.Args[1:]) {
+		return
+	}
 	context.Run(func(ctx context.Context) error {
 		var cfg Config
 		err := ctx.LoadCustomConfig(&cfg)
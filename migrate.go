@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"sort"
+
+	"github.com/baetyl/baetyl-state/database"
+)
+
+// migrate copies the kvs of all namespaces from one database to another in batches with their metadata
+// and verifies them, the destination must be empty unless forced, then the existing keys are overwritten.
+// Returns the count of kvs migrated
+func migrate(from, to database.DB, force bool, batchSize int) (int, error) {
+	if !force {
+		empty, err := isEmpty(to)
+		if err != nil {
+			return 0, err
+		}
+		if !empty {
+			return 0, errors.New("the destination database already has data, use -force to overwrite")
+		}
+	}
+	im := &importer{db: to, opts: importOptions{batchSize: batchSize, keepTime: true}}
+	err := walk(from, "", func(name string, kv *database.KV) error {
+		return im.put(name, database.KV{
+			Key:         kv.Key,
+			Value:       kv.Value,
+			Expire:      kv.Expire,
+			ContentType: kv.ContentType,
+			Labels:      kv.Labels,
+			Created:     kv.Created,
+			Updated:     kv.Updated,
+		})
+	})
+	if err != nil {
+		return im.res.imported, err
+	}
+	if err = im.flush(); err != nil {
+		return im.res.imported, err
+	}
+	return verify(from, to)
+}
+
+// verify checks that the source and the destination have the same kvs with the same values and metadata,
+// by walking both sides and comparing their counts and checksums, returns the count of kvs verified
+func verify(from, to database.DB) (int, error) {
+	n, srcSum, err := digest(from)
+	if err != nil {
+		return 0, err
+	}
+	m, dstSum, err := digest(to)
+	if err != nil {
+		return 0, err
+	}
+	if n != m {
+		return 0, fmt.Errorf("count mismatch: %d kvs in source, %d kvs in destination", n, m)
+	}
+	if !bytes.Equal(srcSum, dstSum) {
+		return 0, errors.New("checksum mismatch between source and destination")
+	}
+	return n, nil
+}
+
+// digest walks the kvs of all namespaces in order, returns the count and the checksum of them
+func digest(db database.DB) (int, []byte, error) {
+	h := sha256.New()
+	n := 0
+	err := walk(db, "", func(name string, kv *database.KV) error {
+		n++
+		checksum(h, name, kv)
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, h.Sum(nil), nil
+}
+
+// checksum writes the namespace, key, value, expiration and metadata of the kv into the hash
+func checksum(h hash.Hash, name string, kv *database.KV) {
+	var buf [binary.MaxVarintLen64]byte
+	write := func(v []byte) {
+		h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(v)))])
+		h.Write(v)
+	}
+	for _, v := range [][]byte{[]byte(name), []byte(kv.Key), kv.Value, []byte(kv.ContentType)} {
+		write(v)
+	}
+	labels := make([]string, 0, len(kv.Labels))
+	for k := range kv.Labels {
+		labels = append(labels, k)
+	}
+	sort.Strings(labels)
+	h.Write(buf[:binary.PutUvarint(buf[:], uint64(len(labels)))])
+	for _, k := range labels {
+		write([]byte(k))
+		write([]byte(kv.Labels[k]))
+	}
+	for _, v := range []int64{kv.Expire, kv.Created, kv.Updated} {
+		h.Write(buf[:binary.PutVarint(buf[:], v)])
+	}
+}
+
+// isEmpty returns true if the database has no namespaces and no kvs
+func isEmpty(db database.DB) (bool, error) {
+	names, err := db.Namespaces()
+	if err != nil || len(names) != 0 {
+		return false, err
+	}
+	kvs, _, err := db.ListRange(&database.ListOptions{Limit: 1})
+	if err != nil {
+		return false, err
+	}
+	return len(kvs) == 0, nil
+}
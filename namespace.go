@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/baetyl/baetyl-state/database"
+	routing "github.com/qiangxue/fasthttp-routing"
+)
+
+// ListNamespaces lists the names of all namespaces, the default namespace and the reserved ones are not included
+func (h *KVHandler) ListNamespaces(c *routing.Context) error {
+	all, err := h.db.Namespaces()
+	if err != nil {
+		respondDBError(c, err)
+		return nil
+	}
+	names := []string{}
+	for _, name := range all {
+		if !database.ReservedNamespace(name) {
+			names = append(names, name)
+		}
+	}
+	data, err := json.Marshal(names)
+	if err != nil {
+		respondError(c, 500, "ERR_JSON", err.Error())
+		return nil
+	}
+	respond(c, http.StatusOK, data)
+	return nil
+}
+
+// CreateNamespace creates the namespace if not exists
+func (h *KVHandler) CreateNamespace(c *routing.Context) error {
+	name := c.Param("namespace")
+	if database.ReservedNamespace(name) {
+		respondDBError(c, database.ErrNamespaceInvalid)
+		return nil
+	}
+	err := h.db.CreateNamespace(name)
+	if err != nil {
+		respondDBError(c, err)
+		return nil
+	}
+	respond(c, http.StatusOK, []byte(""))
+	return nil
+}
+
+// DropNamespace drops the namespace with all its kvs and queues, the queues are dropped first,
+// so that the namespace is left to be dropped again if either fails
+func (h *KVHandler) DropNamespace(c *routing.Context) error {
+	name := c.Param("namespace")
+	if database.ReservedNamespace(name) {
+		respondDBError(c, database.ErrNamespaceInvalid)
+		return nil
+	}
+	if _, err := h.db.Namespace(name); err != nil {
+		respondDBError(c, err)
+		return nil
+	}
+	if _, err := database.DropQueues(h.db, name); err != nil {
+		respondDBError(c, err)
+		return nil
+	}
+	if err := h.db.DropNamespace(name); err != nil {
+		respondDBError(c, err)
+		return nil
+	}
+	respond(c, http.StatusOK, []byte(""))
+	return nil
+}
+
+// scope returns the database of the namespace in the path, the default namespace if not set,
+// the error is responded if the namespace is not found or reserved
+func (h *KVHandler) scope(c *routing.Context) (database.DB, bool) {
+	name := c.Param("namespace")
+	if name == "" {
+		return h.db, true
+	}
+	if database.ReservedNamespace(name) {
+		respondDBError(c, database.ErrNamespaceInvalid)
+		return nil, false
+	}
+	db, err := h.db.Namespace(name)
+	if err != nil {
+		respondDBError(c, err)
+		return nil, false
+	}
+	return db, true
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/baetyl/baetyl-state/database"
+	routing "github.com/qiangxue/fasthttp-routing"
+)
+
+// the content types of patches
+const (
+	mergePatchContentType = "application/merge-patch+json"
+	jsonPatchContentType  = "application/json-patch+json"
+)
+
+var (
+	errKeyNotFound = errors.New("key not found")
+	errNotJSON     = errors.New("value is not JSON")
+	// errPatchConflict the patch cannot be applied to the current value, e.g. the path is not found or the test fails
+	errPatchConflict = errors.New("patch cannot be applied")
+)
+
+// Patch updates the JSON value of the key by the JSON Merge Patch (RFC 7386) or the JSON Patch (RFC 6902)
+// in the body according to the Content-Type, the patch is applied in one transaction. The value which is not JSON
+// is rejected with 409 ERR_NOT_JSON, and the patch which cannot be applied with 409 ERR_PATCH
+func (h *KVHandler) Patch(c *routing.Context) error {
+	db, ok := h.scope(c)
+	if !ok {
+		return nil
+	}
+	key := c.Param("key")
+	if !checkKey(c, key) {
+		return nil
+	}
+	typ, _, _ := mime.ParseMediaType(string(c.Request.Header.ContentType()))
+	var apply func(doc interface{}) (interface{}, error)
+	switch typ {
+	case mergePatchContentType:
+		patch, err := decodeJSON(c.Request.Body())
+		if err != nil {
+			respondError(c, http.StatusBadRequest, "ERR_PATCH", "invalid merge patch: "+err.Error())
+			return nil
+		}
+		apply = func(doc interface{}) (interface{}, error) {
+			return mergePatch(doc, patch), nil
+		}
+	case jsonPatchContentType:
+		var ops []patchOp
+		if err := json.Unmarshal(c.Request.Body(), &ops); err != nil {
+			respondError(c, http.StatusBadRequest, "ERR_PATCH", "invalid json patch: "+err.Error())
+			return nil
+		}
+		for i := range ops {
+			if err := ops[i].parse(); err != nil {
+				respondError(c, http.StatusBadRequest, "ERR_PATCH", fmt.Sprintf("invalid json patch: operation %d: %s", i, err.Error()))
+				return nil
+			}
+		}
+		apply = func(doc interface{}) (interface{}, error) {
+			return jsonPatch(doc, ops)
+		}
+	default:
+		respondError(c, http.StatusUnsupportedMediaType, "ERR_PATCH",
+			fmt.Sprintf("Content-Type %s or %s required", mergePatchContentType, jsonPatchContentType))
+		return nil
+	}
+	rev, cond, err := precondition(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "ERR_HEADER", err.Error())
+		return nil
+	}
+	var patched *database.KV
+	err = db.Update(key, func(kv *database.KV) error {
+		patched = kv
+		if kv.Revision == 0 {
+			return errKeyNotFound
+		}
+		if cond && kv.Revision != rev {
+			return database.ErrRevisionMismatch
+		}
+		doc, err := decodeJSON(kv.Value)
+		if err != nil {
+			return errNotJSON
+		}
+		if doc, err = apply(doc); err != nil {
+			return err
+		}
+		if kv.Value, err = encodeJSON(doc); err != nil {
+			return err
+		}
+		kv.TTL = 0
+		return nil
+	})
+	switch {
+	case err == nil:
+	case err == errKeyNotFound:
+		respondError(c, http.StatusNotFound, "ERR_KEY", err.Error())
+		return nil
+	case err == errNotJSON:
+		respondError(c, http.StatusConflict, "ERR_NOT_JSON", err.Error())
+		return nil
+	case errors.Is(err, errPatchConflict):
+		respondError(c, http.StatusConflict, "ERR_PATCH", err.Error())
+		return nil
+	default:
+		respondDBError(c, err)
+		return nil
+	}
+	// the revision is assigned to the kv changed once written
+	setETag(c, patched.Revision)
+	respond(c, http.StatusOK, []byte(""))
+	return nil
+}
+
+// decodeJSON decodes the JSON document keeping the numbers as they are
+func decodeJSON(data []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var doc interface{}
+	if err := d.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, errors.New("unexpected data after the JSON document")
+	}
+	return doc, nil
+}
+
+// encodeJSON encodes the JSON document without escaping HTML characters
+func encodeJSON(doc interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	e := json.NewEncoder(&buf)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(doc); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// mergePatch applies the merge patch to the document as RFC 7386, the document is modified in place
+func mergePatch(doc, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	d, ok := doc.(map[string]interface{})
+	if !ok {
+		d = map[string]interface{}{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(d, k)
+		} else {
+			d[k] = mergePatch(d[k], v)
+		}
+	}
+	return d
+}
+
+// patchOp an operation of JSON Patch
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"`
+
+	path  []string
+	from  []string
+	value interface{}
+}
+
+// parse checks the operation and parses its pointers and value
+func (o *patchOp) parse() (err error) {
+	switch o.Op {
+	case "add", "remove", "replace", "move", "copy", "test":
+	default:
+		return fmt.Errorf("op (%s) not supported", o.Op)
+	}
+	if o.Path == nil {
+		return errors.New("path required")
+	}
+	if o.path, err = parsePointer(*o.Path); err != nil {
+		return err
+	}
+	switch o.Op {
+	case "add", "replace", "test":
+		if o.Value == nil {
+			return errors.New("value required")
+		}
+		if o.value, err = decodeJSON(o.Value); err != nil {
+			return err
+		}
+	case "move", "copy":
+		if o.From == nil {
+			return errors.New("from required")
+		}
+		if o.from, err = parsePointer(*o.From); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parsePointer parses the JSON Pointer (RFC 6901) into tokens, "" points to the whole document
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if p[0] != '/' {
+		return nil, fmt.Errorf("pointer (%s) must start with /", p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(t, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// jsonPatch applies the operations to the document in order as RFC 6902, the document is modified in place
+func jsonPatch(doc interface{}, ops []patchOp) (interface{}, error) {
+	var err error
+	for i := range ops {
+		o := &ops[i]
+		switch o.Op {
+		case "add":
+			doc, err = addValue(doc, o.path, copyJSON(o.value))
+		case "remove":
+			doc, _, err = removeValue(doc, o.path)
+		case "replace":
+			if len(o.path) == 0 {
+				doc = copyJSON(o.value)
+			} else if doc, _, err = removeValue(doc, o.path); err == nil {
+				doc, err = addValue(doc, o.path, copyJSON(o.value))
+			}
+		case "move":
+			if isPrefix(o.from, o.path) && len(o.from) < len(o.path) {
+				err = fmt.Errorf("%w: cannot move (%s) into its child (%s)", errPatchConflict, *o.From, *o.Path)
+				break
+			}
+			var v interface{}
+			if doc, v, err = removeValue(doc, o.from); err == nil {
+				doc, err = addValue(doc, o.path, v)
+			}
+		case "copy":
+			var v interface{}
+			if v, err = getValue(doc, o.from); err == nil {
+				doc, err = addValue(doc, o.path, copyJSON(v))
+			}
+		case "test":
+			var v interface{}
+			if v, err = getValue(doc, o.path); err == nil && !equalJSON(v, o.value) {
+				err = fmt.Errorf("%w: test of (%s) failed", errPatchConflict, *o.Path)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+	return doc, nil
+}
+
+// getValue returns the value at the path
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	for i, t := range path {
+		switch n := doc.(type) {
+		case map[string]interface{}:
+			v, ok := n[t]
+			if !ok {
+				return nil, pathError(path[:i+1])
+			}
+			doc = v
+		case []interface{}:
+			idx, err := arrayIndex(t, len(n)-1, path[:i+1])
+			if err != nil {
+				return nil, err
+			}
+			doc = n[idx]
+		default:
+			return nil, pathError(path[:i+1])
+		}
+	}
+	return doc, nil
+}
+
+// addValue adds the value at the path, the member of object is replaced and the value is inserted into array,
+// "-" appends the value to array
+func addValue(doc interface{}, path []string, v interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return v, nil
+	}
+	parent, err := getValue(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	t := path[len(path)-1]
+	switch n := parent.(type) {
+	case map[string]interface{}:
+		n[t] = v
+		return doc, nil
+	case []interface{}:
+		idx := len(n)
+		if t != "-" {
+			if idx, err = arrayIndex(t, len(n), path); err != nil {
+				return nil, err
+			}
+		}
+		n = append(n, nil)
+		copy(n[idx+1:], n[idx:])
+		n[idx] = v
+		return setValue(doc, path[:len(path)-1], n), nil
+	}
+	return nil, pathError(path)
+}
+
+// removeValue removes the value at the path and returns it
+func removeValue(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("%w: cannot remove the whole document", errPatchConflict)
+	}
+	parent, err := getValue(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	t := path[len(path)-1]
+	switch n := parent.(type) {
+	case map[string]interface{}:
+		v, ok := n[t]
+		if !ok {
+			return nil, nil, pathError(path)
+		}
+		delete(n, t)
+		return doc, v, nil
+	case []interface{}:
+		idx, err := arrayIndex(t, len(n)-1, path)
+		if err != nil {
+			return nil, nil, err
+		}
+		v := n[idx]
+		n = append(n[:idx:idx], n[idx+1:]...)
+		return setValue(doc, path[:len(path)-1], n), v, nil
+	}
+	return nil, nil, pathError(path)
+}
+
+// setValue replaces the existing value at the path, which is used to replace the arrays resized
+func setValue(doc interface{}, path []string, v interface{}) interface{} {
+	if len(path) == 0 {
+		return v
+	}
+	// the parent exists since the value at the path exists
+	parent, _ := getValue(doc, path[:len(path)-1])
+	t := path[len(path)-1]
+	switch n := parent.(type) {
+	case map[string]interface{}:
+		n[t] = v
+	case []interface{}:
+		idx, _ := strconv.Atoi(t)
+		n[idx] = v
+	}
+	return doc
+}
+
+// arrayIndex parses the index of array not greater than max
+func arrayIndex(t string, max int, path []string) (int, error) {
+	idx, err := strconv.Atoi(t)
+	if err != nil || idx < 0 || idx > max || (len(t) > 1 && t[0] == '0') {
+		return 0, pathError(path)
+	}
+	return idx, nil
+}
+
+func pathError(path []string) error {
+	p := make([]string, len(path))
+	for i, t := range path {
+		p[i] = strings.Replace(strings.Replace(t, "~", "~0", -1), "/", "~1", -1)
+	}
+	return fmt.Errorf("%w: path (/%s) not found", errPatchConflict, strings.Join(p, "/"))
+}
+
+// isPrefix checks whether the pointer a is a prefix of b
+func isPrefix(a, b []string) bool {
+	if len(a) > len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// copyJSON returns a deep copy of the document
+func copyJSON(v interface{}) interface{} {
+	switch n := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(n))
+		for k, v := range n {
+			m[k] = copyJSON(v)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(n))
+		for i, v := range n {
+			a[i] = copyJSON(v)
+		}
+		return a
+	}
+	return v
+}
+
+// equalJSON checks whether the documents are equal, the numbers are compared by value
+func equalJSON(a, b interface{}) bool {
+	switch x := a.(type) {
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		fx, errx := x.Float64()
+		fy, erry := y.Float64()
+		if errx != nil || erry != nil {
+			return x == y
+		}
+		return fx == fy
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			w, ok := y[k]
+			if !ok || !equalJSON(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equalJSON(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
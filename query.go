@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/baetyl/baetyl-state/database"
+	routing "github.com/qiangxue/fasthttp-routing"
+)
+
+// Query looks up the kvs by the ?index= declared in the configuration, whose indexed value equals ?eq=,
+// or is in the range [?start=, ?end=) if ?eq= is not set, at most ?limit= kvs are responded
+func (h *KVHandler) Query(c *routing.Context) error {
+	db, ok := h.scope(c)
+	if !ok {
+		return nil
+	}
+	args := c.QueryArgs()
+	q := &database.IndexQuery{
+		Index: string(args.Peek("index")),
+		Value: string(args.Peek("eq")),
+		Range: !args.Has("eq"),
+		Start: string(args.Peek("start")),
+		End:   string(args.Peek("end")),
+	}
+	if q.Index == "" {
+		respondError(c, http.StatusBadRequest, "ERR_PARAM", "index required")
+		return nil
+	}
+	if args.Has("limit") {
+		limit, err := args.GetUint("limit")
+		if err != nil || limit == 0 {
+			respondError(c, http.StatusBadRequest, "ERR_PARAM", "invalid limit")
+			return nil
+		}
+		q.Limit = limit
+	}
+	kvs, err := db.Query(q)
+	if err != nil {
+		respondDBError(c, err)
+		return nil
+	}
+	data, err := json.Marshal(kvs)
+	if err != nil {
+		respondError(c, 500, "ERR_JSON", err.Error())
+		return nil
+	}
+	respond(c, http.StatusOK, data)
+	return nil
+}
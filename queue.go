@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/baetyl/baetyl-state/database"
+	routing "github.com/qiangxue/fasthttp-routing"
+)
+
+// defaultVisibilityTimeout the time a message popped is invisible for if ?timeout= is not set
+const defaultVisibilityTimeout = 30 * time.Second
+
+// queue returns the queue of the <queue> in the scope, false if responded with an error
+func (h *KVHandler) queue(c *routing.Context) (*database.Queue, bool) {
+	db, ok := h.scope(c)
+	if !ok {
+		return nil, false
+	}
+	q, err := database.NewQueue(db, c.Param("namespace"), c.Param("queue"))
+	if err != nil {
+		respondDBError(c, err)
+		return nil, false
+	}
+	return q, true
+}
+
+// QueuePush pushes the body as the value of a message to the queue, and responds its sequence
+func (h *KVHandler) QueuePush(c *routing.Context) error {
+	q, ok := h.queue(c)
+	if !ok {
+		return nil
+	}
+	m, err := q.Push(append([]byte{}, c.Request.Body()...))
+	if err != nil {
+		respondDBError(c, err)
+		return nil
+	}
+	respondMessage(c, &database.Message{Seq: m.Seq})
+	return nil
+}
+
+// QueuePop pops the first message visible, which is invisible for the ?timeout= (30s by default)
+// until it is acknowledged, 0 deletes the message once popped. 204 No Content is responded if there is none
+func (h *KVHandler) QueuePop(c *routing.Context) error {
+	q, ok := h.queue(c)
+	if !ok {
+		return nil
+	}
+	timeout := defaultVisibilityTimeout
+	if args := c.QueryArgs(); args.Has("timeout") {
+		var err error
+		timeout, err = time.ParseDuration(string(args.Peek("timeout")))
+		if err != nil || timeout < 0 {
+			respondError(c, http.StatusBadRequest, "ERR_PARAM", "invalid timeout")
+			return nil
+		}
+	}
+	m, err := q.Pop(timeout)
+	if err != nil {
+		respondDBError(c, err)
+		return nil
+	}
+	respondMessage(c, m)
+	return nil
+}
+
+// QueuePeek responds the first message visible without popping it, 204 No Content if there is none
+func (h *KVHandler) QueuePeek(c *routing.Context) error {
+	q, ok := h.queue(c)
+	if !ok {
+		return nil
+	}
+	m, err := q.Peek()
+	if err != nil {
+		respondDBError(c, err)
+		return nil
+	}
+	respondMessage(c, m)
+	return nil
+}
+
+// QueueAck acknowledges the message of the <seq> popped with the ?receipt=, and deletes it from the queue
+func (h *KVHandler) QueueAck(c *routing.Context) error {
+	q, ok := h.queue(c)
+	if !ok {
+		return nil
+	}
+	seq, err := strconv.ParseUint(c.Param("seq"), 10, 64)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "ERR_PARAM", "invalid seq")
+		return nil
+	}
+	receipt, err := strconv.ParseUint(string(c.QueryArgs().Peek("receipt")), 10, 64)
+	if err != nil || receipt == 0 {
+		respondError(c, http.StatusBadRequest, "ERR_PARAM", "invalid receipt")
+		return nil
+	}
+	if err = q.Ack(seq, receipt); err != nil {
+		respondDBError(c, err)
+		return nil
+	}
+	respond(c, http.StatusOK, []byte(""))
+	return nil
+}
+
+// QueueLength responds the count of messages not acknowledged, including the ones popped and invisible
+func (h *KVHandler) QueueLength(c *routing.Context) error {
+	q, ok := h.queue(c)
+	if !ok {
+		return nil
+	}
+	n, err := q.Len()
+	if err != nil {
+		respondDBError(c, err)
+		return nil
+	}
+	data, err := json.Marshal(QueueResponse{Length: n})
+	if err != nil {
+		respondError(c, 500, "ERR_JSON", err.Error())
+		return nil
+	}
+	respond(c, http.StatusOK, data)
+	return nil
+}
+
+// respondMessage responds the message, 204 No Content if it is nil
+func respondMessage(c *routing.Context, m *database.Message) {
+	if m == nil {
+		respond(c, http.StatusNoContent, nil)
+		return
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		respondError(c, 500, "ERR_JSON", err.Error())
+		return
+	}
+	respond(c, http.StatusOK, data)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/baetyl/baetyl-state/database"
+	routing "github.com/qiangxue/fasthttp-routing"
+)
+
+// QuotaUsage returns the quotas enforced on the database with their usage in the namespace,
+// the global quota counts the kvs of all namespaces
+func (h *KVHandler) QuotaUsage(c *routing.Context) error {
+	db, ok := h.scope(c)
+	if !ok {
+		return nil
+	}
+	usages, ok, err := database.QuotaUsageOf(db)
+	if err != nil {
+		respondDBError(c, err)
+		return nil
+	}
+	if !ok {
+		respondError(c, http.StatusNotFound, "ERR_QUOTA", "quota is not enabled")
+		return nil
+	}
+	data, err := json.Marshal(usages)
+	if err != nil {
+		respondError(c, 500, "ERR_JSON", err.Error())
+		return nil
+	}
+	respond(c, http.StatusOK, data)
+	return nil
+}
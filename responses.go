@@ -2,6 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/baetyl/baetyl-state/database"
 	routing "github.com/qiangxue/fasthttp-routing"
 )
 
@@ -15,6 +19,27 @@ type ErrorResponse struct {
 	Message string `json:"message"`
 }
 
+// ListResponse a page of kvs, Next is the cursor of the next page, empty if no more kvs
+type ListResponse struct {
+	KVs  []database.KV `json:"kvs"`
+	Next string        `json:"next,omitempty"`
+}
+
+// DeleteResponse the count of kvs deleted
+type DeleteResponse struct {
+	Deleted int `json:"deleted"`
+}
+
+// CounterResponse the value of the counter incremented
+type CounterResponse struct {
+	Value int64 `json:"value"`
+}
+
+// QueueResponse the count of messages of the queue
+type QueueResponse struct {
+	Length int64 `json:"length"`
+}
+
 // NewErrorResponse NewErrorResponse
 func NewErrorResponse(errCode, message string) ErrorResponse {
 	return ErrorResponse{
@@ -29,6 +54,51 @@ func respondError(c *routing.Context, code int, errCode, msg string) {
 	respond(c, code, b)
 }
 
+// respondDBError responds the error returned by database,
+// revision mismatch is responded as 412 Precondition Failed,
+// unknown namespace as 404 Not Found, invalid namespace as 400 Bad Request,
+// exceeded quota as 413 Request Entity Too Large, the counter which cannot be incremented
+// and the invalid receipt of a message as 409 Conflict
+func respondDBError(c *routing.Context, err error) {
+	if errors.Is(err, database.ErrQuotaExceeded) {
+		respondError(c, http.StatusRequestEntityTooLarge, "ERR_QUOTA", err.Error())
+		return
+	}
+	switch err {
+	case database.ErrRevisionMismatch:
+		respondError(c, http.StatusPreconditionFailed, "ERR_REVISION", err.Error())
+		return
+	case database.ErrNamespaceNotFound:
+		respondError(c, http.StatusNotFound, "ERR_NAMESPACE", err.Error())
+		return
+	case database.ErrNamespaceInvalid:
+		respondError(c, http.StatusBadRequest, "ERR_NAMESPACE", err.Error())
+		return
+	case database.ErrReadOnly:
+		respondError(c, http.StatusForbidden, "ERR_READONLY", err.Error())
+		return
+	case database.ErrIndexNotFound:
+		respondError(c, http.StatusNotFound, "ERR_INDEX", err.Error())
+		return
+	case database.ErrIndexValueInvalid:
+		respondError(c, http.StatusBadRequest, "ERR_INDEX", err.Error())
+		return
+	case database.ErrNotInteger:
+		respondError(c, http.StatusConflict, "ERR_NOT_INTEGER", err.Error())
+		return
+	case database.ErrOutOfBounds:
+		respondError(c, http.StatusConflict, "ERR_BOUNDS", err.Error())
+		return
+	case database.ErrQueueInvalid:
+		respondError(c, http.StatusBadRequest, "ERR_QUEUE", err.Error())
+		return
+	case database.ErrReceiptInvalid:
+		respondError(c, http.StatusConflict, "ERR_RECEIPT", err.Error())
+		return
+	}
+	respondError(c, 500, "ERR_DB", err.Error())
+}
+
 func respond(c *routing.Context, code int, obj []byte) {
 	c.RequestCtx.Response.SetStatusCode(code)
 	c.RequestCtx.Response.SetBody(obj)
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/baetyl/baetyl-go/log"
+	"github.com/baetyl/baetyl-state/database"
+	routing "github.com/qiangxue/fasthttp-routing"
+)
+
+const (
+	defaultWatchTimeout = 30 * time.Second
+	maxWatchTimeout     = 5 * time.Minute
+	heartbeatInterval   = 15 * time.Second
+	eventStreamType     = "text/event-stream"
+)
+
+// Watch watches the changes of a key (?key=) or the keys with a prefix (?prefix=),
+// the kept events since revision ?rev= are replayed first.
+// The events are streamed as Server-Sent Events if the client accepts text/event-stream,
+// the id of each event is <revision>:<index> since the events of a batch share the revision,
+// the Last-Event-ID header is used to resume after reconnecting, even in the middle of a batch.
+// Otherwise, the request is held until events arrive or ?timeout= elapses (long-poll).
+func (h *KVHandler) Watch(c *routing.Context) error {
+	db, ok := h.scope(c)
+	if !ok {
+		return nil
+	}
+	args := c.QueryArgs()
+	key, prefix := string(args.Peek("key")), false
+	if args.Has("prefix") {
+		key, prefix = string(args.Peek("prefix")), true
+	}
+	if key == "" && !prefix {
+		respondError(c, http.StatusBadRequest, "ERR_PARAM", "key or prefix required")
+		return nil
+	}
+	rev, ids, err := watchRevision(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "ERR_PARAM", err.Error())
+		return nil
+	}
+	timeout := defaultWatchTimeout
+	if v := args.Peek("timeout"); len(v) != 0 {
+		timeout, err = time.ParseDuration(string(v))
+		if err != nil || timeout <= 0 || timeout > maxWatchTimeout {
+			respondError(c, http.StatusBadRequest, "ERR_PARAM", "invalid timeout")
+			return nil
+		}
+	}
+
+	w, err := db.Watch(key, prefix, rev)
+	if err == database.ErrCompacted {
+		respondError(c, http.StatusGone, "ERR_COMPACTED", err.Error())
+		return nil
+	}
+	if err != nil {
+		respondDBError(c, err)
+		return nil
+	}
+	if strings.Contains(string(c.Request.Header.Peek("Accept")), eventStreamType) {
+		h.stream(c, w, ids)
+		return nil
+	}
+	h.poll(c, w, ids, timeout)
+	return nil
+}
+
+// poll waits for the first event, then responds it with the other events already arrived
+func (h *KVHandler) poll(c *routing.Context, w *database.Watcher, ids *eventIDs, timeout time.Duration) {
+	defer w.Close()
+
+	events := []database.Event{}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+WAIT:
+	for {
+		select {
+		case e, ok := <-w.Events():
+			if !ok {
+				break WAIT
+			}
+			if _, ok = ids.next(&e); ok {
+				events = append(events, e)
+				break WAIT
+			}
+		case <-t.C:
+			break WAIT
+		case <-h.done:
+			break WAIT
+		}
+	}
+DRAIN:
+	for len(events) != 0 {
+		select {
+		case e, ok := <-w.Events():
+			if !ok {
+				break DRAIN
+			}
+			if _, ok = ids.next(&e); ok {
+				events = append(events, e)
+			}
+		default:
+			break DRAIN
+		}
+	}
+	data, err := json.Marshal(events)
+	if err != nil {
+		respondError(c, 500, "ERR_JSON", err.Error())
+		return
+	}
+	respond(c, http.StatusOK, data)
+}
+
+// stream sends events as Server-Sent Events until the client disconnects or the server closes
+func (h *KVHandler) stream(c *routing.Context, w *database.Watcher, ids *eventIDs) {
+	c.Response.Header.SetContentType(eventStreamType)
+	c.Response.Header.Set("Cache-Control", "no-cache")
+	c.SetStatusCode(http.StatusOK)
+	c.SetBodyStreamWriter(func(bw *bufio.Writer) {
+		defer w.Close()
+
+		t := time.NewTicker(heartbeatInterval)
+		defer t.Stop()
+		for {
+			select {
+			case e, ok := <-w.Events():
+				if !ok {
+					if err := w.Err(); err != nil {
+						h.log.Debug("watcher closed", log.Error(err))
+					}
+					return
+				}
+				id, ok := ids.next(&e)
+				if !ok {
+					continue
+				}
+				data, err := json.Marshal(e)
+				if err != nil {
+					h.log.Error("failed to marshal event", log.Error(err))
+					return
+				}
+				fmt.Fprintf(bw, "id: %s\nevent: %s\ndata: %s\n\n", id, e.Type, data)
+			case <-t.C:
+				bw.WriteString(": heartbeat\n\n")
+			case <-h.done:
+				return
+			}
+			if err := bw.Flush(); err != nil {
+				return
+			}
+		}
+	})
+}
+
+// eventIDs numbers the events of a watcher by the revision and the index in the revision,
+// the events of the revision resumed from which were received before are skipped
+type eventIDs struct {
+	rev uint64
+	// n the count of the events of rev passed
+	n int
+	// skip the count of the events of rev to skip
+	skip int
+}
+
+// next returns the id of the event, false if it was received before resuming
+func (ids *eventIDs) next(e *database.Event) (string, bool) {
+	if e.Revision != ids.rev {
+		ids.rev, ids.n, ids.skip = e.Revision, 0, 0
+	}
+	ids.n++
+	if ids.n <= ids.skip {
+		return "", false
+	}
+	return fmt.Sprintf("%d:%d", ids.rev, ids.n-1), true
+}
+
+// watchRevision returns the revision to resume from and the ids of the events to send,
+// Last-Event-ID takes precedence over ?rev=. The id without index resumes after the whole revision
+func watchRevision(c *routing.Context) (uint64, *eventIDs, error) {
+	if id := c.Request.Header.Peek("Last-Event-ID"); len(id) != 0 {
+		parts := strings.SplitN(string(id), ":", 2)
+		rev, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			return 0, nil, errors.New("invalid Last-Event-ID header")
+		}
+		if len(parts) == 1 {
+			return rev + 1, &eventIDs{}, nil
+		}
+		idx, err := strconv.ParseUint(parts[1], 10, 31)
+		if err != nil || rev == 0 {
+			return 0, nil, errors.New("invalid Last-Event-ID header")
+		}
+		return rev, &eventIDs{rev: rev, skip: int(idx) + 1}, nil
+	}
+	if v := c.QueryArgs().Peek("rev"); len(v) != 0 {
+		rev, err := strconv.ParseUint(string(v), 10, 64)
+		if err != nil {
+			return 0, nil, errors.New("invalid rev")
+		}
+		return rev, &eventIDs{}, nil
+	}
+	return 0, &eventIDs{}, nil
+}